@@ -0,0 +1,65 @@
+// auditverify walks the audit log chain and checks signed checkpoints,
+// it reports the first broken link and exits with status 1.
+//
+// Environment: DB_URL and AUDIT_PUBLIC_KEY (base64 Ed25519 public key),
+// or AUDIT_SIGNING_KEY to take the public key from the signing one.
+package main
+
+import (
+	"AstralTest/internal/auditchain"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/postgres"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	publicKey, err := loadPublicKey()
+	if err != nil {
+		log.Fatal("bad key: ", err)
+	}
+	dbConn, err := postgres.InitDb(os.Getenv("DB_URL"))
+	if err != nil {
+		log.Fatal("database connection error: ", err)
+	}
+	defer dbConn.Close()
+
+	ctx := context.Background()
+	auditStorage := storage.NewAuditStorage(dbConn)
+	checkpoints, err := auditStorage.GetCheckpoints(ctx)
+	if err != nil {
+		log.Fatal("can't read checkpoints: ", err)
+	}
+
+	verifier := auditchain.NewVerifier(publicKey, checkpoints)
+	err = auditStorage.WalkAudit(ctx, verifier.Next)
+	if err == nil {
+		err = verifier.Finish()
+	}
+	var broken *auditchain.BrokenLinkError
+	if errors.As(err, &broken) {
+		fmt.Println(broken.Error())
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal("can't read the audit log: ", err)
+	}
+
+	fmt.Printf("ok: %d entries, %d checkpoints, signed up to entry %d\n",
+		verifier.Entries, len(checkpoints), verifier.Signed)
+}
+
+func loadPublicKey() (ed25519.PublicKey, error) {
+	if value := os.Getenv("AUDIT_PUBLIC_KEY"); value != "" {
+		return auditchain.ParsePublicKey(value)
+	}
+	privateKey, err := auditchain.ParseKey(os.Getenv("AUDIT_SIGNING_KEY"))
+	if err != nil {
+		return nil, err
+	}
+	return privateKey.Public().(ed25519.PublicKey), nil
+}
@@ -1,34 +1,225 @@
 package config
 
 import (
+	"AstralTest/internal/auditchain"
+	"crypto/ed25519"
 	"fmt"
 	"os"
-
-	"github.com/google/uuid"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	ServerAddres         string
-	DbURL                string
-	AdminToken           uuid.UUID
-	LocalFileStoragePath string
+	ServerAddres string
+	DbURL        string
+	// BootstrapAdmin is created on start while there is no active admin,
+	// an existing user with the login gets the admin role
+	BootstrapAdminLogin    string
+	BootstrapAdminPassword string
+	BlobBackend            string
+	LocalFileStoragePath   string
+	S3                     S3Config
+	// documents in the trash are purged after TrashRetention,
+	// purger checks the trash every TrashPurgeInterval
+	TrashRetention     time.Duration
+	TrashPurgeInterval time.Duration
+	// session lives SessionTTL after login and SessionIdleTTL after the last request,
+	// expired sessions are deleted every SessionSweepInterval
+	SessionTTL           time.Duration
+	SessionIdleTTL       time.Duration
+	SessionSweepInterval time.Duration
+	// CookieSecure marks the session cookie as https only,
+	// turn it off only for local development over http
+	CookieSecure bool
+	// ShareLinkSecret signs share links, changing it invalidates all links.
+	// Links live up to ShareLinkMaxTTL
+	ShareLinkSecret []byte
+	ShareLinkMaxTTL time.Duration
+	// PublicAccess lets anonymous clients read public documents,
+	// each IP makes up to PublicRateLimit anonymous requests a minute
+	PublicAccess    bool
+	PublicRateLimit int
+	// AuditAdmins are logins which read the whole audit log besides admins,
+	// other users read records of their documents
+	AuditAdmins []string
+	// AuditSigningKey signs checkpoints of the audit log every AuditCheckpointInterval
+	AuditSigningKey         ed25519.PrivateKey
+	AuditCheckpointInterval time.Duration
+	// responses are cached up to CacheMaxBytes in total, each for CacheTTL.
+	// CacheBackend "redis" shares them between replicas through RedisURL,
+	// CacheMaxBytes is the local part of each replica then.
+	// "postgres" keeps them in memory of each replica, replicas tell each
+	// other about changes with LISTEN/NOTIFY of the database
+	CacheMaxBytes int
+	CacheTTL      time.Duration
+	CacheBackend  string
+	RedisURL      string
+}
+
+// S3Config is used when BlobBackend is "s3"
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
 }
 
+const (
+	BlobBackendLocal = "local"
+	BlobBackendS3    = "s3"
+
+	CacheBackendMemory   = "memory"
+	CacheBackendRedis    = "redis"
+	CacheBackendPostgres = "postgres"
+)
+
 func LoadConfig() (*Config, error) {
+	var err error
+	config := &Config{
+		ServerAddres:           os.Getenv("SERVER_ADDR"),
+		DbURL:                  os.Getenv("DB_URL"),
+		BlobBackend:            os.Getenv("BLOB_BACKEND"),
+		LocalFileStoragePath:   os.Getenv("LOCAL_STORAGE_PATH"),
+		BootstrapAdminLogin:    os.Getenv("BOOTSTRAP_ADMIN_LOGIN"),
+		BootstrapAdminPassword: os.Getenv("BOOTSTRAP_ADMIN_PASSWORD"),
+		CookieSecure:           os.Getenv("COOKIE_SECURE") != "false",
+		ShareLinkSecret:        []byte(os.Getenv("SHARE_LINK_SECRET")),
+		PublicAccess:           os.Getenv("PUBLIC_ACCESS") == "true",
+		AuditAdmins:            listEnv("AUDIT_ADMINS"),
+		CacheBackend:           os.Getenv("CACHE_BACKEND"),
+		RedisURL:               os.Getenv("REDIS_URL"),
+		S3: S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: os.Getenv("S3_PATH_STYLE") != "false",
+		},
+	}
 
-	uuidAdminToken, err := uuid.Parse(os.Getenv("ADMIN_TOKEN"))
+	config.TrashRetention, err = durationEnv("TRASH_RETENTION", 30*24*time.Hour)
 	if err != nil {
-		return nil, fmt.Errorf("bad admin token")
+		return nil, err
 	}
-	config := &Config{
-		ServerAddres:         os.Getenv("SERVER_ADDR"),
-		DbURL:                os.Getenv("DB_URL"),
-		LocalFileStoragePath: os.Getenv("LOCAL_STORAGE_PATH"),
-		AdminToken:           uuidAdminToken,
+	config.TrashPurgeInterval, err = durationEnv("TRASH_PURGE_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
 	}
 
-	if config.ServerAddres == "" || config.DbURL == "" || config.LocalFileStoragePath == "" {
+	config.SessionTTL, err = durationEnv("SESSION_TTL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	config.SessionIdleTTL, err = durationEnv("SESSION_IDLE_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	config.SessionSweepInterval, err = durationEnv("SESSION_SWEEP_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	config.ShareLinkMaxTTL, err = durationEnv("SHARE_LINK_MAX_TTL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.ShareLinkSecret) < 32 {
+		return nil, fmt.Errorf("not enough data in config: SHARE_LINK_SECRET of at least 32 bytes is required")
+	}
+
+	config.PublicRateLimit, err = intEnv("PUBLIC_RATE_LIMIT", 60)
+	if err != nil {
+		return nil, err
+	}
+
+	config.AuditSigningKey, err = auditchain.ParseKey(os.Getenv("AUDIT_SIGNING_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("bad AUDIT_SIGNING_KEY value: %w", err)
+	}
+	config.AuditCheckpointInterval, err = durationEnv("AUDIT_CHECKPOINT_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	config.CacheMaxBytes, err = intEnv("CACHE_MAX_BYTES", 64<<20)
+	if err != nil {
+		return nil, err
+	}
+	config.CacheTTL, err = durationEnv("CACHE_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ServerAddres == "" || config.DbURL == "" {
 		return nil, fmt.Errorf("not enough data in config")
 	}
+
+	switch config.BlobBackend {
+	case "", BlobBackendLocal:
+		config.BlobBackend = BlobBackendLocal
+		if config.LocalFileStoragePath == "" {
+			return nil, fmt.Errorf("not enough data in config: LOCAL_STORAGE_PATH is required")
+		}
+	case BlobBackendS3:
+		if config.S3.Endpoint == "" || config.S3.Bucket == "" || config.S3.AccessKey == "" || config.S3.SecretKey == "" {
+			return nil, fmt.Errorf("not enough data in config: S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY are required")
+		}
+	default:
+		return nil, fmt.Errorf("unknown blob backend %q", config.BlobBackend)
+	}
+
+	switch config.CacheBackend {
+	case "", CacheBackendMemory:
+		config.CacheBackend = CacheBackendMemory
+	case CacheBackendPostgres:
+		// notifications go through DB_URL
+	case CacheBackendRedis:
+		if config.RedisURL == "" {
+			return nil, fmt.Errorf("not enough data in config: REDIS_URL is required")
+		}
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", config.CacheBackend)
+	}
 	return config, nil
 }
+
+// durationEnv parses env variable like "720h", empty variable gives the default value
+func durationEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("bad %s value", name)
+	}
+	return duration, nil
+}
+
+// intEnv parses positive int env variable, empty variable gives the default value
+func intEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad %s value", name)
+	}
+	return n, nil
+}
+
+// listEnv splits comma separated env variable, empty items are skipped
+func listEnv(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -1,13 +1,26 @@
 create table users(
 	login text primary key constraint unique_login unique,
-	password text not null
+	password text not null,
+	-- readonly users only read documents
+	role text not null default 'user' check (role in ('admin', 'user', 'readonly')),
+	-- disabled users can't log in, their sessions are deleted
+	disabled_at timestamp,
+	-- users besides admins who create invitations
+	can_invite boolean not null default false,
+	created timestamp not null default NOW()
 	);
 
 
 
+-- session_id is the secret token, id is safe to show in sessions list
 create table sessions(
     session_id UUID primary key default gen_random_uuid(),
-    login text not null references users(login) on delete cascade
+    id UUID not null unique default gen_random_uuid(),
+    login text not null references users(login) on delete cascade,
+    created timestamp not null default NOW(),
+    last_seen timestamp not null default NOW(),
+    user_agent text,
+    ip text
 	);
 
 
@@ -18,7 +31,193 @@ CREATE TABLE docs (
     file boolean not null,
     public boolean not null,
     created timestamp default NOW(),
-    owner_login text not null references users(login),
-    grant_logins text[],
-    json_data JSONB
-);
\ No newline at end of file
+    -- documents of a deleted user are transferred or purged before, see DeleteUser
+    owner_login text not null references users(login) on delete restrict,
+    json_data JSONB,
+    content_hash text,
+    blob_key text,
+    size bigint not null default 0,
+    current_version integer not null default 1,
+    updated timestamp default NOW(),
+    -- not null for documents in the trash
+    deleted_at timestamp,
+    -- text extracted from text-like files, only for search
+    content_text text,
+    search tsvector generated always as (
+        setweight(to_tsvector('simple', name), 'A') ||
+        setweight(jsonb_to_tsvector('simple', coalesce(json_data, '{}'::jsonb), '["string"]'), 'B') ||
+        setweight(to_tsvector('simple', coalesce(content_text, '')), 'C')
+    ) stored
+);
+
+create index docs_search_idx on docs using gin(search) where deleted_at is null;
+
+-- keyset pagination of the documents list, see GetDocsList
+create index docs_owner_name_idx on docs(owner_login, name, id) where deleted_at is null;
+create index docs_owner_created_idx on docs(owner_login, coalesce(created, 'epoch'::timestamp), id) where deleted_at is null;
+
+-- batches of the trash purger, see GetExpiredTrash
+create index docs_trash_idx on docs(deleted_at, id) where deleted_at is not null;
+
+
+-- documents are shared with groups as "group:<name>", the owner manages members
+create table groups(
+    name text primary key,
+    owner_login text not null references users(login) on delete cascade,
+    created timestamp not null default NOW()
+);
+
+create table group_members(
+    group_name text not null references groups(name) on delete cascade,
+    login text not null references users(login) on delete cascade,
+    primary key (group_name, login)
+);
+
+create index group_members_login_idx on group_members(login);
+
+
+-- roles of other users and groups on documents, the owner has no rows.
+-- Permissions are not versioned: restoring a version never gives access back
+create table doc_permissions(
+    doc_id UUID not null references docs(id) on delete cascade,
+    login text references users(login) on delete cascade,
+    group_name text references groups(name) on delete cascade,
+    role text not null check (role in ('viewer', 'editor', 'manager')),
+    check ((login is null) <> (group_name is null))
+);
+
+create unique index doc_permissions_login_idx on doc_permissions(login, doc_id) where login is not null;
+create unique index doc_permissions_group_idx on doc_permissions(group_name, doc_id) where group_name is not null;
+create index doc_permissions_doc_idx on doc_permissions(doc_id);
+
+
+-- every change of a document is stored as an immutable version,
+-- docs row is a copy of the current one
+create table doc_versions(
+    doc_id UUID not null references docs(id) on delete cascade,
+    version integer not null,
+    name text not null,
+    mime text,
+    public boolean not null,
+    json_data JSONB,
+    content_hash text,
+    blob_key text,
+    size bigint not null default 0,
+    author_login text not null,
+    created timestamp default NOW(),
+    primary key (doc_id, version)
+);
+
+-- only sha256 of the key is stored, prefix helps to recognize the key in the list
+create table api_keys(
+    id UUID primary key,
+    login text not null references users(login) on delete cascade,
+    name text not null,
+    prefix text not null,
+    key_hash text not null unique,
+    scopes text[] not null,
+    -- null or empty means documents of any owner
+    owners text[],
+    expires_at timestamp,
+    created timestamp not null default NOW(),
+    last_used timestamp
+);
+
+
+-- single-use codes for self-registration, only sha256 of the code is stored
+create table invitations(
+    id UUID primary key,
+    code_hash text not null unique,
+    prefix text not null,
+    created_by text not null references users(login) on delete cascade,
+    -- null lets the invitee choose the login
+    login text,
+    role text not null check (role in ('admin', 'user', 'readonly')),
+    -- the invitee joins these groups, deleted ones are skipped
+    groups text[] not null default '{}',
+    expires_at timestamp not null,
+    created timestamp not null default NOW(),
+    used_at timestamp,
+    used_by text
+);
+
+
+-- share links give anonymous access to one document, the token is
+-- signed and is not stored, rows keep limits and revocation
+create table share_links(
+    id UUID primary key,
+    doc_id UUID not null references docs(id) on delete cascade,
+    created_by text not null references users(login) on delete cascade,
+    expires_at timestamp not null,
+    -- null means unlimited
+    max_downloads integer,
+    downloads integer not null default 0,
+    password_hash text,
+    revoked_at timestamp,
+    created timestamp not null default NOW()
+);
+
+create index share_links_doc_idx on share_links(doc_id);
+
+create table share_link_uses(
+    link_id UUID not null references share_links(id) on delete cascade,
+    used_at timestamp not null default NOW(),
+    ip text,
+    user_agent text,
+    -- download, open or the reason of refusal
+    result text not null
+);
+
+create index share_link_uses_link_idx on share_link_uses(link_id, used_at);
+
+
+-- audit log of auth and document operations, rows are only appended.
+-- Logins and document ids are not foreign keys, records outlive them.
+-- Every row keeps the hash of the previous one (see package auditchain)
+create table audit_log(
+    id bigserial primary key,
+    at timestamp not null default NOW(),
+    -- null for anonymous callers and background jobs
+    actor text,
+    action text not null,
+    doc_id UUID,
+    -- owner of the document at the time of the action, owners read records of their documents
+    doc_owner text,
+    -- other object of the action: session, api key, share link, version
+    target text,
+    ip text,
+    user_agent text,
+    result text not null,
+    -- empty for the first row
+    prev_hash text not null,
+    hash text not null unique
+);
+
+create index audit_log_doc_owner_idx on audit_log(doc_owner, id);
+create index audit_log_doc_idx on audit_log(doc_id, id);
+create index audit_log_actor_idx on audit_log(actor, id);
+
+create function audit_log_append_only() returns trigger as $$
+begin
+    raise exception '% is append-only', TG_TABLE_NAME;
+end;
+$$ language plpgsql;
+
+create trigger audit_log_no_update before update or delete on audit_log
+    for each row execute function audit_log_append_only();
+create trigger audit_log_no_truncate before truncate on audit_log
+    for each statement execute function audit_log_append_only();
+
+-- checkpoints sign the hash of the last row with the Ed25519 key
+create table audit_checkpoints(
+    id bigserial primary key,
+    entry_id bigint not null references audit_log(id),
+    entry_hash text not null,
+    at timestamp not null,
+    signature text not null
+);
+
+create trigger audit_checkpoints_no_update before update or delete on audit_checkpoints
+    for each row execute function audit_log_append_only();
+create trigger audit_checkpoints_no_truncate before truncate on audit_checkpoints
+    for each statement execute function audit_log_append_only();
@@ -0,0 +1,217 @@
+-- init.sql runs only on an empty database. This brings a database made by
+-- an earlier init.sql to the current schema: it adds the new columns and
+-- tables, keeps every document with its first version and moves shares from
+-- docs.grant_logins to doc_permissions. It can be run again, the steps
+-- which are done already are skipped
+begin;
+
+alter table users
+    add column if not exists role text not null default 'user' check (role in ('admin', 'user', 'readonly')),
+    add column if not exists disabled_at timestamp,
+    add column if not exists can_invite boolean not null default false,
+    add column if not exists created timestamp not null default NOW();
+
+alter table sessions
+    add column if not exists id UUID not null default gen_random_uuid(),
+    add column if not exists created timestamp not null default NOW(),
+    add column if not exists last_seen timestamp not null default NOW(),
+    add column if not exists user_agent text,
+    add column if not exists ip text;
+
+create unique index if not exists sessions_id_key on sessions(id);
+
+-- files of old documents stay where they are, their blob key is the document id.
+-- Sizes and hashes of old files are unknown, they are filled on the next change
+alter table docs
+    add column if not exists content_hash text,
+    add column if not exists blob_key text,
+    add column if not exists size bigint not null default 0,
+    add column if not exists current_version integer not null default 1,
+    add column if not exists updated timestamp default NOW(),
+    add column if not exists deleted_at timestamp,
+    add column if not exists content_text text;
+
+-- the generated column reads content_text, which is added above
+alter table docs
+    add column if not exists search tsvector generated always as (
+        setweight(to_tsvector('simple', name), 'A') ||
+        setweight(jsonb_to_tsvector('simple', coalesce(json_data, '{}'::jsonb), '["string"]'), 'B') ||
+        setweight(to_tsvector('simple', coalesce(content_text, '')), 'C')
+    ) stored;
+
+create index if not exists docs_search_idx on docs using gin(search) where deleted_at is null;
+create index if not exists docs_owner_name_idx on docs(owner_login, name, id) where deleted_at is null;
+create index if not exists docs_owner_created_idx on docs(owner_login, coalesce(created, 'epoch'::timestamp), id) where deleted_at is null;
+create index if not exists docs_trash_idx on docs(deleted_at, id) where deleted_at is not null;
+
+
+create table if not exists groups(
+    name text primary key,
+    owner_login text not null references users(login) on delete cascade,
+    created timestamp not null default NOW()
+);
+
+create table if not exists group_members(
+    group_name text not null references groups(name) on delete cascade,
+    login text not null references users(login) on delete cascade,
+    primary key (group_name, login)
+);
+
+create index if not exists group_members_login_idx on group_members(login);
+
+
+create table if not exists doc_permissions(
+    doc_id UUID not null references docs(id) on delete cascade,
+    login text references users(login) on delete cascade,
+    group_name text references groups(name) on delete cascade,
+    role text not null check (role in ('viewer', 'editor', 'manager')),
+    check ((login is null) <> (group_name is null))
+);
+
+create unique index if not exists doc_permissions_login_idx on doc_permissions(login, doc_id) where login is not null;
+create unique index if not exists doc_permissions_group_idx on doc_permissions(group_name, doc_id) where group_name is not null;
+create index if not exists doc_permissions_doc_idx on doc_permissions(doc_id);
+
+-- shares become viewers, the arrays had no foreign keys so deleted users are skipped
+do $$
+begin
+    if exists (select 1 from information_schema.columns
+                where table_name = 'docs' and column_name = 'grant_logins') then
+        insert into doc_permissions(doc_id, login, role)
+        select distinct d.id, g.login, 'viewer'
+            from docs d
+            cross join lateral unnest(d.grant_logins) as g(login)
+            join users u on u.login = g.login
+            where g.login <> d.owner_login
+        on conflict do nothing;
+    end if;
+end
+$$;
+
+alter table docs drop column if exists grant_logins;
+
+
+create table if not exists doc_versions(
+    doc_id UUID not null references docs(id) on delete cascade,
+    version integer not null,
+    name text not null,
+    mime text,
+    public boolean not null,
+    json_data JSONB,
+    content_hash text,
+    blob_key text,
+    size bigint not null default 0,
+    author_login text not null,
+    created timestamp default NOW(),
+    primary key (doc_id, version)
+);
+
+alter table doc_versions drop column if exists grant_logins;
+
+-- the current state of every document is its version, the owner is the author
+insert into doc_versions(doc_id, version, name, mime, public, json_data, content_hash, blob_key, size, author_login, created)
+select id, current_version, name, mime, public, json_data, content_hash, blob_key, size, owner_login, coalesce(updated, created)
+    from docs
+on conflict do nothing;
+
+
+create table if not exists api_keys(
+    id UUID primary key,
+    login text not null references users(login) on delete cascade,
+    name text not null,
+    prefix text not null,
+    key_hash text not null unique,
+    scopes text[] not null,
+    owners text[],
+    expires_at timestamp,
+    created timestamp not null default NOW(),
+    last_used timestamp
+);
+
+create table if not exists invitations(
+    id UUID primary key,
+    code_hash text not null unique,
+    prefix text not null,
+    created_by text not null references users(login) on delete cascade,
+    login text,
+    role text not null check (role in ('admin', 'user', 'readonly')),
+    groups text[] not null default '{}',
+    expires_at timestamp not null,
+    created timestamp not null default NOW(),
+    used_at timestamp,
+    used_by text
+);
+
+create table if not exists share_links(
+    id UUID primary key,
+    doc_id UUID not null references docs(id) on delete cascade,
+    created_by text not null references users(login) on delete cascade,
+    expires_at timestamp not null,
+    max_downloads integer,
+    downloads integer not null default 0,
+    password_hash text,
+    revoked_at timestamp,
+    created timestamp not null default NOW()
+);
+
+create index if not exists share_links_doc_idx on share_links(doc_id);
+
+create table if not exists share_link_uses(
+    link_id UUID not null references share_links(id) on delete cascade,
+    used_at timestamp not null default NOW(),
+    ip text,
+    user_agent text,
+    result text not null
+);
+
+create index if not exists share_link_uses_link_idx on share_link_uses(link_id, used_at);
+
+
+create table if not exists audit_log(
+    id bigserial primary key,
+    at timestamp not null default NOW(),
+    actor text,
+    action text not null,
+    doc_id UUID,
+    doc_owner text,
+    target text,
+    ip text,
+    user_agent text,
+    result text not null,
+    prev_hash text not null,
+    hash text not null unique
+);
+
+create index if not exists audit_log_doc_owner_idx on audit_log(doc_owner, id);
+create index if not exists audit_log_doc_idx on audit_log(doc_id, id);
+create index if not exists audit_log_actor_idx on audit_log(actor, id);
+
+create or replace function audit_log_append_only() returns trigger as $$
+begin
+    raise exception '% is append-only', TG_TABLE_NAME;
+end;
+$$ language plpgsql;
+
+drop trigger if exists audit_log_no_update on audit_log;
+create trigger audit_log_no_update before update or delete on audit_log
+    for each row execute function audit_log_append_only();
+drop trigger if exists audit_log_no_truncate on audit_log;
+create trigger audit_log_no_truncate before truncate on audit_log
+    for each statement execute function audit_log_append_only();
+
+create table if not exists audit_checkpoints(
+    id bigserial primary key,
+    entry_id bigint not null references audit_log(id),
+    entry_hash text not null,
+    at timestamp not null,
+    signature text not null
+);
+
+drop trigger if exists audit_checkpoints_no_update on audit_checkpoints;
+create trigger audit_checkpoints_no_update before update or delete on audit_checkpoints
+    for each row execute function audit_log_append_only();
+drop trigger if exists audit_checkpoints_no_truncate on audit_checkpoints;
+create trigger audit_checkpoints_no_truncate before truncate on audit_checkpoints
+    for each statement execute function audit_log_append_only();
+
+commit;
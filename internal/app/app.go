@@ -4,6 +4,7 @@ import (
 	"AstralTest/config"
 	"AstralTest/internal/service"
 	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/blob"
 	"AstralTest/internal/storage/cache"
 	"AstralTest/internal/storage/postgres"
 	"AstralTest/internal/transport"
@@ -15,11 +16,21 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 type App struct {
 	Config *config.Config
-	Router *http.ServeMux
+	Router http.Handler
+	jobs   []job
+}
+
+// job is a periodic background task, it works until the server shutdown
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
 }
 
 func InitApp() (*App, error) {
@@ -34,24 +45,129 @@ func InitApp() (*App, error) {
 	}
 
 	userStorage := storage.NewUserStorage(dbConn)
-	sessionStorage := storage.NewSessionStorage(dbConn)
-	authService := service.NewAuthService(userStorage, sessionStorage, cfg.AdminToken)
+	sessionStorage := storage.NewSessionStorage(dbConn, cfg.SessionTTL, cfg.SessionIdleTTL)
+	apiKeyStorage := storage.NewApiKeyStorage(dbConn)
+	auditStorage := storage.NewAuditStorage(dbConn)
+	groupStorage := storage.NewGroupStorage(dbConn)
+	// every auth and document operation is recorded to the audit log
+	authService := service.NewAuditedAuthService(
+		service.NewAuthService(userStorage, sessionStorage, apiKeyStorage, storage.NewInvitationStorage(dbConn), groupStorage), auditStorage)
+	if cfg.BootstrapAdminLogin != "" {
+		if err := authService.BootstrapAdmin(context.Background(), cfg.BootstrapAdminLogin, cfg.BootstrapAdminPassword); err != nil {
+			return nil, fmt.Errorf("bootstrap admin error: %w", err)
+		}
+	}
 
-	fileStorage, err := storage.NewFileStorage(dbConn, cfg.LocalFileStoragePath)
+	fileStorage := storage.NewFileStorage(dbConn)
+	blobStore, err := initBlobStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("can't init blob storage: %w", err)
+	}
+	cacheStorage, cacheListener, err := initCache(cfg, dbConn)
 	if err != nil {
-		return nil, fmt.Errorf("can't init local storage")
+		return nil, fmt.Errorf("can't init cache: %w", err)
 	}
-	cacheStorage := cache.NewStructuredCache()
-	wcsService := service.NewWcsService(sessionStorage, fileStorage, cfg.LocalFileStoragePath, cacheStorage)
+	wcsService := service.NewAuditedWcsService(service.NewWcsService(fileStorage, blobStore, cacheStorage, groupStorage, service.ShareLinks{
+		Storage: storage.NewShareLinkStorage(dbConn),
+		Secret:  cfg.ShareLinkSecret,
+		MaxTTL:  cfg.ShareLinkMaxTTL,
+	}, cfg.PublicAccess), auditStorage)
+	groupService := service.NewGroupService(groupStorage, cacheStorage)
+	auditService := service.NewAuditService(auditStorage, cfg.AuditAdmins, cfg.AuditSigningKey)
+	adminService := service.NewAuditedAdminService(
+		service.NewAdminService(userStorage, sessionStorage, groupStorage, wcsService, cacheStorage), auditStorage)
 
-	handler := transport.NewHandler(authService, wcsService)
+	handler := transport.NewHandler(authService, wcsService, groupService, auditService, adminService, transport.SessionCookie{
+		Secure: cfg.CookieSecure,
+		MaxAge: cfg.SessionTTL,
+	}, cfg.PublicRateLimit)
+
+	jobs := []job{
+		{
+			name:     "trash purger",
+			interval: cfg.TrashPurgeInterval,
+			run: func(ctx context.Context) error {
+				purged, err := wcsService.PurgeExpiredTrash(ctx, cfg.TrashRetention)
+				if purged > 0 {
+					log.Printf("trash purger: %d documents purged", purged)
+				}
+				return err
+			},
+		},
+		{
+			name:     "session sweeper",
+			interval: cfg.SessionSweepInterval,
+			run: func(ctx context.Context) error {
+				_, err := authService.SweepSessions(ctx)
+				return err
+			},
+		},
+		{
+			name:     "audit checkpoint",
+			interval: cfg.AuditCheckpointInterval,
+			run: func(ctx context.Context) error {
+				_, err := auditService.Checkpoint(ctx)
+				return err
+			},
+		},
+	}
+
+	if cacheListener != nil {
+		jobs = append(jobs, job{
+			name: "cache invalidations",
+			// the subscription is made again after a break
+			interval: time.Second,
+			run:      cacheListener.Listen,
+		})
+	}
 
 	return &App{
 		Config: cfg,
 		Router: handler.InitRouter(),
+		jobs:   jobs,
 	}, nil
 }
 
+func initBlobStore(cfg *config.Config) (blob.BlobStore, error) {
+	switch cfg.BlobBackend {
+	case config.BlobBackendS3:
+		return blob.NewS3Store(blob.S3Config{
+			Endpoint:  cfg.S3.Endpoint,
+			Region:    cfg.S3.Region,
+			Bucket:    cfg.S3.Bucket,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey,
+			PathStyle: cfg.S3.PathStyle,
+		})
+	default:
+		return blob.NewLocalStore(cfg.LocalFileStoragePath)
+	}
+}
+
+// cacheListener receives invalidations made by other replicas
+type cacheListener interface {
+	Listen(ctx context.Context) error
+}
+
+// initCache returns the cache and, for caches shared by replicas,
+// the listener of their invalidations
+func initCache(cfg *config.Config, dbConn postgres.DBPool) (cache.Cache, cacheListener, error) {
+	switch cfg.CacheBackend {
+	case config.CacheBackendRedis:
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad REDIS_URL: %w", err)
+		}
+		redisCache := cache.NewRedisCache(redis.NewClient(opts), "wcs:cache", int64(cfg.CacheMaxBytes), cfg.CacheTTL)
+		return redisCache, redisCache, nil
+	case config.CacheBackendPostgres:
+		notifyCache := cache.NewNotifyCache(cache.NewPgNotifier(dbConn, cfg.DbURL), int64(cfg.CacheMaxBytes), cfg.CacheTTL)
+		return notifyCache, notifyCache, nil
+	default:
+		return cache.NewStructuredCache(int64(cfg.CacheMaxBytes), cfg.CacheTTL), nil, nil
+	}
+}
+
 func (a *App) Run() {
 	fmt.Println("Run server")
 
@@ -60,11 +176,17 @@ func (a *App) Run() {
 		Handler: a.Router,
 	}
 
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	for _, j := range a.jobs {
+		go runJob(jobsCtx, j)
+	}
+
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		<-sigint
+		stopJobs()
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -81,3 +203,18 @@ func (a *App) Run() {
 
 	<-idleConnsClosed
 }
+
+func runJob(ctx context.Context, j job) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		if err := j.run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("%s error: %v", j.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package auditchain makes the audit log tamper-evident. Every record
+// keeps the hash of the previous one, so editing or removing a record
+// breaks the chain. Checkpoints sign the hash of the last record with
+// an Ed25519 key, so the chain can't be rewritten from scratch either.
+package auditchain
+
+import (
+	"AstralTest/internal/models/entity"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// record is the hashed form of entity.AuditEntry, json of a struct
+// keeps the field order, so the encoding is stable
+type record struct {
+	ID        int64  `json:"id"`
+	Time      string `json:"time"`
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	DocID     string `json:"doc_id"`
+	DocOwner  string `json:"doc_owner"`
+	Target    string `json:"target"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Result    string `json:"result"`
+	PrevHash  string `json:"prev_hash"`
+}
+
+// Hash returns hex SHA-256 of the entry and entry.PrevHash,
+// the first entry of the chain has empty PrevHash
+func Hash(entry *entity.AuditEntry) string {
+	rec := record{
+		ID:        entry.ID,
+		Time:      entry.Time.UTC().Format(time.RFC3339Nano),
+		Actor:     entry.Actor,
+		Action:    entry.Action,
+		DocOwner:  entry.DocOwner,
+		Target:    entry.Target,
+		IP:        entry.IP,
+		UserAgent: entry.UserAgent,
+		Result:    entry.Result,
+		PrevHash:  entry.PrevHash,
+	}
+	if entry.DocID != nil {
+		rec.DocID = entry.DocID.String()
+	}
+	data, _ := json.Marshal(rec)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Now is the time of a new record, the database keeps microseconds
+func Now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func checkpointMessage(cp *entity.AuditCheckpoint) []byte {
+	return []byte("audit-checkpoint:" + strconv.FormatInt(cp.EntryID, 10) + ":" + cp.EntryHash + ":" +
+		cp.Time.UTC().Format(time.RFC3339Nano))
+}
+
+// Sign sets the signature of the checkpoint
+func Sign(key ed25519.PrivateKey, cp *entity.AuditCheckpoint) {
+	cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, checkpointMessage(cp)))
+}
+
+func VerifySignature(key ed25519.PublicKey, cp *entity.AuditCheckpoint) bool {
+	signature, err := base64.StdEncoding.DecodeString(cp.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, checkpointMessage(cp), signature)
+}
+
+// ParseKey parses base64 Ed25519 seed (32 bytes) or private key (64 bytes)
+func ParseKey(value string) (ed25519.PrivateKey, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64")
+	}
+	switch len(data) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(data), nil
+	}
+	return nil, fmt.Errorf("key should be %d or %d bytes", ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// ParsePublicKey parses base64 Ed25519 public key
+func ParsePublicKey(value string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64")
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key should be %d bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// BrokenLinkError tells where the chain is broken
+type BrokenLinkError struct {
+	EntryID int64
+	Reason  string
+}
+
+func (e *BrokenLinkError) Error() string {
+	return fmt.Sprintf("broken link at entry %d: %s", e.EntryID, e.Reason)
+}
+
+// Verifier walks the chain from the first entry, entries are passed in id order
+type Verifier struct {
+	key         ed25519.PublicKey
+	checkpoints map[int64]*entity.AuditCheckpoint
+
+	prevHash string
+	lastID   int64
+	// Entries is the number of checked entries
+	Entries int
+	// Signed is the id of the last entry covered by a checkpoint
+	Signed int64
+}
+
+// NewVerifier checks entries against checkpoints signed by key
+func NewVerifier(key ed25519.PublicKey, checkpoints []*entity.AuditCheckpoint) *Verifier {
+	v := &Verifier{
+		key:         key,
+		checkpoints: make(map[int64]*entity.AuditCheckpoint, len(checkpoints)),
+	}
+	for _, cp := range checkpoints {
+		v.checkpoints[cp.EntryID] = cp
+	}
+	return v
+}
+
+// Next checks the next entry of the chain
+func (v *Verifier) Next(entry *entity.AuditEntry) error {
+	if entry.ID <= v.lastID {
+		return &BrokenLinkError{EntryID: entry.ID, Reason: "entries are out of order"}
+	}
+	if entry.PrevHash != v.prevHash {
+		return &BrokenLinkError{EntryID: entry.ID, Reason: "previous entry hash doesn't match, an entry before it is changed or removed"}
+	}
+	if Hash(entry) != entry.Hash {
+		return &BrokenLinkError{EntryID: entry.ID, Reason: "entry hash doesn't match, the entry is changed"}
+	}
+	if cp, ok := v.checkpoints[entry.ID]; ok {
+		if cp.EntryHash != entry.Hash {
+			return &BrokenLinkError{EntryID: entry.ID, Reason: fmt.Sprintf("checkpoint %d is made for another hash", cp.ID)}
+		}
+		if !VerifySignature(v.key, cp) {
+			return &BrokenLinkError{EntryID: entry.ID, Reason: fmt.Sprintf("checkpoint %d has a bad signature", cp.ID)}
+		}
+		v.Signed = entry.ID
+		delete(v.checkpoints, entry.ID)
+	}
+	v.prevHash = entry.Hash
+	v.lastID = entry.ID
+	v.Entries++
+	return nil
+}
+
+// Finish checks that every checkpoint has met its entry,
+// a checkpoint past the end means the tail of the chain is removed
+func (v *Verifier) Finish() error {
+	var first int64
+	for id := range v.checkpoints {
+		if first == 0 || id < first {
+			first = id
+		}
+	}
+	if first == 0 {
+		return nil
+	}
+	if first > v.lastID {
+		return &BrokenLinkError{EntryID: first, Reason: "signed entry is missing, the end of the log is removed"}
+	}
+	return &BrokenLinkError{EntryID: first, Reason: "signed entry is missing"}
+}
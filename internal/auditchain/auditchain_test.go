@@ -0,0 +1,120 @@
+package auditchain
+
+import (
+	"AstralTest/internal/models/entity"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chain makes n linked entries, with a checkpoint of every entry in signed
+func chain(t *testing.T, key ed25519.PrivateKey, n int, signed ...int64) ([]*entity.AuditEntry, []*entity.AuditCheckpoint) {
+	t.Helper()
+	var entries []*entity.AuditEntry
+	var checkpoints []*entity.AuditCheckpoint
+	prev := ""
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= n; i++ {
+		docId := uuid.New()
+		entry := &entity.AuditEntry{
+			ID:       int64(i),
+			Time:     start.Add(time.Duration(i) * time.Second),
+			Actor:    "owner1",
+			Action:   "doc.delete",
+			DocID:    &docId,
+			Result:   "ok",
+			PrevHash: prev,
+		}
+		entry.Hash = Hash(entry)
+		prev = entry.Hash
+		entries = append(entries, entry)
+	}
+	for _, id := range signed {
+		cp := &entity.AuditCheckpoint{ID: id, EntryID: id, EntryHash: entries[id-1].Hash, Time: start}
+		Sign(key, cp)
+		checkpoints = append(checkpoints, cp)
+	}
+	return entries, checkpoints
+}
+
+func verify(key ed25519.PrivateKey, entries []*entity.AuditEntry, checkpoints []*entity.AuditCheckpoint) error {
+	v := NewVerifier(key.Public().(ed25519.PublicKey), checkpoints)
+	for _, entry := range entries {
+		if err := v.Next(entry); err != nil {
+			return err
+		}
+	}
+	return v.Finish()
+}
+
+func brokenAt(t *testing.T, err error) int64 {
+	t.Helper()
+	broken, ok := err.(*BrokenLinkError)
+	require.True(t, ok, "expected a broken link, got %v", err)
+	return broken.EntryID
+}
+
+func TestVerifier(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+	t.Run("intact chain", func(t *testing.T) {
+		entries, checkpoints := chain(t, key, 5, 3, 5)
+		v := NewVerifier(key.Public().(ed25519.PublicKey), checkpoints)
+		for _, entry := range entries {
+			require.NoError(t, v.Next(entry))
+		}
+		require.NoError(t, v.Finish())
+		assert.Equal(t, 5, v.Entries)
+		assert.Equal(t, int64(5), v.Signed)
+	})
+
+	t.Run("changed entry", func(t *testing.T) {
+		entries, checkpoints := chain(t, key, 5, 5)
+		entries[2].Result = "forbidden"
+		assert.Equal(t, int64(3), brokenAt(t, verify(key, entries, checkpoints)))
+	})
+
+	t.Run("rehashed entry breaks the next link", func(t *testing.T) {
+		entries, checkpoints := chain(t, key, 5, 5)
+		entries[2].Actor = "someone"
+		entries[2].Hash = Hash(entries[2])
+		assert.Equal(t, int64(4), brokenAt(t, verify(key, entries, checkpoints)))
+	})
+
+	t.Run("removed entry", func(t *testing.T) {
+		entries, checkpoints := chain(t, key, 5)
+		entries = append(entries[:1], entries[2:]...)
+		assert.Equal(t, int64(3), brokenAt(t, verify(key, entries, checkpoints)))
+	})
+
+	t.Run("rewritten chain fails the checkpoint", func(t *testing.T) {
+		_, checkpoints := chain(t, key, 3, 3)
+		rewritten, _ := chain(t, key, 3)
+		assert.Equal(t, int64(3), brokenAt(t, verify(key, rewritten, checkpoints)))
+	})
+
+	t.Run("checkpoint of another key", func(t *testing.T) {
+		entries, checkpoints := chain(t, key, 3, 2)
+		otherKey := ed25519.NewKeyFromSeed([]byte("0123456789abcdef0123456789abcdef"))
+		assert.Equal(t, int64(2), brokenAt(t, verify(otherKey, entries, checkpoints)))
+	})
+
+	t.Run("removed tail", func(t *testing.T) {
+		entries, checkpoints := chain(t, key, 5, 5)
+		assert.Equal(t, int64(5), brokenAt(t, verify(key, entries[:3], checkpoints)))
+	})
+}
+
+func TestParseKey(t *testing.T) {
+	_, err := ParseKey("AAAA")
+	assert.Error(t, err)
+	_, err = ParseKey("not base64!")
+	assert.Error(t, err)
+	key, err := ParseKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	require.NoError(t, err)
+	assert.Len(t, key, ed25519.PrivateKeySize)
+}
@@ -0,0 +1,42 @@
+// Package authctx carries the authenticated caller and the client
+// through the request context. Middlewares put them in, services take them out.
+package authctx
+
+import (
+	"AstralTest/internal/models/entity"
+	"context"
+)
+
+type (
+	ctxKey    struct{}
+	clientKey struct{}
+)
+
+func WithPrincipal(ctx context.Context, principal *entity.Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, principal)
+}
+
+// Principal returns the caller of the request, nil for anonymous requests
+func Principal(ctx context.Context) *entity.Principal {
+	principal, _ := ctx.Value(ctxKey{}).(*entity.Principal)
+	return principal
+}
+
+// Login returns login of the caller, false for anonymous requests
+func Login(ctx context.Context) (string, bool) {
+	principal := Principal(ctx)
+	if principal == nil {
+		return "", false
+	}
+	return principal.Login, true
+}
+
+func WithClient(ctx context.Context, client entity.ClientInfo) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// Client returns the client which made the request, empty for background jobs
+func Client(ctx context.Context) entity.ClientInfo {
+	client, _ := ctx.Value(clientKey{}).(entity.ClientInfo)
+	return client
+}
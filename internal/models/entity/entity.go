@@ -2,26 +2,334 @@ package entity
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type User struct {
-	Token        uuid.UUID `json:"token"`
-	Login        string    `json:"login"`
-	Password     string    `json:"pswd"`
-	PasswordHash string    `json:"-"`
+	Login        string   `json:"login"`
+	Password     string   `json:"pswd,omitempty"`
+	PasswordHash string   `json:"-"`
+	Role         UserRole `json:"role"`
+	Disabled     bool     `json:"disabled"`
+	// CanInvite lets the user create invitations, admins always can
+	CanInvite bool      `json:"can_invite"`
+	Created   time.Time `json:"created"`
 }
+
+type UserRole string
+
+const (
+	// RoleAdmin manages users
+	RoleAdmin    UserRole = "admin"
+	RoleUser     UserRole = "user"
+	RoleReadonly UserRole = "readonly"
+)
+
+func (r UserRole) Valid() bool {
+	return r == RoleAdmin || r == RoleUser || r == RoleReadonly
+}
+
+// Principal is the authenticated caller of the request
+type Principal struct {
+	Login     string
+	Role      UserRole
+	CanInvite bool
+	SessionID uuid.UUID // token of the session used for the request
+	// ApiKey is set if the request is authenticated by an api key
+	ApiKey *ApiKey
+}
+
+// Allows checks that the caller has the scope, sessions have all scopes
+// except readonly users which only read
+func (p *Principal) Allows(scope string) bool {
+	if p.Role == RoleReadonly && scope != ScopeDocsRead {
+		return false
+	}
+	if p.ApiKey == nil {
+		return true
+	}
+	for _, s := range p.ApiKey.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsOwner checks that the caller may touch documents of the owner
+func (p *Principal) AllowsOwner(owner string) bool {
+	if p.ApiKey == nil || len(p.ApiKey.Owners) == 0 {
+		return true
+	}
+	for _, o := range p.ApiKey.Owners {
+		if o == owner {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	ScopeDocsRead   = "docs:read"
+	ScopeDocsWrite  = "docs:write"
+	ScopeDocsDelete = "docs:delete"
+)
+
+// ApiKey is a long-lived credential of a user for scripts and services,
+// only hash of the key is stored
+type ApiKey struct {
+	ID     uuid.UUID `json:"id"`
+	Login  string    `json:"-"`
+	Name   string    `json:"name"`
+	Prefix string    `json:"prefix"` // first symbols of the key to recognize it
+	Scopes []string  `json:"scopes"`
+	// Owners limits the key to documents of these users, empty means any
+	Owners   []string   `json:"owners,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// Invitation lets one person register, only hash of the code is stored
+type Invitation struct {
+	ID        uuid.UUID `json:"id"`
+	Prefix    string    `json:"prefix"` // first symbols of the code to recognize it
+	CreatedBy string    `json:"created_by"`
+	// Login is pre-assigned to the invitee, empty lets the invitee choose
+	Login   string     `json:"login,omitempty"`
+	Role    UserRole   `json:"role"`
+	Groups  []string   `json:"groups"`
+	Expires time.Time  `json:"expires"`
+	Created time.Time  `json:"created"`
+	Used    *time.Time `json:"used,omitempty"`
+	UsedBy  string     `json:"used_by,omitempty"`
+}
+
+// ClientInfo describes the client which made the request
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+type Session struct {
+	ID        uuid.UUID `json:"id"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Current   bool      `json:"current"` // session of the request
+}
+
 type Document struct {
-	ID       uuid.UUID       `json:"id"`
-	Name     string          `json:"name"`
-	File     bool            `json:"file"`
-	Public   bool            `json:"public"`
-	Token    string          `json:"-"`
-	Mime     string          `json:"mime"`
-	Grant    []string        `json:"grant"`
-	Created  time.Time       `json:"created"`
-	Owner    string          `json:"-"`
-	JsonData json.RawMessage `json:"json,omitempty"`
+	ID          uuid.UUID       `json:"id"`
+	Name        string          `json:"name"`
+	File        bool            `json:"file"`
+	Public      bool            `json:"public"`
+	Mime        string          `json:"mime"`
+	Permissions []Permission    `json:"permissions,omitempty"` // roles of other users, the owner can do everything
+	Created     time.Time       `json:"created"`
+	Hash        string          `json:"hash,omitempty"` // sha256 of the content, used as ETag
+	Size        int64           `json:"size"`           // size of the file or json data
+	Version     int             `json:"version"`
+	Updated     time.Time       `json:"updated"`          // creation time of the version
+	Author      string          `json:"author,omitempty"` // author of the version, only in versions list
+	BlobKey     string          `json:"-"`
+	Deleted     *time.Time      `json:"deleted,omitempty"` // time of moving to the trash
+	Owner       string          `json:"-"`
+	JsonData    json.RawMessage `json:"json,omitempty"`
+
+	// ContentText is text extracted from the file for search, nil keeps the stored one
+	ContentText *string `json:"-"`
+}
+
+// Role of a grantee, every role includes the rights of the previous ones
+type Role string
+
+const (
+	RoleViewer  Role = "viewer"  // read
+	RoleEditor  Role = "editor"  // update content and metadata
+	RoleManager Role = "manager" // share and delete
+)
+
+var roleRanks = map[Role]int{
+	RoleViewer:  1,
+	RoleEditor:  2,
+	RoleManager: 3,
+}
+
+func (r Role) Valid() bool {
+	return roleRanks[r] > 0
+}
+
+// Includes tells if the role gives rights of the other one
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[other]
+}
+
+// Permission gives the role on a document to the user or group
+type Permission struct {
+	Login string `json:"login"` // login of the user or "group:<name>"
+	Role  Role   `json:"role"`
+}
+
+// GroupPrefix marks groups among grantees
+const GroupPrefix = "group:"
+
+// Group is a named set of users which documents can be shared with
+type Group struct {
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Members []string  `json:"members,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// ViewerPermissions converts the legacy grant list to permissions
+func ViewerPermissions(logins []string) []Permission {
+	permissions := make([]Permission, len(logins))
+	for i, login := range logins {
+		permissions[i] = Permission{Login: login, Role: RoleViewer}
+	}
+	return permissions
+}
+
+// RoleOf returns the highest role of the user, given directly or to one
+// of the user's groups, empty if there is none.
+// The owner has no role, it is checked separately
+func (d *Document) RoleOf(login string, groups []string) Role {
+	var role Role
+	for _, p := range d.Permissions {
+		if p.Login == login || (strings.HasPrefix(p.Login, GroupPrefix) && contains(groups, p.Login[len(GroupPrefix):])) {
+			if p.Role.Includes(role) {
+				role = p.Role
+			}
+		}
+	}
+	return role
+}
+
+// HasGroups tells if the document is shared with any group
+func (d *Document) HasGroups() bool {
+	for _, p := range d.Permissions {
+		if strings.HasPrefix(p.Login, GroupPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Grantees returns logins of all users and groups with a role on the document
+func (d *Document) Grantees() []string {
+	logins := make([]string, len(d.Permissions))
+	for i, p := range d.Permissions {
+		logins[i] = p.Login
+	}
+	return logins
+}
+
+// ShareLink gives anonymous access to one document by a signed token,
+// the token itself is not stored
+type ShareLink struct {
+	ID           uuid.UUID  `json:"id"`
+	DocID        uuid.UUID  `json:"doc_id"`
+	CreatedBy    string     `json:"created_by"`
+	Expires      time.Time  `json:"expires"`
+	MaxDownloads *int       `json:"max_downloads,omitempty"` // nil is unlimited
+	Downloads    int        `json:"downloads"`
+	HasPassword  bool       `json:"has_password"`
+	Revoked      *time.Time `json:"revoked,omitempty"`
+	Created      time.Time  `json:"created"`
+}
+
+// ShareLinkOptions are limits of a new share link
+type ShareLinkOptions struct {
+	Expires      *time.Time `json:"expires"` // nil is the default lifetime
+	MaxDownloads *int       `json:"max_downloads"`
+	Password     string     `json:"password"`
+}
+
+// ShareLinkUse is a record of the share link usage log
+type ShareLinkUse struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Result    string    `json:"result"` // download, open or the reason of refusal
+}
+
+// AuditEntry is a record of the audit log
+type AuditEntry struct {
+	ID     int64      `json:"id"`
+	Time   time.Time  `json:"time"`
+	Actor  string     `json:"actor,omitempty"` // empty for anonymous callers and jobs
+	Action string     `json:"action"`
+	DocID  *uuid.UUID `json:"doc_id,omitempty"`
+	// DocOwner is found by DocID when empty
+	DocOwner  string `json:"doc_owner,omitempty"`
+	Target    string `json:"target,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Result    string `json:"result"` // ok or the kind of error
+	// PrevHash is Hash of the previous record, records make a chain
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// AuditCheckpoint is a signed hash of the audit log record,
+// records up to it can't be changed unnoticed
+type AuditCheckpoint struct {
+	ID        int64     `json:"id"`
+	EntryID   int64     `json:"entry_id"`
+	EntryHash string    `json:"entry_hash"`
+	Time      time.Time `json:"time"`
+	Signature string    `json:"signature"` // base64 Ed25519
+}
+
+// SearchHit is a document found by full-text search
+type SearchHit struct {
+	Document
+	Rank float32 `json:"rank"`
+	// Headline is the name and Snippet is a part of the content,
+	// matched words are wrapped in <b></b>, the rest is html escaped
+	Headline string `json:"headline"`
+	Snippet  string `json:"snippet,omitempty"`
+}
+
+// DocsPage is a page of documents list,
+// Next and Prev are opaque cursors of neighbour pages
+type DocsPage struct {
+	Docs  []*Document `json:"docs"`
+	Next  string      `json:"next,omitempty"`
+	Prev  string      `json:"prev,omitempty"`
+	Total *int64      `json:"total,omitempty"`
+}
+
+// DocumentPatch is a partial update of document metadata,
+// nil fields are left unchanged
+type DocumentPatch struct {
+	Name   *string `json:"name"`
+	Public *bool   `json:"public"`
+	Mime   *string `json:"mime"`
+	// Grant is the legacy form of Permissions, all logins become viewers
+	Grant       *[]string       `json:"grant"`
+	Permissions *[]Permission   `json:"permissions"`
+	Json        json.RawMessage `json:"json"` // "null" clears json data
+}
+
+// JsonChange is one difference between json data of two versions
+type JsonChange struct {
+	Path string      `json:"path"` // JSON Pointer
+	Op   string      `json:"op"`   // added, removed or changed
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
 }
@@ -0,0 +1,264 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/cache"
+	"AstralTest/pkg/appError"
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type adminService struct {
+	userStorage    storage.UserStorage
+	sessionStorage storage.SessionStorage
+	groupStorage   storage.GroupStorage
+	wcsService     WcsService
+	cache          cache.Cache
+}
+
+// AdminService manages users, only admins logged in with a password use it.
+// There is always at least one active admin
+type AdminService interface {
+	ListUsers(ctx context.Context) ([]*entity.User, error)
+	SetRole(ctx context.Context, login string, role entity.UserRole) error
+	// SetCanInvite lets the user create invitations, admins can without it
+	SetCanInvite(ctx context.Context, login string, canInvite bool) error
+	// DisableUser blocks login and deletes sessions of the user,
+	// api keys of a disabled user don't work
+	DisableUser(ctx context.Context, login string) error
+	EnableUser(ctx context.Context, login string) error
+	// ResetPassword sets a new password and logs the user out everywhere
+	ResetPassword(ctx context.Context, login, password string) error
+	// DeleteUser deletes the user with sessions, api keys and share links.
+	// Documents and groups go to transferTo, empty transferTo purges the documents
+	// and deletes the groups. Returns the number of purged documents
+	DeleteUser(ctx context.Context, login, transferTo string) (int, error)
+	// CacheStats returns counters of the response cache, zero if it doesn't count,
+	// and of storage reads shared by cache misses
+	CacheStats(ctx context.Context) (CacheStats, error)
+}
+
+// CacheStats keeps fields of cache.Stats on the top level of json
+type CacheStats struct {
+	cache.Stats
+	Coalescing CoalesceStats `json:"coalescing"`
+}
+
+func NewAdminService(userStorage storage.UserStorage, sessionStorage storage.SessionStorage, groupStorage storage.GroupStorage, wcsService WcsService, cache cache.Cache) AdminService {
+	return &adminService{
+		userStorage:    userStorage,
+		sessionStorage: sessionStorage,
+		groupStorage:   groupStorage,
+		wcsService:     wcsService,
+		cache:          cache,
+	}
+}
+
+func (as *adminService) ListUsers(ctx context.Context) ([]*entity.User, error) {
+	if _, err := adminPrincipal(ctx); err != nil {
+		return nil, err
+	}
+	return as.userStorage.ListUsers(ctx)
+}
+
+func (as *adminService) SetRole(ctx context.Context, login string, role entity.UserRole) error {
+	user, err := as.getUser(ctx, login)
+	if err != nil {
+		return err
+	}
+	if !role.Valid() {
+		return appError.BadRequest("unknown role " + string(role))
+	}
+	if role != entity.RoleAdmin {
+		if err := as.keepAdmin(ctx, user); err != nil {
+			return err
+		}
+	}
+	return as.userStorage.SetUserRole(ctx, login, role)
+}
+
+func (as *adminService) SetCanInvite(ctx context.Context, login string, canInvite bool) error {
+	if _, err := as.getUser(ctx, login); err != nil {
+		return err
+	}
+	return as.userStorage.SetUserCanInvite(ctx, login, canInvite)
+}
+
+func (as *adminService) DisableUser(ctx context.Context, login string) error {
+	user, err := as.getUser(ctx, login)
+	if err != nil {
+		return err
+	}
+	if err := as.keepAdmin(ctx, user); err != nil {
+		return err
+	}
+	return as.disable(ctx, login)
+}
+
+func (as *adminService) EnableUser(ctx context.Context, login string) error {
+	if _, err := as.getUser(ctx, login); err != nil {
+		return err
+	}
+	return as.userStorage.SetUserDisabled(ctx, login, false)
+}
+
+func (as *adminService) ResetPassword(ctx context.Context, login, password string) error {
+	if _, err := as.getUser(ctx, login); err != nil {
+		return err
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return appError.Internal()
+	}
+	if err := as.userStorage.SetPassword(ctx, login, string(passwordHash)); err != nil {
+		return err
+	}
+	_, err = as.sessionStorage.DeleteUserSessions(ctx, login)
+	return err
+}
+
+func (as *adminService) DeleteUser(ctx context.Context, login, transferTo string) (int, error) {
+	user, err := as.getUser(ctx, login)
+	if err != nil {
+		return 0, err
+	}
+	if err := as.keepAdmin(ctx, user); err != nil {
+		return 0, err
+	}
+	if transferTo != "" {
+		if transferTo == login {
+			return 0, appError.BadRequest("can't transfer documents to the deleted user")
+		}
+		target, err := as.userStorage.GetUser(ctx, transferTo)
+		if err != nil || target.Disabled {
+			return 0, appError.BadRequest("transfer_to should be an active user")
+		}
+	}
+
+	// the disabled user can't add documents while they are moved
+	if err := as.disable(ctx, login); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	if transferTo != "" {
+		err = as.wcsService.TransferOwnerDocs(ctx, login, transferTo)
+	} else {
+		purged, err = as.wcsService.PurgeOwnerDocs(ctx, login)
+	}
+	if err != nil {
+		return purged, err
+	}
+
+	// groups left are deleted with the user, their members lose access
+	groups, err := as.ownGroups(ctx, login)
+	if err != nil {
+		return purged, err
+	}
+	if err := as.userStorage.DeleteUser(ctx, login); err != nil {
+		return purged, err
+	}
+	for _, group := range groups {
+		for _, member := range group.Members {
+			invalidateMember(as.cache, group.docOwners, member)
+		}
+	}
+	as.cache.InvalidateOwnerList(login)
+	return purged, nil
+}
+
+func (as *adminService) CacheStats(ctx context.Context) (CacheStats, error) {
+	if _, err := adminPrincipal(ctx); err != nil {
+		return CacheStats{}, err
+	}
+	stats := CacheStats{Coalescing: as.wcsService.CoalesceStats()}
+	if reporter, ok := as.cache.(cache.StatsReporter); ok {
+		stats.Stats = reporter.Stats()
+	}
+	return stats, nil
+}
+
+// getUser checks the caller is an admin and returns the user it manages
+func (as *adminService) getUser(ctx context.Context, login string) (*entity.User, error) {
+	if _, err := adminPrincipal(ctx); err != nil {
+		return nil, err
+	}
+	user, err := as.userStorage.GetUser(ctx, login)
+	var appErr appError.AppError
+	if errors.As(err, &appErr) && appErr.Code() == 401 {
+		return nil, appError.NotFound()
+	}
+	return user, err
+}
+
+// keepAdmin refuses to demote, disable or delete the last active admin
+func (as *adminService) keepAdmin(ctx context.Context, user *entity.User) error {
+	if user.Role != entity.RoleAdmin || user.Disabled {
+		return nil
+	}
+	admins, err := as.userStorage.CountAdmins(ctx)
+	if err != nil {
+		return err
+	}
+	if admins <= 1 {
+		return appError.BadRequest("can't remove the last admin")
+	}
+	return nil
+}
+
+func (as *adminService) disable(ctx context.Context, login string) error {
+	if err := as.userStorage.SetUserDisabled(ctx, login, true); err != nil {
+		return err
+	}
+	_, err := as.sessionStorage.DeleteUserSessions(ctx, login)
+	return err
+}
+
+type ownedGroup struct {
+	*entity.Group
+	docOwners []string
+}
+
+// ownGroups returns groups owned by the user with members
+// and owners of documents shared with them
+func (as *adminService) ownGroups(ctx context.Context, login string) ([]ownedGroup, error) {
+	list, err := as.groupStorage.ListGroups(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []ownedGroup
+	for _, group := range list {
+		if group.Owner != login {
+			continue
+		}
+		group, err := as.groupStorage.GetGroup(ctx, group.Name)
+		if err != nil {
+			return nil, err
+		}
+		owners, err := as.groupStorage.GetGroupDocOwners(ctx, group.Name)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, ownedGroup{Group: group, docOwners: owners})
+	}
+	return groups, nil
+}
+
+// adminPrincipal returns the caller if it is an admin logged in with a password
+func adminPrincipal(ctx context.Context) (*entity.Principal, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if principal.Role != entity.RoleAdmin {
+		return nil, appError.Forbidden()
+	}
+	return principal, nil
+}
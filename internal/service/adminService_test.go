@@ -0,0 +1,159 @@
+package service
+
+import (
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func adminCtx(login string) context.Context {
+	return authctx.WithPrincipal(context.Background(), &entity.Principal{Login: login, Role: entity.RoleAdmin, SessionID: uuid.New()})
+}
+
+func TestAdminService_OnlyAdmins(t *testing.T) {
+	svc := NewAdminService(new(mockUserStorage), new(mockSessionStorage), new(mockGroupStorage), nil, new(mockCache))
+
+	_, err := svc.ListUsers(userCtx("someuser"))
+	require.Error(t, err)
+	assert.Equal(t, 403, err.(appError.AppError).Code())
+
+	// api keys of admins don't manage users
+	keyCtx := authctx.WithPrincipal(context.Background(), &entity.Principal{Login: "administrator", Role: entity.RoleAdmin, ApiKey: &entity.ApiKey{}})
+	err = svc.DisableUser(keyCtx, "someuser")
+	require.Error(t, err)
+	assert.Equal(t, 403, err.(appError.AppError).Code())
+}
+
+func TestAdminService_LastAdmin(t *testing.T) {
+	ctx := adminCtx("administrator")
+	users := new(mockUserStorage)
+	users.On("GetUser", ctx, "administrator").Return(&entity.User{Login: "administrator", Role: entity.RoleAdmin}, nil)
+	users.On("CountAdmins", ctx).Return(1, nil)
+	svc := NewAdminService(users, new(mockSessionStorage), new(mockGroupStorage), nil, new(mockCache))
+
+	for name, call := range map[string]func() error{
+		"demote":  func() error { return svc.SetRole(ctx, "administrator", entity.RoleUser) },
+		"disable": func() error { return svc.DisableUser(ctx, "administrator") },
+		"delete":  func() error { _, err := svc.DeleteUser(ctx, "administrator", ""); return err },
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := call()
+			require.Error(t, err)
+			assert.Equal(t, 400, err.(appError.AppError).Code())
+		})
+	}
+	users.AssertNotCalled(t, "SetUserRole", mock.Anything, mock.Anything, mock.Anything)
+	users.AssertNotCalled(t, "SetUserDisabled", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestAdminService_DisableUser(t *testing.T) {
+	ctx := adminCtx("administrator")
+	users := new(mockUserStorage)
+	sessions := new(mockSessionStorage)
+	users.On("GetUser", ctx, "someuser").Return(&entity.User{Login: "someuser", Role: entity.RoleUser}, nil).Once()
+	users.On("SetUserDisabled", ctx, "someuser", true).Return(nil).Once()
+	sessions.On("DeleteUserSessions", ctx, "someuser").Return(int64(2), nil).Once()
+
+	svc := NewAdminService(users, sessions, new(mockGroupStorage), nil, new(mockCache))
+	require.NoError(t, svc.DisableUser(ctx, "someuser"))
+
+	users.On("GetUser", ctx, "missing").Return(nil, appError.Unauthorized()).Once()
+	err := svc.DisableUser(ctx, "missing")
+	require.Error(t, err)
+	assert.Equal(t, 404, err.(appError.AppError).Code())
+
+	users.AssertExpectations(t)
+	sessions.AssertExpectations(t)
+}
+
+func TestAdminService_DeleteUser(t *testing.T) {
+	ctx := adminCtx("administrator")
+
+	setup := func() (*mockUserStorage, *mockSessionStorage, *mockGroupStorage, *mockFileStorage, *mockBlobStore, *mockCache) {
+		users := new(mockUserStorage)
+		sessions := new(mockSessionStorage)
+		groups := new(mockGroupStorage)
+		users.On("GetUser", ctx, "leaving1").Return(&entity.User{Login: "leaving1", Role: entity.RoleUser}, nil)
+		users.On("SetUserDisabled", ctx, "leaving1", true).Return(nil).Once()
+		sessions.On("DeleteUserSessions", ctx, "leaving1").Return(int64(0), nil).Once()
+		users.On("DeleteUser", ctx, "leaving1").Return(nil).Once()
+		return users, sessions, groups, new(mockFileStorage), new(mockBlobStore), new(mockCache)
+	}
+
+	t.Run("transfer", func(t *testing.T) {
+		users, sessions, groups, files, blobs, c := setup()
+		users.On("GetUser", ctx, "newowner").Return(&entity.User{Login: "newowner", Role: entity.RoleUser}, nil).Once()
+		movedId := uuid.New()
+		files.On("GetOwnerGrantees", ctx, "leaving1").Return([]string{"reader01"}, nil).Once()
+		files.On("GetOwnerDocIds", ctx, "leaving1").Return([]uuid.UUID{movedId}, nil).Once()
+		files.On("TransferDocs", ctx, "leaving1", "newowner").Return(nil).Once()
+		// groups went to the new owner
+		groups.On("ListGroups", ctx, "leaving1").Return([]*entity.Group{}, nil).Once()
+		c.On("InvalidateOwnerList", mock.Anything).Return()
+		c.On("InvalidatePublic", mock.Anything).Return()
+		c.On("InvalidateGrant", "leaving1", []string{"reader01"}).Return().Once()
+		c.On("InvalidateGrant", "newowner", []string{"reader01"}).Return().Once()
+		// responses with the moved documents name the old owner
+		c.On("InvalidateDocs", []uuid.UUID{movedId}).Return().Once()
+
+		wcsService := NewWcsService(files, blobs, c, groups, ShareLinks{}, false)
+		svc := NewAdminService(users, sessions, groups, wcsService, c)
+		purged, err := svc.DeleteUser(ctx, "leaving1", "newowner")
+		require.NoError(t, err)
+		assert.Equal(t, 0, purged)
+
+		users.AssertExpectations(t)
+		files.AssertExpectations(t)
+		c.AssertExpectations(t)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		users, sessions, groups, files, blobs, c := setup()
+		docId := uuid.New()
+		files.On("GetOwnerGrantees", ctx, "leaving1").Return([]string(nil), nil).Once()
+		files.On("GetOwnerDocIds", ctx, "leaving1").Return([]uuid.UUID{docId}, nil).Once()
+		files.On("GetBlobKeys", ctx, docId).Return([]string{"blob1"}, nil).Once()
+		files.On("DeleteDoc", ctx, docId).Return(nil).Once()
+		blobs.On("Delete", ctx, "blob1").Return(nil).Once()
+		// members of the user's group lose documents shared with it
+		groups.On("ListGroups", ctx, "leaving1").Return([]*entity.Group{{Name: "team", Owner: "leaving1"}, {Name: "other", Owner: "someone1"}}, nil).Once()
+		groups.On("GetGroup", ctx, "team").Return(&entity.Group{Name: "team", Owner: "leaving1", Members: []string{"member01"}}, nil).Once()
+		groups.On("GetGroupDocOwners", ctx, "team").Return([]string{"owner001"}, nil).Once()
+		c.On("InvalidateOwnerList", mock.Anything).Return()
+		c.On("InvalidatePublic", "leaving1").Return()
+		c.On("InvalidateGrant", "leaving1", mock.Anything).Return().Maybe()
+		c.On("InvalidateGrant", "owner001", []string{"member01"}).Return().Once()
+		c.On("InvalidateDocs", []uuid.UUID{docId}).Return().Once()
+
+		wcsService := NewWcsService(files, blobs, c, groups, ShareLinks{}, false)
+		svc := NewAdminService(users, sessions, groups, wcsService, c)
+		purged, err := svc.DeleteUser(ctx, "leaving1", "")
+		require.NoError(t, err)
+		assert.Equal(t, 1, purged)
+
+		users.AssertExpectations(t)
+		files.AssertExpectations(t)
+		blobs.AssertExpectations(t)
+		groups.AssertExpectations(t)
+		c.AssertExpectations(t)
+	})
+
+	t.Run("transfer to unknown user", func(t *testing.T) {
+		users := new(mockUserStorage)
+		users.On("GetUser", ctx, "leaving1").Return(&entity.User{Login: "leaving1", Role: entity.RoleUser}, nil)
+		users.On("GetUser", ctx, "nobody01").Return(nil, appError.Unauthorized())
+		svc := NewAdminService(users, new(mockSessionStorage), new(mockGroupStorage), nil, new(mockCache))
+
+		_, err := svc.DeleteUser(ctx, "leaving1", "nobody01")
+		require.Error(t, err)
+		assert.Equal(t, 400, err.(appError.AppError).Code())
+		users.AssertNotCalled(t, "SetUserDisabled", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
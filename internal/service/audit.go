@@ -0,0 +1,288 @@
+package service
+
+import (
+	"AstralTest/internal/auditchain"
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/pkg/appError"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// audited actions
+const (
+	AuditRegister        = "auth.register"
+	AuditBootstrapAdmin  = "auth.bootstrap_admin"
+	AuditRegisterInvited = "auth.register_invited"
+	AuditLogin           = "auth.login"
+	AuditLogout          = "auth.logout"
+	AuditAuthenticate    = "auth.authenticate"
+	AuditListSessions    = "session.list"
+	AuditRevokeSession   = "session.revoke"
+	AuditRevokeSessions  = "session.revoke_all"
+	AuditSweepSessions   = "session.sweep"
+	AuditCreateApiKey    = "api_key.create"
+	AuditListApiKeys     = "api_key.list"
+	AuditRevokeApiKey    = "api_key.revoke"
+	AuditCreateInvite    = "invitation.create"
+	AuditListInvites     = "invitation.list"
+	AuditRevokeInvite    = "invitation.revoke"
+	AuditUpload          = "doc.upload"
+	AuditRead            = "doc.read"
+	AuditList            = "doc.list"
+	AuditUpdate          = "doc.update"
+	AuditShare           = "doc.share"
+	AuditReplace         = "doc.replace"
+	AuditDelete          = "doc.delete"
+	AuditSearch          = "doc.search"
+	AuditListVersions    = "version.list"
+	AuditReadVersion     = "version.read"
+	AuditRestoreVersion  = "version.restore"
+	AuditDiffVersions    = "version.diff"
+	AuditCreateShareLink = "share_link.create"
+	AuditListShareLinks  = "share_link.list"
+	AuditRevokeShareLink = "share_link.revoke"
+	AuditShareLinkUses   = "share_link.uses"
+	AuditOpenShareLink   = "share_link.open"
+	AuditListTrash       = "trash.list"
+	AuditRestore         = "trash.restore"
+	AuditPurge           = "trash.purge"
+	AuditEmptyTrash      = "trash.empty"
+	AuditPurgeExpired    = "trash.purge_expired"
+	AuditExport          = "audit.export"
+	AuditListUsers       = "user.list"
+	AuditSetRole         = "user.set_role"
+	AuditSetCanInvite    = "user.set_can_invite"
+	AuditDisableUser     = "user.disable"
+	AuditEnableUser      = "user.enable"
+	AuditResetPassword   = "user.reset_password"
+	AuditDeleteUser      = "user.delete"
+	AuditCacheStats      = "cache.stats"
+)
+
+// auditor appends records of operations, failure to record
+// is logged and doesn't fail the operation which is already done
+type auditor struct {
+	storage storage.AuditStorage
+}
+
+// record writes the entry of the caller and the client of ctx
+func (a auditor) record(ctx context.Context, entry entity.AuditEntry, err error) {
+	if entry.Actor == "" {
+		if login, ok := authctx.Login(ctx); ok {
+			entry.Actor = login
+		}
+	}
+	client := authctx.Client(ctx)
+	entry.IP = client.IP
+	entry.UserAgent = client.UserAgent
+	entry.Result = auditResult(err)
+
+	// the record is kept even if the client has gone
+	ctx = context.WithoutCancel(ctx)
+	if err := a.storage.AppendAudit(ctx, &entry); err != nil {
+		log.Printf("[audit] %s by %q is not recorded: %v", entry.Action, entry.Actor, err)
+	}
+}
+
+func (a auditor) recordDoc(ctx context.Context, action string, docId uuid.UUID, err error) {
+	a.record(ctx, entity.AuditEntry{Action: action, DocID: &docId}, err)
+}
+
+// authFailureWindow is how often failed authentications of one IP are recorded
+const authFailureWindow = time.Minute
+
+// failureCounter folds failed authentications of a client into one record
+// per window, so garbage tokens don't flood the audit log
+type failureCounter struct {
+	mu        sync.Mutex
+	clients   map[string]*failures
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type failures struct {
+	count    int
+	recorded time.Time
+}
+
+func newFailureCounter() *failureCounter {
+	return &failureCounter{
+		clients: make(map[string]*failures),
+		now:     time.Now,
+	}
+}
+
+// add counts the failure of the client and returns the number of failures
+// since its previous record, 0 while the window of that record lasts
+func (f *failureCounter) add(client string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	f.sweep(now)
+
+	c, ok := f.clients[client]
+	if !ok {
+		c = &failures{}
+		f.clients[client] = c
+	}
+	c.count++
+	if ok && now.Sub(c.recorded) < authFailureWindow {
+		return 0
+	}
+	n := c.count
+	c.count = 0
+	c.recorded = now
+	return n
+}
+
+// sweep drops clients without failures in the last window,
+// the few failures not recorded yet are dropped with them
+func (f *failureCounter) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < authFailureWindow {
+		return
+	}
+	f.lastSweep = now
+	for client, c := range f.clients {
+		if now.Sub(c.recorded) >= 2*authFailureWindow {
+			delete(f.clients, client)
+		}
+	}
+}
+
+// auditResult is "ok" or the kind of the error
+func auditResult(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	var appErr appError.AppError
+	if !errors.As(err, &appErr) {
+		return "error"
+	}
+	switch appErr.Code() {
+	case 400:
+		return "bad_request"
+	case 401:
+		return "unauthorized"
+	case 403:
+		return "forbidden"
+	case 404:
+		return "not_found"
+	case 409:
+		return "conflict"
+	case 429:
+		return "rate_limited"
+	}
+	return "error"
+}
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditService reads the audit log. Admins read all records,
+// other users read records of their own documents
+type AuditService interface {
+	// QueryAudit returns a page of records, newest first,
+	// q.Before of the next page is the id of the last record
+	QueryAudit(ctx context.Context, q storage.AuditQuery) ([]*entity.AuditEntry, error)
+	// ExportAudit streams all records matching q to fn, the export is audited too
+	ExportAudit(ctx context.Context, q storage.AuditQuery, fn func(*entity.AuditEntry) error) error
+	// Checkpoint signs the hash of the newest record,
+	// returns nil if there are no records since the last checkpoint
+	Checkpoint(ctx context.Context) (*entity.AuditCheckpoint, error)
+}
+
+type auditService struct {
+	auditor
+	admins     map[string]bool
+	signingKey ed25519.PrivateKey
+}
+
+// NewAuditService makes the service, users with the admin role and admins logins
+// read the whole log, signingKey signs checkpoints
+func NewAuditService(auditStorage storage.AuditStorage, admins []string, signingKey ed25519.PrivateKey) AuditService {
+	adminSet := make(map[string]bool, len(admins))
+	for _, login := range admins {
+		adminSet[login] = true
+	}
+	return &auditService{
+		auditor:    auditor{storage: auditStorage},
+		admins:     adminSet,
+		signingKey: signingKey,
+	}
+}
+
+func (as *auditService) QueryAudit(ctx context.Context, q storage.AuditQuery) ([]*entity.AuditEntry, error) {
+	q, err := as.scope(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultAuditLimit
+	}
+	if q.Limit < 0 || q.Limit > maxAuditLimit {
+		return nil, appError.BadRequest("limit should be from 1 to 1000")
+	}
+	return as.storage.QueryAudit(ctx, q)
+}
+
+func (as *auditService) ExportAudit(ctx context.Context, q storage.AuditQuery, fn func(*entity.AuditEntry) error) error {
+	q, err := as.scope(ctx, q)
+	if err != nil {
+		return err
+	}
+	q.Limit = 0
+	err = as.storage.ExportAudit(ctx, q, fn)
+	as.record(ctx, entity.AuditEntry{Action: AuditExport, DocID: q.DocID, DocOwner: q.DocOwner}, err)
+	return err
+}
+
+func (as *auditService) Checkpoint(ctx context.Context) (*entity.AuditCheckpoint, error) {
+	last, err := as.storage.LastAudit(ctx)
+	if err != nil || last == nil {
+		return nil, err
+	}
+	lastCheckpoint, err := as.storage.LastCheckpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if lastCheckpoint != nil && lastCheckpoint.EntryID == last.ID {
+		return nil, nil
+	}
+
+	cp := &entity.AuditCheckpoint{
+		EntryID:   last.ID,
+		EntryHash: last.Hash,
+		Time:      auditchain.Now(),
+	}
+	auditchain.Sign(as.signingKey, cp)
+	if err := as.storage.AddCheckpoint(ctx, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// scope limits the query of not admins to their own documents
+func (as *auditService) scope(ctx context.Context, q storage.AuditQuery) (storage.AuditQuery, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return q, err
+	}
+	if !as.admins[principal.Login] && principal.Role != entity.RoleAdmin {
+		q.DocOwner = principal.Login
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return q, appError.BadRequest("from should be before to")
+	}
+	return q, nil
+}
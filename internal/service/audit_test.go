@@ -0,0 +1,243 @@
+package service
+
+import (
+	"AstralTest/internal/auditchain"
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/cache"
+	"AstralTest/pkg/appError"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockAuditStorage struct{ mock.Mock }
+
+func (m *mockAuditStorage) AppendAudit(ctx context.Context, entry *entity.AuditEntry) error {
+	args := m.Called(ctx, entry)
+	return args.Error(0)
+}
+func (m *mockAuditStorage) QueryAudit(ctx context.Context, q storage.AuditQuery) ([]*entity.AuditEntry, error) {
+	args := m.Called(ctx, q)
+	entries, _ := args.Get(0).([]*entity.AuditEntry)
+	return entries, args.Error(1)
+}
+func (m *mockAuditStorage) ExportAudit(ctx context.Context, q storage.AuditQuery, fn func(*entity.AuditEntry) error) error {
+	args := m.Called(ctx, q, fn)
+	return args.Error(0)
+}
+func (m *mockAuditStorage) WalkAudit(ctx context.Context, fn func(*entity.AuditEntry) error) error {
+	args := m.Called(ctx, fn)
+	return args.Error(0)
+}
+func (m *mockAuditStorage) LastAudit(ctx context.Context) (*entity.AuditEntry, error) {
+	args := m.Called(ctx)
+	entry, _ := args.Get(0).(*entity.AuditEntry)
+	return entry, args.Error(1)
+}
+func (m *mockAuditStorage) AddCheckpoint(ctx context.Context, cp *entity.AuditCheckpoint) error {
+	args := m.Called(ctx, cp)
+	return args.Error(0)
+}
+func (m *mockAuditStorage) LastCheckpoint(ctx context.Context) (*entity.AuditCheckpoint, error) {
+	args := m.Called(ctx)
+	cp, _ := args.Get(0).(*entity.AuditCheckpoint)
+	return cp, args.Error(1)
+}
+func (m *mockAuditStorage) GetCheckpoints(ctx context.Context) ([]*entity.AuditCheckpoint, error) {
+	args := m.Called(ctx)
+	checkpoints, _ := args.Get(0).([]*entity.AuditCheckpoint)
+	return checkpoints, args.Error(1)
+}
+
+func TestAuditResult(t *testing.T) {
+	assert.Equal(t, "ok", auditResult(nil))
+	assert.Equal(t, "forbidden", auditResult(appError.Forbidden()))
+	assert.Equal(t, "not_found", auditResult(appError.NotFound()))
+	assert.Equal(t, "bad_request", auditResult(appError.BadRequest("bad")))
+	assert.Equal(t, "error", auditResult(errors.New("db is down")))
+}
+
+func TestAuditedWcs(t *testing.T) {
+	client := entity.ClientInfo{IP: "10.0.0.1", UserAgent: "curl"}
+	ctx := authctx.WithClient(userCtx("stranger1"), client)
+	doc := &entity.Document{ID: uuid.New(), Owner: "owner1"}
+
+	t.Run("denied read is recorded", func(t *testing.T) {
+		files := new(mockFileStorage)
+		c := new(mockCache)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		c.On("GetOwner", "stranger1", mock.Anything).Return(cache.CachedDocResp{}, false)
+		audit := new(mockAuditStorage)
+		audit.On("AppendAudit", mock.Anything, &entity.AuditEntry{
+			Actor:     "stranger1",
+			Action:    AuditRead,
+			DocID:     &doc.ID,
+			IP:        "10.0.0.1",
+			UserAgent: "curl",
+			Result:    "forbidden",
+		}).Return(nil)
+
+		svc := NewAuditedWcsService(NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, false), audit)
+		_, _, err := svc.GetFile(ctx, doc.ID)
+		assert.Equal(t, appError.Forbidden(), err)
+		audit.AssertExpectations(t)
+	})
+
+	t.Run("failed record doesn't fail the operation", func(t *testing.T) {
+		files := new(mockFileStorage)
+		files.On("GetTrash", ctx, "stranger1").Return([]*entity.Document{}, nil)
+		audit := new(mockAuditStorage)
+		audit.On("AppendAudit", mock.Anything, mock.Anything).Return(appError.Internal())
+
+		svc := NewAuditedWcsService(NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false), audit)
+		_, err := svc.GetTrash(ctx)
+		assert.NoError(t, err)
+	})
+
+	t.Run("sharing is recorded with the change", func(t *testing.T) {
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		audit := new(mockAuditStorage)
+		audit.On("AppendAudit", mock.Anything, mock.MatchedBy(func(entry *entity.AuditEntry) bool {
+			return entry.Action == AuditShare && entry.Target == "public=true" && entry.Result == "forbidden"
+		})).Return(nil)
+
+		svc := NewAuditedWcsService(NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false), audit)
+		public := true
+		_, err := svc.UpdateFileMeta(ctx, doc.ID, entity.DocumentPatch{Public: &public})
+		assert.Error(t, err)
+		audit.AssertExpectations(t)
+	})
+}
+
+func TestAuditService_Scope(t *testing.T) {
+	t.Run("users read records of their documents", func(t *testing.T) {
+		ctx := userCtx("owner1")
+		audit := new(mockAuditStorage)
+		audit.On("QueryAudit", ctx, storage.AuditQuery{Actor: "other1", DocOwner: "owner1", Limit: defaultAuditLimit}).
+			Return([]*entity.AuditEntry{}, nil)
+
+		svc := NewAuditService(audit, []string{"admin1"}, nil)
+		_, err := svc.QueryAudit(ctx, storage.AuditQuery{Actor: "other1", DocOwner: "admin1"})
+		require.NoError(t, err)
+		audit.AssertExpectations(t)
+	})
+
+	t.Run("admins read all records", func(t *testing.T) {
+		ctx := userCtx("admin1")
+		audit := new(mockAuditStorage)
+		audit.On("QueryAudit", ctx, storage.AuditQuery{Limit: 10}).Return([]*entity.AuditEntry{}, nil)
+
+		svc := NewAuditService(audit, []string{"admin1"}, nil)
+		_, err := svc.QueryAudit(ctx, storage.AuditQuery{Limit: 10})
+		require.NoError(t, err)
+		audit.AssertExpectations(t)
+	})
+
+	t.Run("anonymous callers read nothing", func(t *testing.T) {
+		svc := NewAuditService(new(mockAuditStorage), nil, nil)
+		_, err := svc.QueryAudit(context.Background(), storage.AuditQuery{})
+		assert.Equal(t, appError.Unauthorized(), err)
+	})
+
+	t.Run("export is recorded", func(t *testing.T) {
+		ctx := userCtx("owner1")
+		audit := new(mockAuditStorage)
+		audit.On("ExportAudit", ctx, storage.AuditQuery{DocOwner: "owner1"}, mock.Anything).Return(nil)
+		audit.On("AppendAudit", mock.Anything, mock.MatchedBy(func(entry *entity.AuditEntry) bool {
+			return entry.Action == AuditExport && entry.Actor == "owner1"
+		})).Return(nil)
+
+		svc := NewAuditService(audit, nil, nil)
+		err := svc.ExportAudit(ctx, storage.AuditQuery{Limit: 5}, func(*entity.AuditEntry) error { return nil })
+		require.NoError(t, err)
+		audit.AssertExpectations(t)
+	})
+}
+
+func TestShareChange(t *testing.T) {
+	public := false
+	grant := []string{"alice"}
+	permissions := []entity.Permission{{Login: "group:sales", Role: entity.RoleEditor}}
+
+	assert.Equal(t, "public=false", shareChange(entity.DocumentPatch{Public: &public}))
+	assert.Equal(t, "permissions=alice:viewer", shareChange(entity.DocumentPatch{Grant: &grant}))
+	assert.Equal(t, "public=false permissions=group:sales:editor",
+		shareChange(entity.DocumentPatch{Public: &public, Permissions: &permissions}))
+}
+
+func TestAuditService_Checkpoint(t *testing.T) {
+	ctx := context.Background()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	last := &entity.AuditEntry{ID: 42, Hash: "abc"}
+
+	t.Run("nothing new since the last checkpoint", func(t *testing.T) {
+		audit := new(mockAuditStorage)
+		audit.On("LastAudit", ctx).Return(last, nil)
+		audit.On("LastCheckpoint", ctx).Return(&entity.AuditCheckpoint{EntryID: 42}, nil)
+
+		cp, err := NewAuditService(audit, nil, key).Checkpoint(ctx)
+		require.NoError(t, err)
+		assert.Nil(t, cp)
+		audit.AssertNotCalled(t, "AddCheckpoint", mock.Anything, mock.Anything)
+	})
+
+	t.Run("newest record is signed", func(t *testing.T) {
+		audit := new(mockAuditStorage)
+		audit.On("LastAudit", ctx).Return(last, nil)
+		audit.On("LastCheckpoint", ctx).Return(nil, nil)
+		audit.On("AddCheckpoint", ctx, mock.Anything).Return(nil)
+
+		cp, err := NewAuditService(audit, nil, key).Checkpoint(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(42), cp.EntryID)
+		assert.Equal(t, "abc", cp.EntryHash)
+		assert.True(t, auditchain.VerifySignature(key.Public().(ed25519.PublicKey), cp))
+	})
+}
+
+func TestAuditedAuth_FailedAuthentication(t *testing.T) {
+	ctx := authctx.WithClient(context.Background(), entity.ClientInfo{IP: "10.0.0.1"})
+	sessions := new(mockSessionStorage)
+	sessions.On("GetSession", ctx, mock.Anything).Return("", appError.Unauthorized())
+	audit := new(mockAuditStorage)
+	recorded := func(target string) interface{} {
+		return mock.MatchedBy(func(entry *entity.AuditEntry) bool {
+			return entry.Action == AuditAuthenticate && entry.Target == target && entry.Result == "unauthorized"
+		})
+	}
+
+	svc := NewAuditedAuthService(NewAuthService(new(mockUserStorage), sessions, new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage)), audit)
+	now := time.Now()
+	svc.(*auditedAuth).failures.now = func() time.Time { return now }
+
+	// garbage is not a credential, it's never recorded
+	for _, token := range []string{"garbage", "ak_garbage"} {
+		_, err := svc.Authenticate(ctx, token)
+		assert.Error(t, err)
+	}
+	audit.AssertNotCalled(t, "AppendAudit", mock.Anything, mock.Anything)
+
+	// failures of the client are folded into one record per window
+	audit.On("AppendAudit", mock.Anything, recorded("1")).Return(nil).Once()
+	for i := 0; i < 3; i++ {
+		_, err := svc.Authenticate(ctx, uuid.NewString())
+		assert.Equal(t, appError.Unauthorized(), err)
+	}
+	audit.AssertExpectations(t)
+
+	now = now.Add(authFailureWindow)
+	audit.On("AppendAudit", mock.Anything, recorded("3")).Return(nil).Once()
+	_, err := svc.Authenticate(ctx, uuid.NewString())
+	assert.Error(t, err)
+	audit.AssertExpectations(t)
+}
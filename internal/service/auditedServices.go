@@ -0,0 +1,412 @@
+package service
+
+import (
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// auditedWcs records every operation of WcsService in the audit log
+type auditedWcs struct {
+	next WcsService
+	auditor
+}
+
+func NewAuditedWcsService(next WcsService, auditStorage storage.AuditStorage) WcsService {
+	return &auditedWcs{
+		next:    next,
+		auditor: auditor{storage: auditStorage},
+	}
+}
+
+func (a *auditedWcs) HandleUploadingFile(ctx context.Context, doc entity.Document, fileData io.Reader) (*uuid.UUID, error) {
+	id, err := a.next.HandleUploadingFile(ctx, doc, fileData)
+	a.record(ctx, entity.AuditEntry{Action: AuditUpload, DocID: id}, err)
+	return id, err
+}
+
+func (a *auditedWcs) GetFile(ctx context.Context, fileId uuid.UUID) (*entity.Document, io.ReadSeekCloser, error) {
+	doc, content, err := a.next.GetFile(ctx, fileId)
+	a.recordDoc(ctx, AuditRead, fileId, err)
+	return doc, content, err
+}
+
+func (a *auditedWcs) GetFilesList(ctx context.Context, headOnly bool, query storage.DocsListQuery) (*entity.DocsPage, error) {
+	page, err := a.next.GetFilesList(ctx, headOnly, query)
+	a.record(ctx, entity.AuditEntry{Action: AuditList, Target: query.OwnerLogin}, err)
+	return page, err
+}
+
+func (a *auditedWcs) UpdateFileMeta(ctx context.Context, fileId uuid.UUID, patch entity.DocumentPatch) (*entity.Document, error) {
+	doc, err := a.next.UpdateFileMeta(ctx, fileId, patch)
+	entry := entity.AuditEntry{Action: AuditUpdate, DocID: &fileId}
+	// access changes are recorded with what was asked
+	if patch.Grant != nil || patch.Permissions != nil || patch.Public != nil {
+		entry.Action = AuditShare
+		entry.Target = shareChange(patch)
+	}
+	a.record(ctx, entry, err)
+	return doc, err
+}
+
+// shareChange describes access change of the patch,
+// like "public=true permissions=alice:viewer,group:sales:editor"
+func shareChange(patch entity.DocumentPatch) string {
+	var parts []string
+	if patch.Public != nil {
+		parts = append(parts, "public="+strconv.FormatBool(*patch.Public))
+	}
+	permissions := patch.Permissions
+	if patch.Grant != nil {
+		viewers := entity.ViewerPermissions(*patch.Grant)
+		permissions = &viewers
+	}
+	if permissions != nil {
+		list := make([]string, 0, len(*permissions))
+		for _, p := range *permissions {
+			list = append(list, p.Login+":"+string(p.Role))
+		}
+		parts = append(parts, "permissions="+strings.Join(list, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (a *auditedWcs) ReplaceFileContent(ctx context.Context, fileId uuid.UUID, mime string, content io.Reader) (*entity.Document, error) {
+	doc, err := a.next.ReplaceFileContent(ctx, fileId, mime, content)
+	a.recordDoc(ctx, AuditReplace, fileId, err)
+	return doc, err
+}
+
+func (a *auditedWcs) DeleteFile(ctx context.Context, fileId uuid.UUID) error {
+	err := a.next.DeleteFile(ctx, fileId)
+	a.recordDoc(ctx, AuditDelete, fileId, err)
+	return err
+}
+
+// SearchFiles records no query, it may contain what the caller keeps secret
+func (a *auditedWcs) SearchFiles(ctx context.Context, query string, limit int) ([]*entity.SearchHit, error) {
+	hits, err := a.next.SearchFiles(ctx, query, limit)
+	a.record(ctx, entity.AuditEntry{Action: AuditSearch}, err)
+	return hits, err
+}
+
+func (a *auditedWcs) GetVersions(ctx context.Context, fileId uuid.UUID) ([]*entity.Document, error) {
+	versions, err := a.next.GetVersions(ctx, fileId)
+	a.recordDoc(ctx, AuditListVersions, fileId, err)
+	return versions, err
+}
+
+func (a *auditedWcs) GetFileVersion(ctx context.Context, fileId uuid.UUID, version int) (*entity.Document, io.ReadSeekCloser, error) {
+	doc, content, err := a.next.GetFileVersion(ctx, fileId, version)
+	a.record(ctx, entity.AuditEntry{Action: AuditReadVersion, DocID: &fileId, Target: strconv.Itoa(version)}, err)
+	return doc, content, err
+}
+
+func (a *auditedWcs) RestoreVersion(ctx context.Context, fileId uuid.UUID, version int) (*entity.Document, error) {
+	doc, err := a.next.RestoreVersion(ctx, fileId, version)
+	a.record(ctx, entity.AuditEntry{Action: AuditRestoreVersion, DocID: &fileId, Target: strconv.Itoa(version)}, err)
+	return doc, err
+}
+
+func (a *auditedWcs) DiffVersions(ctx context.Context, fileId uuid.UUID, from, to int) ([]entity.JsonChange, error) {
+	changes, err := a.next.DiffVersions(ctx, fileId, from, to)
+	a.record(ctx, entity.AuditEntry{Action: AuditDiffVersions, DocID: &fileId, Target: strconv.Itoa(from) + ".." + strconv.Itoa(to)}, err)
+	return changes, err
+}
+
+func (a *auditedWcs) CreateShareLink(ctx context.Context, fileId uuid.UUID, options entity.ShareLinkOptions) (*entity.ShareLink, string, error) {
+	link, token, err := a.next.CreateShareLink(ctx, fileId, options)
+	entry := entity.AuditEntry{Action: AuditCreateShareLink, DocID: &fileId}
+	if link != nil {
+		entry.Target = link.ID.String()
+	}
+	a.record(ctx, entry, err)
+	return link, token, err
+}
+
+func (a *auditedWcs) ListShareLinks(ctx context.Context, fileId uuid.UUID) ([]*entity.ShareLink, error) {
+	links, err := a.next.ListShareLinks(ctx, fileId)
+	a.recordDoc(ctx, AuditListShareLinks, fileId, err)
+	return links, err
+}
+
+func (a *auditedWcs) RevokeShareLink(ctx context.Context, fileId, linkId uuid.UUID) error {
+	err := a.next.RevokeShareLink(ctx, fileId, linkId)
+	a.record(ctx, entity.AuditEntry{Action: AuditRevokeShareLink, DocID: &fileId, Target: linkId.String()}, err)
+	return err
+}
+
+func (a *auditedWcs) GetShareLinkUses(ctx context.Context, fileId, linkId uuid.UUID) ([]entity.ShareLinkUse, error) {
+	uses, err := a.next.GetShareLinkUses(ctx, fileId, linkId)
+	a.record(ctx, entity.AuditEntry{Action: AuditShareLinkUses, DocID: &fileId, Target: linkId.String()}, err)
+	return uses, err
+}
+
+// OpenSharedFile records the document only if the link was valid,
+// share link uses keep the details of refusals
+func (a *auditedWcs) OpenSharedFile(ctx context.Context, token, password string, client entity.ClientInfo) (*SharedFile, error) {
+	file, err := a.next.OpenSharedFile(ctx, token, password, client)
+	entry := entity.AuditEntry{Action: AuditOpenShareLink}
+	if file != nil {
+		entry.DocID = &file.Doc.ID
+	}
+	a.record(ctx, entry, err)
+	return file, err
+}
+
+func (a *auditedWcs) GetTrash(ctx context.Context) ([]*entity.Document, error) {
+	docs, err := a.next.GetTrash(ctx)
+	a.record(ctx, entity.AuditEntry{Action: AuditListTrash}, err)
+	return docs, err
+}
+
+func (a *auditedWcs) RestoreFile(ctx context.Context, fileId uuid.UUID) error {
+	err := a.next.RestoreFile(ctx, fileId)
+	a.recordDoc(ctx, AuditRestore, fileId, err)
+	return err
+}
+
+// PurgeFile takes the owner of the record from the caller after a successful purge,
+// the document is gone then and only owners purge their documents
+func (a *auditedWcs) PurgeFile(ctx context.Context, fileId uuid.UUID) error {
+	err := a.next.PurgeFile(ctx, fileId)
+	entry := entity.AuditEntry{Action: AuditPurge, DocID: &fileId}
+	if err == nil {
+		// only owners purge their documents
+		entry.DocOwner, _ = ownUser(ctx, entity.ScopeDocsDelete)
+	}
+	a.record(ctx, entry, err)
+	return err
+}
+
+func (a *auditedWcs) EmptyTrash(ctx context.Context) (int, error) {
+	purged, err := a.next.EmptyTrash(ctx)
+	a.record(ctx, entity.AuditEntry{Action: AuditEmptyTrash, Target: strconv.Itoa(purged)}, err)
+	return purged, err
+}
+
+func (a *auditedWcs) PurgeExpiredTrash(ctx context.Context, retention time.Duration) (int, error) {
+	purged, err := a.next.PurgeExpiredTrash(ctx, retention)
+	if purged > 0 || err != nil {
+		a.record(ctx, entity.AuditEntry{Action: AuditPurgeExpired, Target: strconv.Itoa(purged)}, err)
+	}
+	return purged, err
+}
+
+// TransferOwnerDocs and PurgeOwnerDocs are recorded as the deletion of the user
+func (a *auditedWcs) TransferOwnerDocs(ctx context.Context, fromLogin, toLogin string) error {
+	return a.next.TransferOwnerDocs(ctx, fromLogin, toLogin)
+}
+
+func (a *auditedWcs) PurgeOwnerDocs(ctx context.Context, login string) (int, error) {
+	return a.next.PurgeOwnerDocs(ctx, login)
+}
+
+func (a *auditedWcs) CoalesceStats() CoalesceStats {
+	return a.next.CoalesceStats()
+}
+
+// auditedAuth records every operation of AuthService in the audit log
+type auditedAuth struct {
+	next AuthService
+	auditor
+	failures *failureCounter
+}
+
+func NewAuditedAuthService(next AuthService, auditStorage storage.AuditStorage) AuthService {
+	return &auditedAuth{
+		next:     next,
+		auditor:  auditor{storage: auditStorage},
+		failures: newFailureCounter(),
+	}
+}
+
+func (a *auditedAuth) Register(ctx context.Context, user *entity.User) error {
+	err := a.next.Register(ctx, user)
+	a.record(ctx, entity.AuditEntry{Action: AuditRegister, Target: user.Login}, err)
+	return err
+}
+
+// RegisterInvited has no caller, the invitee is the actor
+func (a *auditedAuth) RegisterInvited(ctx context.Context, code string, user *entity.User) error {
+	err := a.next.RegisterInvited(ctx, code, user)
+	a.record(ctx, entity.AuditEntry{Action: AuditRegisterInvited, Actor: user.Login, Target: user.Login}, err)
+	return err
+}
+
+func (a *auditedAuth) BootstrapAdmin(ctx context.Context, login, password string) error {
+	err := a.next.BootstrapAdmin(ctx, login, password)
+	a.record(ctx, entity.AuditEntry{Action: AuditBootstrapAdmin, Target: login}, err)
+	return err
+}
+
+// Login records the login the client tried, the password is wrong or not
+func (a *auditedAuth) Login(ctx context.Context, user *entity.User, client entity.ClientInfo) (*uuid.UUID, error) {
+	session, err := a.next.Login(ctx, user, client)
+	a.record(ctx, entity.AuditEntry{Action: AuditLogin, Actor: user.Login}, err)
+	return session, err
+}
+
+// Logout records the owner of the deleted session as the actor
+func (a *auditedAuth) Logout(ctx context.Context, token uuid.UUID) (string, error) {
+	login, err := a.next.Logout(ctx, token)
+	a.record(ctx, entity.AuditEntry{Action: AuditLogout, Actor: login}, err)
+	return login, err
+}
+
+// Authenticate runs for every request, only failures are recorded,
+// successful ones are seen in records of the operations. Tokens which are
+// not credentials at all are not recorded, others are recorded once a
+// window per IP with the number of failures as the target
+func (a *auditedAuth) Authenticate(ctx context.Context, token string) (*entity.Principal, error) {
+	principal, err := a.next.Authenticate(ctx, token)
+	if err != nil && isCredential(token) {
+		if n := a.failures.add(authctx.Client(ctx).IP); n > 0 {
+			a.record(ctx, entity.AuditEntry{Action: AuditAuthenticate, Target: strconv.Itoa(n)}, err)
+		}
+	}
+	return principal, err
+}
+
+func (a *auditedAuth) ListSessions(ctx context.Context) ([]entity.Session, error) {
+	sessions, err := a.next.ListSessions(ctx)
+	a.record(ctx, entity.AuditEntry{Action: AuditListSessions}, err)
+	return sessions, err
+}
+
+func (a *auditedAuth) RevokeSession(ctx context.Context, sessionId uuid.UUID) error {
+	err := a.next.RevokeSession(ctx, sessionId)
+	a.record(ctx, entity.AuditEntry{Action: AuditRevokeSession, Target: sessionId.String()}, err)
+	return err
+}
+
+func (a *auditedAuth) RevokeAllSessions(ctx context.Context) (int64, error) {
+	revoked, err := a.next.RevokeAllSessions(ctx)
+	a.record(ctx, entity.AuditEntry{Action: AuditRevokeSessions, Target: strconv.FormatInt(revoked, 10)}, err)
+	return revoked, err
+}
+
+func (a *auditedAuth) SweepSessions(ctx context.Context) (int64, error) {
+	swept, err := a.next.SweepSessions(ctx)
+	if swept > 0 || err != nil {
+		a.record(ctx, entity.AuditEntry{Action: AuditSweepSessions, Target: strconv.FormatInt(swept, 10)}, err)
+	}
+	return swept, err
+}
+
+func (a *auditedAuth) CreateApiKey(ctx context.Context, key *entity.ApiKey) (string, error) {
+	secret, err := a.next.CreateApiKey(ctx, key)
+	entry := entity.AuditEntry{Action: AuditCreateApiKey}
+	if key.ID != uuid.Nil {
+		entry.Target = key.ID.String()
+	}
+	a.record(ctx, entry, err)
+	return secret, err
+}
+
+func (a *auditedAuth) ListApiKeys(ctx context.Context) ([]*entity.ApiKey, error) {
+	keys, err := a.next.ListApiKeys(ctx)
+	a.record(ctx, entity.AuditEntry{Action: AuditListApiKeys}, err)
+	return keys, err
+}
+
+func (a *auditedAuth) RevokeApiKey(ctx context.Context, id uuid.UUID) error {
+	err := a.next.RevokeApiKey(ctx, id)
+	a.record(ctx, entity.AuditEntry{Action: AuditRevokeApiKey, Target: id.String()}, err)
+	return err
+}
+
+func (a *auditedAuth) CreateInvitation(ctx context.Context, inv *entity.Invitation) (string, error) {
+	code, err := a.next.CreateInvitation(ctx, inv)
+	entry := entity.AuditEntry{Action: AuditCreateInvite}
+	if inv.ID != uuid.Nil {
+		entry.Target = inv.ID.String()
+	}
+	a.record(ctx, entry, err)
+	return code, err
+}
+
+func (a *auditedAuth) ListInvitations(ctx context.Context) ([]*entity.Invitation, error) {
+	invitations, err := a.next.ListInvitations(ctx)
+	a.record(ctx, entity.AuditEntry{Action: AuditListInvites}, err)
+	return invitations, err
+}
+
+func (a *auditedAuth) RevokeInvitation(ctx context.Context, id uuid.UUID) error {
+	err := a.next.RevokeInvitation(ctx, id)
+	a.record(ctx, entity.AuditEntry{Action: AuditRevokeInvite, Target: id.String()}, err)
+	return err
+}
+
+// auditedAdmin records every operation of AdminService in the audit log
+type auditedAdmin struct {
+	next AdminService
+	auditor
+}
+
+func NewAuditedAdminService(next AdminService, auditStorage storage.AuditStorage) AdminService {
+	return &auditedAdmin{
+		next:    next,
+		auditor: auditor{storage: auditStorage},
+	}
+}
+
+func (a *auditedAdmin) ListUsers(ctx context.Context) ([]*entity.User, error) {
+	users, err := a.next.ListUsers(ctx)
+	a.record(ctx, entity.AuditEntry{Action: AuditListUsers}, err)
+	return users, err
+}
+
+func (a *auditedAdmin) SetRole(ctx context.Context, login string, role entity.UserRole) error {
+	err := a.next.SetRole(ctx, login, role)
+	a.record(ctx, entity.AuditEntry{Action: AuditSetRole, Target: login + ":" + string(role)}, err)
+	return err
+}
+
+func (a *auditedAdmin) SetCanInvite(ctx context.Context, login string, canInvite bool) error {
+	err := a.next.SetCanInvite(ctx, login, canInvite)
+	a.record(ctx, entity.AuditEntry{Action: AuditSetCanInvite, Target: login + ":" + strconv.FormatBool(canInvite)}, err)
+	return err
+}
+
+func (a *auditedAdmin) DisableUser(ctx context.Context, login string) error {
+	err := a.next.DisableUser(ctx, login)
+	a.record(ctx, entity.AuditEntry{Action: AuditDisableUser, Target: login}, err)
+	return err
+}
+
+func (a *auditedAdmin) EnableUser(ctx context.Context, login string) error {
+	err := a.next.EnableUser(ctx, login)
+	a.record(ctx, entity.AuditEntry{Action: AuditEnableUser, Target: login}, err)
+	return err
+}
+
+func (a *auditedAdmin) ResetPassword(ctx context.Context, login, password string) error {
+	err := a.next.ResetPassword(ctx, login, password)
+	a.record(ctx, entity.AuditEntry{Action: AuditResetPassword, Target: login}, err)
+	return err
+}
+
+// DeleteUser records where the documents went, "<login>:><new owner>" or the number of purged ones
+func (a *auditedAdmin) DeleteUser(ctx context.Context, login, transferTo string) (int, error) {
+	purged, err := a.next.DeleteUser(ctx, login, transferTo)
+	target := login + ":purged:" + strconv.Itoa(purged)
+	if transferTo != "" {
+		target = login + ":>" + transferTo
+	}
+	a.record(ctx, entity.AuditEntry{Action: AuditDeleteUser, Target: target}, err)
+	return purged, err
+}
+
+func (a *auditedAdmin) CacheStats(ctx context.Context) (CacheStats, error) {
+	stats, err := a.next.CacheStats(ctx)
+	a.record(ctx, entity.AuditEntry{Action: AuditCacheStats}, err)
+	return stats, err
+}
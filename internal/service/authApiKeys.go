@@ -0,0 +1,98 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// apiKeyPrefix tells api keys from session tokens
+	apiKeyPrefix = "ak_"
+	// shown part of the key: prefix and 8 symbols of the secret
+	apiKeyShownLength = len(apiKeyPrefix) + 8
+	apiKeySecretSize  = 32
+)
+
+var knownScopes = map[string]bool{
+	entity.ScopeDocsRead:   true,
+	entity.ScopeDocsWrite:  true,
+	entity.ScopeDocsDelete: true,
+}
+
+func (a *auth) CreateApiKey(ctx context.Context, key *entity.ApiKey) (string, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if key.Name == "" {
+		return "", appError.BadRequest("name is required")
+	}
+	if len(key.Scopes) == 0 {
+		return "", appError.BadRequest("at least one scope is required")
+	}
+	for _, scope := range key.Scopes {
+		if !knownScopes[scope] {
+			return "", appError.BadRequest("unknown scope " + scope)
+		}
+	}
+	if key.Expires != nil && !key.Expires.After(time.Now()) {
+		return "", appError.BadRequest("expires must be in the future")
+	}
+
+	secret := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", appError.Internal()
+	}
+	token := apiKeyPrefix + hex.EncodeToString(secret)
+
+	key.ID = uuid.New()
+	key.Login = principal.Login
+	key.Prefix = token[:apiKeyShownLength]
+	if err := a.apiKeyStorage.CreateApiKey(ctx, key, hashApiKey(token)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (a *auth) ListApiKeys(ctx context.Context) ([]*entity.ApiKey, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.apiKeyStorage.ListApiKeys(ctx, principal.Login)
+}
+
+func (a *auth) RevokeApiKey(ctx context.Context, id uuid.UUID) error {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	return a.apiKeyStorage.DeleteApiKey(ctx, principal.Login, id)
+}
+
+func (a *auth) authenticateApiKey(ctx context.Context, token string) (*entity.Principal, error) {
+	key, err := a.apiKeyStorage.GetApiKey(ctx, hashApiKey(token))
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.activeUser(ctx, key.Login)
+	if err != nil {
+		return nil, err
+	}
+	return &entity.Principal{Login: key.Login, Role: user.Role, CanInvite: user.CanInvite, ApiKey: key}, nil
+}
+
+// hashApiKey returns the stored form of the key. Keys are random
+// and long, so a fast hash is enough, unlike passwords
+func hashApiKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	invitationPrefix = "inv_"
+	// shown part of the code: prefix and 6 symbols of the secret
+	invitationShownLength = len(invitationPrefix) + 6
+
+	defaultInvitationTTL = 7 * 24 * time.Hour
+	maxInvitationTTL     = 30 * 24 * time.Hour
+)
+
+func (a *auth) CreateInvitation(ctx context.Context, inv *entity.Invitation) (string, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return "", err
+	}
+	isAdmin := principal.Role == entity.RoleAdmin
+	if !isAdmin && !principal.CanInvite {
+		return "", appError.Forbidden()
+	}
+
+	if inv.Role == "" {
+		inv.Role = entity.RoleUser
+	}
+	if !inv.Role.Valid() {
+		return "", appError.BadRequest("unknown role " + string(inv.Role))
+	}
+	// users who can invite don't make admins
+	if inv.Role == entity.RoleAdmin && !isAdmin {
+		return "", appError.Forbidden()
+	}
+	if inv.Login != "" {
+		if err := validateLogin(inv.Login); err != nil {
+			return "", err
+		}
+	}
+
+	now := time.Now()
+	if inv.Expires.IsZero() {
+		inv.Expires = now.Add(defaultInvitationTTL)
+	}
+	if !inv.Expires.After(now) {
+		return "", appError.BadRequest("expires must be in the future")
+	}
+	if inv.Expires.Sub(now) > maxInvitationTTL {
+		return "", appError.BadRequest(fmt.Sprintf("invitation can't live longer than %s", maxInvitationTTL))
+	}
+
+	// only owners of groups bring new members, admins to any group
+	if inv.Groups == nil {
+		inv.Groups = []string{}
+	}
+	for _, name := range inv.Groups {
+		group, err := a.groupStorage.GetGroup(ctx, name)
+		if err != nil {
+			var appErr appError.AppError
+			if errors.As(err, &appErr) && appErr.Code() == 404 {
+				return "", appError.BadRequest("group " + name + " doesn't exist")
+			}
+			return "", err
+		}
+		if group.Owner != principal.Login && !isAdmin {
+			return "", appError.Forbidden()
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", appError.Internal()
+	}
+	code := invitationPrefix + hex.EncodeToString(secret)
+
+	inv.ID = uuid.New()
+	inv.CreatedBy = principal.Login
+	inv.Prefix = code[:invitationShownLength]
+	// codes are random and long like api keys, so they are hashed the same way
+	if err := a.invitations.CreateInvitation(ctx, inv, hashApiKey(code)); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func (a *auth) ListInvitations(ctx context.Context) ([]*entity.Invitation, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.invitations.ListInvitations(ctx, principal.Login)
+}
+
+func (a *auth) RevokeInvitation(ctx context.Context, id uuid.UUID) error {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	return a.invitations.DeleteInvitation(ctx, principal.Login, id)
+}
+
+func (a *auth) RegisterInvited(ctx context.Context, code string, user *entity.User) error {
+	inv, err := a.invitations.GetInvitation(ctx, hashApiKey(code))
+	if err != nil {
+		var appErr appError.AppError
+		if errors.As(err, &appErr) && appErr.Code() == 404 {
+			return appError.BadRequest("unknown invitation code")
+		}
+		return err
+	}
+	// clear errors for the invitee, RedeemInvitation checks them again atomically
+	if inv.Used != nil {
+		return appError.BadRequest("invitation code is already used")
+	}
+	if !inv.Expires.After(time.Now()) {
+		return appError.BadRequest("invitation code has expired")
+	}
+
+	if inv.Login != "" {
+		if user.Login == "" {
+			user.Login = inv.Login
+		}
+		if user.Login != inv.Login {
+			return appError.BadRequest("invitation is for login " + inv.Login)
+		}
+	}
+	user.Role = inv.Role
+	if err := prepareUser(user); err != nil {
+		return err
+	}
+	return a.invitations.RedeemInvitation(ctx, inv.ID, user)
+}
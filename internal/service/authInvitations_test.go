@@ -0,0 +1,185 @@
+package service
+
+import (
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockInvitationStorage struct{ mock.Mock }
+
+func (m *mockInvitationStorage) CreateInvitation(ctx context.Context, inv *entity.Invitation, codeHash string) error {
+	args := m.Called(ctx, inv, codeHash)
+	return args.Error(0)
+}
+
+func (m *mockInvitationStorage) GetInvitation(ctx context.Context, codeHash string) (*entity.Invitation, error) {
+	args := m.Called(ctx, codeHash)
+	if inv, ok := args.Get(0).(*entity.Invitation); ok {
+		return inv, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *mockInvitationStorage) ListInvitations(ctx context.Context, createdBy string) ([]*entity.Invitation, error) {
+	args := m.Called(ctx, createdBy)
+	return args.Get(0).([]*entity.Invitation), args.Error(1)
+}
+
+func (m *mockInvitationStorage) DeleteInvitation(ctx context.Context, createdBy string, id uuid.UUID) error {
+	args := m.Called(ctx, createdBy, id)
+	return args.Error(0)
+}
+
+func (m *mockInvitationStorage) RedeemInvitation(ctx context.Context, id uuid.UUID, user *entity.User) error {
+	args := m.Called(ctx, id, user)
+	return args.Error(0)
+}
+
+func inviterCtx(login string) context.Context {
+	return authctx.WithPrincipal(context.Background(), &entity.Principal{Login: login, Role: entity.RoleUser, CanInvite: true, SessionID: uuid.New()})
+}
+
+func TestCreateInvitation(t *testing.T) {
+	t.Run("user who can invite", func(t *testing.T) {
+		ctx := inviterCtx("inviter1")
+		invitations := new(mockInvitationStorage)
+		groups := new(mockGroupStorage)
+		groups.On("GetGroup", ctx, "sales").Return(&entity.Group{Name: "sales", Owner: "inviter1"}, nil).Once()
+		invitations.On("CreateInvitation", ctx, mock.AnythingOfType("*entity.Invitation"), mock.AnythingOfType("string")).Return(nil).Once()
+
+		auth := NewAuthService(new(mockUserStorage), new(mockSessionStorage), new(mockApiKeyStorage), invitations, groups)
+		inv := &entity.Invitation{Groups: []string{"sales"}}
+		code, err := auth.CreateInvitation(ctx, inv)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(code, invitationPrefix))
+		assert.True(t, strings.HasPrefix(code, inv.Prefix))
+		assert.Equal(t, "inviter1", inv.CreatedBy)
+		assert.Equal(t, entity.RoleUser, inv.Role)
+		assert.WithinDuration(t, time.Now().Add(defaultInvitationTTL), inv.Expires, time.Minute)
+		// the code itself is never stored
+		assert.NotEqual(t, code, invitations.Calls[0].Arguments.String(2))
+		invitations.AssertExpectations(t)
+	})
+
+	refused := []struct {
+		name    string
+		ctx     context.Context
+		inv     *entity.Invitation
+		errCode int
+	}{
+		{"user without permission", userCtx("someuser"), &entity.Invitation{}, 403},
+		{"admin by not an admin", inviterCtx("inviter1"), &entity.Invitation{Role: entity.RoleAdmin}, 403},
+		{"group of another owner", inviterCtx("inviter1"), &entity.Invitation{Groups: []string{"others"}}, 403},
+		{"missing group", inviterCtx("inviter1"), &entity.Invitation{Groups: []string{"missing"}}, 400},
+		{"expired", inviterCtx("inviter1"), &entity.Invitation{Expires: time.Now().Add(-time.Hour)}, 400},
+		{"too long", inviterCtx("inviter1"), &entity.Invitation{Expires: time.Now().Add(2 * maxInvitationTTL)}, 400},
+		{"bad login", inviterCtx("inviter1"), &entity.Invitation{Login: "short"}, 400},
+	}
+	for _, tc := range refused {
+		t.Run(tc.name, func(t *testing.T) {
+			groups := new(mockGroupStorage)
+			groups.On("GetGroup", mock.Anything, "others").Return(&entity.Group{Name: "others", Owner: "someone1"}, nil).Maybe()
+			groups.On("GetGroup", mock.Anything, "missing").Return(nil, appError.NotFound()).Maybe()
+			invitations := new(mockInvitationStorage)
+
+			auth := NewAuthService(new(mockUserStorage), new(mockSessionStorage), new(mockApiKeyStorage), invitations, groups)
+			_, err := auth.CreateInvitation(tc.ctx, tc.inv)
+			require.Error(t, err)
+			assert.Equal(t, tc.errCode, err.(appError.AppError).Code())
+			invitations.AssertNotCalled(t, "CreateInvitation", mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestRegisterInvited(t *testing.T) {
+	ctx := context.Background()
+	code := invitationPrefix + "secret"
+	used := time.Now().Add(-time.Minute)
+
+	testCases := []struct {
+		name    string
+		inv     *entity.Invitation
+		getErr  error
+		login   string
+		errCode int
+		errText string
+	}{
+		{
+			name:  "login of the invitation",
+			inv:   &entity.Invitation{ID: uuid.New(), Login: "invitee1", Role: entity.RoleReadonly, Expires: time.Now().Add(time.Hour)},
+			login: "",
+		},
+		{
+			name:  "own login",
+			inv:   &entity.Invitation{ID: uuid.New(), Role: entity.RoleUser, Expires: time.Now().Add(time.Hour)},
+			login: "invitee2",
+		},
+		{
+			name:    "another login",
+			inv:     &entity.Invitation{ID: uuid.New(), Login: "invitee1", Role: entity.RoleUser, Expires: time.Now().Add(time.Hour)},
+			login:   "invitee2",
+			errCode: 400,
+			errText: "invitation is for login invitee1",
+		},
+		{
+			name:    "unknown code",
+			getErr:  appError.NotFound(),
+			login:   "invitee2",
+			errCode: 400,
+			errText: "unknown invitation code",
+		},
+		{
+			name:    "used code",
+			inv:     &entity.Invitation{ID: uuid.New(), Role: entity.RoleUser, Expires: time.Now().Add(time.Hour), Used: &used},
+			login:   "invitee2",
+			errCode: 400,
+			errText: "invitation code is already used",
+		},
+		{
+			name:    "expired code",
+			inv:     &entity.Invitation{ID: uuid.New(), Role: entity.RoleUser, Expires: time.Now().Add(-time.Hour)},
+			login:   "invitee2",
+			errCode: 400,
+			errText: "invitation code has expired",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			invitations := new(mockInvitationStorage)
+			invitations.On("GetInvitation", ctx, hashApiKey(code)).Return(tc.inv, tc.getErr).Once()
+			if tc.errCode == 0 {
+				invitations.On("RedeemInvitation", ctx, tc.inv.ID, mock.MatchedBy(func(u *entity.User) bool {
+					return u.Role == tc.inv.Role && u.PasswordHash != ""
+				})).Return(nil).Once()
+			}
+
+			auth := NewAuthService(new(mockUserStorage), new(mockSessionStorage), new(mockApiKeyStorage), invitations, new(mockGroupStorage))
+			user := &entity.User{Login: tc.login, Password: "GoodPass1!", Role: entity.RoleAdmin}
+			err := auth.RegisterInvited(ctx, code, user)
+			if tc.errCode != 0 {
+				require.Error(t, err)
+				assert.Equal(t, tc.errCode, err.(appError.AppError).Code())
+				assert.Equal(t, tc.errText, err.Error())
+			} else {
+				require.NoError(t, err)
+				// the role comes from the invitation, not from the request
+				assert.Equal(t, tc.inv.Role, user.Role)
+				if tc.login == "" {
+					assert.Equal(t, tc.inv.Login, user.Login)
+				}
+			}
+			invitations.AssertExpectations(t)
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package service
 
 import (
+	"AstralTest/internal/authctx"
 	"AstralTest/internal/models/entity"
 	"AstralTest/internal/storage"
 	"AstralTest/pkg/appError"
 	"context"
+	"encoding/hex"
+	"strings"
 	"unicode"
 
 	"github.com/google/uuid"
@@ -14,20 +17,57 @@ import (
 type auth struct {
 	userStorage    storage.UserStorage
 	sessionStorage storage.SessionStorage
-	adminToken     uuid.UUID
+	apiKeyStorage  storage.ApiKeyStorage
+	invitations    storage.InvitationStorage
+	groupStorage   storage.GroupStorage
 }
 
 type AuthService interface {
-	Register(ctx context.Context, user *entity.User, token uuid.UUID) error
-	Login(ctx context.Context, user *entity.User) (*uuid.UUID, error)
-	Logout(ctx context.Context, token uuid.UUID) error
+	// Register creates the user, only admins register users.
+	// Empty role is the user role
+	Register(ctx context.Context, user *entity.User) error
+	// BootstrapAdmin makes the first admin while there is no active one:
+	// an existing user gets the admin role, otherwise the user is created
+	BootstrapAdmin(ctx context.Context, login, password string) error
+	Login(ctx context.Context, user *entity.User, client entity.ClientInfo) (*uuid.UUID, error)
+	// Logout deletes the session, returns login of its owner (empty if there was none)
+	Logout(ctx context.Context, token uuid.UUID) (string, error)
+	// Authenticate resolves the caller by session token or api key
+	Authenticate(ctx context.Context, token string) (*entity.Principal, error)
+
+	// ListSessions returns active sessions of the caller
+	ListSessions(ctx context.Context) ([]entity.Session, error)
+	RevokeSession(ctx context.Context, sessionId uuid.UUID) error
+	// RevokeAllSessions logs out the caller everywhere, including the current session
+	RevokeAllSessions(ctx context.Context) (int64, error)
+	// SweepSessions deletes expired sessions
+	SweepSessions(ctx context.Context) (int64, error)
+
+	// CreateApiKey creates the key for the caller and returns its secret,
+	// the secret isn't stored and can't be shown again
+	CreateApiKey(ctx context.Context, key *entity.ApiKey) (string, error)
+	ListApiKeys(ctx context.Context) ([]*entity.ApiKey, error)
+	RevokeApiKey(ctx context.Context, id uuid.UUID) error
+
+	// CreateInvitation makes a single-use registration code, admins and users
+	// who can invite create them. Returns the code, it can't be shown again
+	CreateInvitation(ctx context.Context, inv *entity.Invitation) (string, error)
+	// ListInvitations returns invitations created by the caller
+	ListInvitations(ctx context.Context) ([]*entity.Invitation, error)
+	// RevokeInvitation deletes the caller's invitation which is not used yet
+	RevokeInvitation(ctx context.Context, id uuid.UUID) error
+	// RegisterInvited creates the user by the invitation code without a caller,
+	// the code is consumed with the registration. Empty login takes the one of the invitation
+	RegisterInvited(ctx context.Context, code string, user *entity.User) error
 }
 
-func NewAuthService(userStorage storage.UserStorage, sessionStorage storage.SessionStorage, adminToken uuid.UUID) AuthService {
+func NewAuthService(userStorage storage.UserStorage, sessionStorage storage.SessionStorage, apiKeyStorage storage.ApiKeyStorage, invitations storage.InvitationStorage, groupStorage storage.GroupStorage) AuthService {
 	return &auth{
 		userStorage:    userStorage,
 		sessionStorage: sessionStorage,
-		adminToken:     adminToken,
+		apiKeyStorage:  apiKeyStorage,
+		invitations:    invitations,
+		groupStorage:   groupStorage,
 	}
 }
 
@@ -83,15 +123,59 @@ func validatePassword(password string) error {
 	return nil
 }
 
-func (a *auth) Register(ctx context.Context, user *entity.User, token uuid.UUID) error {
-	if err := validatePassword(user.Password); err != nil {
+func (a *auth) Register(ctx context.Context, user *entity.User) error {
+	if _, err := adminPrincipal(ctx); err != nil {
+		return err
+	}
+	return a.addUser(ctx, user)
+}
+
+func (a *auth) BootstrapAdmin(ctx context.Context, login, password string) error {
+	admins, err := a.userStorage.CountAdmins(ctx)
+	if err != nil || admins > 0 {
 		return err
 	}
-	if len(user.Login) < 8 {
+
+	if _, err := a.userStorage.GetUser(ctx, login); err == nil {
+		if err := a.userStorage.SetUserRole(ctx, login, entity.RoleAdmin); err != nil {
+			return err
+		}
+		return a.userStorage.SetUserDisabled(ctx, login, false)
+	}
+	return a.addUser(ctx, &entity.User{Login: login, Password: password, Role: entity.RoleAdmin})
+}
+
+func (a *auth) addUser(ctx context.Context, user *entity.User) error {
+	if err := prepareUser(user); err != nil {
+		return err
+	}
+	return a.userStorage.AddUser(ctx, user)
+}
+
+func validateLogin(login string) error {
+	if len(login) < 8 {
 		return appError.BadRequest("login length can't be less than 8")
 	}
-	if token != a.adminToken {
-		return appError.BadRequest("invalid admin token")
+	// "group:<name>" grantees are groups
+	if strings.Contains(login, ":") {
+		return appError.BadRequest("login can't contain ':'")
+	}
+	return nil
+}
+
+// prepareUser validates the new user and sets the password hash
+func prepareUser(user *entity.User) error {
+	if err := validatePassword(user.Password); err != nil {
+		return err
+	}
+	if err := validateLogin(user.Login); err != nil {
+		return err
+	}
+	if user.Role == "" {
+		user.Role = entity.RoleUser
+	}
+	if !user.Role.Valid() {
+		return appError.BadRequest("unknown role " + string(user.Role))
 	}
 
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
@@ -99,16 +183,10 @@ func (a *auth) Register(ctx context.Context, user *entity.User, token uuid.UUID)
 		return appError.Internal()
 	}
 	user.PasswordHash = string(passwordHash)
-
-	err = a.userStorage.AddUser(ctx, user)
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func (a *auth) Login(ctx context.Context, user *entity.User) (*uuid.UUID, error) {
+func (a *auth) Login(ctx context.Context, user *entity.User, client entity.ClientInfo) (*uuid.UUID, error) {
 	originalUser, err := a.userStorage.GetUser(ctx, user.Login)
 	if err != nil {
 		return nil, err
@@ -119,14 +197,104 @@ func (a *auth) Login(ctx context.Context, user *entity.User) (*uuid.UUID, error)
 	if validPassword != nil {
 		return nil, appError.BadRequest("wrong password")
 	}
+	if originalUser.Disabled {
+		return nil, appError.Forbidden()
+	}
 
-	connToken, err := a.sessionStorage.CreateSession(ctx, user.Login)
+	connToken, err := a.sessionStorage.CreateSession(ctx, user.Login, client)
 	if err != nil {
 		return nil, err
 	}
 	return connToken, nil
 }
 
-func (a *auth) Logout(ctx context.Context, token uuid.UUID) error {
+func (a *auth) Logout(ctx context.Context, token uuid.UUID) (string, error) {
 	return a.sessionStorage.DeleteSession(ctx, token)
 }
+
+func (a *auth) Authenticate(ctx context.Context, token string) (*entity.Principal, error) {
+	if !isCredential(token) {
+		return nil, appError.Unauthorized()
+	}
+	if strings.HasPrefix(token, apiKeyPrefix) {
+		return a.authenticateApiKey(ctx, token)
+	}
+
+	sessionId, err := uuid.Parse(token)
+	if err != nil {
+		return nil, appError.Unauthorized()
+	}
+	login, err := a.sessionStorage.GetSession(ctx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.activeUser(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	return &entity.Principal{Login: login, Role: user.Role, CanInvite: user.CanInvite, SessionID: sessionId}, nil
+}
+
+// isCredential tells session tokens and api keys from garbage,
+// it doesn't check that they exist
+func isCredential(token string) bool {
+	if secret, ok := strings.CutPrefix(token, apiKeyPrefix); ok {
+		decoded, err := hex.DecodeString(secret)
+		return err == nil && len(decoded) == apiKeySecretSize
+	}
+	_, err := uuid.Parse(token)
+	return err == nil
+}
+
+// activeUser returns the user of the credential, disabled users are not authenticated
+func (a *auth) activeUser(ctx context.Context, login string) (*entity.User, error) {
+	user, err := a.userStorage.GetUser(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, appError.Unauthorized()
+	}
+	return user, nil
+}
+
+func (a *auth) ListSessions(ctx context.Context) ([]entity.Session, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return a.sessionStorage.ListSessions(ctx, principal.Login, principal.SessionID)
+}
+
+func (a *auth) RevokeSession(ctx context.Context, sessionId uuid.UUID) error {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	return a.sessionStorage.DeleteSessionById(ctx, principal.Login, sessionId)
+}
+
+func (a *auth) RevokeAllSessions(ctx context.Context) (int64, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return a.sessionStorage.DeleteUserSessions(ctx, principal.Login)
+}
+
+func (a *auth) SweepSessions(ctx context.Context) (int64, error) {
+	return a.sessionStorage.DeleteExpiredSessions(ctx)
+}
+
+// sessionPrincipal returns the caller logged in with a password,
+// api keys can't manage sessions and other keys
+func sessionPrincipal(ctx context.Context) (*entity.Principal, error) {
+	principal := authctx.Principal(ctx)
+	if principal == nil {
+		return nil, appError.Unauthorized()
+	}
+	if principal.ApiKey != nil {
+		return nil, appError.Forbidden()
+	}
+	return principal, nil
+}
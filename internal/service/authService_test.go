@@ -1,9 +1,11 @@
 package service
 
 import (
+	"AstralTest/internal/authctx"
 	"AstralTest/internal/models/entity"
 	"AstralTest/pkg/appError"
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/google/uuid"
@@ -28,10 +30,45 @@ func (m *mockUserStorage) GetUser(ctx context.Context, login string) (*entity.Us
 	return nil, args.Error(1)
 }
 
-type mockSessionStorage struct{ mock.Mock }
+func (m *mockUserStorage) ListUsers(ctx context.Context) ([]*entity.User, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]*entity.User), args.Error(1)
+}
+
+func (m *mockUserStorage) SetUserRole(ctx context.Context, login string, role entity.UserRole) error {
+	args := m.Called(ctx, login, role)
+	return args.Error(0)
+}
+
+func (m *mockUserStorage) SetUserDisabled(ctx context.Context, login string, disabled bool) error {
+	args := m.Called(ctx, login, disabled)
+	return args.Error(0)
+}
 
-func (m *mockSessionStorage) CreateSession(ctx context.Context, login string) (*uuid.UUID, error) {
+func (m *mockUserStorage) SetUserCanInvite(ctx context.Context, login string, canInvite bool) error {
+	args := m.Called(ctx, login, canInvite)
+	return args.Error(0)
+}
+
+func (m *mockUserStorage) SetPassword(ctx context.Context, login, passwordHash string) error {
+	args := m.Called(ctx, login, passwordHash)
+	return args.Error(0)
+}
+
+func (m *mockUserStorage) CountAdmins(ctx context.Context) (int, error) {
+	args := m.Called(ctx)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockUserStorage) DeleteUser(ctx context.Context, login string) error {
 	args := m.Called(ctx, login)
+	return args.Error(0)
+}
+
+type mockSessionStorage struct{ mock.Mock }
+
+func (m *mockSessionStorage) CreateSession(ctx context.Context, login string, client entity.ClientInfo) (*uuid.UUID, error) {
+	args := m.Called(ctx, login, client)
 	if id, ok := args.Get(0).(*uuid.UUID); ok {
 		return id, args.Error(1)
 	}
@@ -43,15 +80,60 @@ func (m *mockSessionStorage) GetSession(ctx context.Context, sessionId uuid.UUID
 	return args.String(0), args.Error(1)
 }
 
-func (m *mockSessionStorage) DeleteSession(ctx context.Context, token uuid.UUID) error {
+func (m *mockSessionStorage) DeleteSession(ctx context.Context, token uuid.UUID) (string, error) {
 	args := m.Called(ctx, token)
+	return args.String(0), args.Error(1)
+}
+
+func (m *mockSessionStorage) ListSessions(ctx context.Context, login string, current uuid.UUID) ([]entity.Session, error) {
+	args := m.Called(ctx, login, current)
+	return args.Get(0).([]entity.Session), args.Error(1)
+}
+
+func (m *mockSessionStorage) DeleteSessionById(ctx context.Context, login string, id uuid.UUID) error {
+	args := m.Called(ctx, login, id)
+	return args.Error(0)
+}
+
+func (m *mockSessionStorage) DeleteUserSessions(ctx context.Context, login string) (int64, error) {
+	args := m.Called(ctx, login)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockSessionStorage) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+type mockApiKeyStorage struct{ mock.Mock }
+
+func (m *mockApiKeyStorage) CreateApiKey(ctx context.Context, key *entity.ApiKey, keyHash string) error {
+	args := m.Called(ctx, key, keyHash)
+	return args.Error(0)
+}
+
+func (m *mockApiKeyStorage) GetApiKey(ctx context.Context, keyHash string) (*entity.ApiKey, error) {
+	args := m.Called(ctx, keyHash)
+	if key, ok := args.Get(0).(*entity.ApiKey); ok {
+		return key, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *mockApiKeyStorage) ListApiKeys(ctx context.Context, login string) ([]*entity.ApiKey, error) {
+	args := m.Called(ctx, login)
+	return args.Get(0).([]*entity.ApiKey), args.Error(1)
+}
+
+func (m *mockApiKeyStorage) DeleteApiKey(ctx context.Context, login string, id uuid.UUID) error {
+	args := m.Called(ctx, login, id)
 	return args.Error(0)
 }
 
 func TestAuthService_Login(t *testing.T) {
-	adminToken := uuid.New()
 	correctPassword := "StrongPass1!"
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(correctPassword), bcrypt.DefaultCost)
+	client := entity.ClientInfo{UserAgent: "test-agent", IP: "127.0.0.1"}
 
 	testCases := []struct {
 		name                string
@@ -104,6 +186,21 @@ func TestAuthService_Login(t *testing.T) {
 			errCode:             401,
 			expectCreateSession: false,
 		},
+		{
+			name: "disabled user",
+			loginInput: &entity.User{
+				Login:    "testuser",
+				Password: correctPassword,
+			},
+			storedUser: &entity.User{
+				Login:        "testuser",
+				PasswordHash: string(hashedPassword),
+				Disabled:     true,
+			},
+			expectErr:           true,
+			errCode:             403,
+			expectCreateSession: false,
+		},
 		{
 			name: "error creating session",
 			loginInput: &entity.User{
@@ -125,7 +222,7 @@ func TestAuthService_Login(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			userMock := new(mockUserStorage)
 			sessMock := new(mockSessionStorage)
-			auth := NewAuthService(userMock, sessMock, adminToken)
+			auth := NewAuthService(userMock, sessMock, new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage))
 			ctx := context.Background()
 
 			if tc.getUserErr != nil {
@@ -135,10 +232,10 @@ func TestAuthService_Login(t *testing.T) {
 			}
 
 			if tc.expectCreateSession {
-				sessMock.On("CreateSession", ctx, tc.loginInput.Login).Return(tc.createSessionID, tc.createSessErr).Once()
+				sessMock.On("CreateSession", ctx, tc.loginInput.Login, client).Return(tc.createSessionID, tc.createSessErr).Once()
 			}
 
-			token, err := auth.Login(ctx, tc.loginInput)
+			token, err := auth.Login(ctx, tc.loginInput, client)
 			if tc.expectErr {
 				require.Error(t, err)
 				appErr, ok := err.(appError.AppError)
@@ -158,15 +255,16 @@ func TestAuthService_Login(t *testing.T) {
 }
 
 func TestAuthService_Register(t *testing.T) {
-	adminToken := uuid.New()
+	adminCtx := authctx.WithPrincipal(context.Background(), &entity.Principal{Login: "administrator", Role: entity.RoleAdmin, SessionID: uuid.New()})
 
 	testCases := []struct {
 		name        string
 		user        *entity.User
-		inputToken  uuid.UUID
+		ctx         context.Context
 		expectError bool
 		errorCode   int
 		mockAddErr  error
+		wantRole    entity.UserRole
 	}{
 		{
 			name: "successful registration",
@@ -174,8 +272,31 @@ func TestAuthService_Register(t *testing.T) {
 				Login:    "ValidLogin",
 				Password: "GoodPass1!",
 			},
-			inputToken:  adminToken,
+			ctx:         adminCtx,
+			expectError: false,
+			wantRole:    entity.RoleUser,
+		},
+		{
+			name: "readonly user",
+			user: &entity.User{
+				Login:    "ValidLogin",
+				Password: "GoodPass1!",
+				Role:     entity.RoleReadonly,
+			},
+			ctx:         adminCtx,
 			expectError: false,
+			wantRole:    entity.RoleReadonly,
+		},
+		{
+			name: "unknown role",
+			user: &entity.User{
+				Login:    "ValidLogin",
+				Password: "GoodPass1!",
+				Role:     "root",
+			},
+			ctx:         adminCtx,
+			expectError: true,
+			errorCode:   400,
 		},
 		{
 			name: "too short login",
@@ -183,7 +304,7 @@ func TestAuthService_Register(t *testing.T) {
 				Login:    "short",
 				Password: "GoodPass1!",
 			},
-			inputToken:  adminToken,
+			ctx:         adminCtx,
 			expectError: true,
 			errorCode:   400,
 		},
@@ -193,19 +314,29 @@ func TestAuthService_Register(t *testing.T) {
 				Login:    "ValidLogin",
 				Password: "NoDigits!",
 			},
-			inputToken:  adminToken,
+			ctx:         adminCtx,
 			expectError: true,
 			errorCode:   400,
 		},
 		{
-			name: "invalid admin token",
+			name: "not an admin",
 			user: &entity.User{
 				Login:    "ValidLogin",
 				Password: "GoodPass1!",
 			},
-			inputToken:  uuid.New(),
+			ctx:         userCtx("someuser"),
 			expectError: true,
-			errorCode:   400,
+			errorCode:   403,
+		},
+		{
+			name: "anonymous",
+			user: &entity.User{
+				Login:    "ValidLogin",
+				Password: "GoodPass1!",
+			},
+			ctx:         context.Background(),
+			expectError: true,
+			errorCode:   401,
 		},
 	}
 
@@ -213,14 +344,13 @@ func TestAuthService_Register(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			mockUser := new(mockUserStorage)
 			mockSess := new(mockSessionStorage)
-			auth := NewAuthService(mockUser, mockSess, adminToken)
-			ctx := context.Background()
+			auth := NewAuthService(mockUser, mockSess, new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage))
 
 			if !tc.expectError || tc.mockAddErr != nil {
-				mockUser.On("AddUser", ctx, mock.AnythingOfType("*entity.User")).Return(tc.mockAddErr).Maybe()
+				mockUser.On("AddUser", tc.ctx, mock.AnythingOfType("*entity.User")).Return(tc.mockAddErr).Once()
 			}
 
-			err := auth.Register(ctx, tc.user, tc.inputToken)
+			err := auth.Register(tc.ctx, tc.user)
 			if tc.expectError {
 				require.Error(t, err)
 				appErr, ok := err.(appError.AppError)
@@ -228,22 +358,142 @@ func TestAuthService_Register(t *testing.T) {
 				assert.Equal(t, tc.errorCode, appErr.Code())
 			} else {
 				require.NoError(t, err)
+				assert.Equal(t, tc.wantRole, tc.user.Role)
 			}
+			mockUser.AssertExpectations(t)
 		})
 	}
 }
 
+func TestAuthService_BootstrapAdmin(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("admin exists", func(t *testing.T) {
+		users := new(mockUserStorage)
+		users.On("CountAdmins", ctx).Return(1, nil).Once()
+		require.NoError(t, NewAuthService(users, new(mockSessionStorage), new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage)).BootstrapAdmin(ctx, "administrator", "GoodPass1!"))
+		users.AssertExpectations(t)
+	})
+
+	t.Run("creates admin", func(t *testing.T) {
+		users := new(mockUserStorage)
+		users.On("CountAdmins", ctx).Return(0, nil).Once()
+		users.On("GetUser", ctx, "administrator").Return(nil, appError.Unauthorized()).Once()
+		users.On("AddUser", ctx, mock.MatchedBy(func(u *entity.User) bool {
+			return u.Login == "administrator" && u.Role == entity.RoleAdmin && u.PasswordHash != ""
+		})).Return(nil).Once()
+		require.NoError(t, NewAuthService(users, new(mockSessionStorage), new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage)).BootstrapAdmin(ctx, "administrator", "GoodPass1!"))
+		users.AssertExpectations(t)
+	})
+
+	t.Run("promotes existing user", func(t *testing.T) {
+		users := new(mockUserStorage)
+		users.On("CountAdmins", ctx).Return(0, nil).Once()
+		users.On("GetUser", ctx, "administrator").Return(&entity.User{Login: "administrator", Role: entity.RoleUser, Disabled: true}, nil).Once()
+		users.On("SetUserRole", ctx, "administrator", entity.RoleAdmin).Return(nil).Once()
+		users.On("SetUserDisabled", ctx, "administrator", false).Return(nil).Once()
+		require.NoError(t, NewAuthService(users, new(mockSessionStorage), new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage)).BootstrapAdmin(ctx, "administrator", ""))
+		users.AssertExpectations(t)
+	})
+}
+
 func TestAuthService_Logout(t *testing.T) {
-	adminToken := uuid.New()
 	sessionID := uuid.New()
 
 	mockUser := new(mockUserStorage)
 	mockSess := new(mockSessionStorage)
-	auth := NewAuthService(mockUser, mockSess, adminToken)
+	auth := NewAuthService(mockUser, mockSess, new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage))
 	ctx := context.Background()
 
-	mockSess.On("DeleteSession", ctx, sessionID).Return(nil).Once()
-	err := auth.Logout(ctx, sessionID)
+	mockSess.On("DeleteSession", ctx, sessionID).Return("testuser", nil).Once()
+	login, err := auth.Logout(ctx, sessionID)
 	require.NoError(t, err)
+	assert.Equal(t, "testuser", login)
 	mockSess.AssertExpectations(t)
 }
+
+func TestAuthService_RevokeSession(t *testing.T) {
+	sessionID := uuid.New()
+
+	mockSess := new(mockSessionStorage)
+	auth := NewAuthService(new(mockUserStorage), mockSess, new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage))
+	ctx := userCtx("testuser")
+
+	mockSess.On("DeleteSessionById", ctx, "testuser", sessionID).Return(nil).Once()
+
+	require.NoError(t, auth.RevokeSession(ctx, sessionID))
+	mockSess.AssertExpectations(t)
+}
+
+func TestAuthService_Authenticate(t *testing.T) {
+	token := uuid.New()
+	ctx := context.Background()
+
+	mockSess := new(mockSessionStorage)
+	mockUser := new(mockUserStorage)
+	auth := NewAuthService(mockUser, mockSess, new(mockApiKeyStorage), new(mockInvitationStorage), new(mockGroupStorage))
+	mockSess.On("GetSession", ctx, token).Return("testuser", nil).Once()
+	mockUser.On("GetUser", ctx, "testuser").Return(&entity.User{Login: "testuser", Role: entity.RoleReadonly}, nil).Once()
+
+	principal, err := auth.Authenticate(ctx, token.String())
+	require.NoError(t, err)
+	assert.Equal(t, "testuser", principal.Login)
+	assert.Equal(t, token, principal.SessionID)
+	assert.Equal(t, entity.RoleReadonly, principal.Role)
+	// readonly users only read
+	assert.True(t, principal.Allows(entity.ScopeDocsRead))
+	assert.False(t, principal.Allows(entity.ScopeDocsWrite))
+
+	// sessions of a disabled user don't work
+	mockSess.On("GetSession", ctx, token).Return("testuser", nil).Once()
+	mockUser.On("GetUser", ctx, "testuser").Return(&entity.User{Login: "testuser", Role: entity.RoleUser, Disabled: true}, nil).Once()
+	_, err = auth.Authenticate(ctx, token.String())
+	require.Error(t, err)
+	assert.Equal(t, 401, err.(appError.AppError).Code())
+
+	_, err = auth.Authenticate(ctx, "not-a-token")
+	require.Error(t, err)
+	assert.Equal(t, 401, err.(appError.AppError).Code())
+	mockSess.AssertExpectations(t)
+	mockUser.AssertExpectations(t)
+}
+
+func TestAuthService_ApiKey(t *testing.T) {
+	keys := new(mockApiKeyStorage)
+	users := new(mockUserStorage)
+	users.On("GetUser", mock.Anything, "testuser").Return(&entity.User{Login: "testuser", Role: entity.RoleUser}, nil)
+	auth := NewAuthService(users, new(mockSessionStorage), keys, new(mockInvitationStorage), new(mockGroupStorage))
+	ctx := userCtx("testuser")
+
+	var storedHash string
+	keys.On("CreateApiKey", ctx, mock.AnythingOfType("*entity.ApiKey"), mock.AnythingOfType("string")).
+		Run(func(args mock.Arguments) { storedHash = args.String(2) }).
+		Return(nil).Once()
+
+	key := &entity.ApiKey{Name: "ci", Scopes: []string{entity.ScopeDocsRead}}
+	token, err := auth.CreateApiKey(ctx, key)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, apiKeyPrefix))
+	assert.True(t, strings.HasPrefix(token, key.Prefix))
+	assert.Equal(t, "testuser", key.Login)
+	// the secret itself is never stored
+	assert.NotContains(t, storedHash, token[len(apiKeyPrefix):])
+
+	keys.On("GetApiKey", mock.Anything, storedHash).Return(key, nil).Once()
+	principal, err := auth.Authenticate(context.Background(), token)
+	require.NoError(t, err)
+	assert.Equal(t, "testuser", principal.Login)
+	assert.True(t, principal.Allows(entity.ScopeDocsRead))
+	assert.False(t, principal.Allows(entity.ScopeDocsWrite))
+
+	// keys can't create other keys
+	_, err = auth.CreateApiKey(authctx.WithPrincipal(context.Background(), principal), key)
+	require.Error(t, err)
+	assert.Equal(t, 403, err.(appError.AppError).Code())
+
+	_, err = auth.CreateApiKey(ctx, &entity.ApiKey{Name: "bad", Scopes: []string{"docs:everything"}})
+	require.Error(t, err)
+	assert.Equal(t, 400, err.(appError.AppError).Code())
+
+	keys.AssertExpectations(t)
+}
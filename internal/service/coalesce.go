@@ -0,0 +1,105 @@
+package service
+
+import (
+	"AstralTest/internal/storage/cache"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// CoalesceStats count storage reads of cache misses since the start
+type CoalesceStats struct {
+	Loads    uint64 `json:"loads"`    // reads which went to the storage
+	Shared   uint64 `json:"shared"`   // callers who got the result of another caller's read
+	Canceled uint64 `json:"canceled"` // callers who stopped waiting with their context
+}
+
+// coalescer runs one load per key at a time, callers who come meanwhile
+// wait for it and share its result. A caller joining a running load may get
+// data read a moment before its request, like a request which came earlier.
+// The load runs with the context of the caller who started it, if that
+// caller is gone the waiters start over instead of sharing its failure
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+
+	loads    atomic.Uint64
+	shared   atomic.Uint64
+	canceled atomic.Uint64
+}
+
+type flight struct {
+	ctx  context.Context
+	done chan struct{}
+	val  any
+	err  error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{flights: make(map[string]*flight)}
+}
+
+// do returns the result of load for the key, the result is shared
+// between callers and must not be changed
+func (c *coalescer) do(ctx context.Context, key string, load func(ctx context.Context) (any, error)) (any, error) {
+	for {
+		c.mu.Lock()
+		f, ok := c.flights[key]
+		if ok {
+			c.mu.Unlock()
+			c.shared.Add(1)
+		} else {
+			f = &flight{ctx: ctx, done: make(chan struct{})}
+			c.flights[key] = f
+			c.mu.Unlock()
+			c.loads.Add(1)
+
+			go func() {
+				f.val, f.err = load(ctx)
+				c.mu.Lock()
+				delete(c.flights, key)
+				c.mu.Unlock()
+				close(f.done)
+			}()
+		}
+
+		select {
+		case <-f.done:
+			if f.ctx != ctx && f.ctx.Err() != nil && ctx.Err() == nil {
+				// the load was stopped with its caller
+				continue
+			}
+			return f.val, f.err
+		case <-ctx.Done():
+			c.canceled.Add(1)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *coalescer) stats() CoalesceStats {
+	return CoalesceStats{
+		Loads:    c.loads.Load(),
+		Shared:   c.shared.Load(),
+		Canceled: c.canceled.Load(),
+	}
+}
+
+// coalesce is coalescer.do with the type of the result
+func coalesce[T any](ctx context.Context, c *coalescer, key string, load func(ctx context.Context) (T, error)) (T, error) {
+	val, err := c.do(ctx, key, func(ctx context.Context) (any, error) {
+		return load(ctx)
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return val.(T), nil
+}
+
+// ticketed is a storage read with the cache ticket taken before it,
+// so a shared result is not cached if it is changed meanwhile
+type ticketed[T any] struct {
+	value  T
+	ticket cache.Ticket
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/cache"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// waitFlight waits until the key is being loaded
+func waitFlight(t *testing.T, c *coalescer, key string) {
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.flights[key] != nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestCoalescer_SharedLoad(t *testing.T) {
+	c := newCoalescer()
+	release := make(chan struct{})
+	load := func(ctx context.Context) (int, error) {
+		<-release
+		return 42, nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	results := make(chan int, callers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, err := coalesce(context.Background(), c, "key", load)
+		assert.NoError(t, err)
+		results <- v
+	}()
+	waitFlight(t, c, "key")
+	for i := 1; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := coalesce(context.Background(), c, "key", load)
+			assert.NoError(t, err)
+			results <- v
+		}()
+	}
+	require.Eventually(t, func() bool { return c.stats().Shared == callers-1 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for v := range results {
+		assert.Equal(t, 42, v)
+	}
+	assert.Equal(t, CoalesceStats{Loads: 1, Shared: callers - 1}, c.stats())
+
+	// the next miss loads again
+	release = make(chan struct{})
+	close(release)
+	_, err := coalesce(context.Background(), c, "key", load)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), c.stats().Loads)
+}
+
+type ctxKey struct{}
+
+func TestCoalescer_Cancel(t *testing.T) {
+	t.Run("waiter", func(t *testing.T) {
+		c := newCoalescer()
+		release := make(chan struct{})
+		load := func(ctx context.Context) (string, error) {
+			<-release
+			return "doc", nil
+		}
+
+		leader := make(chan string)
+		go func() {
+			v, _ := coalesce(context.Background(), c, "key", load)
+			leader <- v
+		}()
+		waitFlight(t, c, "key")
+
+		// the waiter leaves, the load goes on for the others
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := coalesce(ctx, c, "key", load)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		close(release)
+		assert.Equal(t, "doc", <-leader)
+		assert.Equal(t, uint64(1), c.stats().Canceled)
+	})
+
+	t.Run("caller of the load", func(t *testing.T) {
+		c := newCoalescer()
+		var loads sync.WaitGroup
+		loads.Add(1)
+		load := func(ctx context.Context) (string, error) {
+			if ctx.Value(ctxKey{}) == "leader" {
+				loads.Done()
+				<-ctx.Done()
+				return "", ctx.Err()
+			}
+			return "doc", nil
+		}
+
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "leader"))
+		leader := make(chan error)
+		go func() {
+			_, err := coalesce(ctx, c, "key", load)
+			leader <- err
+		}()
+		loads.Wait()
+
+		waiter := make(chan string)
+		go func() {
+			v, err := coalesce(context.Background(), c, "key", load)
+			assert.NoError(t, err)
+			waiter <- v
+		}()
+		require.Eventually(t, func() bool { return c.stats().Shared == 1 }, time.Second, time.Millisecond)
+
+		// the waiter doesn't get the failure of the canceled caller, it loads again
+		cancel()
+		assert.ErrorIs(t, <-leader, context.Canceled)
+		assert.Equal(t, "doc", <-waiter)
+		assert.Equal(t, uint64(2), c.stats().Loads)
+	})
+}
+
+func TestGetFilesList_Coalescing(t *testing.T) {
+	const callers = 5
+	ctx := userCtx("owner1")
+	files := new(mockFileStorage)
+	c := new(mockCache)
+	c.On("GetOwner", "owner1", mock.Anything).Return(cache.CachedDocResp{}, false)
+	c.On("SetOwner", "owner1", mock.Anything, mock.Anything).Return()
+
+	release := make(chan struct{})
+	files.On("GetDocsList", ctx, mock.Anything).Return(&entity.DocsPage{Docs: []*entity.Document{{Name: "doc"}}}, nil).
+		Run(func(mock.Arguments) { <-release }).Once()
+
+	svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, false)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			page, err := svc.GetFilesList(ctx, false, storage.DocsListQuery{Limit: 10})
+			assert.NoError(t, err)
+			assert.Len(t, page.Docs, 1)
+		}()
+	}
+	require.Eventually(t, func() bool { return svc.CoalesceStats().Shared == callers-1 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// one storage read for all callers
+	files.AssertExpectations(t)
+	assert.Equal(t, uint64(1), svc.CoalesceStats().Loads)
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/cache"
+	"AstralTest/pkg/appError"
+	"context"
+	"regexp"
+)
+
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+func validGroupName(name string) bool {
+	return groupNamePattern.MatchString(name)
+}
+
+type groupService struct {
+	groupStorage storage.GroupStorage
+	cache        cache.Cache
+}
+
+// GroupService manages groups of users, documents are shared with them
+// as "group:<name>". Only the owner of a group changes it, api keys can't
+// manage groups
+type GroupService interface {
+	CreateGroup(ctx context.Context, name string) (*entity.Group, error)
+	// ListGroups returns groups owned by the caller or having the caller as a member
+	ListGroups(ctx context.Context) ([]*entity.Group, error)
+	// GetGroup returns the group with members to its owner and members
+	GetGroup(ctx context.Context, name string) (*entity.Group, error)
+	DeleteGroup(ctx context.Context, name string) error
+	AddMember(ctx context.Context, name, login string) error
+	// RemoveMember is allowed to the owner and to the member leaving the group
+	RemoveMember(ctx context.Context, name, login string) error
+}
+
+func NewGroupService(groupStorage storage.GroupStorage, cache cache.Cache) GroupService {
+	return &groupService{
+		groupStorage: groupStorage,
+		cache:        cache,
+	}
+}
+
+func (gs *groupService) CreateGroup(ctx context.Context, name string) (*entity.Group, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !validGroupName(name) {
+		return nil, appError.BadRequest("group name should be 1-64 symbols of a-z, 0-9, '.', '_', '-'")
+	}
+
+	group := &entity.Group{Name: name, Owner: principal.Login}
+	if err := gs.groupStorage.CreateGroup(ctx, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (gs *groupService) ListGroups(ctx context.Context) ([]*entity.Group, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gs.groupStorage.ListGroups(ctx, principal.Login)
+}
+
+func (gs *groupService) GetGroup(ctx context.Context, name string) (*entity.Group, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	group, err := gs.groupStorage.GetGroup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if group.Owner != principal.Login && !isMember(group, principal.Login) {
+		// other groups are not shown, as if they don't exist
+		return nil, appError.NotFound()
+	}
+	return group, nil
+}
+
+func (gs *groupService) DeleteGroup(ctx context.Context, name string) error {
+	group, err := gs.getOwnGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	// permissions of the group are deleted with it, so owners are read before
+	owners, err := gs.groupStorage.GetGroupDocOwners(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := gs.groupStorage.DeleteGroup(ctx, name); err != nil {
+		return err
+	}
+	for _, member := range group.Members {
+		invalidateMember(gs.cache, owners, member)
+	}
+	return nil
+}
+
+func (gs *groupService) AddMember(ctx context.Context, name, login string) error {
+	if _, err := gs.getOwnGroup(ctx, name); err != nil {
+		return err
+	}
+	if err := gs.groupStorage.AddMember(ctx, name, login); err != nil {
+		return err
+	}
+	return gs.membershipChanged(ctx, name, login)
+}
+
+func (gs *groupService) RemoveMember(ctx context.Context, name, login string) error {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return err
+	}
+	group, err := gs.groupStorage.GetGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if group.Owner != principal.Login && !(login == principal.Login && isMember(group, login)) {
+		return appError.Forbidden()
+	}
+	if err := gs.groupStorage.RemoveMember(ctx, name, login); err != nil {
+		return err
+	}
+	return gs.membershipChanged(ctx, name, login)
+}
+
+// getOwnGroup returns the group with members if the caller is its owner
+func (gs *groupService) getOwnGroup(ctx context.Context, name string) (*entity.Group, error) {
+	principal, err := sessionPrincipal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	group, err := gs.groupStorage.GetGroup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if group.Owner != principal.Login {
+		return nil, appError.Forbidden()
+	}
+	return group, nil
+}
+
+// membershipChanged drops cache of the user for documents shared with the group,
+// so a new member sees them at once and a removed one loses them
+func (gs *groupService) membershipChanged(ctx context.Context, name, login string) error {
+	owners, err := gs.groupStorage.GetGroupDocOwners(ctx, name)
+	if err != nil {
+		return err
+	}
+	invalidateMember(gs.cache, owners, login)
+	return nil
+}
+
+// invalidateMember drops cache of the group member for documents of the owners
+func invalidateMember(c cache.Cache, owners []string, login string) {
+	for _, owner := range owners {
+		c.InvalidateGrant(owner, []string{login})
+	}
+	// single documents are cached with the user's own entries
+	c.InvalidateOwnerList(login)
+}
+
+func isMember(group *entity.Group, login string) bool {
+	for _, member := range group.Members {
+		if member == login {
+			return true
+		}
+	}
+	return false
+}
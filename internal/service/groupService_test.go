@@ -0,0 +1,137 @@
+package service
+
+import (
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage/cache"
+	"AstralTest/pkg/appError"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type mockGroupStorage struct{ mock.Mock }
+
+func (m *mockGroupStorage) CreateGroup(ctx context.Context, group *entity.Group) error {
+	args := m.Called(ctx, group)
+	return args.Error(0)
+}
+func (m *mockGroupStorage) GetGroup(ctx context.Context, name string) (*entity.Group, error) {
+	args := m.Called(ctx, name)
+	if group, ok := args.Get(0).(*entity.Group); ok {
+		return group, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockGroupStorage) ListGroups(ctx context.Context, login string) ([]*entity.Group, error) {
+	args := m.Called(ctx, login)
+	groups, _ := args.Get(0).([]*entity.Group)
+	return groups, args.Error(1)
+}
+func (m *mockGroupStorage) DeleteGroup(ctx context.Context, name string) error {
+	args := m.Called(ctx, name)
+	return args.Error(0)
+}
+func (m *mockGroupStorage) AddMember(ctx context.Context, name, login string) error {
+	args := m.Called(ctx, name, login)
+	return args.Error(0)
+}
+func (m *mockGroupStorage) RemoveMember(ctx context.Context, name, login string) error {
+	args := m.Called(ctx, name, login)
+	return args.Error(0)
+}
+func (m *mockGroupStorage) GetUserGroups(ctx context.Context, login string) ([]string, error) {
+	args := m.Called(ctx, login)
+	groups, _ := args.Get(0).([]string)
+	return groups, args.Error(1)
+}
+func (m *mockGroupStorage) GetGroupDocOwners(ctx context.Context, name string) ([]string, error) {
+	args := m.Called(ctx, name)
+	owners, _ := args.Get(0).([]string)
+	return owners, args.Error(1)
+}
+
+func TestGroupMembership(t *testing.T) {
+	group := &entity.Group{Name: "sales", Owner: "owner1", Members: []string{"member1"}}
+
+	t.Run("new member loses cached lists", func(t *testing.T) {
+		ctx := userCtx("owner1")
+		groups := new(mockGroupStorage)
+		c := new(mockCache)
+		groups.On("GetGroup", ctx, "sales").Return(group, nil)
+		groups.On("AddMember", ctx, "sales", "member2").Return(nil)
+		groups.On("GetGroupDocOwners", ctx, "sales").Return([]string{"owner1", "owner2"}, nil)
+		c.On("InvalidateGrant", "owner1", []string{"member2"}).Return()
+		c.On("InvalidateGrant", "owner2", []string{"member2"}).Return()
+		c.On("InvalidateOwnerList", "member2").Return()
+
+		svc := NewGroupService(groups, c)
+		require.NoError(t, svc.AddMember(ctx, "sales", "member2"))
+		groups.AssertExpectations(t)
+		c.AssertExpectations(t)
+	})
+
+	t.Run("only owner adds members", func(t *testing.T) {
+		ctx := userCtx("member1")
+		groups := new(mockGroupStorage)
+		groups.On("GetGroup", ctx, "sales").Return(group, nil)
+
+		svc := NewGroupService(groups, new(mockCache))
+		err := svc.AddMember(ctx, "sales", "member2")
+		require.Error(t, err)
+		assert.Equal(t, 403, err.(appError.AppError).Code())
+		groups.AssertNotCalled(t, "AddMember", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("member leaves", func(t *testing.T) {
+		ctx := userCtx("member1")
+		groups := new(mockGroupStorage)
+		c := new(mockCache)
+		groups.On("GetGroup", ctx, "sales").Return(group, nil)
+		groups.On("RemoveMember", ctx, "sales", "member1").Return(nil)
+		groups.On("GetGroupDocOwners", ctx, "sales").Return([]string{"owner1"}, nil)
+		c.On("InvalidateGrant", "owner1", []string{"member1"}).Return()
+		c.On("InvalidateOwnerList", "member1").Return()
+
+		svc := NewGroupService(groups, c)
+		require.NoError(t, svc.RemoveMember(ctx, "sales", "member1"))
+		c.AssertExpectations(t)
+	})
+
+	t.Run("api key", func(t *testing.T) {
+		ctx := authctx.WithPrincipal(context.Background(), &entity.Principal{
+			Login:  "owner1",
+			ApiKey: &entity.ApiKey{Scopes: []string{entity.ScopeDocsWrite}},
+		})
+		svc := NewGroupService(new(mockGroupStorage), new(mockCache))
+		_, err := svc.CreateGroup(ctx, "sales")
+		require.Error(t, err)
+		assert.Equal(t, 403, err.(appError.AppError).Code())
+	})
+}
+
+func TestGetFile_GroupMember(t *testing.T) {
+	ctx := userCtx("member1")
+	doc := &entity.Document{
+		Name:        "plan.json",
+		Owner:       "owner1",
+		Permissions: []entity.Permission{{Login: "group:sales", Role: entity.RoleViewer}},
+	}
+
+	files := new(mockFileStorage)
+	groups := new(mockGroupStorage)
+	c := new(mockCache)
+	files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+	groups.On("GetUserGroups", ctx, "member1").Return([]string{"sales"}, nil)
+	c.On("GetOwner", "member1", mock.Anything).Return(cache.CachedDocResp{}, false)
+	c.On("SetOwner", "member1", mock.Anything, mock.Anything).Return()
+
+	svc := NewWcsService(files, new(mockBlobStore), c, groups, ShareLinks{}, false)
+	got, _, err := svc.GetFile(ctx, doc.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "plan.json", got.Name)
+	groups.AssertExpectations(t)
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Action is an operation on a document checked by the policy
+type Action int
+
+const (
+	ActionRead Action = iota
+	// ActionUpdate changes content and metadata
+	ActionUpdate
+	// ActionShare changes permissions and public flag
+	ActionShare
+	ActionDelete
+)
+
+// minimal role of a grantee for the action
+var actionRoles = map[Action]entity.Role{
+	ActionRead:   entity.RoleViewer,
+	ActionUpdate: entity.RoleEditor,
+	ActionShare:  entity.RoleManager,
+	ActionDelete: entity.RoleManager,
+}
+
+// api key scope required for the action
+var actionScopes = map[Action]string{
+	ActionRead:   entity.ScopeDocsRead,
+	ActionUpdate: entity.ScopeDocsWrite,
+	ActionShare:  entity.ScopeDocsWrite,
+	ActionDelete: entity.ScopeDocsDelete,
+}
+
+// userIsAllowedToFile tells if the user, a member of groups, can do the action
+// with the document: the owner can do everything, anybody can read public
+// documents, grantees can do what their highest role allows
+func userIsAllowedToFile(doc *entity.Document, userLogin string, groups []string, action Action) bool {
+	if doc.Owner == userLogin {
+		return true
+	}
+	if action == ActionRead && doc.Public {
+		return true
+	}
+	return doc.RoleOf(userLogin, groups).Includes(actionRoles[action])
+}
+
+// isAllowed works like userIsAllowedToFile, groups of the user
+// are loaded only if the document is shared with groups
+func (wc *wcs) isAllowed(ctx context.Context, doc *entity.Document, userLogin string, action Action) (bool, error) {
+	var groups []string
+	if doc.Owner != userLogin && doc.HasGroups() {
+		var err error
+		if groups, err = wc.groupStorage.GetUserGroups(ctx, userLogin); err != nil {
+			return false, err
+		}
+	}
+	return userIsAllowedToFile(doc, userLogin, groups, action), nil
+}
+
+// getDocFor returns the document if the caller can do the action with it,
+// and the caller's login
+func (wc *wcs) getDocFor(ctx context.Context, action Action, fileId uuid.UUID) (*entity.Document, string, error) {
+	userLogin, err := currentUser(ctx, actionScopes[action])
+	if err != nil {
+		return nil, "", err
+	}
+
+	doc, err := wc.fileStorage.GetDoc(ctx, fileId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	allowed, err := wc.isAllowed(ctx, doc, userLogin, action)
+	if err != nil {
+		return nil, "", err
+	}
+	if !allowed {
+		return nil, "", appError.Forbidden()
+	}
+	if err := checkOwner(ctx, doc.Owner); err != nil {
+		return nil, "", err
+	}
+	return doc, userLogin, nil
+}
+
+// normalizePermissions validates permissions of the owner's document.
+// The owner's own entries are dropped and a login listed twice
+// gets the highest of its roles, so legacy grant lists stay valid
+func normalizePermissions(owner string, permissions []entity.Permission) ([]entity.Permission, error) {
+	normalized := make([]entity.Permission, 0, len(permissions))
+	index := make(map[string]int, len(permissions))
+	for _, p := range permissions {
+		if p.Login == "" {
+			return nil, appError.BadRequest("permissions: login is required")
+		}
+		if !p.Role.Valid() {
+			return nil, appError.BadRequest(fmt.Sprintf("permissions: unknown role %q, expected one of viewer, editor, manager", p.Role))
+		}
+		if p.Login == owner {
+			continue
+		}
+		if name, ok := strings.CutPrefix(p.Login, entity.GroupPrefix); ok && !validGroupName(name) {
+			return nil, appError.BadRequest(fmt.Sprintf("permissions: bad group name %q", name))
+		}
+		if i, ok := index[p.Login]; ok {
+			if p.Role.Includes(normalized[i].Role) {
+				normalized[i].Role = p.Role
+			}
+			continue
+		}
+		index[p.Login] = len(normalized)
+		normalized = append(normalized, p)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserIsAllowedToFile(t *testing.T) {
+	doc := &entity.Document{
+		Owner: "owner",
+		Permissions: []entity.Permission{
+			{Login: "viewer", Role: entity.RoleViewer},
+			{Login: "editor", Role: entity.RoleEditor},
+			{Login: "manager", Role: entity.RoleManager},
+			{Login: "group:sales", Role: entity.RoleEditor},
+		},
+	}
+	public := &entity.Document{Owner: "owner", Public: true}
+
+	testCases := []struct {
+		doc    *entity.Document
+		login  string
+		groups []string
+		action Action
+		want   bool
+	}{
+		{doc, "owner", nil, ActionDelete, true},
+		{doc, "viewer", nil, ActionRead, true},
+		{doc, "viewer", nil, ActionUpdate, false},
+		{doc, "editor", nil, ActionUpdate, true},
+		{doc, "editor", nil, ActionShare, false},
+		{doc, "editor", nil, ActionDelete, false},
+		{doc, "manager", nil, ActionShare, true},
+		{doc, "manager", nil, ActionDelete, true},
+		{doc, "stranger", nil, ActionRead, false},
+		{public, "stranger", nil, ActionRead, true},
+		{public, "stranger", nil, ActionUpdate, false},
+		{doc, "member", []string{"sales"}, ActionUpdate, true},
+		{doc, "member", []string{"support"}, ActionRead, false},
+		// the highest of direct and group roles
+		{doc, "viewer", []string{"sales"}, ActionUpdate, true},
+		{doc, "manager", []string{"sales"}, ActionDelete, true},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, userIsAllowedToFile(tc.doc, tc.login, tc.groups, tc.action), "%s %d", tc.login, tc.action)
+	}
+}
+
+func TestNormalizePermissions(t *testing.T) {
+	permissions, err := normalizePermissions("owner", []entity.Permission{
+		{Login: "a", Role: entity.RoleViewer},
+		{Login: "owner", Role: entity.RoleViewer},
+		{Login: "b", Role: entity.RoleManager},
+		{Login: "a", Role: entity.RoleEditor},
+		{Login: "b", Role: entity.RoleViewer},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []entity.Permission{
+		{Login: "a", Role: entity.RoleEditor},
+		{Login: "b", Role: entity.RoleManager},
+	}, permissions)
+
+	_, err = normalizePermissions("owner", []entity.Permission{{Login: "a", Role: "admin"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown role")
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/cache"
+	"AstralTest/pkg/appError"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// anonymousAllowed tells if the caller is anonymous and may read public documents,
+// with public access off anonymous callers are rejected as before
+func (wc *wcs) anonymousAllowed(ctx context.Context) bool {
+	return wc.publicAccess && authctx.Principal(ctx) == nil
+}
+
+// getPublicFile works like GetFile for anonymous callers.
+// Responses are cached apart from the users' ones
+func (wc *wcs) getPublicFile(ctx context.Context, fileId uuid.UUID) (*entity.Document, io.ReadSeekCloser, error) {
+	cacheKey := makeFileKey(fileId)
+
+	var document *entity.Document
+	if cached, ok := wc.cache.GetPublic(cacheKey); ok {
+		var cachedDoc cachedDocument
+		if err := json.Unmarshal(cached.Body, &cachedDoc); err == nil {
+			document = cachedDoc.toDocument()
+		}
+	}
+
+	if document == nil {
+		read, err := wc.loadDoc(ctx, fileId)
+		if err != nil {
+			return nil, nil, err
+		}
+		document = read.value
+		// the caller may see it after logging in
+		if !document.Public {
+			return nil, nil, appError.Unauthorized()
+		}
+		document = publicView(document)
+
+		body, _ := json.Marshal(newCachedDocument(document))
+		wc.cache.SetPublic(document.Owner, cacheKey, cache.CachedDocResp{
+			Status: 200,
+			Body:   body,
+			Docs:   []uuid.UUID{document.ID},
+			Ticket: read.ticket,
+		})
+	}
+
+	content, err := wc.openContent(ctx, document)
+	if err != nil {
+		return nil, nil, err
+	}
+	return document, content, nil
+}
+
+// getPublicList returns public documents of query.OwnerLogin,
+// anonymous callers have no documents of their own
+func (wc *wcs) getPublicList(ctx context.Context, headOnly bool, query storage.DocsListQuery) (*entity.DocsPage, error) {
+	if query.OwnerLogin == "" {
+		return nil, appError.BadRequest("login of the owner is required")
+	}
+	// documents shared with nobody are the public ones
+	query.Login = ""
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+
+	cacheKey := makeOwnerListKey(query)
+	if cached, ok := wc.cache.GetPublic(cacheKey); ok {
+		if headOnly {
+			return nil, nil
+		}
+		var page entity.DocsPage
+		if err := json.Unmarshal(cached.Body, &page); err == nil {
+			return &page, nil
+		}
+	}
+
+	// the page is shared by callers, so it is made public while loading
+	read, err := coalesce(ctx, wc.loads, string(cacheKey), func(ctx context.Context) (ticketed[*entity.DocsPage], error) {
+		ticket := wc.cache.Ticket()
+		page, err := wc.fileStorage.GetDocsList(ctx, query)
+		if err != nil {
+			return ticketed[*entity.DocsPage]{}, err
+		}
+		for i, doc := range page.Docs {
+			page.Docs[i] = publicView(doc)
+		}
+		return ticketed[*entity.DocsPage]{value: page, ticket: ticket}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	page := read.value
+
+	jsonOut, err := json.Marshal(page)
+	if err != nil {
+		return nil, appError.Internal()
+	}
+	wc.cache.SetPublic(query.OwnerLogin, cacheKey, cache.CachedDocResp{
+		Status: 200,
+		Body:   jsonOut,
+		Docs:   pageDocIds(page),
+		Ticket: read.ticket,
+	})
+
+	return page, nil
+}
+
+// publicView hides whom the document is shared with from anonymous callers
+func publicView(doc *entity.Document) *entity.Document {
+	public := *doc
+	public.Permissions = nil
+	return &public
+}
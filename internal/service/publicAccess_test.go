@@ -0,0 +1,87 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/cache"
+	"AstralTest/pkg/appError"
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetFile_PublicAccess(t *testing.T) {
+	ctx := context.Background()
+	public := &entity.Document{
+		ID:          uuid.New(),
+		Name:        "faq.json",
+		Owner:       "owner1",
+		Public:      true,
+		Permissions: []entity.Permission{{Login: "editor1", Role: entity.RoleEditor}},
+	}
+	private := &entity.Document{ID: uuid.New(), Owner: "owner1"}
+
+	t.Run("public document is cached apart", func(t *testing.T) {
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, public.ID).Return(public, nil)
+		c := new(mockCache)
+		c.On("GetPublic", makeFileKey(public.ID)).Return(cache.CachedDocResp{}, false)
+		c.On("SetPublic", "owner1", makeFileKey(public.ID), mock.Anything).Return()
+
+		svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, true)
+		got, _, err := svc.GetFile(ctx, public.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "faq.json", got.Name)
+		assert.Empty(t, got.Permissions)
+		c.AssertNotCalled(t, "SetOwner", mock.Anything, mock.Anything, mock.Anything)
+		c.AssertExpectations(t)
+	})
+
+	t.Run("private document needs login", func(t *testing.T) {
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, private.ID).Return(private, nil)
+		c := new(mockCache)
+		c.On("GetPublic", makeFileKey(private.ID)).Return(cache.CachedDocResp{}, false)
+
+		svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, true)
+		_, _, err := svc.GetFile(ctx, private.ID)
+		assert.Equal(t, appError.Unauthorized(), err)
+		c.AssertNotCalled(t, "SetPublic", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestGetFilesList_PublicAccess(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("owner is required", func(t *testing.T) {
+		svc := NewWcsService(new(mockFileStorage), new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, true)
+		_, err := svc.GetFilesList(ctx, false, storage.DocsListQuery{Limit: 10})
+		assert.Error(t, err)
+	})
+
+	t.Run("public documents of the owner", func(t *testing.T) {
+		page := &entity.DocsPage{Docs: []*entity.Document{{
+			Name:        "faq.json",
+			Public:      true,
+			Permissions: []entity.Permission{{Login: "editor1", Role: entity.RoleEditor}},
+		}}}
+		files := new(mockFileStorage)
+		files.On("GetDocsList", ctx, mock.MatchedBy(func(q storage.DocsListQuery) bool {
+			return q.OwnerLogin == "owner1" && q.Login == ""
+		})).Return(page, nil)
+		c := new(mockCache)
+		c.On("GetPublic", mock.Anything).Return(cache.CachedDocResp{}, false)
+		c.On("SetPublic", "owner1", mock.Anything, mock.Anything).Return()
+
+		svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, true)
+		got, err := svc.GetFilesList(ctx, false, storage.DocsListQuery{OwnerLogin: "owner1", Limit: 10})
+		require.NoError(t, err)
+		require.Len(t, got.Docs, 1)
+		assert.Empty(t, got.Docs[0].Permissions)
+		c.AssertExpectations(t)
+	})
+}
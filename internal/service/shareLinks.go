@@ -0,0 +1,336 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/pkg/appError"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultShareLinkTTL = 7 * 24 * time.Hour
+	// share link usage log shown to the owner
+	shareLinkUsesLimit = 100
+	// wrong passwords in a row which lock a link for shareLinkLockout
+	shareLinkPasswordAttempts = 5
+	shareLinkLockout          = 15 * time.Minute
+)
+
+// share link usage results
+const (
+	shareUseDownload = "download"
+	// opened without a counted download: HEAD, not modified or a resumed range
+	shareUseOpen        = "open"
+	shareUseRevoked     = "revoked"
+	shareUseExpired     = "expired"
+	shareUseUsedUp      = "used_up"
+	shareUseBadPassword = "bad_password"
+	shareUseLocked      = "locked"
+	shareUseNoDocument  = "no_document"
+)
+
+// ShareLinks configures share links of documents
+type ShareLinks struct {
+	Storage storage.ShareLinkStorage
+	// Secret is the HMAC key of link tokens
+	Secret []byte
+	MaxTTL time.Duration
+}
+
+// sign makes the link token: base64url(id | expiry) "." base64url(hmac of them).
+// Forged and expired tokens are refused without a database query
+func (s ShareLinks) sign(id uuid.UUID, expires time.Time) string {
+	payload := make([]byte, 16+8)
+	copy(payload, id[:])
+	binary.BigEndian.PutUint64(payload[16:], uint64(expires.Unix()))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload))
+}
+
+func (s ShareLinks) verify(token string) (uuid.UUID, time.Time, bool) {
+	encodedPayload, encodedMac, ok := strings.Cut(token, ".")
+	if !ok {
+		return uuid.Nil, time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) != 16+8 {
+		return uuid.Nil, time.Time{}, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMac)
+	if err != nil || !hmac.Equal(mac, s.mac(payload)) {
+		return uuid.Nil, time.Time{}, false
+	}
+	id, _ := uuid.FromBytes(payload[:16])
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[16:])), 0)
+	return id, expires, true
+}
+
+func (s ShareLinks) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, s.Secret)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// CreateShareLink mints a link to the document, returns the link and its token
+func (wc *wcs) CreateShareLink(ctx context.Context, fileId uuid.UUID, options entity.ShareLinkOptions) (*entity.ShareLink, string, error) {
+	doc, userLogin, err := wc.getDocFor(ctx, ActionShare, fileId)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	expires := now.Add(defaultShareLinkTTL)
+	if options.Expires != nil {
+		expires = *options.Expires
+	}
+	if !expires.After(now) {
+		return nil, "", appError.BadRequest("expires must be in the future")
+	}
+	if expires.Sub(now) > wc.shareLinks.MaxTTL {
+		return nil, "", appError.BadRequest(fmt.Sprintf("share link can't live longer than %s", wc.shareLinks.MaxTTL))
+	}
+	if options.MaxDownloads != nil && *options.MaxDownloads < 1 {
+		return nil, "", appError.BadRequest("max_downloads should be more than 0")
+	}
+
+	var passwordHash string
+	if options.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(options.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, "", appError.Internal()
+		}
+		passwordHash = string(hash)
+	}
+
+	link := &entity.ShareLink{
+		ID:        uuid.New(),
+		DocID:     doc.ID,
+		CreatedBy: userLogin,
+		// the token keeps seconds only
+		Expires:      expires.Truncate(time.Second),
+		MaxDownloads: options.MaxDownloads,
+		HasPassword:  passwordHash != "",
+	}
+	if err := wc.shareLinks.Storage.CreateShareLink(ctx, link, passwordHash); err != nil {
+		return nil, "", err
+	}
+	return link, wc.shareLinks.sign(link.ID, link.Expires), nil
+}
+
+func (wc *wcs) ListShareLinks(ctx context.Context, fileId uuid.UUID) ([]*entity.ShareLink, error) {
+	if _, _, err := wc.getDocFor(ctx, ActionShare, fileId); err != nil {
+		return nil, err
+	}
+	return wc.shareLinks.Storage.ListShareLinks(ctx, fileId)
+}
+
+func (wc *wcs) RevokeShareLink(ctx context.Context, fileId, linkId uuid.UUID) error {
+	if _, _, err := wc.getDocFor(ctx, ActionShare, fileId); err != nil {
+		return err
+	}
+	return wc.shareLinks.Storage.RevokeShareLink(ctx, fileId, linkId)
+}
+
+func (wc *wcs) GetShareLinkUses(ctx context.Context, fileId, linkId uuid.UUID) ([]entity.ShareLinkUse, error) {
+	if _, _, err := wc.getDocFor(ctx, ActionShare, fileId); err != nil {
+		return nil, err
+	}
+	link, _, err := wc.shareLinks.Storage.GetShareLink(ctx, linkId)
+	if err != nil {
+		return nil, err
+	}
+	if link.DocID != fileId {
+		return nil, appError.NotFound()
+	}
+	return wc.shareLinks.Storage.GetShareLinkUses(ctx, linkId, shareLinkUsesLimit)
+}
+
+// OpenSharedFile works like GetFile for the holder of the link token.
+// Opening is not a download, the caller counts it with CountDownload.
+// All refusals look like a missing document, except a wrong password
+// and a link locked after wrong passwords
+func (wc *wcs) OpenSharedFile(ctx context.Context, token, password string, client entity.ClientInfo) (*SharedFile, error) {
+	linkId, expires, ok := wc.shareLinks.verify(token)
+	if !ok || !expires.After(time.Now()) {
+		return nil, appError.NotFound()
+	}
+
+	link, passwordHash, err := wc.shareLinks.Storage.GetShareLink(ctx, linkId)
+	if err != nil {
+		return nil, err
+	}
+	refuse := func(result string, err error) (*SharedFile, error) {
+		wc.logShareLinkUse(ctx, link.ID, client, result)
+		return nil, err
+	}
+
+	switch {
+	case link.Revoked != nil:
+		return refuse(shareUseRevoked, appError.NotFound())
+	case !link.Expires.After(time.Now()):
+		return refuse(shareUseExpired, appError.NotFound())
+	case link.MaxDownloads != nil && link.Downloads >= *link.MaxDownloads:
+		return refuse(shareUseUsedUp, appError.NotFound())
+	}
+	if passwordHash != "" {
+		// the right password is refused too while the link is locked
+		if wc.passwordFailures.locked(link.ID) {
+			return refuse(shareUseLocked, appError.TooManyRequests())
+		}
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) != nil {
+			wc.passwordFailures.add(link.ID)
+			return refuse(shareUseBadPassword, appError.Unauthorized())
+		}
+		wc.passwordFailures.reset(link.ID)
+	}
+
+	// documents in the trash are not found
+	doc, err := wc.fileStorage.GetDoc(ctx, link.DocID)
+	if err != nil {
+		return refuse(shareUseNoDocument, appError.NotFound())
+	}
+	content, err := wc.openContent(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	return &SharedFile{
+		Doc:     doc,
+		Content: content,
+		ctx:     ctx,
+		wc:      wc,
+		link:    link,
+		client:  client,
+	}, nil
+}
+
+// SharedFile is a document opened by a share link
+type SharedFile struct {
+	Doc *entity.Document
+	// Content is nil for json documents
+	Content io.ReadSeekCloser
+
+	ctx     context.Context
+	wc      *wcs
+	link    *entity.ShareLink
+	client  entity.ClientInfo
+	counted bool
+}
+
+// CountDownload counts the download against the link limit, call it once
+// the content is going to be sent. A range after the first byte resumes
+// a download and is not counted, unless the link was never downloaded:
+// then there is nothing to resume. Not found if concurrent downloads used the link up
+func (f *SharedFile) CountDownload(resumed bool) error {
+	if f.counted || resumed && f.link.Downloads > 0 {
+		return nil
+	}
+	counted, err := f.wc.shareLinks.Storage.CountDownload(f.ctx, f.link.ID)
+	if err != nil {
+		return err
+	}
+	if !counted {
+		f.wc.logShareLinkUse(f.ctx, f.link.ID, f.client, shareUseUsedUp)
+		return appError.NotFound()
+	}
+	f.counted = true
+	return nil
+}
+
+// Close closes the content and logs the use of the link
+func (f *SharedFile) Close() error {
+	result := shareUseOpen
+	if f.counted {
+		result = shareUseDownload
+	}
+	f.wc.logShareLinkUse(f.ctx, f.link.ID, f.client, result)
+	if f.Content == nil {
+		return nil
+	}
+	return f.Content.Close()
+}
+
+// passwordFailures counts wrong passwords of share links. A link is locked
+// for shareLinkLockout after shareLinkPasswordAttempts failures in a row,
+// so a password can't be guessed from many IPs. Counters are kept per replica
+type passwordFailures struct {
+	mu        sync.Mutex
+	links     map[uuid.UUID]*linkFailures
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type linkFailures struct {
+	count int
+	last  time.Time
+}
+
+func newPasswordFailures() *passwordFailures {
+	return &passwordFailures{
+		links: make(map[uuid.UUID]*linkFailures),
+		now:   time.Now,
+	}
+}
+
+func (p *passwordFailures) locked(id uuid.UUID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	p.sweep(now)
+	f, ok := p.links[id]
+	return ok && f.count >= shareLinkPasswordAttempts && now.Sub(f.last) < shareLinkLockout
+}
+
+// add counts a failure, failures older than the lockout are forgotten
+func (p *passwordFailures) add(id uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	f, ok := p.links[id]
+	if !ok || now.Sub(f.last) >= shareLinkLockout {
+		f = &linkFailures{}
+		p.links[id] = f
+	}
+	f.count++
+	f.last = now
+}
+
+func (p *passwordFailures) reset(id uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.links, id)
+}
+
+// sweep drops links without failures during the lockout
+func (p *passwordFailures) sweep(now time.Time) {
+	if now.Sub(p.lastSweep) < time.Minute {
+		return
+	}
+	p.lastSweep = now
+	for id, f := range p.links {
+		if now.Sub(f.last) >= shareLinkLockout {
+			delete(p.links, id)
+		}
+	}
+}
+
+// logShareLinkUse writes the usage log, failure to log doesn't fail the request
+func (wc *wcs) logShareLinkUse(ctx context.Context, linkId uuid.UUID, client entity.ClientInfo, result string) {
+	wc.shareLinks.Storage.LogShareLinkUse(ctx, linkId, entity.ShareLinkUse{
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		Result:    result,
+	})
+}
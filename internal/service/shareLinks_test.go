@@ -0,0 +1,315 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type mockShareLinkStorage struct{ mock.Mock }
+
+func (m *mockShareLinkStorage) CreateShareLink(ctx context.Context, link *entity.ShareLink, passwordHash string) error {
+	args := m.Called(ctx, link, passwordHash)
+	return args.Error(0)
+}
+func (m *mockShareLinkStorage) GetShareLink(ctx context.Context, id uuid.UUID) (*entity.ShareLink, string, error) {
+	args := m.Called(ctx, id)
+	if link, ok := args.Get(0).(*entity.ShareLink); ok {
+		return link, args.String(1), args.Error(2)
+	}
+	return nil, "", args.Error(2)
+}
+func (m *mockShareLinkStorage) ListShareLinks(ctx context.Context, docId uuid.UUID) ([]*entity.ShareLink, error) {
+	args := m.Called(ctx, docId)
+	links, _ := args.Get(0).([]*entity.ShareLink)
+	return links, args.Error(1)
+}
+func (m *mockShareLinkStorage) RevokeShareLink(ctx context.Context, docId, id uuid.UUID) error {
+	args := m.Called(ctx, docId, id)
+	return args.Error(0)
+}
+func (m *mockShareLinkStorage) CountDownload(ctx context.Context, id uuid.UUID) (bool, error) {
+	args := m.Called(ctx, id)
+	return args.Bool(0), args.Error(1)
+}
+func (m *mockShareLinkStorage) LogShareLinkUse(ctx context.Context, id uuid.UUID, use entity.ShareLinkUse) error {
+	args := m.Called(ctx, id, use)
+	return args.Error(0)
+}
+func (m *mockShareLinkStorage) GetShareLinkUses(ctx context.Context, id uuid.UUID, limit int) ([]entity.ShareLinkUse, error) {
+	args := m.Called(ctx, id, limit)
+	uses, _ := args.Get(0).([]entity.ShareLinkUse)
+	return uses, args.Error(1)
+}
+
+var testShareLinkSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestShareLinkToken(t *testing.T) {
+	links := ShareLinks{Secret: testShareLinkSecret}
+	id := uuid.New()
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	token := links.sign(id, expires)
+
+	gotId, gotExpires, ok := links.verify(token)
+	require.True(t, ok)
+	assert.Equal(t, id, gotId)
+	assert.True(t, expires.Equal(gotExpires))
+
+	payload, mac, _ := strings.Cut(token, ".")
+	forged := links.sign(uuid.New(), expires)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for name, bad := range map[string]string{
+		"other payload": forgedPayload + "." + mac,
+		"no mac":        payload,
+		"bad base64":    payload + ".!!!",
+		"empty":         "",
+	} {
+		_, _, ok := links.verify(bad)
+		assert.False(t, ok, name)
+	}
+
+	other := ShareLinks{Secret: []byte("another-secret-another-secret-xx")}
+	_, _, ok = other.verify(token)
+	assert.False(t, ok, "other secret")
+}
+
+func TestCreateShareLink(t *testing.T) {
+	doc := &entity.Document{
+		ID:    uuid.New(),
+		Owner: "owner1",
+		Permissions: []entity.Permission{
+			{Login: "editor1", Role: entity.RoleEditor},
+			{Login: "manager1", Role: entity.RoleManager},
+		},
+	}
+
+	t.Run("editor can't share", func(t *testing.T) {
+		ctx := userCtx("editor1")
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		links := new(mockShareLinkStorage)
+
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage),
+			ShareLinks{Storage: links, Secret: testShareLinkSecret, MaxTTL: 30 * 24 * time.Hour}, false)
+		_, _, err := svc.CreateShareLink(ctx, doc.ID, entity.ShareLinkOptions{})
+		assert.Equal(t, appError.Forbidden(), err)
+		links.AssertNotCalled(t, "CreateShareLink", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("longer than max ttl", func(t *testing.T) {
+		ctx := userCtx("manager1")
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		expires := time.Now().Add(48 * time.Hour)
+
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage),
+			ShareLinks{Storage: new(mockShareLinkStorage), Secret: testShareLinkSecret, MaxTTL: 24 * time.Hour}, false)
+		_, _, err := svc.CreateShareLink(ctx, doc.ID, entity.ShareLinkOptions{Expires: &expires})
+		assert.Error(t, err)
+	})
+
+	t.Run("manager gets a token of the link", func(t *testing.T) {
+		ctx := userCtx("manager1")
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		links := new(mockShareLinkStorage)
+		links.On("CreateShareLink", ctx, mock.Anything, mock.MatchedBy(func(hash string) bool {
+			return bcrypt.CompareHashAndPassword([]byte(hash), []byte("secret")) == nil
+		})).Return(nil)
+
+		shareLinks := ShareLinks{Storage: links, Secret: testShareLinkSecret, MaxTTL: 30 * 24 * time.Hour}
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+		link, token, err := svc.CreateShareLink(ctx, doc.ID, entity.ShareLinkOptions{Password: "secret"})
+		require.NoError(t, err)
+		assert.Equal(t, "manager1", link.CreatedBy)
+		assert.True(t, link.HasPassword)
+
+		id, _, ok := shareLinks.verify(token)
+		require.True(t, ok)
+		assert.Equal(t, link.ID, id)
+		links.AssertExpectations(t)
+	})
+}
+
+func TestOpenSharedFile(t *testing.T) {
+	ctx := context.Background()
+	client := entity.ClientInfo{IP: "10.0.0.1", UserAgent: "curl"}
+	doc := &entity.Document{ID: uuid.New(), Owner: "owner1", JsonData: []byte(`{}`)}
+	maxDownloads := 2
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	newLink := func() *entity.ShareLink {
+		return &entity.ShareLink{
+			ID:           uuid.New(),
+			DocID:        doc.ID,
+			Expires:      time.Now().Add(time.Hour).Truncate(time.Second),
+			MaxDownloads: &maxDownloads,
+		}
+	}
+	loggedResult := func(result string) interface{} {
+		return mock.MatchedBy(func(use entity.ShareLinkUse) bool {
+			return use.Result == result && use.IP == client.IP
+		})
+	}
+
+	t.Run("expired token is refused without a query", func(t *testing.T) {
+		shareLinks := ShareLinks{Storage: new(mockShareLinkStorage), Secret: testShareLinkSecret}
+		svc := NewWcsService(new(mockFileStorage), new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+		token := shareLinks.sign(uuid.New(), time.Now().Add(-time.Minute))
+
+		_, err := svc.OpenSharedFile(ctx, token, "", client)
+		assert.Equal(t, appError.NotFound(), err)
+	})
+
+	t.Run("bad password is logged", func(t *testing.T) {
+		link := newLink()
+		links := new(mockShareLinkStorage)
+		links.On("GetShareLink", ctx, link.ID).Return(link, string(hash), nil)
+		links.On("LogShareLinkUse", ctx, link.ID, loggedResult(shareUseBadPassword)).Return(nil)
+		shareLinks := ShareLinks{Storage: links, Secret: testShareLinkSecret}
+		svc := NewWcsService(new(mockFileStorage), new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+
+		_, err := svc.OpenSharedFile(ctx, shareLinks.sign(link.ID, link.Expires), "wrong", client)
+		assert.Equal(t, appError.Unauthorized(), err)
+		links.AssertExpectations(t)
+	})
+
+	t.Run("link is locked after wrong passwords", func(t *testing.T) {
+		link := newLink()
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		links := new(mockShareLinkStorage)
+		links.On("GetShareLink", ctx, link.ID).Return(link, string(hash), nil)
+		links.On("LogShareLinkUse", ctx, link.ID, mock.Anything).Return(nil)
+		shareLinks := ShareLinks{Storage: links, Secret: testShareLinkSecret}
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+		now := time.Now()
+		svc.(*wcs).passwordFailures.now = func() time.Time { return now }
+		token := shareLinks.sign(link.ID, link.Expires)
+
+		for i := 0; i < shareLinkPasswordAttempts; i++ {
+			_, err := svc.OpenSharedFile(ctx, token, "wrong", client)
+			assert.Equal(t, appError.Unauthorized(), err)
+		}
+		// the right password is refused too, without comparing it
+		_, err := svc.OpenSharedFile(ctx, token, "secret", client)
+		assert.Equal(t, appError.TooManyRequests(), err)
+		links.AssertCalled(t, "LogShareLinkUse", ctx, link.ID, loggedResult(shareUseLocked))
+
+		// other links are not locked
+		other := newLink()
+		links.On("GetShareLink", ctx, other.ID).Return(other, string(hash), nil)
+		links.On("LogShareLinkUse", ctx, other.ID, mock.Anything).Return(nil)
+		file, err := svc.OpenSharedFile(ctx, shareLinks.sign(other.ID, other.Expires), "secret", client)
+		require.NoError(t, err)
+		file.Close()
+
+		now = now.Add(shareLinkLockout)
+		file, err = svc.OpenSharedFile(ctx, token, "secret", client)
+		require.NoError(t, err)
+		file.Close()
+	})
+
+	t.Run("used up link", func(t *testing.T) {
+		link := newLink()
+		link.Downloads = maxDownloads
+		links := new(mockShareLinkStorage)
+		links.On("GetShareLink", ctx, link.ID).Return(link, "", nil)
+		links.On("LogShareLinkUse", ctx, link.ID, loggedResult(shareUseUsedUp)).Return(nil)
+		shareLinks := ShareLinks{Storage: links, Secret: testShareLinkSecret}
+		svc := NewWcsService(new(mockFileStorage), new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+
+		_, err := svc.OpenSharedFile(ctx, shareLinks.sign(link.ID, link.Expires), "", client)
+		assert.Equal(t, appError.NotFound(), err)
+		links.AssertExpectations(t)
+	})
+
+	t.Run("download is counted once", func(t *testing.T) {
+		link := newLink()
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		links := new(mockShareLinkStorage)
+		links.On("GetShareLink", ctx, link.ID).Return(link, string(hash), nil)
+		links.On("CountDownload", ctx, link.ID).Return(true, nil).Once()
+		links.On("LogShareLinkUse", ctx, link.ID, loggedResult(shareUseDownload)).Return(nil).Once()
+		shareLinks := ShareLinks{Storage: links, Secret: testShareLinkSecret}
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+
+		file, err := svc.OpenSharedFile(ctx, shareLinks.sign(link.ID, link.Expires), "secret", client)
+		require.NoError(t, err)
+		assert.Equal(t, doc.ID, file.Doc.ID)
+		require.NoError(t, file.CountDownload(false))
+		require.NoError(t, file.CountDownload(false))
+		file.Close()
+		links.AssertExpectations(t)
+	})
+
+	t.Run("opening is not counted", func(t *testing.T) {
+		link := newLink()
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		links := new(mockShareLinkStorage)
+		links.On("GetShareLink", ctx, link.ID).Return(link, "", nil)
+		links.On("LogShareLinkUse", ctx, link.ID, loggedResult(shareUseOpen)).Return(nil)
+		shareLinks := ShareLinks{Storage: links, Secret: testShareLinkSecret}
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+
+		file, err := svc.OpenSharedFile(ctx, shareLinks.sign(link.ID, link.Expires), "", client)
+		require.NoError(t, err)
+		file.Close()
+		links.AssertNotCalled(t, "CountDownload", mock.Anything, mock.Anything)
+		links.AssertExpectations(t)
+	})
+
+	t.Run("resumed range", func(t *testing.T) {
+		link := newLink()
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		links := new(mockShareLinkStorage)
+		links.On("GetShareLink", ctx, link.ID).Return(link, "", nil)
+		links.On("CountDownload", ctx, link.ID).Return(true, nil)
+		links.On("LogShareLinkUse", ctx, link.ID, mock.Anything).Return(nil)
+		shareLinks := ShareLinks{Storage: links, Secret: testShareLinkSecret}
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+		token := shareLinks.sign(link.ID, link.Expires)
+
+		// a link never downloaded has nothing to resume
+		file, err := svc.OpenSharedFile(ctx, token, "", client)
+		require.NoError(t, err)
+		require.NoError(t, file.CountDownload(true))
+		links.AssertNumberOfCalls(t, "CountDownload", 1)
+
+		link.Downloads = 1
+		file, err = svc.OpenSharedFile(ctx, token, "", client)
+		require.NoError(t, err)
+		require.NoError(t, file.CountDownload(true))
+		links.AssertNumberOfCalls(t, "CountDownload", 1)
+	})
+
+	t.Run("used up by a concurrent download", func(t *testing.T) {
+		link := newLink()
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, doc.ID).Return(doc, nil)
+		links := new(mockShareLinkStorage)
+		links.On("GetShareLink", ctx, link.ID).Return(link, "", nil)
+		links.On("CountDownload", ctx, link.ID).Return(false, nil)
+		links.On("LogShareLinkUse", ctx, link.ID, loggedResult(shareUseUsedUp)).Return(nil)
+		shareLinks := ShareLinks{Storage: links, Secret: testShareLinkSecret}
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), shareLinks, false)
+
+		file, err := svc.OpenSharedFile(ctx, shareLinks.sign(link.ID, link.Expires), "", client)
+		require.NoError(t, err)
+		assert.Equal(t, appError.NotFound(), file.CountDownload(false))
+		links.AssertExpectations(t)
+	})
+}
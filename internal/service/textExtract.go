@@ -0,0 +1,137 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"context"
+	"html"
+	"io"
+	"path"
+	"strings"
+)
+
+// maxExtractedText limits text kept for search, the rest of the file isn't indexed
+const maxExtractedText = 1 << 20 // 1 MB
+
+var textExtensions = map[string]bool{
+	".txt":      true,
+	".csv":      true,
+	".md":       true,
+	".markdown": true,
+	".html":     true,
+	".htm":      true,
+}
+
+// isTextLike tells if text of the file can be indexed.
+// Mime is trusted first, the extension is used for unknown mime
+func isTextLike(mime, name string) bool {
+	mime = strings.ToLower(strings.TrimSpace(strings.Split(mime, ";")[0]))
+	switch {
+	case strings.HasPrefix(mime, "text/"), mime == "application/csv":
+		return true
+	case mime == "" || mime == "application/octet-stream":
+		return textExtensions[strings.ToLower(path.Ext(name))]
+	}
+	return false
+}
+
+func isHtml(mime, name string) bool {
+	mime = strings.ToLower(strings.TrimSpace(strings.Split(mime, ";")[0]))
+	ext := strings.ToLower(path.Ext(name))
+	return mime == "text/html" || ((mime == "" || mime == "application/octet-stream") && (ext == ".html" || ext == ".htm"))
+}
+
+// textCollector keeps the beginning of the written content,
+// it never fails, so it can be used with io.MultiWriter
+type textCollector struct {
+	buf []byte
+}
+
+func (t *textCollector) Write(p []byte) (int, error) {
+	if free := maxExtractedText - len(t.buf); free > 0 {
+		if len(p) > free {
+			t.buf = append(t.buf, p[:free]...)
+		} else {
+			t.buf = append(t.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// extractText returns searchable text of the content
+func extractText(mime, name string, content []byte) string {
+	text := string(content)
+	if isHtml(mime, name) {
+		text = stripHtml(text)
+	}
+	// postgres text can't keep invalid utf-8 and zero bytes,
+	// the cut at maxExtractedText can also split a symbol
+	text = strings.ToValidUTF8(text, "")
+	return strings.ReplaceAll(text, "\x00", "")
+}
+
+// stripHtml drops tags, comments, scripts and styles and unescapes entities
+func stripHtml(s string) string {
+	var b strings.Builder
+	lower := strings.ToLower(s)
+	for i := 0; i < len(s); {
+		if s[i] != '<' {
+			next := strings.IndexByte(s[i:], '<')
+			if next < 0 {
+				next = len(s) - i
+			}
+			b.WriteString(s[i : i+next])
+			i += next
+			continue
+		}
+
+		end := ">"
+		skipTo := ""
+		switch {
+		case strings.HasPrefix(lower[i:], "<!--"):
+			end = "-->"
+		case strings.HasPrefix(lower[i:], "<script"):
+			skipTo = "</script"
+		case strings.HasPrefix(lower[i:], "<style"):
+			skipTo = "</style"
+		}
+		if skipTo != "" {
+			if closing := strings.Index(lower[i:], skipTo); closing >= 0 {
+				i += closing
+			}
+		}
+		closeAt := strings.Index(s[i:], end)
+		if closeAt < 0 {
+			break
+		}
+		i += closeAt + len(end)
+		// tags separate words
+		b.WriteByte(' ')
+	}
+	return html.UnescapeString(b.String())
+}
+
+// contentText returns text of the collected content for the document,
+// content of other files is not indexed, so their text is empty
+func contentText(mime, name string, collected *textCollector) *string {
+	text := ""
+	if isTextLike(mime, name) {
+		text = extractText(mime, name, collected.buf)
+	}
+	return &text
+}
+
+// blobText extracts text from the stored content of the file document
+func (wc *wcs) blobText(ctx context.Context, doc *entity.Document) (*string, error) {
+	text := &textCollector{}
+	if isTextLike(doc.Mime, doc.Name) {
+		content, _, err := wc.blobStore.Get(ctx, doc.BlobKey)
+		if err != nil {
+			return nil, err
+		}
+		defer content.Close()
+		if _, err := io.Copy(text, io.LimitReader(content, maxExtractedText)); err != nil {
+			return nil, err
+		}
+	}
+	return contentText(doc.Mime, doc.Name, text), nil
+}
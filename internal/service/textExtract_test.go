@@ -0,0 +1,55 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTextLike(t *testing.T) {
+	testCases := []struct {
+		mime string
+		name string
+		want bool
+	}{
+		{"text/plain; charset=utf-8", "a.bin", true},
+		{"text/csv", "a", true},
+		{"application/csv", "a", true},
+		{"", "notes.MD", true},
+		{"application/octet-stream", "page.htm", true},
+		{"application/pdf", "a.txt", false},
+		{"", "photo.png", false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, isTextLike(tc.mime, tc.name), tc.mime+" "+tc.name)
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	page := `<html><head><style>p {color: red}</style><script>var contract = 1;</script></head>
+<body><!-- draft --><p>Supply&nbsp;contract</p><p>No&#46;&nbsp;42 &amp; annex</p></body></html>`
+	text := extractText("text/html", "page.html", []byte(page))
+	assert.Equal(t, "Supply contract No. 42 & annex", strings.Join(strings.Fields(text), " "))
+	assert.NotContains(t, text, "color")
+	assert.NotContains(t, text, "var contract")
+	assert.NotContains(t, text, "draft")
+
+	// markdown and csv are kept as is, except symbols postgres can't store
+	assert.Equal(t, "# title\nab", extractText("", "a.md", []byte("# title\na\x00b\xff")))
+}
+
+func TestTextCollector(t *testing.T) {
+	c := &textCollector{}
+	chunk := make([]byte, maxExtractedText-1)
+	n, err := c.Write(chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, len(chunk), n)
+
+	// the rest of the content is accepted, but not kept
+	n, err = c.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Len(t, c.buf, maxExtractedText)
+	assert.Equal(t, byte('a'), c.buf[maxExtractedText-1])
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+)
+
+func (wc *wcs) TransferOwnerDocs(ctx context.Context, fromLogin, toLogin string) error {
+	grantees, err := wc.fileStorage.GetOwnerGrantees(ctx, fromLogin)
+	if err != nil {
+		return err
+	}
+	ids, err := wc.fileStorage.GetOwnerDocIds(ctx, fromLogin)
+	if err != nil {
+		return err
+	}
+	if err := wc.fileStorage.TransferDocs(ctx, fromLogin, toLogin); err != nil {
+		return err
+	}
+
+	// documents change the owner in every response,
+	// lists are cached under the owner, both the old and the new one
+	wc.cache.InvalidateDocs(ids...)
+	wc.invalidateLists(ctx, fromLogin, grantees)
+	wc.invalidateLists(ctx, toLogin, grantees)
+	return nil
+}
+
+func (wc *wcs) PurgeOwnerDocs(ctx context.Context, login string) (int, error) {
+	grantees, err := wc.fileStorage.GetOwnerGrantees(ctx, login)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := wc.fileStorage.GetOwnerDocIds(ctx, login)
+	if err != nil {
+		return 0, err
+	}
+
+	// grantees lose the documents even if a purge fails halfway
+	defer wc.invalidateLists(ctx, login, grantees)
+	for i, id := range ids {
+		if err := wc.purgeDoc(ctx, id); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchQuery     = 256
+)
+
+// SearchFiles finds documents visible to the caller, results are not cached:
+// queries rarely repeat
+func (wc *wcs) SearchFiles(ctx context.Context, query string, limit int) ([]*entity.SearchHit, error) {
+	userLogin, err := currentUser(ctx, entity.ScopeDocsRead)
+	if err != nil {
+		return nil, err
+	}
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, appError.BadRequest("search query is required")
+	}
+	if len(query) > maxSearchQuery {
+		return nil, appError.BadRequest("search query is too long")
+	}
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	if limit < 1 || limit > maxSearchLimit {
+		return nil, appError.BadRequest("limit value should be from 1 to 100")
+	}
+
+	// api keys limited to some owners find only their documents
+	var owners []string
+	if principal := authctx.Principal(ctx); principal.ApiKey != nil {
+		owners = principal.ApiKey.Owners
+	}
+
+	return wc.fileStorage.SearchDocs(ctx, userLogin, owners, query, limit)
+}
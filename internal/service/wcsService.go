@@ -1,219 +1,580 @@
 package service
 
 import (
+	"AstralTest/internal/authctx"
 	"AstralTest/internal/models/entity"
 	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/blob"
 	"AstralTest/internal/storage/cache"
 	"AstralTest/pkg/appError"
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type wcs struct {
-	sessionStorage      storage.SessionStorage
-	fileStorage         storage.FileStorage
-	savingFileDirectory string
-	cache               cache.Cache
+	fileStorage  storage.FileStorage
+	blobStore    blob.BlobStore
+	cache        cache.Cache
+	groupStorage storage.GroupStorage
+	shareLinks   ShareLinks
+	// wrong passwords of share links
+	passwordFailures *passwordFailures
+	// publicAccess lets anonymous callers read public documents
+	publicAccess bool
+	// concurrent cache misses of the same key share one storage read
+	loads *coalescer
 }
 
 type WcsService interface {
-	HandleUploadingFile(ctx context.Context, doc entity.Document, fileData *[]byte) (*uuid.UUID, error)
-	GetFile(ctx context.Context, token, fileId uuid.UUID, headOnly bool) (*entity.Document, string, error)
-	GetFilesList(ctx context.Context, headOnly bool, token uuid.UUID, ownerLogin, key, value string, limit int) (json.RawMessage, error)
-	DeleteFile(ctx context.Context, token, fileId uuid.UUID) error
+	HandleUploadingFile(ctx context.Context, doc entity.Document, fileData io.Reader) (*uuid.UUID, error)
+	// GetFile returns document and, for files, opened content.
+	// Anonymous callers get public documents if public access is on.
+	// Caller must close the content.
+	GetFile(ctx context.Context, fileId uuid.UUID) (*entity.Document, io.ReadSeekCloser, error)
+	// GetFilesList returns a page of documents of query.OwnerLogin (the caller if empty),
+	// query.Login is set to the caller. Anonymous callers get public documents
+	// of query.OwnerLogin if public access is on
+	GetFilesList(ctx context.Context, headOnly bool, query storage.DocsListQuery) (*entity.DocsPage, error)
+	// UpdateFileMeta merges patch into document metadata, editors can change
+	// name, mime and json, public and permissions need the manager role
+	UpdateFileMeta(ctx context.Context, fileId uuid.UUID, patch entity.DocumentPatch) (*entity.Document, error)
+	// ReplaceFileContent replaces content of the file document, editors and up.
+	// Empty mime keeps the old one.
+	ReplaceFileContent(ctx context.Context, fileId uuid.UUID, mime string, content io.Reader) (*entity.Document, error)
+	// DeleteFile moves the document to the owner's trash, managers and up
+	DeleteFile(ctx context.Context, fileId uuid.UUID) error
+	// SearchFiles finds documents visible to the caller by names, json strings
+	// and text of text-like files, best matches first. Limit 0 means default.
+	SearchFiles(ctx context.Context, query string, limit int) ([]*entity.SearchHit, error)
+
+	// GetVersions returns history of the document, newest version first
+	GetVersions(ctx context.Context, fileId uuid.UUID) ([]*entity.Document, error)
+	// GetFileVersion works like GetFile for the given version
+	GetFileVersion(ctx context.Context, fileId uuid.UUID, version int) (*entity.Document, io.ReadSeekCloser, error)
+	// RestoreVersion creates a new version with content and metadata of the given one,
+	// editors and up. Public flag and permissions are kept
+	RestoreVersion(ctx context.Context, fileId uuid.UUID, version int) (*entity.Document, error)
+	DiffVersions(ctx context.Context, fileId uuid.UUID, from, to int) ([]entity.JsonChange, error)
+
+	// CreateShareLink mints an anonymous link to the document, managers and up.
+	// Returns the link and its token, the token is shown only once
+	CreateShareLink(ctx context.Context, fileId uuid.UUID, options entity.ShareLinkOptions) (*entity.ShareLink, string, error)
+	ListShareLinks(ctx context.Context, fileId uuid.UUID) ([]*entity.ShareLink, error)
+	RevokeShareLink(ctx context.Context, fileId, linkId uuid.UUID) error
+	GetShareLinkUses(ctx context.Context, fileId, linkId uuid.UUID) ([]entity.ShareLinkUse, error)
+	// OpenSharedFile returns the document of the link token without a caller.
+	// Caller counts the download with CountDownload and must close the file
+	OpenSharedFile(ctx context.Context, token, password string, client entity.ClientInfo) (*SharedFile, error)
+
+	GetTrash(ctx context.Context) ([]*entity.Document, error)
+	RestoreFile(ctx context.Context, fileId uuid.UUID) error
+	// PurgeFile deletes the document from the trash for good
+	PurgeFile(ctx context.Context, fileId uuid.UUID) error
+	// EmptyTrash purges all documents from the trash, returns their number
+	EmptyTrash(ctx context.Context) (int, error)
+	// PurgeExpiredTrash purges documents which are in the trash longer than retention
+	PurgeExpiredTrash(ctx context.Context, retention time.Duration) (int, error)
+
+	// TransferOwnerDocs gives all documents and groups of the user to another user,
+	// PurgeOwnerDocs deletes all documents of the user. Both are used on deletion
+	// of the user and don't check the caller
+	TransferOwnerDocs(ctx context.Context, fromLogin, toLogin string) error
+	PurgeOwnerDocs(ctx context.Context, login string) (int, error)
+
+	// CoalesceStats counts storage reads of GetFile and GetFilesList cache misses
+	CoalesceStats() CoalesceStats
 }
 
-func NewWcsService(sessionStorage storage.SessionStorage, fileStorage storage.FileStorage, savingFileDirectory string, cache cache.Cache) WcsService {
+func NewWcsService(fileStorage storage.FileStorage, blobStore blob.BlobStore, cache cache.Cache, groupStorage storage.GroupStorage, shareLinks ShareLinks, publicAccess bool) WcsService {
 	return &wcs{
-		sessionStorage:      sessionStorage,
-		fileStorage:         fileStorage,
-		savingFileDirectory: savingFileDirectory,
-		cache:               cache,
+		fileStorage:      fileStorage,
+		blobStore:        blobStore,
+		cache:            cache,
+		groupStorage:     groupStorage,
+		shareLinks:       shareLinks,
+		passwordFailures: newPasswordFailures(),
+		publicAccess:     publicAccess,
+		loads:            newCoalescer(),
 	}
 }
 
-func (wc *wcs) HandleUploadingFile(ctx context.Context, doc entity.Document, fileData *[]byte) (*uuid.UUID, error) {
-	token, err := uuid.Parse(doc.Token)
+func (wc *wcs) HandleUploadingFile(ctx context.Context, doc entity.Document, fileData io.Reader) (*uuid.UUID, error) {
+	var err error
+	doc.Owner, err = currentUser(ctx, entity.ScopeDocsWrite)
 	if err != nil {
-		return nil, appError.BadRequest("invalid meta.Token")
+		return nil, err
 	}
-	doc.Owner, err = wc.sessionStorage.GetSession(ctx, token)
-	if err != nil {
+	if err = checkOwner(ctx, doc.Owner); err != nil {
+		return nil, err
+	}
+	if doc.Permissions, err = normalizePermissions(doc.Owner, doc.Permissions); err != nil {
 		return nil, err
 	}
 
 	doc.ID = uuid.New()
 
-	err = wc.fileStorage.SaveDoc(ctx, &doc)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
+	// content is stored first, so the document never points to a missing blob
+	if doc.File {
+		hash := sha256.New()
+		text := &textCollector{}
+		var written int64
+		doc.BlobKey = newBlobKey()
+		written, err = wc.blobStore.Put(ctx, doc.BlobKey, io.TeeReader(fileData, io.MultiWriter(hash, text)))
 		if err != nil {
-			wc.fileStorage.DeleteDoc(ctx, doc.ID)
-			if doc.File {
-				wc.fileStorage.RmFile(doc.ID)
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				wc.blobStore.Delete(ctx, doc.BlobKey)
 			}
+		}()
+		if written == 0 {
+			err = appError.BadRequest("file is required (meta.file = true)")
+			return nil, err
 		}
-	}()
+		doc.Hash = hex.EncodeToString(hash.Sum(nil))
+		doc.Size = written
+		doc.ContentText = contentText(doc.Mime, doc.Name, text)
+	} else {
+		doc.Hash = hashBytes(doc.JsonData)
+		doc.Size = int64(len(doc.JsonData))
+	}
 
-	if doc.File {
-		err := wc.fileStorage.SaveFile(doc.ID, fileData)
-		if err != nil {
-			return nil, appError.Internal()
-		}
+	err = wc.fileStorage.SaveDoc(ctx, &doc)
+	if err != nil {
+		return nil, err
 	}
 
 	// invalidate owner + grantees
 	wc.cache.InvalidateOwnerList(doc.Owner)
-	wc.cache.InvalidateGrant(doc.Owner, doc.Grant)
+	wc.cache.InvalidatePublic(doc.Owner)
+	wc.cache.InvalidateGrant(doc.Owner, wc.expandGroups(ctx, doc.Grantees()))
 
 	return &doc.ID, nil
 }
 
-func (wc *wcs) GetFile(ctx context.Context, token, fileId uuid.UUID, headOnly bool) (*entity.Document, string, error) {
-	userLogin, err := wc.sessionStorage.GetSession(ctx, token)
+func (wc *wcs) GetFile(ctx context.Context, fileId uuid.UUID) (*entity.Document, io.ReadSeekCloser, error) {
+	if wc.anonymousAllowed(ctx) {
+		return wc.getPublicFile(ctx, fileId)
+	}
+	userLogin, err := currentUser(ctx, entity.ScopeDocsRead)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
 	cacheKey := makeFileKey(fileId)
 
+	var document *entity.Document
 	// Try cache
 	if cached, ok := wc.cache.GetOwner(userLogin, cacheKey); ok {
-		if headOnly {
-			return nil, "", nil
-		}
-		var document entity.Document
-		if err := json.Unmarshal(cached.Body, &document); err == nil {
-			return &document, wc.fileStorage.GetFilePath(fileId), nil
+		var cachedDoc cachedDocument
+		if err := json.Unmarshal(cached.Body, &cachedDoc); err == nil {
+			document = cachedDoc.toDocument()
 		}
 	}
 
-	document, err := wc.fileStorage.GetDoc(ctx, fileId)
-	if err != nil {
-		return nil, "", err
-	}
-	if !userIsAllowedToFile(document, userLogin) {
-		return nil, "", appError.Forbidden()
-	}
+	if document == nil {
+		read, err := wc.loadDoc(ctx, fileId)
+		if err != nil {
+			return nil, nil, err
+		}
+		document = read.value
+		allowed, err := wc.isAllowed(ctx, document, userLogin, ActionRead)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !allowed {
+			return nil, nil, appError.Forbidden()
+		}
 
-	if !headOnly {
-		body, _ := json.Marshal(document)
+		body, _ := json.Marshal(newCachedDocument(document))
 		wc.cache.SetOwner(userLogin, cacheKey, cache.CachedDocResp{
 			Status: 200,
 			Body:   body,
+			Docs:   []uuid.UUID{document.ID},
+			Ticket: read.ticket,
 		})
 	}
+	if err := checkOwner(ctx, document.Owner); err != nil {
+		return nil, nil, err
+	}
+
+	content, err := wc.openContent(ctx, document)
+	if err != nil {
+		return nil, nil, err
+	}
+	return document, content, nil
+}
+
+func (wc *wcs) CoalesceStats() CoalesceStats {
+	return wc.loads.stats()
+}
+
+// loadDoc reads the document for a cache miss of GetFile, concurrent
+// misses share one read. Callers check access each for itself
+func (wc *wcs) loadDoc(ctx context.Context, fileId uuid.UUID) (ticketed[*entity.Document], error) {
+	read, err := coalesce(ctx, wc.loads, string(makeFileKey(fileId)), func(ctx context.Context) (ticketed[*entity.Document], error) {
+		ticket := wc.cache.Ticket()
+		doc, err := wc.fileStorage.GetDoc(ctx, fileId)
+		return ticketed[*entity.Document]{value: doc, ticket: ticket}, err
+	})
+	if err != nil {
+		return read, err
+	}
+	// the shared document stays untouched
+	doc := *read.value
+	read.value = &doc
+	return read, nil
+}
 
-	var filePath string
-	if document.File && !headOnly {
-		filePath = wc.fileStorage.GetFilePath(fileId)
+// openContent opens file content of the document (or its version),
+// documents without file have no content.
+// Opening is cheap for every backend, so HEAD gets content too:
+// it is needed to answer with size and ranges
+func (wc *wcs) openContent(ctx context.Context, doc *entity.Document) (io.ReadSeekCloser, error) {
+	if !doc.File {
+		return nil, nil
+	}
+	content, _, err := wc.blobStore.Get(ctx, doc.BlobKey)
+	if err != nil {
+		return nil, err
 	}
-	return document, filePath, nil
+	return content, nil
 }
 
-func (wc *wcs) GetFilesList(ctx context.Context, headOnly bool, token uuid.UUID, ownerLogin, key, value string, limit int) (json.RawMessage, error) {
-	userLogin, err := wc.sessionStorage.GetSession(ctx, token)
+// cachedDocument keeps document fields which are hidden from API json
+type cachedDocument struct {
+	entity.Document
+	Owner   string `json:"owner"`
+	BlobKey string `json:"blob_key"`
+}
+
+func newCachedDocument(doc *entity.Document) cachedDocument {
+	return cachedDocument{
+		Document: *doc,
+		Owner:    doc.Owner,
+		BlobKey:  doc.BlobKey,
+	}
+}
+
+func (c cachedDocument) toDocument() *entity.Document {
+	doc := c.Document
+	doc.Owner = c.Owner
+	doc.BlobKey = c.BlobKey
+	return &doc
+}
+
+func (wc *wcs) GetFilesList(ctx context.Context, headOnly bool, query storage.DocsListQuery) (*entity.DocsPage, error) {
+	if wc.anonymousAllowed(ctx) {
+		return wc.getPublicList(ctx, headOnly, query)
+	}
+	userLogin, err := currentUser(ctx, entity.ScopeDocsRead)
 	if err != nil {
 		return nil, err
 	}
+	ownerLogin := query.OwnerLogin
+	listOwner := ownerLogin
+	if listOwner == "" {
+		listOwner = userLogin
+	}
+	if err := checkOwner(ctx, listOwner); err != nil {
+		return nil, err
+	}
+	query.Login = userLogin
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
 
-	cacheKey := makeOwnerListKey(ownerLogin, key, value, userLogin)
+	cacheKey := makeOwnerListKey(query)
 
 	// check if cache exists
+	var (
+		cached cache.CachedDocResp
+		ok     bool
+	)
 	if ownerLogin == "" {
-		if cached, ok := wc.cache.GetOwner(userLogin, cacheKey); ok {
-			if headOnly {
-				return nil, nil
-			}
-			return cached.Body, nil
-		}
+		cached, ok = wc.cache.GetOwner(userLogin, cacheKey)
 	} else {
-		if cached, ok := wc.cache.GetGrant(userLogin, ownerLogin, cacheKey); ok {
-			if headOnly {
-				return nil, nil
-			}
-			return cached.Body, nil
+		cached, ok = wc.cache.GetGrant(userLogin, ownerLogin, cacheKey)
+	}
+	if ok {
+		if headOnly {
+			return nil, nil
+		}
+		var page entity.DocsPage
+		if err := json.Unmarshal(cached.Body, &page); err == nil {
+			return &page, nil
 		}
 	}
 
-	res, err := wc.fileStorage.GetDocsList(ctx, ownerLogin, userLogin, key, value, limit)
+	read, err := coalesce(ctx, wc.loads, string(cacheKey), func(ctx context.Context) (ticketed[*entity.DocsPage], error) {
+		ticket := wc.cache.Ticket()
+		page, err := wc.fileStorage.GetDocsList(ctx, query)
+		return ticketed[*entity.DocsPage]{value: page, ticket: ticket}, err
+	})
 	if err != nil {
 		return nil, err
 	}
+	page := read.value
 
-	jsonOut, err := json.Marshal(res)
+	jsonOut, err := json.Marshal(page)
 	if err != nil {
 		return nil, appError.Internal()
 	}
 
 	// set cache
+	resp := cache.CachedDocResp{
+		Status: 200,
+		Body:   jsonOut,
+		Docs:   pageDocIds(page),
+		Ticket: read.ticket,
+	}
 	if ownerLogin == "" {
-		wc.cache.SetOwner(userLogin, cacheKey, cache.CachedDocResp{
-			Status: 200,
-			Body:   jsonOut,
-		})
+		wc.cache.SetOwner(userLogin, cacheKey, resp)
 	} else {
-		wc.cache.SetGrant(userLogin, ownerLogin, cacheKey, cache.CachedDocResp{
-			Status: 200,
-			Body:   jsonOut,
-		})
+		wc.cache.SetGrant(userLogin, ownerLogin, cacheKey, resp)
 	}
 
-	return json.RawMessage(jsonOut), nil
+	return page, nil
 }
 
-func (wc *wcs) DeleteFile(ctx context.Context, token, fileId uuid.UUID) error {
-	userLogin, err := wc.sessionStorage.GetSession(ctx, token)
+func (wc *wcs) UpdateFileMeta(ctx context.Context, fileId uuid.UUID, patch entity.DocumentPatch) (*entity.Document, error) {
+	if patch.Grant != nil && patch.Permissions != nil {
+		return nil, appError.BadRequest("use either grant or permissions")
+	}
+	if patch.Grant != nil {
+		permissions := entity.ViewerPermissions(*patch.Grant)
+		patch.Permissions = &permissions
+	}
+
+	// access changes need the manager role, the rest is for editors
+	sharing := patch.Permissions != nil || patch.Public != nil
+	action := ActionUpdate
+	if sharing {
+		action = ActionShare
+	}
+	doc, userLogin, err := wc.getDocFor(ctx, action, fileId)
 	if err != nil {
-		return appError.BadRequest("session doesn't exist")
+		return nil, err
+	}
+	oldGrantees := doc.Grantees()
+
+	var permissions []entity.Permission
+	if patch.Permissions != nil {
+		if permissions, err = normalizePermissions(doc.Owner, *patch.Permissions); err != nil {
+			return nil, err
+		}
+	}
+
+	if patch.Name != nil {
+		if *patch.Name == "" {
+			return nil, appError.BadRequest("name can't be empty")
+		}
+		doc.Name = *patch.Name
+	}
+	if patch.Public != nil {
+		doc.Public = *patch.Public
+	}
+	if patch.Mime != nil {
+		doc.Mime = *patch.Mime
+	}
+	if patch.Json != nil {
+		if string(patch.Json) == "null" {
+			doc.JsonData = nil
+		} else {
+			doc.JsonData = patch.Json
+		}
+		// json is the content of not file documents
+		if !doc.File {
+			doc.Hash = hashBytes(doc.JsonData)
+			doc.Size = int64(len(doc.JsonData))
+		}
+	}
+
+	// permissions are not versioned, a patch of only them makes no new version
+	if patch.Name != nil || patch.Public != nil || patch.Mime != nil || patch.Json != nil {
+		if err := wc.fileStorage.UpdateDoc(ctx, doc, userLogin); err != nil {
+			return nil, err
+		}
 	}
+	if patch.Permissions != nil {
+		if err := wc.fileStorage.SetPermissions(ctx, doc.ID, permissions); err != nil {
+			return nil, err
+		}
+		doc.Permissions = permissions
+	}
+	wc.invalidateDoc(ctx, doc, oldGrantees, doc.Grantees())
 
-	doc, err := wc.fileStorage.GetDoc(ctx, fileId)
+	return doc, nil
+}
+
+func (wc *wcs) ReplaceFileContent(ctx context.Context, fileId uuid.UUID, mime string, content io.Reader) (*entity.Document, error) {
+	doc, userLogin, err := wc.getDocFor(ctx, ActionUpdate, fileId)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if !doc.File {
+		return nil, appError.BadRequest("document has no file content, use PATCH to change json")
 	}
 
-	if doc.Owner != userLogin {
-		return appError.Forbidden()
+	// check for empty content before the old one is replaced
+	bufContent := bufio.NewReader(content)
+	if _, err := bufContent.Peek(1); err != nil {
+		return nil, appError.BadRequest("file content is required")
 	}
 
-	wc.cache.InvalidateOwnerList(doc.Owner)
-	wc.cache.InvalidateGrant(doc.Owner, doc.Grant)
+	// new content is a new version with its own blob, old versions keep theirs
+	hash := sha256.New()
+	text := &textCollector{}
+	newKey := newBlobKey()
+	written, err := wc.blobStore.Put(ctx, newKey, io.TeeReader(bufContent, io.MultiWriter(hash, text)))
+	if err != nil {
+		return nil, err
+	}
 
-	if doc.File {
-		err = wc.fileStorage.RmFile(fileId)
+	doc.BlobKey = newKey
+	doc.Hash = hex.EncodeToString(hash.Sum(nil))
+	doc.Size = written
+	if mime != "" {
+		doc.Mime = mime
+	}
+	doc.ContentText = contentText(doc.Mime, doc.Name, text)
+	if err := wc.fileStorage.UpdateDoc(ctx, doc, userLogin); err != nil {
+		wc.blobStore.Delete(ctx, newKey)
+		return nil, err
+	}
+	wc.invalidateDoc(ctx, doc, doc.Grantees())
+
+	return doc, nil
+}
+
+// invalidateDoc drops cached responses of all users which contain the changed
+// document and lists where it can appear or disappear
+func (wc *wcs) invalidateDoc(ctx context.Context, doc *entity.Document, grants ...[]string) {
+	wc.cache.InvalidateDocs(doc.ID)
+	wc.invalidateLists(ctx, doc.Owner, grants...)
+}
+
+// invalidateLists drops cache entries which can list documents of the owner:
+// owner lists, lists of grantees, anonymous lists of the owner.
+// Groups are replaced with their members
+func (wc *wcs) invalidateLists(ctx context.Context, owner string, grants ...[]string) {
+	wc.cache.InvalidateOwnerList(owner)
+	wc.cache.InvalidatePublic(owner)
+	for _, grantees := range grants {
+		logins := wc.expandGroups(ctx, grantees)
+		wc.cache.InvalidateGrant(owner, logins)
+		for _, login := range logins {
+			wc.cache.InvalidateOwnerList(login)
+		}
+	}
+}
+
+// expandGroups replaces groups among grantees with their members
+func (wc *wcs) expandGroups(ctx context.Context, grantees []string) []string {
+	logins := make([]string, 0, len(grantees))
+	for _, grantee := range grantees {
+		if !strings.HasPrefix(grantee, entity.GroupPrefix) {
+			logins = append(logins, grantee)
+			continue
+		}
+		group, err := wc.groupStorage.GetGroup(ctx, strings.TrimPrefix(grantee, entity.GroupPrefix))
 		if err != nil {
-			return appError.Internal()
+			log.Printf("[expandGroups] can't invalidate cache of %s: %v", grantee, err)
+			continue
 		}
+		logins = append(logins, group.Members...)
 	}
+	return logins
+}
 
-	err = wc.fileStorage.DeleteDoc(ctx, fileId)
+func (wc *wcs) DeleteFile(ctx context.Context, fileId uuid.UUID) error {
+	doc, _, err := wc.getDocFor(ctx, ActionDelete, fileId)
 	if err != nil {
-		return appError.Internal()
+		return err
 	}
 
+	// document goes to the owner's trash, it is purged later
+	if err := wc.fileStorage.TrashDoc(ctx, fileId); err != nil {
+		return err
+	}
+	// after the write, so a response read before it can't be cached under a later ticket
+	wc.invalidateDoc(ctx, doc, doc.Grantees())
 	return nil
 }
 
-func userIsAllowedToFile(doc *entity.Document, userLogin string) bool {
-	if doc.Public || doc.Owner == userLogin {
-		return true
+// currentUser returns login of the caller resolved by the auth middleware,
+// api keys must have the scope
+func currentUser(ctx context.Context, scope string) (string, error) {
+	principal := authctx.Principal(ctx)
+	if principal == nil {
+		return "", appError.Unauthorized()
 	}
-	for _, login := range doc.Grant {
-		if login == userLogin {
-			return true
-		}
+	if !principal.Allows(scope) {
+		return "", appError.Forbidden()
+	}
+	return principal.Login, nil
+}
+
+// ownUser works like currentUser for operations on the caller's own documents
+func ownUser(ctx context.Context, scope string) (string, error) {
+	login, err := currentUser(ctx, scope)
+	if err != nil {
+		return "", err
 	}
-	return false
+	if err := checkOwner(ctx, login); err != nil {
+		return "", err
+	}
+	return login, nil
+}
+
+// checkOwner rejects documents of owners which the caller's api key is not limited to
+func checkOwner(ctx context.Context, owner string) error {
+	if principal := authctx.Principal(ctx); principal != nil && !principal.AllowsOwner(owner) {
+		return appError.Forbidden()
+	}
+	return nil
 }
 
-func makeOwnerListKey(ownerLogin, key, value, viewerLogin string) cache.CacheKey {
-	return cache.CacheKey(fmt.Sprintf("list:%s:%s:%s:viewedBy:%s", ownerLogin, key, value, viewerLogin))
+// makeOwnerListKey includes every parameter of the page, the filter
+// is in canonical form, so equal filters share the entry
+func makeOwnerListKey(query storage.DocsListQuery) cache.CacheKey {
+	var filter string
+	if query.Where != nil {
+		filter = query.Where.String()
+	}
+	return cache.CacheKey(fmt.Sprintf("list:%s:viewedBy:%s:sort:%s:%t:limit:%d:total:%t:cursor:%s:filter:%s",
+		query.OwnerLogin, query.Login, query.Sort, query.Desc, query.Limit, query.WithTotal, query.Cursor, filter))
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// newBlobKey generates a key for new content in blob.BlobStore,
+// blobs are never overwritten, every content version gets its own key
+func newBlobKey() string {
+	return uuid.New().String()
+}
+
+// pageDocIds returns ids of the documents on the page
+func pageDocIds(page *entity.DocsPage) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(page.Docs))
+	for _, doc := range page.Docs {
+		ids = append(ids, doc.ID)
+	}
+	return ids
 }
 
 func makeFileKey(fileId uuid.UUID) cache.CacheKey {
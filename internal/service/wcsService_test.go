@@ -1,10 +1,17 @@
 package service
 
 import (
+	"AstralTest/internal/authctx"
 	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/blob"
 	"AstralTest/internal/storage/cache"
+	"AstralTest/pkg/appError"
+	"bytes"
 	"context"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -18,30 +25,107 @@ func (m *mockFileStorage) SaveDoc(ctx context.Context, doc *entity.Document) err
 	args := m.Called(ctx, doc)
 	return args.Error(0)
 }
-func (m *mockFileStorage) DeleteDoc(ctx context.Context, id uuid.UUID) error {
-	args := m.Called(ctx, id)
+func (m *mockFileStorage) SetPermissions(ctx context.Context, id uuid.UUID, permissions []entity.Permission) error {
+	args := m.Called(ctx, id, permissions)
 	return args.Error(0)
 }
-func (m *mockFileStorage) SaveFile(id uuid.UUID, data *[]byte) error {
-	args := m.Called(id, data)
+func (m *mockFileStorage) UpdateDoc(ctx context.Context, doc *entity.Document, author string) error {
+	args := m.Called(ctx, doc, author)
 	return args.Error(0)
 }
-func (m *mockFileStorage) RmFile(id uuid.UUID) error {
-	args := m.Called(id)
+func (m *mockFileStorage) GetVersions(ctx context.Context, id uuid.UUID) ([]*entity.Document, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).([]*entity.Document), args.Error(1)
+}
+func (m *mockFileStorage) GetVersion(ctx context.Context, id uuid.UUID, version int) (*entity.Document, error) {
+	args := m.Called(ctx, id, version)
+	doc, _ := args.Get(0).(*entity.Document)
+	return doc, args.Error(1)
+}
+func (m *mockFileStorage) GetBlobKeys(ctx context.Context, id uuid.UUID) ([]string, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).([]string), args.Error(1)
+}
+func (m *mockFileStorage) DeleteDoc(ctx context.Context, id uuid.UUID) error {
+	args := m.Called(ctx, id)
 	return args.Error(0)
 }
 func (m *mockFileStorage) GetDoc(ctx context.Context, id uuid.UUID) (*entity.Document, error) {
 	args := m.Called(ctx, id)
 	return args.Get(0).(*entity.Document), args.Error(1)
 }
-func (m *mockFileStorage) GetFilePath(id uuid.UUID) string {
-	args := m.Called(id)
-	return args.String(0)
+func (m *mockFileStorage) GetDocsList(ctx context.Context, q storage.DocsListQuery) (*entity.DocsPage, error) {
+	args := m.Called(ctx, q)
+	if page, ok := args.Get(0).(*entity.DocsPage); ok {
+		return page, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockFileStorage) SearchDocs(ctx context.Context, login string, owners []string, query string, limit int) ([]*entity.SearchHit, error) {
+	args := m.Called(ctx, login, owners, query, limit)
+	if hits, ok := args.Get(0).([]*entity.SearchHit); ok {
+		return hits, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+func (m *mockFileStorage) TrashDoc(ctx context.Context, id uuid.UUID) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+func (m *mockFileStorage) RestoreDoc(ctx context.Context, id uuid.UUID) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
 }
-func (m *mockFileStorage) GetDocsList(ctx context.Context, ownerLogin, login, key, value string, limit int) ([]*entity.Document, error) {
-	args := m.Called(ctx, ownerLogin, login, key, value, limit)
+func (m *mockFileStorage) GetTrashedDoc(ctx context.Context, id uuid.UUID) (*entity.Document, error) {
+	args := m.Called(ctx, id)
+	doc, _ := args.Get(0).(*entity.Document)
+	return doc, args.Error(1)
+}
+func (m *mockFileStorage) GetTrash(ctx context.Context, ownerLogin string) ([]*entity.Document, error) {
+	args := m.Called(ctx, ownerLogin)
 	return args.Get(0).([]*entity.Document), args.Error(1)
 }
+func (m *mockFileStorage) GetExpiredTrash(ctx context.Context, before time.Time, after storage.TrashedDoc, limit int) ([]storage.TrashedDoc, error) {
+	args := m.Called(ctx, before, after, limit)
+	return args.Get(0).([]storage.TrashedDoc), args.Error(1)
+}
+
+func (m *mockFileStorage) GetOwnerDocIds(ctx context.Context, ownerLogin string) ([]uuid.UUID, error) {
+	args := m.Called(ctx, ownerLogin)
+	return args.Get(0).([]uuid.UUID), args.Error(1)
+}
+
+func (m *mockFileStorage) GetOwnerGrantees(ctx context.Context, ownerLogin string) ([]string, error) {
+	args := m.Called(ctx, ownerLogin)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockFileStorage) TransferDocs(ctx context.Context, fromLogin, toLogin string) error {
+	args := m.Called(ctx, fromLogin, toLogin)
+	return args.Error(0)
+}
+
+type mockBlobStore struct{ mock.Mock }
+
+func (m *mockBlobStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	args := m.Called(ctx, key, r)
+	return args.Get(0).(int64), args.Error(1)
+}
+func (m *mockBlobStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, *blob.Info, error) {
+	args := m.Called(ctx, key)
+	content, _ := args.Get(0).(io.ReadSeekCloser)
+	info, _ := args.Get(1).(*blob.Info)
+	return content, info, args.Error(2)
+}
+func (m *mockBlobStore) Stat(ctx context.Context, key string) (*blob.Info, error) {
+	args := m.Called(ctx, key)
+	info, _ := args.Get(0).(*blob.Info)
+	return info, args.Error(1)
+}
+func (m *mockBlobStore) Delete(ctx context.Context, key string) error {
+	args := m.Called(ctx, key)
+	return args.Error(0)
+}
 
 type mockCache struct{ mock.Mock }
 
@@ -65,35 +149,447 @@ func (m *mockCache) GetGrant(grantee, owner string, key cache.CacheKey) (cache.C
 func (m *mockCache) InvalidateGrant(owner string, grantees []string) {
 	m.Called(owner, grantees)
 }
+func (m *mockCache) SetPublic(owner string, key cache.CacheKey, value cache.CachedDocResp) {
+	m.Called(owner, key, value)
+}
+func (m *mockCache) GetPublic(key cache.CacheKey) (cache.CachedDocResp, bool) {
+	args := m.Called(key)
+	return args.Get(0).(cache.CachedDocResp), args.Bool(1)
+}
+func (m *mockCache) InvalidatePublic(owner string) {
+	m.Called(owner)
+}
+func (m *mockCache) InvalidateDocs(ids ...uuid.UUID) {
+	m.Called(ids)
+}
+
+// Ticket isn't checked by the mock, responses carry it as is
+func (m *mockCache) Ticket() cache.Ticket {
+	return 1
+}
+
+// userCtx is the context of a request authenticated by the auth middleware
+func userCtx(login string) context.Context {
+	return authctx.WithPrincipal(context.Background(), &entity.Principal{Login: login, SessionID: uuid.New()})
+}
 
 func TestHandleUploadingFile_Success(t *testing.T) {
-	ctx := context.Background()
-	token := uuid.New()
-	fileData := []byte("test")
+	ctx := userCtx("owner1")
+	fileData := bytes.NewReader([]byte("test"))
 	doc := entity.Document{
-		Token: token.String(),
-		Name:  "doc.txt",
-		File:  true,
-		Grant: []string{"grantee1", "grantee2"},
+		Name: "doc.txt",
+		File: true,
+		Permissions: []entity.Permission{
+			{Login: "grantee1", Role: entity.RoleViewer},
+			{Login: "grantee2", Role: entity.RoleEditor},
+		},
 	}
 
-	session := new(mockSessionStorage)
 	files := new(mockFileStorage)
+	blobs := new(mockBlobStore)
 	cache := new(mockCache)
 
-	session.On("GetSession", ctx, token).Return("owner1", nil)
 	files.On("SaveDoc", ctx, mock.AnythingOfType("*entity.Document")).Return(nil)
-	files.On("SaveFile", mock.Anything, &fileData).Return(nil)
+	blobs.On("Put", ctx, mock.Anything, mock.Anything).Return(int64(4), nil)
 	cache.On("InvalidateOwnerList", "owner1").Return()
-	cache.On("InvalidateGrant", "owner1", doc.Grant).Return()
+	cache.On("InvalidatePublic", "owner1").Return()
+	cache.On("InvalidateGrant", "owner1", []string{"grantee1", "grantee2"}).Return()
 
-	svc := NewWcsService(session, files, "tmp", cache)
+	svc := NewWcsService(files, blobs, cache, new(mockGroupStorage), ShareLinks{}, false)
 
-	result, err := svc.HandleUploadingFile(ctx, doc, &fileData)
+	result, err := svc.HandleUploadingFile(ctx, doc, fileData)
 	require.NoError(t, err)
 	assert.NotNil(t, result)
 
-	session.AssertExpectations(t)
 	files.AssertExpectations(t)
+	blobs.AssertExpectations(t)
+	cache.AssertExpectations(t)
+}
+
+func TestGetFile_Anonymous(t *testing.T) {
+	files := new(mockFileStorage)
+	svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false)
+
+	_, _, err := svc.GetFile(context.Background(), uuid.New())
+	require.Error(t, err)
+	assert.Equal(t, 401, err.(appError.AppError).Code())
+	files.AssertNotCalled(t, "GetDoc", mock.Anything, mock.Anything)
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	fileId := uuid.New()
+	keyCtx := func(scopes, owners []string) context.Context {
+		return authctx.WithPrincipal(context.Background(), &entity.Principal{
+			Login:  "owner1",
+			ApiKey: &entity.ApiKey{Scopes: scopes, Owners: owners},
+		})
+	}
+
+	t.Run("missing scope", func(t *testing.T) {
+		files := new(mockFileStorage)
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false)
+
+		err := svc.DeleteFile(keyCtx([]string{entity.ScopeDocsRead, entity.ScopeDocsWrite}, nil), fileId)
+		require.Error(t, err)
+		assert.Equal(t, 403, err.(appError.AppError).Code())
+		files.AssertNotCalled(t, "TrashDoc", mock.Anything, mock.Anything)
+	})
+
+	t.Run("owner restriction", func(t *testing.T) {
+		ctx := keyCtx([]string{entity.ScopeDocsRead}, []string{"owner2"})
+		files := new(mockFileStorage)
+		c := new(mockCache)
+		c.On("GetOwner", "owner1", mock.Anything).Return(cache.CachedDocResp{}, false)
+		c.On("SetOwner", "owner1", mock.Anything, mock.Anything).Return()
+		files.On("GetDoc", ctx, fileId).Return(&entity.Document{ID: fileId, Owner: "owner3", Public: true}, nil)
+		svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, false)
+
+		_, _, err := svc.GetFile(ctx, fileId)
+		require.Error(t, err)
+		assert.Equal(t, 403, err.(appError.AppError).Code())
+	})
+}
+
+func TestSearchFiles(t *testing.T) {
+	t.Run("visible documents of the caller", func(t *testing.T) {
+		ctx := userCtx("user1")
+		hits := []*entity.SearchHit{{Document: entity.Document{Name: "contract.txt"}, Headline: "<b>contract</b>.txt"}}
+		files := new(mockFileStorage)
+		files.On("SearchDocs", ctx, "user1", []string(nil), "supply contract", defaultSearchLimit).Return(hits, nil)
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false)
+
+		result, err := svc.SearchFiles(ctx, "  supply contract ", 0)
+		require.NoError(t, err)
+		assert.Equal(t, hits, result)
+		files.AssertExpectations(t)
+	})
+
+	t.Run("api key owners", func(t *testing.T) {
+		ctx := authctx.WithPrincipal(context.Background(), &entity.Principal{
+			Login:  "user1",
+			ApiKey: &entity.ApiKey{Scopes: []string{entity.ScopeDocsRead}, Owners: []string{"owner2"}},
+		})
+		files := new(mockFileStorage)
+		files.On("SearchDocs", ctx, "user1", []string{"owner2"}, "contract", 5).Return([]*entity.SearchHit{}, nil)
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false)
+
+		_, err := svc.SearchFiles(ctx, "contract", 5)
+		require.NoError(t, err)
+		files.AssertExpectations(t)
+	})
+
+	t.Run("bad query", func(t *testing.T) {
+		files := new(mockFileStorage)
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false)
+
+		_, err := svc.SearchFiles(userCtx("user1"), " ", 0)
+		require.Error(t, err)
+		assert.Equal(t, 400, err.(appError.AppError).Code())
+
+		_, err = svc.SearchFiles(userCtx("user1"), "contract", maxSearchLimit+1)
+		require.Error(t, err)
+		assert.Equal(t, 400, err.(appError.AppError).Code())
+		files.AssertNotCalled(t, "SearchDocs", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestUpdateFileMeta(t *testing.T) {
+	ctx := userCtx("owner1")
+	fileId := uuid.New()
+	newName := "renamed.txt"
+	newGrant := []string{"grantee2"}
+
+	t.Run("merge patch", func(t *testing.T) {
+		files := new(mockFileStorage)
+		cache := new(mockCache)
+
+		files.On("GetDoc", ctx, fileId).Return(&entity.Document{
+			ID:     fileId,
+			Name:   "doc.txt",
+			File:   true,
+			Public: true,
+			Mime:   "text/plain",
+			Owner:  "owner1",
+			Permissions: []entity.Permission{
+				{Login: "grantee1", Role: entity.RoleManager},
+			},
+		}, nil)
+		files.On("UpdateDoc", ctx, mock.MatchedBy(func(doc *entity.Document) bool {
+			return doc.Name == newName && doc.Public && doc.Mime == "text/plain"
+		}), "owner1").Return(nil)
+		// legacy grant makes viewers
+		files.On("SetPermissions", ctx, fileId, []entity.Permission{{Login: "grantee2", Role: entity.RoleViewer}}).Return(nil)
+		cache.On("InvalidateOwnerList", mock.Anything).Return()
+		cache.On("InvalidatePublic", mock.Anything).Return()
+		cache.On("InvalidateGrant", "owner1", mock.Anything).Return()
+		cache.On("InvalidateDocs", []uuid.UUID{fileId}).Return()
+
+		svc := NewWcsService(files, new(mockBlobStore), cache, new(mockGroupStorage), ShareLinks{}, false)
+		doc, err := svc.UpdateFileMeta(ctx, fileId, entity.DocumentPatch{
+			Name:  &newName,
+			Grant: &newGrant,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, newName, doc.Name)
+
+		files.AssertExpectations(t)
+		// old and new grantees lose cached entries
+		cache.AssertCalled(t, "InvalidateGrant", "owner1", []string{"grantee1"})
+		cache.AssertCalled(t, "InvalidateGrant", "owner1", newGrant)
+		cache.AssertCalled(t, "InvalidateOwnerList", "grantee1")
+	})
+
+	t.Run("concurrent change", func(t *testing.T) {
+		files := new(mockFileStorage)
+		files.On("GetDoc", ctx, fileId).Return(&entity.Document{ID: fileId, Owner: "owner1", Version: 3}, nil)
+		// the write is guarded by the version which was read
+		files.On("UpdateDoc", ctx, mock.MatchedBy(func(doc *entity.Document) bool {
+			return doc.Version == 3
+		}), "owner1").Return(appError.Conflict("document was changed by another request, read it again"))
+
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false)
+		_, err := svc.UpdateFileMeta(ctx, fileId, entity.DocumentPatch{Name: &newName})
+		require.Error(t, err)
+		assert.Equal(t, 409, err.(appError.AppError).Code())
+		files.AssertExpectations(t)
+	})
+
+	sharedDoc := func() *entity.Document {
+		return &entity.Document{
+			ID:    fileId,
+			Owner: "owner1",
+			Permissions: []entity.Permission{
+				{Login: "viewer1", Role: entity.RoleViewer},
+				{Login: "editor1", Role: entity.RoleEditor},
+			},
+		}
+	}
+
+	t.Run("viewer", func(t *testing.T) {
+		files := new(mockFileStorage)
+
+		ctx := userCtx("viewer1")
+		files.On("GetDoc", ctx, fileId).Return(sharedDoc(), nil)
+
+		svc := NewWcsService(files, new(mockBlobStore), new(mockCache), new(mockGroupStorage), ShareLinks{}, false)
+		_, err := svc.UpdateFileMeta(ctx, fileId, entity.DocumentPatch{Name: &newName})
+		require.Error(t, err)
+		assert.Equal(t, 403, err.(appError.AppError).Code())
+		files.AssertNotCalled(t, "UpdateDoc", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("editor", func(t *testing.T) {
+		files := new(mockFileStorage)
+		cache := new(mockCache)
+
+		ctx := userCtx("editor1")
+		files.On("GetDoc", ctx, fileId).Return(sharedDoc(), nil)
+		// the editor is the author of the version
+		files.On("UpdateDoc", ctx, mock.Anything, "editor1").Return(nil)
+		cache.On("InvalidateOwnerList", mock.Anything).Return()
+		cache.On("InvalidatePublic", mock.Anything).Return()
+		cache.On("InvalidateGrant", "owner1", mock.Anything).Return()
+		cache.On("InvalidateDocs", []uuid.UUID{fileId}).Return()
+
+		svc := NewWcsService(files, new(mockBlobStore), cache, new(mockGroupStorage), ShareLinks{}, false)
+		_, err := svc.UpdateFileMeta(ctx, fileId, entity.DocumentPatch{Name: &newName})
+		require.NoError(t, err)
+		files.AssertExpectations(t)
+
+		// sharing needs the manager role
+		public := true
+		_, err = svc.UpdateFileMeta(ctx, fileId, entity.DocumentPatch{Public: &public})
+		require.Error(t, err)
+		assert.Equal(t, 403, err.(appError.AppError).Code())
+		files.AssertNumberOfCalls(t, "UpdateDoc", 1)
+	})
+}
+
+func TestDeleteFile_MovesToTrash(t *testing.T) {
+	ctx := userCtx("owner1")
+	fileId := uuid.New()
+
+	files := new(mockFileStorage)
+	blobs := new(mockBlobStore)
+	cache := new(mockCache)
+
+	files.On("GetDoc", ctx, fileId).Return(&entity.Document{ID: fileId, File: true, Owner: "owner1"}, nil)
+	files.On("TrashDoc", ctx, fileId).Return(nil)
+	cache.On("InvalidateOwnerList", "owner1").Return()
+	cache.On("InvalidatePublic", "owner1").Return()
+	cache.On("InvalidateGrant", "owner1", mock.Anything).Return()
+	cache.On("InvalidateDocs", []uuid.UUID{fileId}).Return()
+
+	svc := NewWcsService(files, blobs, cache, new(mockGroupStorage), ShareLinks{}, false)
+	require.NoError(t, svc.DeleteFile(ctx, fileId))
+
+	files.AssertExpectations(t)
+	files.AssertNotCalled(t, "DeleteDoc", mock.Anything, mock.Anything)
+	blobs.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	ctx := context.Background()
+	expired := []uuid.UUID{uuid.New(), uuid.New()}
+	trashed := []storage.TrashedDoc{{ID: expired[0]}, {ID: expired[1]}}
+
+	files := new(mockFileStorage)
+	blobs := new(mockBlobStore)
+	cache := new(mockCache)
+
+	files.On("GetExpiredTrash", ctx, mock.AnythingOfType("time.Time"), storage.TrashedDoc{}, purgeBatchSize).Return(trashed, nil).Once()
+	for _, id := range expired {
+		files.On("GetBlobKeys", ctx, id).Return([]string{id.String() + "-v1", id.String() + "-v2"}, nil)
+		files.On("DeleteDoc", ctx, id).Return(nil)
+		blobs.On("Delete", ctx, id.String()+"-v1").Return(nil)
+		blobs.On("Delete", ctx, id.String()+"-v2").Return(nil)
+		cache.On("InvalidateDocs", []uuid.UUID{id}).Return().Once()
+	}
+
+	svc := NewWcsService(files, blobs, cache, new(mockGroupStorage), ShareLinks{}, false)
+	purged, err := svc.PurgeExpiredTrash(ctx, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, len(expired), purged)
+
+	files.AssertExpectations(t)
+	blobs.AssertExpectations(t)
 	cache.AssertExpectations(t)
 }
+
+func TestPurgeExpiredTrash_SkipsFailures(t *testing.T) {
+	ctx := context.Background()
+	deleted := time.Now().Add(-48 * time.Hour)
+	first := make([]storage.TrashedDoc, purgeBatchSize)
+	for i := range first {
+		first[i] = storage.TrashedDoc{ID: uuid.New(), DeletedAt: deleted}
+	}
+	second := []storage.TrashedDoc{{ID: uuid.New(), DeletedAt: deleted}}
+	broken := first[0].ID
+
+	files := new(mockFileStorage)
+	blobs := new(mockBlobStore)
+	cache := new(mockCache)
+
+	// the next batch starts after the last document, the failed one isn't read again
+	files.On("GetExpiredTrash", ctx, mock.AnythingOfType("time.Time"), storage.TrashedDoc{}, purgeBatchSize).Return(first, nil).Once()
+	files.On("GetExpiredTrash", ctx, mock.AnythingOfType("time.Time"), first[len(first)-1], purgeBatchSize).Return(second, nil).Once()
+	files.On("GetBlobKeys", ctx, broken).Return([]string(nil), appError.Internal())
+	for _, doc := range append(first[1:], second...) {
+		files.On("GetBlobKeys", ctx, doc.ID).Return([]string{}, nil)
+		files.On("DeleteDoc", ctx, doc.ID).Return(nil)
+		cache.On("InvalidateDocs", []uuid.UUID{doc.ID}).Return()
+	}
+
+	svc := NewWcsService(files, blobs, cache, new(mockGroupStorage), ShareLinks{}, false)
+	purged, err := svc.PurgeExpiredTrash(ctx, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, purgeBatchSize, purged)
+
+	files.AssertExpectations(t)
+	files.AssertNotCalled(t, "DeleteDoc", ctx, broken)
+}
+
+func TestGetFile_CacheDependencies(t *testing.T) {
+	ownerCtx := userCtx("owner1")
+	fileId := uuid.New()
+	shared := func() *entity.Document {
+		return &entity.Document{ID: fileId, Owner: "owner1", Permissions: []entity.Permission{{Login: "grantee1", Role: entity.RoleViewer}}}
+	}
+
+	t.Run("revoke during the read", func(t *testing.T) {
+		ctx := userCtx("grantee1")
+		c := cache.NewStructuredCache(1<<20, time.Minute)
+		files := new(mockFileStorage)
+		svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, false)
+
+		files.On("GetDoc", ownerCtx, fileId).Return(shared(), nil)
+		files.On("SetPermissions", ownerCtx, fileId, []entity.Permission{}).Return(nil).Once()
+		// the grantee reads the document, the owner revokes access before it is cached
+		files.On("GetDoc", ctx, fileId).Return(shared(), nil).Run(func(mock.Arguments) {
+			_, err := svc.UpdateFileMeta(ownerCtx, fileId, entity.DocumentPatch{Permissions: &[]entity.Permission{}})
+			require.NoError(t, err)
+		}).Once()
+		files.On("GetDoc", ctx, fileId).Return(&entity.Document{ID: fileId, Owner: "owner1"}, nil).Once()
+
+		_, _, err := svc.GetFile(ctx, fileId)
+		require.NoError(t, err)
+
+		// the response read before the revoke is not served
+		_, _, err = svc.GetFile(ctx, fileId)
+		require.Error(t, err)
+		assert.Equal(t, 403, err.(appError.AppError).Code())
+		files.AssertExpectations(t)
+	})
+
+	t.Run("revoke after the read", func(t *testing.T) {
+		ctx := userCtx("grantee1")
+		c := cache.NewStructuredCache(1<<20, time.Minute)
+		files := new(mockFileStorage)
+		svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, false)
+
+		files.On("GetDoc", ctx, fileId).Return(shared(), nil).Once()
+		_, _, err := svc.GetFile(ctx, fileId)
+		require.NoError(t, err)
+		_, _, err = svc.GetFile(ctx, fileId)
+		require.NoError(t, err)
+
+		files.On("GetDoc", ownerCtx, fileId).Return(shared(), nil).Once()
+		files.On("SetPermissions", ownerCtx, fileId, []entity.Permission{}).Return(nil).Once()
+		_, err = svc.UpdateFileMeta(ownerCtx, fileId, entity.DocumentPatch{Permissions: &[]entity.Permission{}})
+		require.NoError(t, err)
+
+		files.On("GetDoc", ctx, fileId).Return(&entity.Document{ID: fileId, Owner: "owner1"}, nil).Once()
+		_, _, err = svc.GetFile(ctx, fileId)
+		require.Error(t, err)
+		assert.Equal(t, 403, err.(appError.AppError).Code())
+		files.AssertExpectations(t)
+	})
+
+	t.Run("deleted document of another viewer", func(t *testing.T) {
+		// viewers of public documents are not grantees, their entries go by the document
+		ctx := userCtx("viewer1")
+		c := cache.NewStructuredCache(1<<20, time.Minute)
+		files := new(mockFileStorage)
+		svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, false)
+
+		files.On("GetDoc", ctx, fileId).Return(&entity.Document{ID: fileId, Owner: "owner1", Public: true}, nil).Once()
+		_, _, err := svc.GetFile(ctx, fileId)
+		require.NoError(t, err)
+
+		files.On("GetDoc", ownerCtx, fileId).Return(&entity.Document{ID: fileId, Owner: "owner1", Public: true}, nil).Once()
+		files.On("TrashDoc", ownerCtx, fileId).Return(nil).Once()
+		require.NoError(t, svc.DeleteFile(ownerCtx, fileId))
+
+		files.On("GetDoc", ctx, fileId).Return((*entity.Document)(nil), appError.NotFound()).Once()
+		_, _, err = svc.GetFile(ctx, fileId)
+		require.Error(t, err)
+		assert.Equal(t, 404, err.(appError.AppError).Code())
+		files.AssertExpectations(t)
+	})
+
+	t.Run("read during the delete", func(t *testing.T) {
+		ctx := userCtx("viewer1")
+		c := cache.NewStructuredCache(1<<20, time.Minute)
+		files := new(mockFileStorage)
+		svc := NewWcsService(files, new(mockBlobStore), c, new(mockGroupStorage), ShareLinks{}, false)
+		public := func() *entity.Document {
+			return &entity.Document{ID: fileId, Owner: "owner1", Public: true}
+		}
+
+		// the viewer reads the document before the trash is committed
+		files.On("GetDoc", ownerCtx, fileId).Return(public(), nil).Once()
+		files.On("GetDoc", ctx, fileId).Return(public(), nil).Once()
+		files.On("TrashDoc", ownerCtx, fileId).Return(nil).Run(func(mock.Arguments) {
+			_, _, err := svc.GetFile(ctx, fileId)
+			require.NoError(t, err)
+		}).Once()
+		require.NoError(t, svc.DeleteFile(ownerCtx, fileId))
+
+		// the response read before the commit is not served
+		files.On("GetDoc", ctx, fileId).Return((*entity.Document)(nil), appError.NotFound()).Once()
+		_, _, err := svc.GetFile(ctx, fileId)
+		require.Error(t, err)
+		assert.Equal(t, 404, err.(appError.AppError).Code())
+		files.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage"
+	"AstralTest/pkg/appError"
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// purgeBatchSize limits the number of documents purged by one query
+const purgeBatchSize = 100
+
+func (wc *wcs) GetTrash(ctx context.Context) ([]*entity.Document, error) {
+	userLogin, err := ownUser(ctx, entity.ScopeDocsRead)
+	if err != nil {
+		return nil, err
+	}
+	return wc.fileStorage.GetTrash(ctx, userLogin)
+}
+
+func (wc *wcs) RestoreFile(ctx context.Context, fileId uuid.UUID) error {
+	doc, err := wc.getOwnTrashedDoc(ctx, entity.ScopeDocsWrite, fileId)
+	if err != nil {
+		return err
+	}
+
+	if err := wc.fileStorage.RestoreDoc(ctx, fileId); err != nil {
+		return err
+	}
+
+	wc.invalidateDoc(ctx, doc, doc.Grantees())
+	return nil
+}
+
+func (wc *wcs) PurgeFile(ctx context.Context, fileId uuid.UUID) error {
+	if _, err := wc.getOwnTrashedDoc(ctx, entity.ScopeDocsDelete, fileId); err != nil {
+		return err
+	}
+	return wc.purgeDoc(ctx, fileId)
+}
+
+func (wc *wcs) EmptyTrash(ctx context.Context) (int, error) {
+	userLogin, err := ownUser(ctx, entity.ScopeDocsDelete)
+	if err != nil {
+		return 0, err
+	}
+
+	docs, err := wc.fileStorage.GetTrash(ctx, userLogin)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, doc := range docs {
+		if err := wc.purgeDoc(ctx, doc.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(docs), nil
+}
+
+func (wc *wcs) PurgeExpiredTrash(ctx context.Context, retention time.Duration) (int, error) {
+	before := time.Now().Add(-retention)
+	purged := 0
+	// a document which fails is skipped, so it doesn't block the rest
+	var last storage.TrashedDoc
+	for {
+		docs, err := wc.fileStorage.GetExpiredTrash(ctx, before, last, purgeBatchSize)
+		if err != nil {
+			return purged, err
+		}
+		for _, doc := range docs {
+			if err := ctx.Err(); err != nil {
+				return purged, err
+			}
+			if err := wc.purgeDoc(ctx, doc.ID); err != nil {
+				log.Printf("[PurgeExpiredTrash] can't purge %s: %v", doc.ID, err)
+				continue
+			}
+			purged++
+		}
+		if len(docs) < purgeBatchSize {
+			return purged, nil
+		}
+		last = docs[len(docs)-1]
+	}
+}
+
+// getOwnTrashedDoc returns the document from the trash if the caller is its owner and has the scope
+func (wc *wcs) getOwnTrashedDoc(ctx context.Context, scope string, fileId uuid.UUID) (*entity.Document, error) {
+	userLogin, err := ownUser(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := wc.fileStorage.GetTrashedDoc(ctx, fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.Owner != userLogin {
+		return nil, appError.Forbidden()
+	}
+	return doc, nil
+}
+
+// purgeDoc deletes the document with all its versions and blobs
+func (wc *wcs) purgeDoc(ctx context.Context, fileId uuid.UUID) error {
+	// versions can share blobs, so collect all of them before the rows are gone
+	blobKeys, err := wc.fileStorage.GetBlobKeys(ctx, fileId)
+	if err != nil {
+		return err
+	}
+
+	if err := wc.fileStorage.DeleteDoc(ctx, fileId); err != nil {
+		return err
+	}
+	wc.cache.InvalidateDocs(fileId)
+
+	for _, key := range blobKeys {
+		if err := wc.blobStore.Delete(ctx, key); err != nil {
+			log.Printf("[purgeDoc] can't delete blob %s of %s: %v", key, fileId, err)
+		}
+	}
+	return nil
+}
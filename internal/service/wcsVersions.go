@@ -0,0 +1,190 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+func (wc *wcs) GetVersions(ctx context.Context, fileId uuid.UUID) ([]*entity.Document, error) {
+	if _, _, err := wc.getDocFor(ctx, ActionRead, fileId); err != nil {
+		return nil, err
+	}
+	return wc.fileStorage.GetVersions(ctx, fileId)
+}
+
+func (wc *wcs) GetFileVersion(ctx context.Context, fileId uuid.UUID, version int) (*entity.Document, io.ReadSeekCloser, error) {
+	if _, _, err := wc.getDocFor(ctx, ActionRead, fileId); err != nil {
+		return nil, nil, err
+	}
+
+	document, err := wc.fileStorage.GetVersion(ctx, fileId, version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, err := wc.openContent(ctx, document)
+	if err != nil {
+		return nil, nil, err
+	}
+	return document, content, nil
+}
+
+// RestoreVersion makes a copy of the old version the new current one,
+// history is never rewritten
+func (wc *wcs) RestoreVersion(ctx context.Context, fileId uuid.UUID, version int) (*entity.Document, error) {
+	doc, userLogin, err := wc.getDocFor(ctx, ActionUpdate, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Version == version {
+		return nil, appError.BadRequest("version is already current")
+	}
+
+	old, err := wc.fileStorage.GetVersion(ctx, fileId, version)
+	if err != nil {
+		return nil, err
+	}
+	// versions are immutable, so restored version shares the blob with the old one.
+	// Access (public, permissions) is not restored, it can't be changed by editors
+	doc.Name = old.Name
+	doc.Mime = old.Mime
+	doc.JsonData = old.JsonData
+	doc.Hash = old.Hash
+	doc.Size = old.Size
+	doc.BlobKey = old.BlobKey
+	if doc.File {
+		// versions don't keep extracted text, it is read again from the blob
+		if doc.ContentText, err = wc.blobText(ctx, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := wc.fileStorage.UpdateDoc(ctx, doc, userLogin); err != nil {
+		return nil, err
+	}
+	wc.invalidateDoc(ctx, doc, doc.Grantees())
+
+	return doc, nil
+}
+
+// DiffVersions compares json data of two versions
+func (wc *wcs) DiffVersions(ctx context.Context, fileId uuid.UUID, from, to int) ([]entity.JsonChange, error) {
+	if _, _, err := wc.getDocFor(ctx, ActionRead, fileId); err != nil {
+		return nil, err
+	}
+
+	fromDoc, err := wc.fileStorage.GetVersion(ctx, fileId, from)
+	if err != nil {
+		return nil, err
+	}
+	toDoc, err := wc.fileStorage.GetVersion(ctx, fileId, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffJson(fromDoc.JsonData, toDoc.JsonData)
+}
+
+// diffJson returns changes between two json values,
+// missing json is compared as null
+func diffJson(from, to json.RawMessage) ([]entity.JsonChange, error) {
+	fromValue, err := decodeJson(from)
+	if err != nil {
+		return nil, appError.Internal()
+	}
+	toValue, err := decodeJson(to)
+	if err != nil {
+		return nil, appError.Internal()
+	}
+
+	changes := []entity.JsonChange{}
+	diffValues("", fromValue, toValue, &changes)
+	return changes, nil
+}
+
+func decodeJson(data json.RawMessage) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// keep numbers as is, so 1 and 1.0 are not equal after float conversion
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func diffValues(path string, from, to interface{}, changes *[]entity.JsonChange) {
+	switch fromTyped := from.(type) {
+	case map[string]interface{}:
+		toTyped, ok := to.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(fromTyped)+len(toTyped))
+		for key := range fromTyped {
+			keys = append(keys, key)
+		}
+		for key := range toTyped {
+			if _, ok := fromTyped[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			keyPath := path + "/" + escapePointer(key)
+			fromValue, inFrom := fromTyped[key]
+			toValue, inTo := toTyped[key]
+			switch {
+			case !inFrom:
+				*changes = append(*changes, entity.JsonChange{Path: keyPath, Op: "added", To: toValue})
+			case !inTo:
+				*changes = append(*changes, entity.JsonChange{Path: keyPath, Op: "removed", From: fromValue})
+			default:
+				diffValues(keyPath, fromValue, toValue, changes)
+			}
+		}
+		return
+
+	case []interface{}:
+		toTyped, ok := to.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(fromTyped) || i < len(toTyped); i++ {
+			indexPath := fmt.Sprintf("%s/%d", path, i)
+			switch {
+			case i >= len(fromTyped):
+				*changes = append(*changes, entity.JsonChange{Path: indexPath, Op: "added", To: toTyped[i]})
+			case i >= len(toTyped):
+				*changes = append(*changes, entity.JsonChange{Path: indexPath, Op: "removed", From: fromTyped[i]})
+			default:
+				diffValues(indexPath, fromTyped[i], toTyped[i], changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, entity.JsonChange{Path: path, Op: "changed", From: from, To: to})
+	}
+}
+
+// escapePointer escapes key for JSON Pointer (RFC 6901)
+func escapePointer(key string) string {
+	key = strings.ReplaceAll(key, "~", "~0")
+	return strings.ReplaceAll(key, "/", "~1")
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"AstralTest/internal/models/entity"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffJson(t *testing.T) {
+	from := json.RawMessage(`{"a": 1, "b": {"c": "x", "d/e": true}, "list": [1, 2, 3]}`)
+	to := json.RawMessage(`{"a": 1.0, "b": {"c": "y"}, "list": [1, 2], "new": null}`)
+
+	changes, err := diffJson(from, to)
+	require.NoError(t, err)
+
+	assert.Equal(t, []entity.JsonChange{
+		{Path: "/a", Op: "changed", From: json.Number("1"), To: json.Number("1.0")},
+		{Path: "/b/c", Op: "changed", From: "x", To: "y"},
+		{Path: "/b/d~1e", Op: "removed", From: true},
+		{Path: "/list/2", Op: "removed", From: json.Number("3")},
+		{Path: "/new", Op: "added"},
+	}, changes)
+
+	changes, err = diffJson(from, from)
+	require.NoError(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestRestoreVersion(t *testing.T) {
+	ctx := userCtx("owner1")
+	fileId := uuid.New()
+
+	files := new(mockFileStorage)
+	cache := new(mockCache)
+
+	files.On("GetDoc", ctx, fileId).Return(&entity.Document{
+		ID:      fileId,
+		Name:    "new.txt",
+		File:    true,
+		Owner:   "owner1",
+		Hash:    "newhash",
+		BlobKey: "newblob",
+		Version: 3,
+	}, nil)
+	files.On("GetVersion", ctx, fileId, 1).Return(&entity.Document{
+		ID:      fileId,
+		Name:    "old.txt",
+		File:    true,
+		Owner:   "owner1",
+		Hash:    "oldhash",
+		BlobKey: "oldblob",
+		Version: 1,
+	}, nil)
+	files.On("UpdateDoc", ctx, mock.MatchedBy(func(doc *entity.Document) bool {
+		return doc.Name == "old.txt" && doc.BlobKey == "oldblob" && doc.Hash == "oldhash" &&
+			doc.ContentText != nil && *doc.ContentText == "old text"
+	}), "owner1").Return(nil)
+	cache.On("InvalidateOwnerList", "owner1").Return()
+	cache.On("InvalidatePublic", "owner1").Return()
+	cache.On("InvalidateGrant", "owner1", mock.Anything).Return()
+	cache.On("InvalidateDocs", []uuid.UUID{fileId}).Return()
+	// text of the restored content is extracted again
+	blobs := new(mockBlobStore)
+	blobs.On("Get", ctx, "oldblob").Return(nopReadSeekCloser{strings.NewReader("old text")}, nil, nil)
+
+	svc := NewWcsService(files, blobs, cache, new(mockGroupStorage), ShareLinks{}, false)
+	doc, err := svc.RestoreVersion(ctx, fileId, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "old.txt", doc.Name)
+
+	files.AssertExpectations(t)
+	blobs.AssertExpectations(t)
+}
+
+type nopReadSeekCloser struct{ io.ReadSeeker }
+
+func (nopReadSeekCloser) Close() error { return nil }
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage/postgres"
+	"AstralTest/pkg/appError"
+	"context"
+	"errors"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type ApiKeyStorage interface {
+	// CreateApiKey stores the key with hash of its secret, sets key.Created
+	CreateApiKey(ctx context.Context, key *entity.ApiKey, keyHash string) error
+	// GetApiKey returns not expired key by hash of its secret and marks it as used
+	GetApiKey(ctx context.Context, keyHash string) (*entity.ApiKey, error)
+	ListApiKeys(ctx context.Context, login string) ([]*entity.ApiKey, error)
+	DeleteApiKey(ctx context.Context, login string, id uuid.UUID) error
+}
+
+func NewApiKeyStorage(pool postgres.DBPool) ApiKeyStorage {
+	return &auth{
+		pool: pool,
+	}
+}
+
+const apiKeySelect = `select id, login, name, prefix, scopes, coalesce(owners, '{}'), expires_at, created, last_used
+				from api_keys`
+
+func scanApiKey(row pgx.Row) (*entity.ApiKey, error) {
+	var key entity.ApiKey
+	err := row.Scan(
+		&key.ID,
+		&key.Login,
+		&key.Name,
+		&key.Prefix,
+		&key.Scopes,
+		&key.Owners,
+		&key.Expires,
+		&key.Created,
+		&key.LastUsed,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (a *auth) CreateApiKey(ctx context.Context, key *entity.ApiKey, keyHash string) error {
+	query := `insert into api_keys(id, login, name, prefix, key_hash, scopes, owners, expires_at)
+				values($1, $2, $3, $4, $5, $6, $7, $8)
+				returning created`
+
+	err := a.pool.QueryRow(ctx, query,
+		key.ID,
+		key.Login,
+		key.Name,
+		key.Prefix,
+		keyHash,
+		key.Scopes,
+		key.Owners,
+		key.Expires,
+	).Scan(&key.Created)
+	if err != nil {
+		log.Println("[CreateApiKey] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+func (a *auth) GetApiKey(ctx context.Context, keyHash string) (*entity.ApiKey, error) {
+	query := `update api_keys
+				set last_used = NOW()
+				where key_hash = $1 and (expires_at is null or expires_at > NOW())
+				returning id, login, name, prefix, scopes, coalesce(owners, '{}'), expires_at, created, last_used`
+
+	key, err := scanApiKey(a.pool.QueryRow(ctx, query, keyHash))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, appError.Unauthorized()
+		}
+		log.Println("[GetApiKey] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	return key, nil
+}
+
+func (a *auth) ListApiKeys(ctx context.Context, login string) ([]*entity.ApiKey, error) {
+	query := apiKeySelect + `
+				where login = $1
+				order by created desc`
+
+	rows, err := a.pool.Query(ctx, query, login)
+	if err != nil {
+		log.Println("[ListApiKeys] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	keys := []*entity.ApiKey{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			log.Println("[ListApiKeys] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return keys, nil
+}
+
+func (a *auth) DeleteApiKey(ctx context.Context, login string, id uuid.UUID) error {
+	query := `delete from api_keys
+				where id = $1 and login = $2`
+	tag, err := a.pool.Exec(ctx, query, id, login)
+	if err != nil {
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
+	return nil
+}
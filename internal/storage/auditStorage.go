@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"AstralTest/internal/auditchain"
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage/postgres"
+	"AstralTest/pkg/appError"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type audit struct {
+	pool postgres.DBPool
+}
+
+// AuditQuery selects records of the audit log, empty fields match everything
+type AuditQuery struct {
+	Actor  string
+	Action string
+	DocID  *uuid.UUID
+	// DocOwner limits records to documents of the owner
+	DocOwner string
+	From     time.Time
+	To       time.Time
+	// Before is the id of the last record of the previous page, records go newest first
+	Before int64
+	// Limit 0 means all records
+	Limit int
+}
+
+type AuditStorage interface {
+	// AppendAudit stores the record, sets entry.ID and entry.Time
+	AppendAudit(ctx context.Context, entry *entity.AuditEntry) error
+	QueryAudit(ctx context.Context, q AuditQuery) ([]*entity.AuditEntry, error)
+	// ExportAudit streams records to fn without keeping them in memory
+	ExportAudit(ctx context.Context, q AuditQuery, fn func(*entity.AuditEntry) error) error
+	// WalkAudit streams all records to fn from the first one
+	WalkAudit(ctx context.Context, fn func(*entity.AuditEntry) error) error
+	// LastAudit returns the newest record, nil if the log is empty
+	LastAudit(ctx context.Context) (*entity.AuditEntry, error)
+
+	// AddCheckpoint stores the signed checkpoint, sets cp.ID
+	AddCheckpoint(ctx context.Context, cp *entity.AuditCheckpoint) error
+	// LastCheckpoint returns the newest checkpoint, nil if there is none
+	LastCheckpoint(ctx context.Context) (*entity.AuditCheckpoint, error)
+	GetCheckpoints(ctx context.Context) ([]*entity.AuditCheckpoint, error)
+}
+
+func NewAuditStorage(pool postgres.DBPool) AuditStorage {
+	return &audit{
+		pool: pool,
+	}
+}
+
+// auditLockKey serializes appends, each record needs the hash of the previous one
+const auditLockKey = 7210001
+
+func (a *audit) AppendAudit(ctx context.Context, entry *entity.AuditEntry) error {
+	tx, err := a.pool.Begin(ctx)
+	if err != nil {
+		log.Println("[AppendAudit] error: ", err.Error())
+		return appError.Internal()
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `select pg_advisory_xact_lock($1)`, auditLockKey); err != nil {
+		log.Println("[AppendAudit] error: ", err.Error())
+		return appError.Internal()
+	}
+
+	// owner is taken while the document exists, so its records stay visible to the owner
+	if entry.DocOwner == "" && entry.DocID != nil {
+		err := tx.QueryRow(ctx, `select owner_login from docs where id = $1`, *entry.DocID).Scan(&entry.DocOwner)
+		if err != nil && err != pgx.ErrNoRows {
+			log.Println("[AppendAudit] error: ", err.Error())
+			return appError.Internal()
+		}
+	}
+
+	query := `select nextval('audit_log_id_seq'),
+					coalesce((select hash from audit_log order by id desc limit 1), '')`
+	if err := tx.QueryRow(ctx, query).Scan(&entry.ID, &entry.PrevHash); err != nil {
+		log.Println("[AppendAudit] error: ", err.Error())
+		return appError.Internal()
+	}
+	entry.Time = auditchain.Now()
+	entry.Hash = auditchain.Hash(entry)
+
+	query = `insert into audit_log(id, at, actor, action, doc_id, doc_owner, target, ip, user_agent, result, prev_hash, hash)
+				values($1, $2, nullif($3, ''), $4, $5, nullif($6, ''), nullif($7, ''), nullif($8, ''), nullif($9, ''), $10, $11, $12)`
+	_, err = tx.Exec(ctx, query,
+		entry.ID,
+		entry.Time,
+		entry.Actor,
+		entry.Action,
+		entry.DocID,
+		entry.DocOwner,
+		entry.Target,
+		entry.IP,
+		entry.UserAgent,
+		entry.Result,
+		entry.PrevHash,
+		entry.Hash,
+	)
+	if err != nil {
+		log.Println("[AppendAudit] error: ", err.Error())
+		return appError.Internal()
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		log.Println("[AppendAudit] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+func (a *audit) QueryAudit(ctx context.Context, q AuditQuery) ([]*entity.AuditEntry, error) {
+	entries := []*entity.AuditEntry{}
+	err := a.ExportAudit(ctx, q, func(entry *entity.AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (a *audit) ExportAudit(ctx context.Context, q AuditQuery, fn func(*entity.AuditEntry) error) error {
+	where := "true"
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		where += fmt.Sprintf(" and "+condition, len(args))
+	}
+	if q.Actor != "" {
+		add("actor = $%d", q.Actor)
+	}
+	if q.Action != "" {
+		add("action = $%d", q.Action)
+	}
+	if q.DocID != nil {
+		add("doc_id = $%d", *q.DocID)
+	}
+	if q.DocOwner != "" {
+		add("doc_owner = $%d", q.DocOwner)
+	}
+	if !q.From.IsZero() {
+		add("at >= $%d", q.From)
+	}
+	if !q.To.IsZero() {
+		add("at < $%d", q.To)
+	}
+	if q.Before > 0 {
+		add("id < $%d", q.Before)
+	}
+	query := auditSelect + ` where ` + where + ` order by id desc`
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf(" limit $%d", len(args))
+	}
+	return a.queryAudit(ctx, "ExportAudit", fn, query, args...)
+}
+
+func (a *audit) WalkAudit(ctx context.Context, fn func(*entity.AuditEntry) error) error {
+	return a.queryAudit(ctx, "WalkAudit", fn, auditSelect+` order by id`)
+}
+
+func (a *audit) LastAudit(ctx context.Context) (*entity.AuditEntry, error) {
+	entry, err := scanAuditEntry(a.pool.QueryRow(ctx, auditSelect+` order by id desc limit 1`))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		log.Println("[LastAudit] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	return entry, nil
+}
+
+const auditSelect = `select id, at, coalesce(actor, ''), action, doc_id, coalesce(doc_owner, ''),
+					coalesce(target, ''), coalesce(ip, ''), coalesce(user_agent, ''), result, prev_hash, hash
+				from audit_log`
+
+func (a *audit) queryAudit(ctx context.Context, caller string, fn func(*entity.AuditEntry) error, query string, args ...interface{}) error {
+	rows, err := a.pool.Query(ctx, query, args...)
+	if err != nil {
+		log.Println("["+caller+"] error: ", err.Error())
+		return appError.Internal()
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			log.Println("["+caller+"] error: ", err.Error())
+			return appError.Internal()
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	if rows.Err() != nil {
+		log.Println("["+caller+"] error: ", rows.Err().Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+func scanAuditEntry(row pgx.Row) (*entity.AuditEntry, error) {
+	var entry entity.AuditEntry
+	err := row.Scan(
+		&entry.ID,
+		&entry.Time,
+		&entry.Actor,
+		&entry.Action,
+		&entry.DocID,
+		&entry.DocOwner,
+		&entry.Target,
+		&entry.IP,
+		&entry.UserAgent,
+		&entry.Result,
+		&entry.PrevHash,
+		&entry.Hash,
+	)
+	if err != nil {
+		return nil, err
+	}
+	// timestamps are stored in UTC
+	entry.Time = entry.Time.UTC()
+	return &entry, nil
+}
+
+func (a *audit) AddCheckpoint(ctx context.Context, cp *entity.AuditCheckpoint) error {
+	query := `insert into audit_checkpoints(entry_id, entry_hash, at, signature)
+				values($1, $2, $3, $4)
+				returning id`
+
+	err := a.pool.QueryRow(ctx, query, cp.EntryID, cp.EntryHash, cp.Time, cp.Signature).Scan(&cp.ID)
+	if err != nil {
+		log.Println("[AddCheckpoint] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+const checkpointSelect = `select id, entry_id, entry_hash, at, signature from audit_checkpoints`
+
+func scanCheckpoint(row pgx.Row) (*entity.AuditCheckpoint, error) {
+	var cp entity.AuditCheckpoint
+	if err := row.Scan(&cp.ID, &cp.EntryID, &cp.EntryHash, &cp.Time, &cp.Signature); err != nil {
+		return nil, err
+	}
+	cp.Time = cp.Time.UTC()
+	return &cp, nil
+}
+
+func (a *audit) LastCheckpoint(ctx context.Context) (*entity.AuditCheckpoint, error) {
+	cp, err := scanCheckpoint(a.pool.QueryRow(ctx, checkpointSelect+` order by id desc limit 1`))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		log.Println("[LastCheckpoint] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	return cp, nil
+}
+
+func (a *audit) GetCheckpoints(ctx context.Context) ([]*entity.AuditCheckpoint, error) {
+	rows, err := a.pool.Query(ctx, checkpointSelect+` order by id`)
+	if err != nil {
+		log.Println("[GetCheckpoints] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	checkpoints := []*entity.AuditCheckpoint{}
+	for rows.Next() {
+		cp, err := scanCheckpoint(rows)
+		if err != nil {
+			log.Println("[GetCheckpoints] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return checkpoints, nil
+}
@@ -6,6 +6,7 @@ import (
 	"AstralTest/pkg/appError"
 	"context"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -14,11 +15,25 @@ import (
 
 type auth struct {
 	pool postgres.DBPool
+	// session expires sessionTTL after creation
+	// or sessionIdleTTL after the last request
+	sessionTTL     time.Duration
+	sessionIdleTTL time.Duration
 }
 
 type UserStorage interface {
+	// AddUser stores the user with user.Role, sets user.Created
 	AddUser(ctx context.Context, user *entity.User) error
 	GetUser(ctx context.Context, login string) (*entity.User, error)
+	ListUsers(ctx context.Context) ([]*entity.User, error)
+	SetUserRole(ctx context.Context, login string, role entity.UserRole) error
+	SetUserDisabled(ctx context.Context, login string, disabled bool) error
+	SetUserCanInvite(ctx context.Context, login string, canInvite bool) error
+	SetPassword(ctx context.Context, login, passwordHash string) error
+	// CountAdmins counts admins which are not disabled
+	CountAdmins(ctx context.Context) (int, error)
+	// DeleteUser fails while the user owns documents
+	DeleteUser(ctx context.Context, login string) error
 }
 
 func NewUserStorage(pool postgres.DBPool) UserStorage {
@@ -28,22 +43,38 @@ func NewUserStorage(pool postgres.DBPool) UserStorage {
 }
 
 type SessionStorage interface {
-	CreateSession(ctx context.Context, login string) (*uuid.UUID, error)
+	CreateSession(ctx context.Context, login string, client entity.ClientInfo) (*uuid.UUID, error)
+	// GetSession returns login of the active session and prolongs it
 	GetSession(ctx context.Context, sessionId uuid.UUID) (string, error)
-	DeleteSession(ctx context.Context, token uuid.UUID) error
+	// DeleteSession returns login of the deleted session, empty if there was none
+	DeleteSession(ctx context.Context, token uuid.UUID) (string, error)
+
+	// ListSessions returns active sessions of the user, current token is marked
+	ListSessions(ctx context.Context, login string, current uuid.UUID) ([]entity.Session, error)
+	// DeleteSessionById deletes session by its public id
+	DeleteSessionById(ctx context.Context, login string, id uuid.UUID) error
+	DeleteUserSessions(ctx context.Context, login string) (int64, error)
+	DeleteExpiredSessions(ctx context.Context) (int64, error)
 }
 
-func NewSessionStorage(pool postgres.DBPool) SessionStorage {
+func NewSessionStorage(pool postgres.DBPool, sessionTTL, sessionIdleTTL time.Duration) SessionStorage {
 	return &auth{
-		pool: pool,
+		pool:           pool,
+		sessionTTL:     sessionTTL,
+		sessionIdleTTL: sessionIdleTTL,
 	}
 }
 
+// sessionActive is the sql condition for not expired sessions,
+// $1 and $2 are absolute and idle TTL in seconds
+const sessionActive = `created > NOW() - make_interval(secs => $1) and last_seen > NOW() - make_interval(secs => $2)`
+
 func (a *auth) AddUser(ctx context.Context, user *entity.User) error {
-	query := `insert into users(login, password)
-				values($1, $2)`
+	query := `insert into users(login, password, role)
+				values($1, $2, $3)
+				returning created`
 
-	_, err := a.pool.Exec(ctx, query, user.Login, user.PasswordHash)
+	err := a.pool.QueryRow(ctx, query, user.Login, user.PasswordHash, user.Role).Scan(&user.Created)
 	if err != nil {
 		if pgErr, ok := err.(*pgconn.PgError); ok {
 			if pgErr.Code == "23505" {
@@ -59,12 +90,20 @@ func (a *auth) AddUser(ctx context.Context, user *entity.User) error {
 	return nil
 }
 
-func (a *auth) GetUser(ctx context.Context, login string) (*entity.User, error) {
-	query := `select login, password
-				from users
-				where login = $1`
+const userSelect = `select login, password, role, disabled_at is not null, can_invite, created
+			from users`
+
+func scanUser(row pgx.Row) (*entity.User, error) {
 	var user entity.User
-	err := a.pool.QueryRow(ctx, query, login).Scan(&user.Login, &user.PasswordHash)
+	err := row.Scan(&user.Login, &user.PasswordHash, &user.Role, &user.Disabled, &user.CanInvite, &user.Created)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (a *auth) GetUser(ctx context.Context, login string) (*entity.User, error) {
+	user, err := scanUser(a.pool.QueryRow(ctx, userSelect+` where login = $1`, login))
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, appError.Unauthorized()
@@ -72,15 +111,96 @@ func (a *auth) GetUser(ctx context.Context, login string) (*entity.User, error)
 		return nil, appError.Internal()
 	}
 
-	return &user, nil
+	return user, nil
+}
+
+func (a *auth) ListUsers(ctx context.Context) ([]*entity.User, error) {
+	rows, err := a.pool.Query(ctx, userSelect+` order by login`)
+	if err != nil {
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	users := []*entity.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, appError.Internal()
+		}
+		// hashes are not shown
+		user.PasswordHash = ""
+		users = append(users, user)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return users, nil
+}
+
+func (a *auth) SetUserRole(ctx context.Context, login string, role entity.UserRole) error {
+	return a.updateUser(ctx, `update users set role = $2 where login = $1`, login, role)
+}
+
+func (a *auth) SetUserDisabled(ctx context.Context, login string, disabled bool) error {
+	query := `update users
+				set disabled_at = case when $2 then coalesce(disabled_at, NOW()) end
+				where login = $1`
+	return a.updateUser(ctx, query, login, disabled)
+}
+
+func (a *auth) SetUserCanInvite(ctx context.Context, login string, canInvite bool) error {
+	return a.updateUser(ctx, `update users set can_invite = $2 where login = $1`, login, canInvite)
+}
+
+func (a *auth) SetPassword(ctx context.Context, login, passwordHash string) error {
+	return a.updateUser(ctx, `update users set password = $2 where login = $1`, login, passwordHash)
 }
 
-func (a *auth) CreateSession(ctx context.Context, login string) (*uuid.UUID, error) {
-	query := `insert into sessions(login)
-				values($1)
+func (a *auth) updateUser(ctx context.Context, query string, args ...interface{}) error {
+	tag, err := a.pool.Exec(ctx, query, args...)
+	if err != nil {
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
+	return nil
+}
+
+func (a *auth) CountAdmins(ctx context.Context) (int, error) {
+	query := `select count(*)
+				from users
+				where role = 'admin' and disabled_at is null`
+
+	var count int
+	if err := a.pool.QueryRow(ctx, query).Scan(&count); err != nil {
+		return 0, appError.Internal()
+	}
+	return count, nil
+}
+
+// DeleteUser deletes the user with sessions, api keys, groups, permissions
+// and share links, documents restrict the deletion
+func (a *auth) DeleteUser(ctx context.Context, login string) error {
+	tag, err := a.pool.Exec(ctx, `delete from users where login = $1`, login)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23503" {
+			return appError.BadRequest("user still owns documents")
+		}
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
+	return nil
+}
+
+func (a *auth) CreateSession(ctx context.Context, login string, client entity.ClientInfo) (*uuid.UUID, error) {
+	query := `insert into sessions(login, user_agent, ip)
+				values($1, $2, $3)
 				returning session_id`
 	var connToken uuid.UUID
-	err := a.pool.QueryRow(ctx, query, login).Scan(&connToken)
+	err := a.pool.QueryRow(ctx, query, login, client.UserAgent, client.IP).Scan(&connToken)
 	if err != nil {
 		return nil, appError.Internal()
 	}
@@ -89,13 +209,15 @@ func (a *auth) CreateSession(ctx context.Context, login string) (*uuid.UUID, err
 }
 
 func (a *auth) GetSession(ctx context.Context, sessionId uuid.UUID) (string, error) {
-	query := `select login
-				from sessions
-				where session_id = $1`
+	// sliding renewal: every request moves last_seen
+	query := `update sessions
+				set last_seen = NOW()
+				where session_id = $3 and ` + sessionActive + `
+				returning login`
 
 	var login string
 
-	err := a.pool.QueryRow(ctx, query, sessionId).Scan(&login)
+	err := a.pool.QueryRow(ctx, query, a.sessionTTL.Seconds(), a.sessionIdleTTL.Seconds(), sessionId).Scan(&login)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return "", appError.Unauthorized()
@@ -105,13 +227,82 @@ func (a *auth) GetSession(ctx context.Context, sessionId uuid.UUID) (string, err
 	return login, nil
 }
 
-func (a *auth) DeleteSession(ctx context.Context, token uuid.UUID) error {
+func (a *auth) DeleteSession(ctx context.Context, token uuid.UUID) (string, error) {
 	query := `delete from sessions
-				where session_id = $1`
-	_, err := a.pool.Exec(ctx, query, token)
+				where session_id = $1
+				returning login`
+	var login string
+	err := a.pool.QueryRow(ctx, query, token).Scan(&login)
+	if err != nil && err != pgx.ErrNoRows {
+		return "", appError.Internal()
+	}
+
+	return login, nil
+}
+
+func (a *auth) ListSessions(ctx context.Context, login string, current uuid.UUID) ([]entity.Session, error) {
+	query := `select id, created, last_seen, coalesce(user_agent, ''), coalesce(ip, ''), session_id = $4
+				from sessions
+				where login = $3 and ` + sessionActive + `
+				order by last_seen desc`
+
+	rows, err := a.pool.Query(ctx, query, a.sessionTTL.Seconds(), a.sessionIdleTTL.Seconds(), login, current)
 	if err != nil {
-		return appError.Internal()
+		return nil, appError.Internal()
 	}
+	defer rows.Close()
 
+	sessions := []entity.Session{}
+	for rows.Next() {
+		var session entity.Session
+		err := rows.Scan(
+			&session.ID,
+			&session.Created,
+			&session.LastSeen,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, appError.Internal()
+		}
+		sessions = append(sessions, session)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return sessions, nil
+}
+
+func (a *auth) DeleteSessionById(ctx context.Context, login string, id uuid.UUID) error {
+	query := `delete from sessions
+				where id = $1 and login = $2`
+	tag, err := a.pool.Exec(ctx, query, id, login)
+	if err != nil {
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
 	return nil
 }
+
+func (a *auth) DeleteUserSessions(ctx context.Context, login string) (int64, error) {
+	query := `delete from sessions
+				where login = $1`
+	tag, err := a.pool.Exec(ctx, query, login)
+	if err != nil {
+		return 0, appError.Internal()
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (a *auth) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	query := `delete from sessions
+				where not (` + sessionActive + `)`
+	tag, err := a.pool.Exec(ctx, query, a.sessionTTL.Seconds(), a.sessionIdleTTL.Seconds())
+	if err != nil {
+		return 0, appError.Internal()
+	}
+	return tag.RowsAffected(), nil
+}
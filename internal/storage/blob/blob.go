@@ -0,0 +1,27 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Info describes a stored blob
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore keeps file contents apart from documents metadata.
+// All methods return appError errors, missing blob is appError.NotFound()
+type BlobStore interface {
+	// Put reads r until EOF and stores it under key, replacing the old blob
+	// atomically. Returns the number of stored bytes.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the blob for reading, caller must close it.
+	// The content is seekable, so any backend can serve byte ranges.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, *Info, error)
+	Stat(ctx context.Context, key string) (*Info, error)
+	// Delete removes the blob, missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,123 @@
+package blob
+
+import (
+	"AstralTest/pkg/appError"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type localStore struct {
+	dir string
+}
+
+func NewLocalStore(dir string) (BlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localStore{
+		dir: dir,
+	}, nil
+}
+
+func (l *localStore) path(key string) (string, error) {
+	// keys are generated by the service, but never let them leave the directory
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", appError.BadRequest("bad blob key")
+	}
+	return filepath.Join(l.dir, key), nil
+}
+
+// Put copies r into a temp file inside the storage directory and
+// renames it into place, so readers never see a partially written file.
+func (l *localStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(l.dir, ".upload-*")
+	if err != nil {
+		log.Printf("[localStore.Put] can't create temp file: %v", err)
+		return 0, appError.Internal()
+	}
+	tmpPath := tmp.Name()
+	// after successful rename there is nothing to remove
+	defer os.Remove(tmpPath)
+
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		// reader can fail with our own error (e.g. file is too large)
+		var appErr appError.AppError
+		if errors.As(err, &appErr) {
+			return written, appErr
+		}
+		log.Printf("[localStore.Put] copy error: %v", err)
+		return written, appError.Internal()
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return written, appError.Internal()
+	}
+	if err := tmp.Close(); err != nil {
+		return written, appError.Internal()
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		log.Printf("[localStore.Put] rename error: %v", err)
+		return written, appError.Internal()
+	}
+	return written, nil
+}
+
+func (l *localStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, *Info, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, appError.NotFound()
+		}
+		return nil, nil, appError.Internal()
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, appError.Internal()
+	}
+	return file, &Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (l *localStore) Stat(ctx context.Context, key string) (*Info, error) {
+	filePath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, appError.NotFound()
+		}
+		return nil, appError.Internal()
+	}
+	return &Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (l *localStore) Delete(ctx context.Context, key string) error {
+	filePath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to delete file %s: %v", filePath, err)
+		return appError.Internal()
+	}
+	return nil
+}
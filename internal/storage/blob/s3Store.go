@@ -0,0 +1,384 @@
+package blob
+
+import (
+	"AstralTest/pkg/appError"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config describes any S3-compatible storage (AWS S3, MinIO, ...)
+type S3Config struct {
+	Endpoint  string // e.g. http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle puts bucket into path (endpoint/bucket/key) instead of
+	// host (bucket.endpoint/key). MinIO usually needs path style.
+	PathStyle bool
+}
+
+type s3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// A stalled endpoint fails requests instead of hanging them. Contents are
+// streamed to clients, so reads of the body have no overall limit,
+// uploads are spooled files of limited size and have one
+const (
+	s3DialTimeout           = 10 * time.Second
+	s3ResponseHeaderTimeout = 30 * time.Second
+	s3UploadTimeout         = 5 * time.Minute
+)
+
+func NewS3Store(cfg S3Config) (BlobStore, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("bad s3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &s3Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   s3DialTimeout,
+				ResponseHeaderTimeout: s3ResponseHeaderTimeout,
+				IdleConnTimeout:       90 * time.Second,
+				MaxIdleConnsPerHost:   16,
+			},
+		},
+	}, nil
+}
+
+// Put spools r into a temp file first: S3 needs content length and
+// payload hash before the upload starts, and we still don't keep
+// the whole file in memory.
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp("", "s3-upload-*")
+	if err != nil {
+		log.Printf("[s3Store.Put] can't create temp file: %v", err)
+		return 0, appError.Internal()
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		var appErr appError.AppError
+		if errors.As(err, &appErr) {
+			return written, appErr
+		}
+		log.Printf("[s3Store.Put] copy error: %v", err)
+		return written, appError.Internal()
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return written, appError.Internal()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s3UploadTimeout)
+	defer cancel()
+	req, err := s.newRequest(ctx, http.MethodPut, key, tmp, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return written, appError.Internal()
+	}
+	req.ContentLength = written
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("[s3Store.Put] request error: %v", err)
+		return written, appError.Internal()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return written, s.responseError("Put", resp)
+	}
+	return written, nil
+}
+
+// Get checks that the object exists and returns a lazy reader,
+// the object itself is requested on first Read from the current offset
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadSeekCloser, *Info, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &s3Object{
+		ctx:   ctx,
+		store: s,
+		key:   key,
+		size:  info.Size,
+	}, info, nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, key string) (*Info, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, appError.Internal()
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("[s3Store.Stat] request error: %v", err)
+		return nil, appError.Internal()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError("Stat", resp)
+	}
+	return infoFromHeader(resp), nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, emptyPayloadHash)
+	if err != nil {
+		return appError.Internal()
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("[s3Store.Delete] request error: %v", err)
+		return appError.Internal()
+	}
+	defer resp.Body.Close()
+	// S3 answers 204 even if object doesn't exist
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusNotFound {
+		return s.responseError("Delete", resp)
+	}
+	return nil
+}
+
+// s3Object reads object with ranged GET requests. Seek is free,
+// the next Read opens a new request from the new offset.
+type s3Object struct {
+	ctx    context.Context
+	store  *s3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		if err := o.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) open() error {
+	req, err := o.store.newRequest(o.ctx, http.MethodGet, o.key, nil, emptyPayloadHash)
+	if err != nil {
+		return appError.Internal()
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+	resp, err := o.store.client.Do(req)
+	if err != nil {
+		log.Printf("[s3Object.open] request error: %v", err)
+		return appError.Internal()
+	}
+	// server may ignore Range only if we need the whole object
+	if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && o.offset == 0) {
+		defer resp.Body.Close()
+		return o.store.responseError("Get", resp)
+	}
+	o.body = resp.Body
+	return nil
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = o.offset + offset
+	case io.SeekEnd:
+		newOffset = o.size + offset
+	default:
+		return 0, errors.New("s3Object.Seek: invalid whence")
+	}
+	if newOffset < 0 {
+		return 0, errors.New("s3Object.Seek: negative position")
+	}
+	if newOffset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = newOffset
+	return newOffset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+func (s *s3Store) responseError(op string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return appError.NotFound()
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	log.Printf("[s3Store.%s] unexpected status %d: %s", op, resp.StatusCode, body)
+	return appError.Internal()
+}
+
+func infoFromHeader(resp *http.Response) *Info {
+	info := &Info{Size: resp.ContentLength}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = size
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info
+}
+
+func (s *s3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	if s.cfg.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = ""
+	return &u
+}
+
+func (s *s3Store) newRequest(ctx context.Context, method, key string, body io.Reader, payloadHash string) (*http.Request, error) {
+	if key == "" {
+		return nil, fmt.Errorf("empty blob key")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headerValues := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		canonicalHeaders.WriteString(h + ":" + headerValues[h] + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range values[k] {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escape encodes everything except unreserved characters, as SigV4 requires
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
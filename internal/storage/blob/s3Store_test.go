@@ -0,0 +1,181 @@
+package blob
+
+import (
+	"AstralTest/pkg/appError"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-process S3-compatible server, enough for BlobStore methods
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		hash := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = body
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		status := http.StatusOK
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+			if err != nil || start >= len(body) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			body = body[start:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3Store_PutGetStatDelete(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	store, err := NewS3Store(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "docs",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	require.NoError(t, err)
+	ctx := context.Background()
+	data := []byte("some file content")
+
+	written, err := store.Put(ctx, "key1", bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), written)
+	assert.Contains(t, fake.objects, "/docs/key1")
+
+	info, err := store.Stat(ctx, "key1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	content, info, err := store.Get(ctx, "key1")
+	require.NoError(t, err)
+	got, err := io.ReadAll(content)
+	content.Close()
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	// read from the middle of the object
+	content, _, err = store.Get(ctx, "key1")
+	require.NoError(t, err)
+	_, err = content.Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	got, err = io.ReadAll(content)
+	content.Close()
+	require.NoError(t, err)
+	assert.Equal(t, data[5:], got)
+
+	require.NoError(t, store.Delete(ctx, "key1"))
+	_, err = store.Stat(ctx, "key1")
+	require.Error(t, err)
+	assert.Equal(t, 404, err.(appError.AppError).Code())
+
+	// deleting missing blob is not an error
+	require.NoError(t, store.Delete(ctx, "key1"))
+}
+
+func TestS3Store_PutReaderError(t *testing.T) {
+	fake, srv := newFakeS3(t)
+	store, err := NewS3Store(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "docs",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	require.NoError(t, err)
+
+	_, err = store.Put(context.Background(), "key1", io.MultiReader(
+		strings.NewReader("partial"),
+		errReader{appError.BadRequest("file is too large")},
+	))
+	require.Error(t, err)
+	assert.Equal(t, 400, err.(appError.AppError).Code())
+	assert.Empty(t, fake.objects)
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+func TestS3Store_StalledEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	store, err := NewS3Store(S3Config{Endpoint: srv.URL, Bucket: "docs", PathStyle: true})
+	require.NoError(t, err)
+	// the default waits for headers for 30 seconds
+	store.(*s3Store).client.Transport.(*http.Transport).ResponseHeaderTimeout = 50 * time.Millisecond
+
+	done := make(chan error)
+	go func() {
+		_, err := store.Stat(context.Background(), "key1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request to a stalled endpoint doesn't time out")
+	}
+}
@@ -1,8 +1,11 @@
 package cache
 
 import (
-	"fmt"
+	"container/list"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type CacheKey string
@@ -10,15 +13,20 @@ type CacheKey string
 type CachedDocResp struct {
 	Status int
 	Body   []byte
+	// Docs are ids of the documents in the response, any change of them drops it
+	Docs []uuid.UUID
+	// Ticket is taken before the response was read from the storage, the response
+	// isn't stored if its documents or bucket were invalidated after it.
+	// Responses without a ticket are stored as is
+	Ticket Ticket
 }
 
-type StructuredCache struct {
-	mu sync.RWMutex
-
-	ownerDocs map[string]map[CacheKey]CachedDocResp
-	grantDocs map[string]map[string]map[CacheKey]CachedDocResp // grantee -> owner -> token -> resp
-}
+// Ticket orders reads and invalidations of the cache
+type Ticket uint64
 
+// Cache keeps responses of documents. Invalidations are called after the
+// change is committed: caches shared by replicas send them to the others at
+// once, and a replica which reads the old row after that caches it for good
 type Cache interface {
 	SetOwner(login string, key CacheKey, value CachedDocResp)
 	GetOwner(login string, key CacheKey) (CachedDocResp, bool)
@@ -26,93 +34,344 @@ type Cache interface {
 	SetGrant(grantee, owner string, key CacheKey, value CachedDocResp)
 	GetGrant(grantee, owner string, key CacheKey) (CachedDocResp, bool)
 	InvalidateGrant(owner string, grantees []string)
+	// SetPublic keeps an anonymous response with public documents of the owner,
+	// keys are unique across owners
+	SetPublic(owner string, key CacheKey, value CachedDocResp)
+	GetPublic(key CacheKey) (CachedDocResp, bool)
+	InvalidatePublic(owner string)
+	// InvalidateDocs drops responses of all users which contain the documents
+	InvalidateDocs(ids ...uuid.UUID)
+	// Ticket is taken before reading a response which will be cached
+	Ticket() Ticket
+}
+
+// Stats are counters of the cache since the start
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // entries pushed out by the byte budget
+	Expired   uint64 `json:"expired"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+// StatsReporter is implemented by caches which count their work
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// bucket groups entries dropped together by one invalidation
+type bucket struct {
+	kind   byte // bucketOwner, bucketGrant or bucketPublic
+	login  string
+	holder string // owner of the documents for grants
+}
+
+const (
+	bucketOwner byte = iota
+	bucketGrant
+	bucketPublic
+)
+
+type entry struct {
+	bucket  bucket
+	key     CacheKey
+	value   CachedDocResp
+	size    int64
+	expires time.Time
 }
 
-func NewStructuredCache() *StructuredCache {
+const (
+	// entryOverhead is a rough size of the entry bookkeeping, so tiny
+	// responses are not free for the budget
+	entryOverhead = 128
+	docIdSize     = 16
+
+	// maxTracked limits remembered invalidations, older ones are forgotten
+	// and responses with tickets taken before them are not stored
+	maxTracked = 1 << 16
+)
+
+// StructuredCache keeps responses in buckets of users, least recently used
+// entries are evicted when the byte budget is exceeded, entries live up to ttl
+type StructuredCache struct {
+	mu sync.Mutex
+
+	maxBytes int64
+	ttl      time.Duration
+	now      func() time.Time
+
+	buckets map[bucket]map[CacheKey]*list.Element
+	// anonymous responses are found by key only
+	publicKeys map[CacheKey]string // key -> owner
+	// front is the most recently used
+	lru   *list.List
+	bytes int64
+	stats Stats
+
+	// entries which contain the document
+	docs map[uuid.UUID]map[*list.Element]struct{}
+	// seq grows with every invalidation, tickets are its values;
+	// docSeq and bucketSeq keep the last invalidation of documents and buckets
+	seq       uint64
+	floor     uint64
+	docSeq    map[uuid.UUID]uint64
+	bucketSeq map[bucket]uint64
+}
+
+func NewStructuredCache(maxBytes int64, ttl time.Duration) *StructuredCache {
 	return &StructuredCache{
-		ownerDocs: make(map[string]map[CacheKey]CachedDocResp),
-		grantDocs: make(map[string]map[string]map[CacheKey]CachedDocResp),
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		now:        time.Now,
+		buckets:    make(map[bucket]map[CacheKey]*list.Element),
+		publicKeys: make(map[CacheKey]string),
+		lru:        list.New(),
+		docs:       make(map[uuid.UUID]map[*list.Element]struct{}),
+		// zero ticket means no ticket
+		seq:       1,
+		docSeq:    make(map[uuid.UUID]uint64),
+		bucketSeq: make(map[bucket]uint64),
 	}
 }
 
 func (c *StructuredCache) SetOwner(login string, key CacheKey, value CachedDocResp) {
+	c.set(bucket{kind: bucketOwner, login: login}, key, value)
+}
+
+func (c *StructuredCache) GetOwner(login string, key CacheKey) (CachedDocResp, bool) {
+	return c.get(bucket{kind: bucketOwner, login: login}, key)
+}
+
+func (c *StructuredCache) InvalidateOwnerList(login string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropBucket(bucket{kind: bucketOwner, login: login})
+}
+
+func (c *StructuredCache) SetGrant(grantee, owner string, key CacheKey, value CachedDocResp) {
+	c.set(bucket{kind: bucketGrant, login: grantee, holder: owner}, key, value)
+}
+
+func (c *StructuredCache) GetGrant(grantee, owner string, key CacheKey) (CachedDocResp, bool) {
+	return c.get(bucket{kind: bucketGrant, login: grantee, holder: owner}, key)
+}
+
+func (c *StructuredCache) InvalidateGrant(owner string, grantees []string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.ownerDocs[login] == nil {
-		c.ownerDocs[login] = make(map[CacheKey]CachedDocResp)
+	for _, grantee := range grantees {
+		c.dropBucket(bucket{kind: bucketGrant, login: grantee, holder: owner})
 	}
-	c.ownerDocs[login][key] = value
-	fmt.Println("serOwner: ", login)
 }
 
-func (c *StructuredCache) GetOwner(login string, key CacheKey) (CachedDocResp, bool) {
-	fmt.Println("GetOwner: ", login)
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	m, ok := c.ownerDocs[login]
-	if !ok {
-		return CachedDocResp{}, false
+func (c *StructuredCache) SetPublic(owner string, key CacheKey, value CachedDocResp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the key may move to another owner
+	if oldOwner, ok := c.publicKeys[key]; ok && oldOwner != owner {
+		c.remove(c.buckets[bucket{kind: bucketPublic, login: oldOwner}][key])
 	}
-	v, ok := m[key]
-	if ok {
-		fmt.Println("ok")
+	if c.setLocked(bucket{kind: bucketPublic, login: owner}, key, value) {
+		c.publicKeys[key] = owner
 	}
-	return v, ok
 }
 
-func (c *StructuredCache) InvalidateOwnerList(login string) {
-	fmt.Println("InvalidateOwnerList: ", login)
+func (c *StructuredCache) GetPublic(key CacheKey) (CachedDocResp, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if _, ok := c.ownerDocs[login]; ok {
-		fmt.Println("del: ", login)
-		delete(c.ownerDocs, login)
-	}
+	return c.getLocked(bucket{kind: bucketPublic, login: c.publicKeys[key]}, key)
 }
 
-func (c *StructuredCache) SetGrant(grantee, owner string, key CacheKey, value CachedDocResp) {
-	fmt.Println("SetGrant")
+func (c *StructuredCache) InvalidatePublic(owner string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropBucket(bucket{kind: bucketPublic, login: owner})
+}
+
+func (c *StructuredCache) InvalidateDocs(ids ...uuid.UUID) {
+	c.invalidate(nil, ids)
+}
+
+// invalidate drops buckets and entries with the documents at once
+func (c *StructuredCache) invalidate(buckets []bucket, ids []uuid.UUID) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	if c.grantDocs[grantee] == nil {
-		c.grantDocs[grantee] = make(map[string]map[CacheKey]CachedDocResp)
+	for _, b := range buckets {
+		c.dropBucket(b)
+	}
+	if len(ids) == 0 {
+		return
 	}
-	if c.grantDocs[grantee][owner] == nil {
-		c.grantDocs[grantee][owner] = make(map[CacheKey]CachedDocResp)
+	c.seq++
+	for _, id := range ids {
+		for elem := range c.docs[id] {
+			c.remove(elem)
+		}
+		c.docSeq[id] = c.seq
 	}
-	c.grantDocs[grantee][owner][key] = value
+	c.forgetOld()
 }
 
-func (c *StructuredCache) GetGrant(grantee, owner string, key CacheKey) (CachedDocResp, bool) {
-	fmt.Println("getGrant")
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	m1, ok := c.grantDocs[grantee]
-	if !ok {
-		return CachedDocResp{}, false
+// reset drops all entries, responses read before it are not stored
+func (c *StructuredCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
 	}
-	m2, ok := m1[owner]
+	c.seq++
+	c.docSeq = make(map[uuid.UUID]uint64)
+	c.bucketSeq = make(map[bucket]uint64)
+	c.floor = c.seq
+}
+
+func (c *StructuredCache) Ticket() Ticket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Ticket(c.seq)
+}
+
+func (c *StructuredCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.bytes
+	stats.MaxBytes = c.maxBytes
+	return stats
+}
+
+func (c *StructuredCache) get(b bucket, key CacheKey) (CachedDocResp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getLocked(b, key)
+}
+
+// getLocked returns the live entry and marks it as recently used
+func (c *StructuredCache) getLocked(b bucket, key CacheKey) (CachedDocResp, bool) {
+	elem, ok := c.buckets[b][key]
 	if !ok {
+		c.stats.Misses++
 		return CachedDocResp{}, false
 	}
-	v, ok := m2[key]
-	if ok {
-		fmt.Println(v)
+	e := elem.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.remove(elem)
+		c.stats.Expired++
+		c.stats.Misses++
+		return CachedDocResp{}, false
 	}
-	return v, ok
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	return e.value, true
 }
 
-func (c *StructuredCache) InvalidateGrant(owner string, grantees []string) {
+func (c *StructuredCache) set(b bucket, key CacheKey, value CachedDocResp) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	fmt.Println("grantes: ", grantees)
-	for _, grantee := range grantees {
-		if c.grantDocs[grantee] != nil {
-			fmt.Println("del list: ", owner)
-			delete(c.grantDocs[grantee], owner)
-			if len(c.grantDocs[grantee]) == 0 {
-				delete(c.grantDocs, grantee)
-			}
+	c.setLocked(b, key, value)
+}
+
+// setLocked stores the entry and evicts old ones to fit the budget,
+// responses larger than the whole budget are not cached
+func (c *StructuredCache) setLocked(b bucket, key CacheKey, value CachedDocResp) bool {
+	// a newer response may be stored already
+	if c.stale(b, value) {
+		return false
+	}
+	if old, ok := c.buckets[b][key]; ok {
+		c.remove(old)
+	}
+
+	size := int64(len(value.Body)+len(key)+len(b.login)+len(b.holder)+len(value.Docs)*docIdSize) + entryOverhead
+	if size > c.maxBytes {
+		return false
+	}
+	for c.bytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+
+	e := &entry{
+		bucket:  b,
+		key:     key,
+		value:   value,
+		size:    size,
+		expires: c.now().Add(c.ttl),
+	}
+	if c.buckets[b] == nil {
+		c.buckets[b] = make(map[CacheKey]*list.Element)
+	}
+	elem := c.lru.PushFront(e)
+	c.buckets[b][key] = elem
+	for _, id := range value.Docs {
+		if c.docs[id] == nil {
+			c.docs[id] = make(map[*list.Element]struct{})
+		}
+		c.docs[id][elem] = struct{}{}
+	}
+	c.bytes += size
+	return true
+}
+
+// stale tells if the response was read before an invalidation of its bucket
+// or documents, storing it would bring back data which is already changed
+func (c *StructuredCache) stale(b bucket, value CachedDocResp) bool {
+	ticket := uint64(value.Ticket)
+	if ticket == 0 {
+		return false
+	}
+	if ticket < c.floor || c.bucketSeq[b] > ticket {
+		return true
+	}
+	for _, id := range value.Docs {
+		if c.docSeq[id] > ticket {
+			return true
 		}
 	}
+	return false
+}
+
+func (c *StructuredCache) dropBucket(b bucket) {
+	for _, elem := range c.buckets[b] {
+		c.remove(elem)
+	}
+	c.seq++
+	c.bucketSeq[b] = c.seq
+	c.forgetOld()
+}
+
+// forgetOld bounds remembered invalidations, tickets taken before the
+// forgotten ones become stale
+func (c *StructuredCache) forgetOld() {
+	if len(c.docSeq)+len(c.bucketSeq) <= maxTracked {
+		return
+	}
+	c.docSeq = make(map[uuid.UUID]uint64)
+	c.bucketSeq = make(map[bucket]uint64)
+	c.floor = c.seq
+}
+
+func (c *StructuredCache) remove(elem *list.Element) {
+	if elem == nil {
+		return
+	}
+	e := c.lru.Remove(elem).(*entry)
+	c.bytes -= e.size
+	for _, id := range e.value.Docs {
+		delete(c.docs[id], elem)
+		if len(c.docs[id]) == 0 {
+			delete(c.docs, id)
+		}
+	}
+	entries := c.buckets[e.bucket]
+	delete(entries, e.key)
+	if len(entries) == 0 {
+		delete(c.buckets, e.bucket)
+	}
+	if e.bucket.kind == bucketPublic {
+		delete(c.publicKeys, e.key)
+	}
 }
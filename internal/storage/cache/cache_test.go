@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func resp(body string) CachedDocResp {
+	return CachedDocResp{Status: 200, Body: []byte(body)}
+}
+
+// entrySize matches the size counted by setLocked for owner entries
+func entrySize(login string, key CacheKey, body string) int64 {
+	return int64(len(body)+len(key)+len(login)) + entryOverhead
+}
+
+func TestStructuredCache_GetSet(t *testing.T) {
+	c := NewStructuredCache(1<<20, time.Minute)
+
+	c.SetOwner("owner1", "k1", resp("doc"))
+	c.SetGrant("grantee1", "owner1", "k1", resp("shared"))
+	c.SetPublic("owner1", "p1", resp("public"))
+
+	v, ok := c.GetOwner("owner1", "k1")
+	assert.True(t, ok)
+	assert.Equal(t, "doc", string(v.Body))
+	v, ok = c.GetGrant("grantee1", "owner1", "k1")
+	assert.True(t, ok)
+	assert.Equal(t, "shared", string(v.Body))
+	v, ok = c.GetPublic("p1")
+	assert.True(t, ok)
+	assert.Equal(t, "public", string(v.Body))
+
+	// buckets don't see each other
+	_, ok = c.GetOwner("grantee1", "k1")
+	assert.False(t, ok)
+	_, ok = c.GetGrant("grantee1", "owner2", "k1")
+	assert.False(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 3, stats.Entries)
+}
+
+func TestStructuredCache_Invalidate(t *testing.T) {
+	c := NewStructuredCache(1<<20, time.Minute)
+	c.SetOwner("owner1", "k1", resp("doc"))
+	c.SetOwner("owner1", "k2", resp("list"))
+	c.SetGrant("grantee1", "owner1", "k1", resp("a"))
+	c.SetGrant("grantee1", "owner2", "k1", resp("b"))
+	c.SetPublic("owner1", "p1", resp("public"))
+
+	c.InvalidateOwnerList("owner1")
+	_, ok := c.GetOwner("owner1", "k2")
+	assert.False(t, ok)
+
+	c.InvalidateGrant("owner1", []string{"grantee1"})
+	_, ok = c.GetGrant("grantee1", "owner1", "k1")
+	assert.False(t, ok)
+	_, ok = c.GetGrant("grantee1", "owner2", "k1")
+	assert.True(t, ok)
+
+	c.InvalidatePublic("owner1")
+	_, ok = c.GetPublic("p1")
+	assert.False(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, entrySize("grantee1", "k1", "b")+int64(len("owner2")), stats.Bytes)
+}
+
+func TestStructuredCache_TTL(t *testing.T) {
+	now := time.Now()
+	c := NewStructuredCache(1<<20, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.SetOwner("owner1", "k1", resp("doc"))
+	now = now.Add(59 * time.Second)
+	_, ok := c.GetOwner("owner1", "k1")
+	assert.True(t, ok)
+
+	now = now.Add(time.Second)
+	_, ok = c.GetOwner("owner1", "k1")
+	assert.False(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Expired)
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, int64(0), stats.Bytes)
+}
+
+func TestStructuredCache_LRU(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	size := entrySize("owner1", "k1", body)
+	c := NewStructuredCache(3*size, time.Minute)
+
+	c.SetOwner("owner1", "k1", resp(body))
+	c.SetOwner("owner1", "k2", resp(body))
+	c.SetOwner("owner1", "k3", resp(body))
+	// k1 becomes the most recently used, k2 goes first
+	c.GetOwner("owner1", "k1")
+	c.SetOwner("owner1", "k4", resp(body))
+
+	_, ok := c.GetOwner("owner1", "k2")
+	assert.False(t, ok)
+	for _, key := range []CacheKey{"k1", "k3", "k4"} {
+		_, ok := c.GetOwner("owner1", key)
+		assert.True(t, ok, key)
+	}
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 3*size, stats.Bytes)
+	assert.LessOrEqual(t, stats.Bytes, stats.MaxBytes)
+
+	// a response larger than the budget is not cached and evicts nothing
+	c.SetOwner("owner1", "big", resp(strings.Repeat("x", int(3*size))))
+	_, ok = c.GetOwner("owner1", "big")
+	assert.False(t, ok)
+	assert.Equal(t, 3, c.Stats().Entries)
+}
+
+func TestStructuredCache_Replace(t *testing.T) {
+	c := NewStructuredCache(1<<20, time.Minute)
+	c.SetOwner("owner1", "k1", resp("old"))
+	c.SetOwner("owner1", "k1", resp("new"))
+	v, _ := c.GetOwner("owner1", "k1")
+	assert.Equal(t, "new", string(v.Body))
+	assert.Equal(t, entrySize("owner1", "k1", "new"), c.Stats().Bytes)
+
+	// public key moved to another owner is dropped with the new one only
+	c.SetPublic("owner1", "p1", resp("a"))
+	c.SetPublic("owner2", "p1", resp("b"))
+	c.InvalidatePublic("owner1")
+	v, ok := c.GetPublic("p1")
+	assert.True(t, ok)
+	assert.Equal(t, "b", string(v.Body))
+	assert.Equal(t, 2, c.Stats().Entries)
+}
+
+func TestStructuredCache_InvalidateDocs(t *testing.T) {
+	c := NewStructuredCache(1<<20, time.Minute)
+	doc1, doc2 := uuid.New(), uuid.New()
+
+	file := resp("doc1")
+	file.Docs = []uuid.UUID{doc1}
+	list := resp("doc1 and doc2")
+	list.Docs = []uuid.UUID{doc1, doc2}
+	other := resp("doc2")
+	other.Docs = []uuid.UUID{doc2}
+
+	// the same document is cached for several users in different buckets
+	c.SetOwner("owner1", "file", file)
+	c.SetOwner("viewer1", "file", file)
+	c.SetGrant("grantee1", "owner1", "list", list)
+	c.SetPublic("owner1", "file", file)
+	c.SetOwner("owner1", "other", other)
+
+	c.InvalidateDocs(doc1)
+	_, ok := c.GetOwner("owner1", "file")
+	assert.False(t, ok)
+	_, ok = c.GetOwner("viewer1", "file")
+	assert.False(t, ok)
+	_, ok = c.GetGrant("grantee1", "owner1", "list")
+	assert.False(t, ok)
+	_, ok = c.GetPublic("file")
+	assert.False(t, ok)
+	_, ok = c.GetOwner("owner1", "other")
+	assert.True(t, ok)
+
+	// the index forgets removed entries
+	assert.Len(t, c.docs, 1)
+	assert.Len(t, c.docs[doc2], 1)
+	c.InvalidateOwnerList("owner1")
+	assert.Empty(t, c.docs)
+	assert.Equal(t, int64(0), c.Stats().Bytes)
+}
+
+func TestStructuredCache_RevokeThenRead(t *testing.T) {
+	doc1 := uuid.New()
+	read := func(ticket Ticket) CachedDocResp {
+		v := resp("doc1")
+		v.Docs = []uuid.UUID{doc1}
+		v.Ticket = ticket
+		return v
+	}
+
+	t.Run("document changed during the read", func(t *testing.T) {
+		c := NewStructuredCache(1<<20, time.Minute)
+		ticket := c.Ticket()
+		// the reader got the document, then access is revoked before it stores it
+		c.InvalidateDocs(doc1)
+		c.SetOwner("grantee1", "file", read(ticket))
+		_, ok := c.GetOwner("grantee1", "file")
+		assert.False(t, ok)
+
+		// the next read sees the change and is cached
+		c.SetOwner("grantee1", "file", read(c.Ticket()))
+		_, ok = c.GetOwner("grantee1", "file")
+		assert.True(t, ok)
+	})
+
+	t.Run("bucket dropped during the read", func(t *testing.T) {
+		c := NewStructuredCache(1<<20, time.Minute)
+		ticket := c.Ticket()
+		c.InvalidateGrant("owner1", []string{"grantee1"})
+		c.SetGrant("grantee1", "owner1", "list", read(ticket))
+		_, ok := c.GetGrant("grantee1", "owner1", "list")
+		assert.False(t, ok)
+
+		// other buckets are not affected
+		c.SetGrant("grantee2", "owner1", "list", read(ticket))
+		_, ok = c.GetGrant("grantee2", "owner1", "list")
+		assert.True(t, ok)
+	})
+
+	t.Run("stale response keeps the newer one", func(t *testing.T) {
+		c := NewStructuredCache(1<<20, time.Minute)
+		old := c.Ticket()
+		c.InvalidateDocs(doc1)
+		fresh := read(c.Ticket())
+		fresh.Body = []byte("fresh")
+		c.SetOwner("grantee1", "file", fresh)
+		c.SetOwner("grantee1", "file", read(old))
+		v, ok := c.GetOwner("grantee1", "file")
+		assert.True(t, ok)
+		assert.Equal(t, "fresh", string(v.Body))
+	})
+
+	t.Run("forgotten invalidations", func(t *testing.T) {
+		c := NewStructuredCache(1<<20, time.Minute)
+		ticket := c.Ticket()
+		for i := 0; i <= maxTracked; i++ {
+			c.InvalidateDocs(uuid.New())
+		}
+		assert.LessOrEqual(t, len(c.docSeq), maxTracked)
+		// doc1 wasn't touched, but the reader can't know it anymore
+		c.SetOwner("grantee1", "file", read(ticket))
+		_, ok := c.GetOwner("grantee1", "file")
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,56 @@
+package cache
+
+import "github.com/google/uuid"
+
+// invalidation is sent to other replicas by caches shared between them
+type invalidation struct {
+	Buckets []invalidatedBucket `json:"buckets,omitempty"`
+	Docs    []uuid.UUID         `json:"docs,omitempty"`
+	// Source is the replica which applied it already, empty if unknown
+	Source string `json:"source,omitempty"`
+	// Flush drops everything, sent when the change can't be described
+	Flush bool `json:"flush,omitempty"`
+}
+
+type invalidatedBucket struct {
+	Kind   byte   `json:"kind"`
+	Login  string `json:"login"`
+	Holder string `json:"holder,omitempty"`
+}
+
+func newInvalidation(source string, buckets []bucket, ids []uuid.UUID) invalidation {
+	inv := invalidation{Source: source, Docs: ids}
+	for _, b := range buckets {
+		inv.Buckets = append(inv.Buckets, invalidatedBucket{Kind: b.kind, Login: b.login, Holder: b.holder})
+	}
+	return inv
+}
+
+// apply drops entries of the local cache of the replica
+func (inv invalidation) apply(local *StructuredCache) {
+	if inv.Flush {
+		local.reset()
+		return
+	}
+	buckets := make([]bucket, 0, len(inv.Buckets))
+	for _, b := range inv.Buckets {
+		buckets = append(buckets, bucket{kind: b.Kind, login: b.Login, holder: b.Holder})
+	}
+	local.invalidate(buckets, inv.Docs)
+}
+
+// split gives the first n buckets and documents and the rest
+func (inv invalidation) split(n int) (invalidation, invalidation) {
+	first := invalidation{Source: inv.Source}
+	second := invalidation{Source: inv.Source}
+	if n <= len(inv.Buckets) {
+		first.Buckets = inv.Buckets[:n]
+		second.Buckets = inv.Buckets[n:]
+		second.Docs = inv.Docs
+	} else {
+		first.Buckets = inv.Buckets
+		first.Docs = inv.Docs[:n-len(inv.Buckets)]
+		second.Docs = inv.Docs[n-len(inv.Buckets):]
+	}
+	return first, second
+}
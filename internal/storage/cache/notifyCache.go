@@ -0,0 +1,244 @@
+package cache
+
+import (
+	"AstralTest/internal/storage/postgres"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Notifier carries invalidations between replicas
+type Notifier interface {
+	Notify(ctx context.Context, payload string) error
+	Listen(ctx context.Context) (Subscription, error)
+}
+
+// Subscription gives payloads sent after Listen
+type Subscription interface {
+	Receive(ctx context.Context) (string, error)
+	Close()
+}
+
+// NotifyCache keeps responses in memory of the replica like StructuredCache,
+// every invalidation is applied locally and sent to other replicas over
+// the Notifier. Entries are used only while invalidations are received.
+// Notifications go through the pool, not the transaction of the change,
+// so the callers invalidate after their changes are committed
+type NotifyCache struct {
+	local    *StructuredCache
+	notifier Notifier
+	// own notifications come back, they are already applied
+	source string
+	live   atomic.Bool
+}
+
+// maxPayload keeps notifications under the postgres limit of 8000 bytes
+const maxPayload = 7900
+
+func NewNotifyCache(notifier Notifier, maxBytes int64, ttl time.Duration) *NotifyCache {
+	return &NotifyCache{
+		local:    NewStructuredCache(maxBytes, ttl),
+		notifier: notifier,
+		source:   uuid.NewString(),
+	}
+}
+
+func (c *NotifyCache) SetOwner(login string, key CacheKey, value CachedDocResp) {
+	if c.live.Load() {
+		c.local.SetOwner(login, key, value)
+	}
+}
+
+func (c *NotifyCache) GetOwner(login string, key CacheKey) (CachedDocResp, bool) {
+	if !c.live.Load() {
+		return CachedDocResp{}, false
+	}
+	return c.local.GetOwner(login, key)
+}
+
+func (c *NotifyCache) InvalidateOwnerList(login string) {
+	c.invalidate([]bucket{{kind: bucketOwner, login: login}}, nil)
+}
+
+func (c *NotifyCache) SetGrant(grantee, owner string, key CacheKey, value CachedDocResp) {
+	if c.live.Load() {
+		c.local.SetGrant(grantee, owner, key, value)
+	}
+}
+
+func (c *NotifyCache) GetGrant(grantee, owner string, key CacheKey) (CachedDocResp, bool) {
+	if !c.live.Load() {
+		return CachedDocResp{}, false
+	}
+	return c.local.GetGrant(grantee, owner, key)
+}
+
+func (c *NotifyCache) InvalidateGrant(owner string, grantees []string) {
+	buckets := make([]bucket, 0, len(grantees))
+	for _, grantee := range grantees {
+		buckets = append(buckets, bucket{kind: bucketGrant, login: grantee, holder: owner})
+	}
+	c.invalidate(buckets, nil)
+}
+
+func (c *NotifyCache) SetPublic(owner string, key CacheKey, value CachedDocResp) {
+	if c.live.Load() {
+		c.local.SetPublic(owner, key, value)
+	}
+}
+
+func (c *NotifyCache) GetPublic(key CacheKey) (CachedDocResp, bool) {
+	if !c.live.Load() {
+		return CachedDocResp{}, false
+	}
+	return c.local.GetPublic(key)
+}
+
+func (c *NotifyCache) InvalidatePublic(owner string) {
+	c.invalidate([]bucket{{kind: bucketPublic, login: owner}}, nil)
+}
+
+func (c *NotifyCache) InvalidateDocs(ids ...uuid.UUID) {
+	if len(ids) == 0 {
+		return
+	}
+	c.invalidate(nil, ids)
+}
+
+func (c *NotifyCache) Ticket() Ticket {
+	return c.local.Ticket()
+}
+
+func (c *NotifyCache) Stats() Stats {
+	return c.local.Stats()
+}
+
+// Listen applies invalidations of other replicas until ctx is done or the
+// subscription breaks, the app calls it again then. The cache is flushed on
+// every subscription: invalidations made without it are unknown
+func (c *NotifyCache) Listen(ctx context.Context) error {
+	sub, err := c.notifier.Listen(ctx)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	defer func() {
+		c.live.Store(false)
+		c.local.reset()
+	}()
+
+	c.local.reset()
+	c.live.Store(true)
+	for {
+		payload, err := sub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		var inv invalidation
+		if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+			log.Println("[NotifyCache.Listen] bad message: ", err.Error())
+			continue
+		}
+		if inv.Source == c.source {
+			continue
+		}
+		inv.apply(c.local)
+	}
+}
+
+func (c *NotifyCache) invalidate(buckets []bucket, ids []uuid.UUID) {
+	c.local.invalidate(buckets, ids)
+
+	c.send(newInvalidation(c.source, buckets, ids))
+}
+
+// send splits invalidations which don't fit into one notification,
+// an item too large by itself flushes other replicas
+func (c *NotifyCache) send(inv invalidation) {
+	payload, _ := json.Marshal(inv)
+	if len(payload) > maxPayload {
+		n := len(inv.Buckets) + len(inv.Docs)
+		if n <= 1 {
+			c.send(invalidation{Source: inv.Source, Flush: true})
+			return
+		}
+		first, second := inv.split(n / 2)
+		c.send(first)
+		c.send(second)
+		return
+	}
+	if err := c.notifier.Notify(context.Background(), string(payload)); err != nil {
+		log.Println("[NotifyCache.send] error: ", err.Error())
+	}
+}
+
+const (
+	notifyChannel = "cache_invalidation"
+	// a silent connection is checked so broken ones are noticed
+	notifyPingInterval = 30 * time.Second
+)
+
+// PgNotifier sends invalidations with postgres NOTIFY
+type PgNotifier struct {
+	pool  postgres.DBPool
+	dbURL string
+}
+
+func NewPgNotifier(pool postgres.DBPool, dbURL string) *PgNotifier {
+	return &PgNotifier{
+		pool:  pool,
+		dbURL: dbURL,
+	}
+}
+
+func (n *PgNotifier) Notify(ctx context.Context, payload string) error {
+	_, err := n.pool.Exec(ctx, `select pg_notify($1, $2)`, notifyChannel, payload)
+	return err
+}
+
+// Listen takes its own connection, pooled ones are shared by requests
+func (n *PgNotifier) Listen(ctx context.Context) (Subscription, error) {
+	conn, err := pgx.Connect(ctx, n.dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, `listen `+notifyChannel); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return &pgSubscription{conn: conn}, nil
+}
+
+type pgSubscription struct {
+	conn *pgx.Conn
+}
+
+func (s *pgSubscription) Receive(ctx context.Context) (string, error) {
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, notifyPingInterval)
+		notification, err := s.conn.WaitForNotification(waitCtx)
+		cancel()
+		if err == nil {
+			return notification.Payload, nil
+		}
+		if ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded) {
+			return "", err
+		}
+		if err := s.conn.Ping(ctx); err != nil {
+			return "", err
+		}
+	}
+}
+
+func (s *pgSubscription) Close() {
+	s.conn.Close(context.Background())
+}
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifier delivers payloads to all subscriptions like LISTEN/NOTIFY
+type fakeNotifier struct {
+	mu       sync.Mutex
+	subs     map[*fakeSubscription]struct{}
+	payloads []string
+}
+
+type fakeSubscription struct {
+	notifier *fakeNotifier
+	ch       chan string
+	broken   chan struct{}
+	once     sync.Once
+}
+
+func newFakeNotifier() *fakeNotifier {
+	return &fakeNotifier{subs: make(map[*fakeSubscription]struct{})}
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, payload string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(payload) > 8000 {
+		return errors.New("payload string too long")
+	}
+	n.payloads = append(n.payloads, payload)
+	for sub := range n.subs {
+		sub.ch <- payload
+	}
+	return nil
+}
+
+func (n *fakeNotifier) Listen(ctx context.Context) (Subscription, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sub := &fakeSubscription{notifier: n, ch: make(chan string, 100), broken: make(chan struct{})}
+	n.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+// breakAll drops connections of all listeners
+func (n *fakeNotifier) breakAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for sub := range n.subs {
+		sub.once.Do(func() { close(sub.broken) })
+		delete(n.subs, sub)
+	}
+}
+
+func (n *fakeNotifier) listeners() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.subs)
+}
+
+func (s *fakeSubscription) Receive(ctx context.Context) (string, error) {
+	select {
+	case payload := <-s.ch:
+		return payload, nil
+	case <-s.broken:
+		return "", errors.New("connection lost")
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (s *fakeSubscription) Close() {
+	s.notifier.mu.Lock()
+	defer s.notifier.mu.Unlock()
+	delete(s.notifier.subs, s)
+}
+
+// listen runs the listener like the app does: again after every break
+func listen(t *testing.T, c *NotifyCache) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		for c.Listen(ctx) != context.Canceled {
+		}
+	}()
+	require.Eventually(t, c.live.Load, time.Second, time.Millisecond)
+}
+
+func TestNotifyCache_InvalidateAcrossReplicas(t *testing.T) {
+	notifier := newFakeNotifier()
+	a := NewNotifyCache(notifier, 1<<20, time.Minute)
+	b := NewNotifyCache(notifier, 1<<20, time.Minute)
+	listen(t, a)
+	listen(t, b)
+	doc1 := uuid.New()
+
+	file := resp("doc1")
+	file.Docs = []uuid.UUID{doc1}
+	for _, c := range []*NotifyCache{a, b} {
+		c.SetOwner("owner1", "list", resp("list"))
+		c.SetGrant("grantee1", "owner1", "list", resp("shared"))
+		c.SetPublic("owner1", "list", resp("public"))
+		c.SetOwner("viewer1", "file", file)
+	}
+
+	// an upload on a drops lists on b
+	a.InvalidateOwnerList("owner1")
+	a.InvalidateGrant("owner1", []string{"grantee1"})
+	a.InvalidatePublic("owner1")
+	a.InvalidateDocs(doc1)
+	assert.Eventually(t, func() bool { return b.Stats().Entries == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, 0, a.Stats().Entries)
+
+	// a doesn't apply own notifications twice
+	assert.Len(t, notifier.payloads, 4)
+	for _, payload := range notifier.payloads {
+		assert.Contains(t, payload, a.source)
+	}
+}
+
+func TestNotifyCache_Reconnect(t *testing.T) {
+	notifier := newFakeNotifier()
+	c := NewNotifyCache(notifier, 1<<20, time.Minute)
+
+	// nothing is cached until invalidations are received
+	c.SetOwner("owner1", "k1", resp("doc"))
+	_, ok := c.GetOwner("owner1", "k1")
+	assert.False(t, ok)
+
+	listen(t, c)
+	c.SetOwner("owner1", "k1", resp("doc"))
+	_, ok = c.GetOwner("owner1", "k1")
+	assert.True(t, ok)
+
+	// a response read before the break isn't stored after the reconnect
+	ticket := c.Ticket()
+	notifier.breakAll()
+	require.Eventually(t, func() bool { return c.live.Load() && notifier.listeners() == 1 }, time.Second, time.Millisecond)
+	// the cache is flushed, invalidations could be missed meanwhile
+	assert.Equal(t, 0, c.Stats().Entries)
+	stale := resp("doc")
+	stale.Ticket = ticket
+	c.SetOwner("owner1", "k1", stale)
+	_, ok = c.GetOwner("owner1", "k1")
+	assert.False(t, ok)
+}
+
+func TestNotifyCache_LargeInvalidation(t *testing.T) {
+	notifier := newFakeNotifier()
+	a := NewNotifyCache(notifier, 1<<20, time.Minute)
+	b := NewNotifyCache(notifier, 1<<20, time.Minute)
+	listen(t, b)
+
+	// documents of a transferred owner don't fit into one notification
+	ids := make([]uuid.UUID, 500)
+	for i := range ids {
+		ids[i] = uuid.New()
+		doc := resp("doc")
+		doc.Docs = []uuid.UUID{ids[i]}
+		b.SetOwner("viewer1", CacheKey(ids[i].String()), doc)
+	}
+	b.SetOwner("viewer1", "other", resp("other"))
+
+	a.InvalidateDocs(ids...)
+	assert.Greater(t, len(notifier.payloads), 1)
+	for _, payload := range notifier.payloads {
+		assert.LessOrEqual(t, len(payload), maxPayload)
+	}
+	assert.Eventually(t, func() bool { return b.Stats().Entries == 1 }, time.Second, time.Millisecond)
+
+	// an item too large by itself flushes other replicas
+	a.InvalidateOwnerList(strings.Repeat("x", 2*maxPayload))
+	assert.Eventually(t, func() bool { return b.Stats().Entries == 0 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,367 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache shares responses between replicas of the app.
+// Entries are kept in redis with indexes of buckets and documents,
+// every replica also keeps recently used entries in a local StructuredCache.
+// Invalidations are applied in redis and broadcast over pub/sub,
+// so other replicas drop their local copies too.
+//
+// Tickets are microseconds of the redis clock, the same for all replicas:
+// an invalidation leaves a marker with its time and a response read before
+// the marker is not stored.
+//
+// Scripts touch entries found in indexes, so all keys share one hash tag:
+// on Redis Cluster they live in one slot and one node serves the whole cache.
+// The cache is small and hot, a single node (with replicas) is what it needs
+type RedisCache struct {
+	client  redis.UniversalClient
+	prefix  string
+	ttl     time.Duration
+	channel string
+
+	local *StructuredCache
+	// local entries are used only while invalidations are received
+	live atomic.Bool
+
+	// offset of the redis clock, tickets are taken without a round trip
+	clockMu     sync.Mutex
+	clockOffset time.Duration
+	clockSynced time.Time
+}
+
+// ticketWindow is how long invalidation markers live,
+// responses read longer than that are not stored
+const ticketWindow = time.Minute
+
+// staleTicket is given when redis is unreachable, nothing is stored with it
+const staleTicket Ticket = 1
+
+const (
+	// callTimeout bounds every call, a stalled redis slows requests
+	// down but doesn't hang them
+	callTimeout = 500 * time.Millisecond
+	// clockSyncInterval is how often the redis clock is read for tickets,
+	// clockDrift covers the drift of the local clock meanwhile
+	clockSyncInterval = 10 * time.Second
+	clockDrift        = time.Millisecond
+)
+
+// setScript stores the entry unless its bucket or documents were
+// invalidated after the ticket.
+// KEYS: entry, bucket index, bucket marker, n document markers, n document indexes.
+// ARGV: ticket, value, ttl ms, n, ticket window us
+var setScript = redis.NewScript(`
+local ticket = tonumber(ARGV[1])
+local n = tonumber(ARGV[4])
+if ticket > 0 then
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+	if now - ticket > tonumber(ARGV[5]) then
+		return 0
+	end
+	for i = 3, 3 + n do
+		local mark = redis.call('GET', KEYS[i])
+		if mark and tonumber(mark) >= ticket then
+			return 0
+		end
+	end
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+redis.call('SADD', KEYS[2], KEYS[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[3])
+for i = 4 + n, 3 + 2 * n do
+	redis.call('SADD', KEYS[i], KEYS[1])
+	redis.call('PEXPIRE', KEYS[i], ARGV[3])
+end
+return 1
+`)
+
+// invalidateScript drops entries of the indexes and leaves markers.
+// KEYS: n indexes, n markers. ARGV: marker ttl ms
+var invalidateScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = t[1] .. string.format('%06d', t[2])
+local n = #KEYS / 2
+for i = 1, n do
+	for _, entry in ipairs(redis.call('SMEMBERS', KEYS[i])) do
+		redis.call('DEL', entry)
+	end
+	redis.call('DEL', KEYS[i])
+	redis.call('SET', KEYS[n + i], now, 'PX', ARGV[1])
+end
+return 1
+`)
+
+// redisEntry is the stored form of a response
+type redisEntry struct {
+	Status int         `json:"status"`
+	Body   []byte      `json:"body"`
+	Docs   []uuid.UUID `json:"docs,omitempty"`
+	// owner of anonymous responses, they are found by key only
+	Owner string `json:"owner,omitempty"`
+}
+
+// NewRedisCache keeps entries under keys {name}:... for ttl,
+// the local layer of the replica takes up to localMaxBytes
+func NewRedisCache(client redis.UniversalClient, name string, localMaxBytes int64, ttl time.Duration) *RedisCache {
+	return &RedisCache{
+		client:  client,
+		prefix:  "{" + name + "}:",
+		ttl:     ttl,
+		channel: name + ":invalidate",
+		local:   NewStructuredCache(localMaxBytes, ttl),
+	}
+}
+
+func (c *RedisCache) SetOwner(login string, key CacheKey, value CachedDocResp) {
+	c.set(bucket{kind: bucketOwner, login: login}, key, value)
+}
+
+func (c *RedisCache) GetOwner(login string, key CacheKey) (CachedDocResp, bool) {
+	return c.get(bucket{kind: bucketOwner, login: login}, key)
+}
+
+func (c *RedisCache) InvalidateOwnerList(login string) {
+	c.invalidate([]bucket{{kind: bucketOwner, login: login}}, nil)
+}
+
+func (c *RedisCache) SetGrant(grantee, owner string, key CacheKey, value CachedDocResp) {
+	c.set(bucket{kind: bucketGrant, login: grantee, holder: owner}, key, value)
+}
+
+func (c *RedisCache) GetGrant(grantee, owner string, key CacheKey) (CachedDocResp, bool) {
+	return c.get(bucket{kind: bucketGrant, login: grantee, holder: owner}, key)
+}
+
+func (c *RedisCache) InvalidateGrant(owner string, grantees []string) {
+	buckets := make([]bucket, 0, len(grantees))
+	for _, grantee := range grantees {
+		buckets = append(buckets, bucket{kind: bucketGrant, login: grantee, holder: owner})
+	}
+	c.invalidate(buckets, nil)
+}
+
+func (c *RedisCache) SetPublic(owner string, key CacheKey, value CachedDocResp) {
+	c.set(bucket{kind: bucketPublic, login: owner}, key, value)
+}
+
+// GetPublic finds the owner in the stored entry, keys are unique across owners
+func (c *RedisCache) GetPublic(key CacheKey) (CachedDocResp, bool) {
+	if c.live.Load() {
+		if value, ok := c.local.GetPublic(key); ok {
+			return value, true
+		}
+	}
+	return c.load(bucket{kind: bucketPublic}, key)
+}
+
+func (c *RedisCache) InvalidatePublic(owner string) {
+	c.invalidate([]bucket{{kind: bucketPublic, login: owner}}, nil)
+}
+
+func (c *RedisCache) InvalidateDocs(ids ...uuid.UUID) {
+	if len(ids) == 0 {
+		return
+	}
+	c.invalidate(nil, ids)
+}
+
+// Ticket is the local time moved to the redis clock. The offset is taken as
+// if redis answered at the end of the round trip, so tickets are never later
+// than the redis time of the read and invalidations are not missed
+func (c *RedisCache) Ticket() Ticket {
+	c.clockMu.Lock()
+	defer c.clockMu.Unlock()
+
+	if c.clockSynced.IsZero() || time.Since(c.clockSynced) >= clockSyncInterval {
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+		defer cancel()
+		now, err := c.client.Time(ctx).Result()
+		if err != nil {
+			log.Println("[RedisCache.Ticket] error: ", err.Error())
+			return staleTicket
+		}
+		c.clockSynced = time.Now()
+		c.clockOffset = now.Sub(c.clockSynced)
+	}
+	return Ticket(time.Now().Add(c.clockOffset - clockDrift).UnixMicro())
+}
+
+// Stats are counters of the local layer of the replica
+func (c *RedisCache) Stats() Stats {
+	return c.local.Stats()
+}
+
+// Listen applies invalidations of other replicas to the local layer until
+// ctx is done or the subscription breaks. Local entries are not used
+// while there is no subscription, invalidations can be missed then
+func (c *RedisCache) Listen(ctx context.Context) error {
+	sub := c.client.Subscribe(ctx, c.channel)
+	defer sub.Close()
+	defer func() {
+		c.live.Store(false)
+		c.local.reset()
+	}()
+	// Receive waits for the connection regardless of ctx
+	stop := context.AfterFunc(ctx, func() { sub.Close() })
+	defer stop()
+
+	for {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// invalidations before the subscription are unknown
+			c.local.reset()
+			c.live.Store(true)
+		case *redis.Message:
+			var inv invalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				log.Println("[RedisCache.Listen] bad message: ", err.Error())
+				continue
+			}
+			inv.apply(c.local)
+		}
+	}
+}
+
+func (c *RedisCache) get(b bucket, key CacheKey) (CachedDocResp, bool) {
+	if c.live.Load() {
+		if value, ok := c.local.get(b, key); ok {
+			return value, true
+		}
+	}
+	return c.load(b, key)
+}
+
+// load reads the entry from redis and keeps it in the local layer
+func (c *RedisCache) load(b bucket, key CacheKey) (CachedDocResp, bool) {
+	localTicket := c.local.Ticket()
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	data, err := c.client.Get(ctx, c.entryKey(b, key)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Println("[RedisCache.load] error: ", err.Error())
+		}
+		return CachedDocResp{}, false
+	}
+	var e redisEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		log.Println("[RedisCache.load] bad entry: ", err.Error())
+		return CachedDocResp{}, false
+	}
+	value := CachedDocResp{Status: e.Status, Body: e.Body, Docs: e.Docs}
+
+	if c.live.Load() {
+		local := value
+		local.Ticket = localTicket
+		if b.kind == bucketPublic {
+			c.local.SetPublic(e.Owner, key, local)
+		} else {
+			c.local.set(b, key, local)
+		}
+	}
+	return value, true
+}
+
+func (c *RedisCache) set(b bucket, key CacheKey, value CachedDocResp) {
+	// taken before redis, so an invalidation received meanwhile drops the local copy
+	localTicket := c.local.Ticket()
+
+	e := redisEntry{Status: value.Status, Body: value.Body, Docs: value.Docs}
+	if b.kind == bucketPublic {
+		e.Owner = b.login
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	entryKey := c.entryKey(b, key)
+	keys := []string{entryKey, c.bucketKey("b:", b), c.bucketKey("bm:", b)}
+	for _, id := range value.Docs {
+		keys = append(keys, c.prefix+"dm:"+id.String())
+	}
+	for _, id := range value.Docs {
+		keys = append(keys, c.prefix+"d:"+id.String())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	stored, err := setScript.Run(ctx, c.client, keys,
+		uint64(value.Ticket), data, c.ttl.Milliseconds(), len(value.Docs), ticketWindow.Microseconds()).Int()
+	if err != nil {
+		log.Println("[RedisCache.set] error: ", err.Error())
+		return
+	}
+	if stored == 0 || !c.live.Load() {
+		return
+	}
+
+	value.Ticket = localTicket
+	if b.kind == bucketPublic {
+		c.local.SetPublic(b.login, key, value)
+	} else {
+		c.local.set(b, key, value)
+	}
+}
+
+// invalidate drops entries in redis, then tells all replicas to drop local ones
+func (c *RedisCache) invalidate(buckets []bucket, ids []uuid.UUID) {
+	c.local.invalidate(buckets, ids)
+
+	var indexes, markers []string
+	for _, b := range buckets {
+		indexes = append(indexes, c.bucketKey("b:", b))
+		markers = append(markers, c.bucketKey("bm:", b))
+	}
+	for _, id := range ids {
+		indexes = append(indexes, c.prefix+"d:"+id.String())
+		markers = append(markers, c.prefix+"dm:"+id.String())
+	}
+	if len(indexes) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	if err := invalidateScript.Run(ctx, c.client, append(indexes, markers...), ticketWindow.Milliseconds()).Err(); err != nil {
+		log.Println("[RedisCache.invalidate] error: ", err.Error())
+	}
+
+	payload, _ := json.Marshal(newInvalidation("", buckets, ids))
+	if err := c.client.Publish(ctx, c.channel, payload).Err(); err != nil {
+		log.Println("[RedisCache.invalidate] can't publish: ", err.Error())
+	}
+}
+
+// entryKey of anonymous responses doesn't depend on the owner,
+// logins have no ":" so keys of buckets are not mixed
+func (c *RedisCache) entryKey(b bucket, key CacheKey) string {
+	if b.kind == bucketPublic {
+		return c.prefix + "e:p:" + string(key)
+	}
+	return c.bucketKey("e:", b) + ":" + string(key)
+}
+
+func (c *RedisCache) bucketKey(kind string, b bucket) string {
+	return c.prefix + kind + strconv.Itoa(int(b.kind)) + ":" + b.login + ":" + b.holder
+}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newReplicas returns caches of several app replicas sharing one in-process redis
+func newReplicas(t *testing.T, n int) (*miniredis.Miniredis, []*RedisCache) {
+	srv := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	replicas := make([]*RedisCache, n)
+	for i := range replicas {
+		client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+		t.Cleanup(func() { client.Close() })
+		replicas[i] = NewRedisCache(client, "test", 1<<20, time.Minute)
+		go replicas[i].Listen(ctx)
+	}
+	for _, c := range replicas {
+		require.Eventually(t, c.live.Load, time.Second, time.Millisecond)
+	}
+	return srv, replicas
+}
+
+func TestRedisCache_SharedEntries(t *testing.T) {
+	_, replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+
+	a.SetOwner("owner1", "k1", resp("doc"))
+	a.SetGrant("grantee1", "owner1", "k1", resp("shared"))
+	a.SetPublic("owner1", "p1", resp("public"))
+
+	v, ok := b.GetOwner("owner1", "k1")
+	require.True(t, ok)
+	assert.Equal(t, "doc", string(v.Body))
+	v, ok = b.GetGrant("grantee1", "owner1", "k1")
+	require.True(t, ok)
+	assert.Equal(t, "shared", string(v.Body))
+	v, ok = b.GetPublic("p1")
+	require.True(t, ok)
+	assert.Equal(t, "public", string(v.Body))
+
+	_, ok = b.GetOwner("grantee1", "k1")
+	assert.False(t, ok)
+	_, ok = b.GetGrant("grantee1", "owner2", "k1")
+	assert.False(t, ok)
+}
+
+func TestRedisCache_OneHashSlot(t *testing.T) {
+	srv, replicas := newReplicas(t, 1)
+	c := replicas[0]
+
+	doc := resp("doc")
+	doc.Docs = []uuid.UUID{uuid.New(), uuid.New()}
+	c.SetOwner("owner1", "k1", doc)
+	c.SetPublic("owner1", "p1", resp("public"))
+	c.InvalidateOwnerList("owner2")
+
+	// scripts touch keys of indexes, on Redis Cluster they must be in one slot
+	keys := srv.Keys()
+	require.NotEmpty(t, keys)
+	for _, key := range keys {
+		assert.True(t, strings.HasPrefix(key, "{test}:"), key)
+	}
+}
+
+func TestRedisCache_InvalidateAcrossReplicas(t *testing.T) {
+	_, replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+	doc1 := uuid.New()
+
+	list := resp("list")
+	list.Docs = []uuid.UUID{doc1}
+	a.SetOwner("owner1", "list", list)
+	a.SetGrant("grantee1", "owner1", "list", list)
+	a.SetPublic("owner1", "list", list)
+	a.SetOwner("viewer1", "file", list)
+
+	// b keeps them in its local layer now
+	for _, get := range []func() bool{
+		func() bool { _, ok := b.GetOwner("owner1", "list"); return ok },
+		func() bool { _, ok := b.GetGrant("grantee1", "owner1", "list"); return ok },
+		func() bool { _, ok := b.GetPublic("list"); return ok },
+		func() bool { _, ok := b.GetOwner("viewer1", "file"); return ok },
+	} {
+		require.True(t, get())
+	}
+	assert.Equal(t, 4, b.Stats().Entries)
+
+	// an upload on a drops lists on b
+	a.InvalidateOwnerList("owner1")
+	a.InvalidateGrant("owner1", []string{"grantee1"})
+	a.InvalidatePublic("owner1")
+	assert.Eventually(t, func() bool { return b.Stats().Entries == 1 }, time.Second, time.Millisecond)
+	_, ok := b.GetOwner("owner1", "list")
+	assert.False(t, ok)
+	_, ok = b.GetGrant("grantee1", "owner1", "list")
+	assert.False(t, ok)
+	_, ok = b.GetPublic("list")
+	assert.False(t, ok)
+
+	// a change of the document drops responses of other users
+	a.InvalidateDocs(doc1)
+	assert.Eventually(t, func() bool { return b.Stats().Entries == 0 }, time.Second, time.Millisecond)
+	_, ok = b.GetOwner("viewer1", "file")
+	assert.False(t, ok)
+}
+
+func TestRedisCache_RevokeThenRead(t *testing.T) {
+	_, replicas := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+	doc1 := uuid.New()
+
+	// a reads the document, b revokes access before a stores it
+	ticket := a.Ticket()
+	b.InvalidateDocs(doc1)
+	stale := resp("doc1")
+	stale.Docs = []uuid.UUID{doc1}
+	stale.Ticket = ticket
+	a.SetOwner("grantee1", "file", stale)
+	_, ok := b.GetOwner("grantee1", "file")
+	assert.False(t, ok)
+	_, ok = a.GetOwner("grantee1", "file")
+	assert.False(t, ok)
+
+	// a bucket dropped during the read
+	ticket = a.Ticket()
+	b.InvalidateGrant("owner1", []string{"grantee1"})
+	stale.Ticket = ticket
+	a.SetGrant("grantee1", "owner1", "list", stale)
+	_, ok = a.GetGrant("grantee1", "owner1", "list")
+	assert.False(t, ok)
+
+	// the next read is stored, tickets lag behind the redis clock
+	// by the round trip, so reads right after an invalidation are not
+	fresh := stale
+	assert.Eventually(t, func() bool {
+		fresh.Ticket = a.Ticket()
+		a.SetOwner("grantee1", "file", fresh)
+		_, ok := b.GetOwner("grantee1", "file")
+		return ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestRedisCache_TTL(t *testing.T) {
+	srv, replicas := newReplicas(t, 1)
+	c := replicas[0]
+
+	c.SetOwner("owner1", "k1", resp("doc"))
+	srv.FastForward(time.Minute)
+	// the local copy lives the same ttl
+	c.local.now = func() time.Time { return time.Now().Add(time.Minute) }
+	_, ok := c.GetOwner("owner1", "k1")
+	assert.False(t, ok)
+}
+
+func TestRedisCache_LostSubscription(t *testing.T) {
+	srv := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: srv.Addr()})
+	defer client.Close()
+	c := NewRedisCache(client, "test", 1<<20, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Listen(ctx) }()
+	require.Eventually(t, c.live.Load, time.Second, time.Millisecond)
+
+	c.SetOwner("owner1", "k1", resp("doc"))
+	assert.Equal(t, 1, c.Stats().Entries)
+
+	cancel()
+	<-done
+	// invalidations can be missed now, local entries are gone
+	assert.False(t, c.live.Load())
+	assert.Equal(t, 0, c.Stats().Entries)
+
+	// redis still serves the entry, nothing is kept locally
+	_, ok := c.GetOwner("owner1", "k1")
+	assert.True(t, ok)
+	assert.Equal(t, 0, c.Stats().Entries)
+}
+
+func TestRedisCache_Flush(t *testing.T) {
+	srv, replicas := newReplicas(t, 1)
+	c := replicas[0]
+	c.SetOwner("owner1", "k1", resp("doc"))
+	require.Equal(t, 1, c.Stats().Entries)
+
+	// a flush of a replica which can't describe the change drops local entries
+	srv.Publish(c.channel, `{"flush":true}`)
+	assert.Eventually(t, func() bool { return c.Stats().Entries == 0 }, time.Second, time.Millisecond)
+}
+
+func TestRedisCache_TicketClock(t *testing.T) {
+	srv, replicas := newReplicas(t, 1)
+	c := replicas[0]
+
+	first := c.Ticket()
+	commands := srv.CommandCount()
+	second := c.Ticket()
+	// the redis clock is read once per sync interval
+	assert.Equal(t, commands, srv.CommandCount())
+	assert.GreaterOrEqual(t, second, first)
+	// tickets are not later than the redis clock
+	assert.LessOrEqual(t, int64(second), time.Now().UnixMicro())
+}
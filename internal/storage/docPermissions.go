@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// permissionsOf is the sql expression of permissions of the docs row
+// with the given alias, scanned into []entity.Permission
+func permissionsOf(alias string) string {
+	return `coalesce((select jsonb_agg(jsonb_build_object('login', g.grantee, 'role', g.role) order by g.grantee)
+					from (select coalesce(p.login, '` + entity.GroupPrefix + `' || p.group_name) as grantee, p.role
+						from doc_permissions p where p.doc_id = ` + alias + `.id) g), '[]'::jsonb)`
+}
+
+// sharedWith is the sql condition for documents of the docs row
+// with the given alias shared with the login placeholder or its groups
+func sharedWith(alias, login string) string {
+	return `exists(select 1 from doc_permissions p where p.doc_id = ` + alias + `.id and (p.login = ` + login + `
+				or p.group_name in (select m.group_name from group_members m where m.login = ` + login + `)))`
+}
+
+// SetPermissions replaces all permissions of the document
+func (wc *wcs) SetPermissions(ctx context.Context, id uuid.UUID, permissions []entity.Permission) error {
+	tx, err := wc.pool.Begin(ctx)
+	if err != nil {
+		return appError.Internal()
+	}
+	defer tx.Rollback(ctx)
+
+	// the row lock orders concurrent changes of the same document
+	var locked uuid.UUID
+	err = tx.QueryRow(ctx, `select id from docs where id = $1 and deleted_at is null for update`, id).Scan(&locked)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return appError.NotFound()
+		}
+		log.Println("[SetPermissions] error: ", err.Error())
+		return appError.Internal()
+	}
+
+	if _, err := tx.Exec(ctx, `delete from doc_permissions where doc_id = $1`, id); err != nil {
+		log.Println("[SetPermissions] error: ", err.Error())
+		return appError.Internal()
+	}
+	if err := insertPermissions(ctx, tx, id, permissions); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return appError.Internal()
+	}
+	return nil
+}
+
+func insertPermissions(ctx context.Context, tx pgx.Tx, id uuid.UUID, permissions []entity.Permission) error {
+	if len(permissions) == 0 {
+		return nil
+	}
+	// null login or group is stored as an empty string in the arrays
+	logins := make([]string, len(permissions))
+	groups := make([]string, len(permissions))
+	roles := make([]string, len(permissions))
+	for i, p := range permissions {
+		if strings.HasPrefix(p.Login, entity.GroupPrefix) {
+			groups[i] = strings.TrimPrefix(p.Login, entity.GroupPrefix)
+		} else {
+			logins[i] = p.Login
+		}
+		roles[i] = string(p.Role)
+	}
+
+	query := `insert into doc_permissions(doc_id, login, group_name, role)
+				select $1, nullif(login, ''), nullif(group_name, ''), role
+				from unnest($2::text[], $3::text[], $4::text[]) as t(login, group_name, role)`
+
+	_, err := tx.Exec(ctx, query, id, logins, groups, roles)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23503" {
+			return appError.BadRequest("permissions: user or group doesn't exist")
+		}
+		log.Println("[insertPermissions] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage/filter"
+	"AstralTest/pkg/appError"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SortName    = "name"
+	SortCreated = "created"
+	SortSize    = "size"
+	SortMime    = "mime"
+)
+
+// sortColumns are sql expressions of the sort fields, never null
+var sortColumns = map[string]string{
+	SortName:    "name",
+	SortCreated: "coalesce(created, 'epoch'::timestamp)",
+	SortSize:    "size",
+	SortMime:    "coalesce(mime, '')",
+}
+
+// DocsListQuery describes one page of documents list
+type DocsListQuery struct {
+	// OwnerLogin is the owner of the documents, empty means the caller
+	OwnerLogin string
+	// Login is the caller, lists of other owners show only documents shared with the caller
+	Login string
+	Where filter.Expr
+	Sort  string
+	Desc  bool
+	// Cursor is Next or Prev of the previous page, empty for the first page
+	Cursor string
+	Limit  int
+	// WithTotal counts all documents matching the filter
+	WithTotal bool
+}
+
+// Validate checks sort field and fills defaults
+func (q *DocsListQuery) Validate() error {
+	if q.Sort == "" {
+		q.Sort = SortName
+	}
+	if _, ok := sortColumns[q.Sort]; !ok {
+		return appError.BadRequest(fmt.Sprintf("unknown sort field %q, expected one of name, created, size, mime", q.Sort))
+	}
+	if q.Limit < 1 {
+		return appError.BadRequest("limit value shuld be more than 0")
+	}
+	return nil
+}
+
+// cursor points to the edge document of a page, documents are ordered by (sort value, id)
+type cursor struct {
+	Sort  string    `json:"s"`
+	Desc  bool      `json:"d,omitempty"`
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+	// Back is set for cursors of the previous page
+	Back bool `json:"b,omitempty"`
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string, q *DocsListQuery) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, appError.BadRequest("bad cursor")
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, appError.BadRequest("bad cursor")
+	}
+	if c.Sort != q.Sort || c.Desc != q.Desc {
+		return nil, appError.BadRequest("cursor belongs to a list with another sort order")
+	}
+	return &c, nil
+}
+
+// sortValue returns value of the sort field of the document for the cursor
+func sortValue(doc *entity.Document, sort string) string {
+	switch sort {
+	case SortCreated:
+		return doc.Created.Format(time.RFC3339Nano)
+	case SortSize:
+		return strconv.FormatInt(doc.Size, 10)
+	case SortMime:
+		return doc.Mime
+	default:
+		return doc.Name
+	}
+}
+
+// sqlValue converts cursor value to the type of the sort column
+func (c *cursor) sqlValue() (interface{}, error) {
+	switch c.Sort {
+	case SortCreated:
+		return time.Parse(time.RFC3339Nano, c.Value)
+	case SortSize:
+		return strconv.ParseInt(c.Value, 10, 64)
+	default:
+		return c.Value, nil
+	}
+}
+
+// GetDocsList returns a page of documents. Pages use keyset pagination:
+// the next page starts right after the last document of the current one,
+// so it is stable when documents are added or removed.
+func (wc *wcs) GetDocsList(ctx context.Context, q DocsListQuery) (*entity.DocsPage, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var after *cursor
+	if q.Cursor != "" {
+		var err error
+		if after, err = decodeCursor(q.Cursor, &q); err != nil {
+			return nil, err
+		}
+	}
+
+	var args []interface{}
+	where := ""
+	// add login sorting
+	if q.OwnerLogin == "" {
+		where += fmt.Sprintf(" owner_login = $%d", len(args)+1)
+		args = append(args, q.Login)
+	} else {
+		where += fmt.Sprintf(" owner_login = $%d and (public = true or %s)", len(args)+1, sharedWith("docs", fmt.Sprintf("$%d", len(args)+2)))
+		args = append(args, q.OwnerLogin, q.Login)
+	}
+
+	// documents in the trash are hidden
+	where += " AND deleted_at is null"
+
+	// add user filter, it's compiled to placeholders only
+	if q.Where != nil {
+		var condition string
+		condition, args = filter.SQL(q.Where, args)
+		where += " AND " + condition
+	}
+
+	var total *int64
+	if q.WithTotal {
+		var count int64
+		err := wc.pool.QueryRow(ctx, "select count(*) from docs where"+where, args...).Scan(&count)
+		if err != nil {
+			log.Println("[GetDocsList] count error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		total = &count
+	}
+
+	// previous page is read backwards from its cursor and reversed after
+	column := sortColumns[q.Sort]
+	backward := after != nil && after.Back
+	desc := q.Desc != backward
+	comparison, direction := ">", "ASC"
+	if desc {
+		comparison, direction = "<", "DESC"
+	}
+
+	if after != nil {
+		value, err := after.sqlValue()
+		if err != nil {
+			return nil, appError.BadRequest("bad cursor")
+		}
+		where += fmt.Sprintf(" AND (%s, id) %s ($%d, $%d)", column, comparison, len(args)+1, len(args)+2)
+		args = append(args, value, after.ID)
+	}
+
+	query := `select id, name, coalesce(mime, ''), file, public, coalesce(created, 'epoch'::timestamp), owner_login,
+				` + permissionsOf("docs") + `, json_data, coalesce(content_hash, ''), size, current_version, updated
+			from docs
+			where` + where +
+		fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", column, direction, direction, len(args)+1)
+	// one more document tells if there is a page after this one
+	args = append(args, q.Limit+1)
+
+	rows, err := wc.pool.Query(ctx, query, args...)
+	if err != nil {
+		log.Println("[GetDocsList] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	docs := []*entity.Document{}
+	for rows.Next() {
+		var doc entity.Document
+		err := rows.Scan(
+			&doc.ID,
+			&doc.Name,
+			&doc.Mime,
+			&doc.File,
+			&doc.Public,
+			&doc.Created,
+			&doc.Owner,
+			&doc.Permissions,
+			&doc.JsonData,
+			&doc.Hash,
+			&doc.Size,
+			&doc.Version,
+			&doc.Updated,
+		)
+		if err != nil {
+			log.Println("[GetDocsList] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		docs = append(docs, &doc)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+
+	hasMore := len(docs) > q.Limit
+	if hasMore {
+		docs = docs[:q.Limit]
+	}
+	if backward {
+		for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+			docs[i], docs[j] = docs[j], docs[i]
+		}
+	}
+
+	page := &entity.DocsPage{Docs: docs, Total: total}
+	if len(docs) == 0 {
+		return page, nil
+	}
+	// moving backwards, there is a next page for sure: we came from it
+	hasNext := hasMore || backward
+	hasPrev := (backward && hasMore) || (!backward && after != nil)
+	if hasNext {
+		last := docs[len(docs)-1]
+		page.Next = cursor{Sort: q.Sort, Desc: q.Desc, Value: sortValue(last, q.Sort), ID: last.ID}.encode()
+	}
+	if hasPrev {
+		first := docs[0]
+		page.Prev = cursor{Sort: q.Sort, Desc: q.Desc, Value: sortValue(first, q.Sort), ID: first.ID, Back: true}.encode()
+	}
+	return page, nil
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	doc := &entity.Document{
+		ID:      uuid.New(),
+		Name:    "report.txt",
+		Size:    42,
+		Created: time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC),
+	}
+
+	for _, sort := range []string{SortName, SortCreated, SortSize, SortMime} {
+		q := &DocsListQuery{Sort: sort, Desc: true, Limit: 10}
+		encoded := cursor{Sort: sort, Desc: true, Value: sortValue(doc, sort), ID: doc.ID}.encode()
+
+		decoded, err := decodeCursor(encoded, q)
+		require.NoError(t, err)
+		assert.Equal(t, doc.ID, decoded.ID)
+		_, err = decoded.sqlValue()
+		require.NoError(t, err)
+	}
+
+	created, err := (&cursor{Sort: SortCreated, Value: sortValue(doc, SortCreated)}).sqlValue()
+	require.NoError(t, err)
+	assert.True(t, doc.Created.Equal(created.(time.Time)))
+}
+
+func TestCursor_Errors(t *testing.T) {
+	q := &DocsListQuery{Sort: SortName, Limit: 10}
+
+	_, err := decodeCursor("not a cursor!", q)
+	assert.EqualError(t, err, "bad cursor")
+
+	// cursor of another sort order can't be used
+	other := cursor{Sort: SortSize, Value: "1", ID: uuid.New()}.encode()
+	_, err = decodeCursor(other, q)
+	assert.Error(t, err)
+
+	bad := &DocsListQuery{Sort: "owner_login", Limit: 10}
+	assert.Error(t, bad.Validate())
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// GetOwnerDocIds returns ids of all documents of the owner, the trash included
+func (wc *wcs) GetOwnerDocIds(ctx context.Context, ownerLogin string) ([]uuid.UUID, error) {
+	rows, err := wc.pool.Query(ctx, `select id from docs where owner_login = $1`, ownerLogin)
+	if err != nil {
+		log.Println("[GetOwnerDocIds] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, appError.Internal()
+		}
+		ids = append(ids, id)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return ids, nil
+}
+
+// GetOwnerGrantees returns users and "group:<name>" grantees
+// of any document of the owner
+func (wc *wcs) GetOwnerGrantees(ctx context.Context, ownerLogin string) ([]string, error) {
+	query := `select distinct coalesce(p.login, '` + entity.GroupPrefix + `' || p.group_name)
+				from doc_permissions p
+				join docs d on d.id = p.doc_id
+				where d.owner_login = $1`
+
+	rows, err := wc.pool.Query(ctx, query, ownerLogin)
+	if err != nil {
+		log.Println("[GetOwnerGrantees] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	var grantees []string
+	for rows.Next() {
+		var grantee string
+		if err := rows.Scan(&grantee); err != nil {
+			return nil, appError.Internal()
+		}
+		grantees = append(grantees, grantee)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return grantees, nil
+}
+
+// TransferDocs gives all documents and groups of one user to another.
+// Permissions of the new owner on these documents are dropped, the owner has no rows
+func (wc *wcs) TransferDocs(ctx context.Context, fromLogin, toLogin string) error {
+	tx, err := wc.pool.Begin(ctx)
+	if err != nil {
+		return appError.Internal()
+	}
+	defer tx.Rollback(ctx)
+
+	queries := []string{
+		`delete from doc_permissions
+			where login = $2 and doc_id in (select id from docs where owner_login = $1)`,
+		`update docs set owner_login = $2 where owner_login = $1`,
+		// permissions given to the groups keep working
+		`update groups set owner_login = $2 where owner_login = $1`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(ctx, query, fromLogin, toLogin); err != nil {
+			log.Println("[TransferDocs] error: ", err.Error())
+			return appError.Internal()
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		log.Println("[TransferDocs] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+)
+
+// ts_headline marks matches with these symbols, the text is escaped
+// after that and the marks are replaced with tags
+const (
+	highlightStart = "⟦"
+	highlightStop  = "⟧"
+)
+
+const headlineOptions = "StartSel=" + highlightStart + ", StopSel=" + highlightStop
+
+// SearchDocs finds documents visible to login by websearch query
+// ("quoted phrase", or, -word), best matches first.
+// Non-empty owners limits the search to documents of these owners.
+func (wc *wcs) SearchDocs(ctx context.Context, login string, owners []string, query string, limit int) ([]*entity.SearchHit, error) {
+	// same rules as for reading a single document
+	where := "deleted_at is null and search @@ q and (owner_login = $2 or public or " + sharedWith("docs", "$2") + ")"
+	args := []interface{}{query, login}
+	if len(owners) > 0 {
+		where += fmt.Sprintf(" and owner_login = ANY($%d)", len(args)+1)
+		args = append(args, owners)
+	}
+	args = append(args, limit)
+
+	// headlines are expensive, so they are made only for the found page
+	sqlQuery := `select d.id, d.name, coalesce(d.mime, ''), d.file, d.public, coalesce(d.created, 'epoch'::timestamp),
+					d.owner_login, ` + permissionsOf("d") + `, d.json_data, coalesce(d.content_hash, ''), d.size, d.current_version,
+					d.updated, found.rank,
+					ts_headline('simple', d.name, found.q, '` + headlineOptions + `, HighlightAll=true'),
+					ts_headline('simple', coalesce(nullif(d.content_text, ''),
+						(select string_agg(v #>> '{}', ' ')
+							from jsonb_path_query(d.json_data, 'strict $.** ? (@.type() == "string")') v), ''),
+						found.q, '` + headlineOptions + `, MaxFragments=3, MaxWords=20, MinWords=5')
+				from (
+					select id, q, ts_rank(search, q) as rank
+					from docs, websearch_to_tsquery('simple', $1) q
+					where ` + where + fmt.Sprintf(`
+					order by rank desc, id
+					limit $%d
+				) found
+				join docs d on d.id = found.id
+				order by found.rank desc, d.id`, len(args))
+
+	rows, err := wc.pool.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		log.Println("[SearchDocs] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	hits := []*entity.SearchHit{}
+	for rows.Next() {
+		var hit entity.SearchHit
+		err := rows.Scan(
+			&hit.ID,
+			&hit.Name,
+			&hit.Mime,
+			&hit.File,
+			&hit.Public,
+			&hit.Created,
+			&hit.Owner,
+			&hit.Permissions,
+			&hit.JsonData,
+			&hit.Hash,
+			&hit.Size,
+			&hit.Version,
+			&hit.Updated,
+			&hit.Rank,
+			&hit.Headline,
+			&hit.Snippet,
+		)
+		if err != nil {
+			log.Println("[SearchDocs] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		hit.Headline = highlight(hit.Headline)
+		hit.Snippet = highlight(hit.Snippet)
+		hits = append(hits, &hit)
+	}
+	if rows.Err() != nil {
+		log.Println("[SearchDocs] error: ", rows.Err().Error())
+		return nil, appError.Internal()
+	}
+	return hits, nil
+}
+
+// highlight escapes the headline and turns the marks of matches into <b></b>
+func highlight(headline string) string {
+	headline = html.EscapeString(headline)
+	headline = strings.ReplaceAll(headline, highlightStart, "<b>")
+	return strings.ReplaceAll(headline, highlightStop, "</b>")
+}
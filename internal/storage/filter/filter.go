@@ -0,0 +1,383 @@
+// Package filter implements the filter language of the documents list.
+//
+// Grammar:
+//
+//	expr      = and {"or" and}
+//	and       = factor {"and" factor}
+//	factor    = "(" expr ")" | condition
+//	condition = field op value
+//	field     = "name" | "mime" | "public" | "created" | "file" | "json" {"." segment}
+//	segment   = identifier | integer | string
+//	op        = "eq" | "ne" | "lt" | "gt" | "prefix" | "in" | "contains"
+//	value     = string | number | "true" | "false" | "null" | "[" value {"," value} "]"
+//
+// Strings are single quoted, a quote inside is doubled: 'it”s'.
+// Example: name prefix 'report' and (json.status in ['draft', 'review'] or public eq true)
+//
+// Expressions are compiled to parameterized SQL, user input never gets into the query text.
+package filter
+
+import (
+	"AstralTest/pkg/appError"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// limits protect the database from huge filters
+	maxConditions = 32
+	maxDepth      = 8
+	maxListSize   = 100
+)
+
+type Op string
+
+const (
+	OpEq       Op = "eq"
+	OpNe       Op = "ne"
+	OpLt       Op = "lt"
+	OpGt       Op = "gt"
+	OpPrefix   Op = "prefix"
+	OpIn       Op = "in"
+	OpContains Op = "contains"
+)
+
+type fieldType int
+
+const (
+	typeString fieldType = iota
+	typeBool
+	typeTime
+	typeJson
+)
+
+// columns are the only docs columns which can be filtered
+var columns = map[string]fieldType{
+	"name":    typeString,
+	"mime":    typeString,
+	"public":  typeBool,
+	"created": typeTime,
+	"file":    typeBool,
+}
+
+// allowed operators of every field type
+var typeOps = map[fieldType][]Op{
+	typeString: {OpEq, OpNe, OpLt, OpGt, OpPrefix, OpIn, OpContains},
+	typeBool:   {OpEq, OpNe},
+	typeTime:   {OpEq, OpNe, OpLt, OpGt, OpIn},
+	typeJson:   {OpEq, OpNe, OpLt, OpGt, OpPrefix, OpIn, OpContains},
+}
+
+// Expr is a parsed filter
+type Expr interface {
+	// String returns canonical form of the filter, equal filters have equal strings
+	String() string
+	build(b *builder) string
+}
+
+type logical struct {
+	op    string // "and" or "or"
+	items []Expr
+}
+
+func (l *logical) String() string {
+	parts := make([]string, len(l.items))
+	for i, item := range l.items {
+		parts[i] = item.String()
+	}
+	return "(" + strings.Join(parts, " "+l.op+" ") + ")"
+}
+
+func (l *logical) build(b *builder) string {
+	parts := make([]string, len(l.items))
+	for i, item := range l.items {
+		parts[i] = item.build(b)
+	}
+	return "(" + strings.Join(parts, " "+strings.ToUpper(l.op)+" ") + ")"
+}
+
+type condition struct {
+	field string
+	path  []string // json path, only for json field
+	op    Op
+	value literal
+	// sqlValue is the value converted to the column type
+	sqlValue interface{}
+}
+
+func (c *condition) String() string {
+	field := c.field
+	for _, segment := range c.path {
+		field += "." + quote(segment)
+	}
+	return field + " " + string(c.op) + " " + c.value.String()
+}
+
+func (c *condition) build(b *builder) string {
+	if c.field == "json" {
+		return c.buildJson(b)
+	}
+
+	column := c.field
+	switch c.op {
+	case OpEq:
+		return column + " = " + b.arg(c.sqlValue)
+	case OpNe:
+		return column + " <> " + b.arg(c.sqlValue)
+	case OpLt:
+		return column + " < " + b.arg(c.sqlValue)
+	case OpGt:
+		return column + " > " + b.arg(c.sqlValue)
+	case OpPrefix:
+		return "starts_with(" + column + ", " + b.arg(c.sqlValue) + ")"
+	case OpContains:
+		return "strpos(" + column + ", " + b.arg(c.sqlValue) + ") > 0"
+	default: // OpIn
+		return column + " = ANY(" + b.arg(c.sqlValue) + ")"
+	}
+}
+
+// buildJson compares jsonb values, so 1 equals 1.0 and "1" doesn't equal 1
+func (c *condition) buildJson(b *builder) string {
+	if c.op == OpPrefix {
+		// #>> gives text of the value
+		return "starts_with(json_data #>> " + b.arg(c.path) + ", " + b.arg(c.sqlValue) + ")"
+	}
+
+	path := "json_data #> " + b.arg(c.path)
+	switch c.op {
+	case OpEq:
+		return path + " = " + b.arg(c.sqlValue) + "::jsonb"
+	case OpNe:
+		// documents without the path don't match, as with NULL columns
+		return path + " <> " + b.arg(c.sqlValue) + "::jsonb"
+	case OpLt:
+		return path + " < " + b.arg(c.sqlValue) + "::jsonb"
+	case OpGt:
+		return path + " > " + b.arg(c.sqlValue) + "::jsonb"
+	case OpContains:
+		// array contains the element or object contains the pairs
+		return path + " @> " + b.arg(c.sqlValue) + "::jsonb"
+	default: // OpIn
+		return path + " = ANY(" + b.arg(c.sqlValue) + "::jsonb[])"
+	}
+}
+
+type builder struct {
+	args []interface{}
+}
+
+func (b *builder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+// SQL compiles the filter into a condition. Placeholders continue
+// the numbering of args, the returned args include them.
+func SQL(e Expr, args []interface{}) (string, []interface{}) {
+	b := &builder{args: args}
+	return e.build(b), b.args
+}
+
+// Parse parses and validates the filter
+func Parse(input string) (Expr, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	expr, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, errorAt(tok, "unexpected %s", tok)
+	}
+	return expr, nil
+}
+
+// Equal makes "field eq value" filter from the legacy key/value parameters,
+// value is converted to the type of the field
+func Equal(field, value string) (Expr, error) {
+	fieldType, ok := columns[field]
+	if !ok {
+		return nil, appError.BadRequest(fmt.Sprintf("filter: unknown field %q", field))
+	}
+	var lit literal
+	switch fieldType {
+	case typeBool:
+		if value != "true" && value != "false" {
+			return nil, appError.BadRequest(fmt.Sprintf("filter: %s expects true or false", field))
+		}
+		lit = literal{kind: literalBool, text: value}
+	default:
+		lit = literal{kind: literalString, text: value}
+	}
+
+	cond := &condition{field: field, op: OpEq, value: lit}
+	if err := cond.check(token{pos: 0}); err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+// check validates operator and value for the field and converts the value
+func (c *condition) check(at token) error {
+	fieldType := typeJson
+	if c.field != "json" {
+		fieldType = columns[c.field]
+	}
+
+	allowed := false
+	for _, op := range typeOps[fieldType] {
+		if op == c.op {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return errorAt(at, "operator %s can't be used with %s", c.op, c.field)
+	}
+
+	if c.op == OpIn {
+		if c.value.kind != literalList {
+			return errorAt(at, "operator in expects a list")
+		}
+		if len(c.value.items) == 0 {
+			return errorAt(at, "list of in can't be empty")
+		}
+	} else if c.value.kind == literalList && !(fieldType == typeJson && c.op == OpContains) {
+		return errorAt(at, "operator %s doesn't accept a list", c.op)
+	}
+
+	values := []literal{c.value}
+	if c.op == OpIn {
+		values = c.value.items
+	}
+	converted := make([]interface{}, len(values))
+	for i, value := range values {
+		v, err := convert(fieldType, c.op, value)
+		if err != nil {
+			return errorAt(at, "%s: %s", c.field, err.Error())
+		}
+		converted[i] = v
+	}
+
+	if c.op != OpIn {
+		c.sqlValue = converted[0]
+		return nil
+	}
+	// typed arrays, so pgx can encode them
+	switch fieldType {
+	case typeString, typeJson:
+		list := make([]string, len(converted))
+		for i, v := range converted {
+			list[i] = v.(string)
+		}
+		c.sqlValue = list
+	case typeTime:
+		list := make([]time.Time, len(converted))
+		for i, v := range converted {
+			list[i] = v.(time.Time)
+		}
+		c.sqlValue = list
+	}
+	return nil
+}
+
+func convert(fieldType fieldType, op Op, value literal) (interface{}, error) {
+	switch fieldType {
+	case typeString:
+		if value.kind != literalString {
+			return nil, fmt.Errorf("expected string, got %s", value)
+		}
+		return value.text, nil
+	case typeBool:
+		if value.kind != literalBool {
+			return nil, fmt.Errorf("expected true or false, got %s", value)
+		}
+		return value.text == "true", nil
+	case typeTime:
+		if value.kind != literalString {
+			return nil, fmt.Errorf("expected time string, got %s", value)
+		}
+		return parseTime(value.text)
+	default: // typeJson
+		if op == OpPrefix {
+			if value.kind != literalString {
+				return nil, fmt.Errorf("prefix expects string, got %s", value)
+			}
+			return value.text, nil
+		}
+		return value.json(), nil
+	}
+}
+
+// parseTime accepts RFC 3339 time or a date
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad time %q, expected RFC 3339 or YYYY-MM-DD", s)
+}
+
+type literalKind int
+
+const (
+	literalString literalKind = iota
+	literalNumber
+	literalBool
+	literalNull
+	literalList
+)
+
+type literal struct {
+	kind  literalKind
+	text  string // string value or number, bool, null as written
+	items []literal
+}
+
+func (l literal) String() string {
+	switch l.kind {
+	case literalString:
+		return quote(l.text)
+	case literalList:
+		parts := make([]string, len(l.items))
+		for i, item := range l.items {
+			parts[i] = item.String()
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	default:
+		return l.text
+	}
+}
+
+// json returns the value as json text for jsonb comparisons
+func (l literal) json() string {
+	switch l.kind {
+	case literalString:
+		data, _ := json.Marshal(l.text)
+		return string(data)
+	case literalList:
+		parts := make([]string, len(l.items))
+		for i, item := range l.items {
+			parts[i] = item.json()
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	default:
+		return l.text
+	}
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func errorAt(tok token, format string, args ...interface{}) error {
+	return appError.BadRequest(fmt.Sprintf("filter: "+format+" at position %d", append(args, tok.pos+1)...))
+}
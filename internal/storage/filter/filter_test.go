@@ -0,0 +1,170 @@
+package filter
+
+import (
+	"AstralTest/pkg/appError"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_SQL(t *testing.T) {
+	testCases := []struct {
+		name      string
+		input     string
+		sql       string
+		args      []interface{}
+		canonical string
+	}{
+		{
+			name:      "string column",
+			input:     "name eq 'report'",
+			sql:       "name = $2",
+			args:      []interface{}{"owner", "report"},
+			canonical: "name eq 'report'",
+		},
+		{
+			name:      "bool column",
+			input:     "PUBLIC ne false",
+			sql:       "public <> $2",
+			args:      []interface{}{"owner", false},
+			canonical: "public ne false",
+		},
+		{
+			name:      "prefix and in",
+			input:     "name prefix 'it''s' and mime in ['text/plain', 'application/json']",
+			sql:       "(starts_with(name, $2) AND mime = ANY($3))",
+			args:      []interface{}{"owner", "it's", []string{"text/plain", "application/json"}},
+			canonical: "(name prefix 'it''s' and mime in ['text/plain', 'application/json'])",
+		},
+		{
+			name:  "time column",
+			input: "created gt '2024-01-02'",
+			sql:   "created > $2",
+			args:  []interface{}{"owner", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:  "and binds tighter than or",
+			input: "file eq true or name eq 'a' and mime eq 'b'",
+			sql:   "(file = $2 OR (name = $3 AND mime = $4))",
+			args:  []interface{}{"owner", true, "a", "b"},
+		},
+		{
+			name:  "parentheses",
+			input: "(file eq true or name eq 'a') and mime eq 'b'",
+			sql:   "((file = $2 OR name = $3) AND mime = $4)",
+			args:  []interface{}{"owner", true, "a", "b"},
+		},
+		{
+			name:      "json path",
+			input:     "json.items.0.'price usd' gt 10.5",
+			sql:       "json_data #> $2 > $3::jsonb",
+			args:      []interface{}{"owner", []string{"items", "0", "price usd"}, "10.5"},
+			canonical: "json.'items'.'0'.'price usd' gt 10.5",
+		},
+		{
+			name:  "json in and contains",
+			input: "json.status in ['draft', 1, null] and json.tags contains ['a']",
+			sql:   "(json_data #> $2 = ANY($3::jsonb[]) AND json_data #> $4 @> $5::jsonb)",
+			args:  []interface{}{"owner", []string{"status"}, []string{`"draft"`, "1", "null"}, []string{"tags"}, `["a"]`},
+		},
+		{
+			name:  "json prefix",
+			input: "json.title prefix 'Re'",
+			sql:   "starts_with(json_data #>> $2, $3)",
+			args:  []interface{}{"owner", []string{"title"}, "Re"},
+		},
+		{
+			name:      "non-ascii",
+			input:     "json.цена_руб gt 10 and name eq 'отчёт'",
+			sql:       "(json_data #> $2 > $3::jsonb AND name = $4)",
+			args:      []interface{}{"owner", []string{"цена_руб"}, "10", "отчёт"},
+			canonical: "(json.'цена_руб' gt 10 and name eq 'отчёт')",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expr, err := Parse(tc.input)
+			require.NoError(t, err)
+
+			sql, args := SQL(expr, []interface{}{"owner"})
+			assert.Equal(t, tc.sql, sql)
+			assert.Equal(t, tc.args, args)
+
+			if tc.canonical != "" {
+				assert.Equal(t, tc.canonical, expr.String())
+			}
+			// canonical form parses to the same filter
+			again, err := Parse(expr.String())
+			require.NoError(t, err)
+			assert.Equal(t, expr.String(), again.String())
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	testCases := []struct {
+		input string
+		err   string
+	}{
+		{"owner_login eq 'x'", `filter: unknown field "owner_login", expected one of name, mime, public, created, file, json at position 1`},
+		{"name; drop table docs", `filter: unexpected symbol ';' at position 5`},
+		{"name eq 'a' → 'b'", `filter: unexpected symbol '→' at position 13`},
+		{"name like 'x'", `filter: unknown operator "like", expected one of eq, ne, lt, gt, prefix, in, contains at position 6`},
+		{"name eq report", `filter: expected value, got "report" (strings must be quoted) at position 9`},
+		{"name eq 'x", `filter: unterminated string at position 9`},
+		{"public eq 'yes'", `filter: public: expected true or false, got 'yes' at position 11`},
+		{"public prefix 't'", `filter: operator prefix can't be used with public at position 15`},
+		{"name in 'a'", `filter: operator in expects a list at position 9`},
+		{"name in []", `filter: list of in can't be empty at position 9`},
+		{"name eq ['a']", `filter: operator eq doesn't accept a list at position 9`},
+		{"created lt 'yesterday'", `filter: created: bad time "yesterday", expected RFC 3339 or YYYY-MM-DD at position 12`},
+		{"(name eq 'a'", `filter: expected ")", got end of filter at position 13`},
+		{"name eq 'a' mime eq 'b'", `filter: unexpected "mime" at position 13`},
+		{"json.a.1.5 eq 1", `filter: bad array index 1.5 at position 8`},
+		{"", `filter: expected field, got end of filter at position 1`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := Parse(tc.input)
+			require.Error(t, err)
+			appErr, ok := err.(appError.AppError)
+			require.True(t, ok)
+			assert.Equal(t, 400, appErr.Code())
+			assert.Equal(t, tc.err, appErr.Error())
+		})
+	}
+}
+
+func TestParse_Limits(t *testing.T) {
+	input := "name eq 'a'"
+	for i := 0; i < maxConditions; i++ {
+		input += " or name eq 'a'"
+	}
+	_, err := Parse(input)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "too many conditions")
+
+	deep := "name eq 'a'"
+	for i := 0; i <= maxDepth; i++ {
+		deep = "(" + deep + ")"
+	}
+	_, err = Parse(deep)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "too deep nesting")
+}
+
+func TestEqual(t *testing.T) {
+	expr, err := Equal("public", "true")
+	require.NoError(t, err)
+	sql, args := SQL(expr, nil)
+	assert.Equal(t, "public = $1", sql)
+	assert.Equal(t, []interface{}{true}, args)
+
+	_, err = Equal("1=1; --", "x")
+	require.Error(t, err)
+	assert.Equal(t, 400, err.(appError.AppError).Code())
+}
@@ -0,0 +1,325 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenPunct // ( ) [ ] , .
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // byte offset in the input
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of filter"
+	case tokenString:
+		return quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case strings.IndexByte("()[],.", c) >= 0:
+			tokens = append(tokens, token{kind: tokenPunct, text: string(c), pos: i})
+			i++
+
+		case c == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(input) {
+					return nil, errorAt(token{pos: start}, "unterminated string")
+				}
+				if input[i] == '\'' {
+					// doubled quote is a quote inside the string
+					if i+1 < len(input) && input[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(input[i])
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenString, text: b.String(), pos: start})
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i = scanNumber(input, i)
+			text := input[start:i]
+			if !json.Valid([]byte(text)) {
+				return nil, errorAt(token{pos: start}, "bad number %q", text)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: text, pos: start})
+
+		default:
+			// identifiers may have letters of any script, json keys do
+			r, _ := utf8.DecodeRuneInString(input[i:])
+			if r != '_' && !unicode.IsLetter(r) {
+				return nil, errorAt(token{pos: i}, "unexpected symbol %q", r)
+			}
+			start := i
+			for i < len(input) {
+				r, width := utf8.DecodeRuneInString(input[i:])
+				if r != '_' && r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += width
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: input[start:i], pos: start})
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(input)}), nil
+}
+
+// scanNumber returns the end of json number starting at i. Dot must be
+// followed by a digit, so json.items.0.name has 0 as a path segment
+func scanNumber(input string, i int) int {
+	digits := func() {
+		for i < len(input) && input[i] >= '0' && input[i] <= '9' {
+			i++
+		}
+	}
+	if input[i] == '-' {
+		i++
+	}
+	digits()
+	if i+1 < len(input) && input[i] == '.' && input[i+1] >= '0' && input[i+1] <= '9' {
+		i++
+		digits()
+	}
+	if i < len(input) && (input[i] == 'e' || input[i] == 'E') {
+		i++
+		if i < len(input) && (input[i] == '+' || input[i] == '-') {
+			i++
+		}
+		digits()
+	}
+	return i
+}
+
+type parser struct {
+	tokens     []token
+	pos        int
+	conditions int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, word)
+}
+
+func (p *parser) isPunct(punct string) bool {
+	tok := p.peek()
+	return tok.kind == tokenPunct && tok.text == punct
+}
+
+func (p *parser) expectPunct(punct string) error {
+	if !p.isPunct(punct) {
+		tok := p.peek()
+		return errorAt(tok, "expected %q, got %s", punct, tok)
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) parseOr(depth int) (Expr, error) {
+	return p.parseLogical(depth, "or", p.parseAnd)
+}
+
+func (p *parser) parseAnd(depth int) (Expr, error) {
+	return p.parseLogical(depth, "and", p.parseFactor)
+}
+
+func (p *parser) parseLogical(depth int, op string, operand func(int) (Expr, error)) (Expr, error) {
+	first, err := operand(depth)
+	if err != nil {
+		return nil, err
+	}
+	items := []Expr{first}
+	for p.isKeyword(op) {
+		p.next()
+		item, err := operand(depth)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(items) == 1 {
+		return first, nil
+	}
+	return &logical{op: op, items: items}, nil
+}
+
+func (p *parser) parseFactor(depth int) (Expr, error) {
+	if p.isPunct("(") {
+		open := p.next()
+		if depth+1 > maxDepth {
+			return nil, errorAt(open, "too deep nesting (max %d)", maxDepth)
+		}
+		expr, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *parser) parseCondition() (Expr, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != tokenIdent {
+		return nil, errorAt(fieldTok, "expected field, got %s", fieldTok)
+	}
+	p.conditions++
+	if p.conditions > maxConditions {
+		return nil, errorAt(fieldTok, "too many conditions (max %d)", maxConditions)
+	}
+
+	cond := &condition{field: strings.ToLower(fieldTok.text)}
+	if cond.field == "json" {
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		cond.path = path
+	} else if _, ok := columns[cond.field]; !ok {
+		return nil, errorAt(fieldTok, "unknown field %q, expected one of name, mime, public, created, file, json", fieldTok.text)
+	}
+
+	opTok := p.next()
+	if opTok.kind != tokenIdent {
+		return nil, errorAt(opTok, "expected operator, got %s", opTok)
+	}
+	cond.op = Op(strings.ToLower(opTok.text))
+	if _, known := opNames[cond.op]; !known {
+		return nil, errorAt(opTok, "unknown operator %q, expected one of eq, ne, lt, gt, prefix, in, contains", opTok.text)
+	}
+
+	valueTok := p.peek()
+	value, err := p.parseValue(true)
+	if err != nil {
+		return nil, err
+	}
+	cond.value = value
+
+	if err := cond.check(valueTok); err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+var opNames = map[Op]bool{
+	OpEq: true, OpNe: true, OpLt: true, OpGt: true, OpPrefix: true, OpIn: true, OpContains: true,
+}
+
+// parsePath parses .segment.segment after json
+func (p *parser) parsePath() ([]string, error) {
+	path := []string{}
+	for p.isPunct(".") {
+		p.next()
+		tok := p.next()
+		switch tok.kind {
+		case tokenIdent, tokenString:
+			path = append(path, tok.text)
+		case tokenNumber:
+			if strings.ContainsAny(tok.text, ".eE+-") {
+				return nil, errorAt(tok, "bad array index %s", tok.text)
+			}
+			path = append(path, tok.text)
+		default:
+			return nil, errorAt(tok, "expected json key, got %s", tok)
+		}
+	}
+	return path, nil
+}
+
+func (p *parser) parseValue(allowList bool) (literal, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenString:
+		return literal{kind: literalString, text: tok.text}, nil
+	case tokenNumber:
+		return literal{kind: literalNumber, text: tok.text}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true", "false":
+			return literal{kind: literalBool, text: tok.text}, nil
+		case "null":
+			return literal{kind: literalNull, text: tok.text}, nil
+		}
+		return literal{}, errorAt(tok, "expected value, got %s (strings must be quoted)", tok)
+	case tokenPunct:
+		if tok.text == "[" && allowList {
+			return p.parseList(tok)
+		}
+	}
+	return literal{}, errorAt(tok, "expected value, got %s", tok)
+}
+
+func (p *parser) parseList(open token) (literal, error) {
+	list := literal{kind: literalList}
+	if p.isPunct("]") {
+		p.next()
+		return list, nil
+	}
+	for {
+		item, err := p.parseValue(false)
+		if err != nil {
+			return literal{}, err
+		}
+		list.items = append(list.items, item)
+		if len(list.items) > maxListSize {
+			return literal{}, errorAt(open, "too long list (max %d)", maxListSize)
+		}
+		if p.isPunct("]") {
+			p.next()
+			return list, nil
+		}
+		if err := p.expectPunct(","); err != nil {
+			return literal{}, err
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage/postgres"
+	"AstralTest/pkg/appError"
+	"context"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type groups struct {
+	pool postgres.DBPool
+}
+
+type GroupStorage interface {
+	// CreateGroup stores the group without members, sets group.Created
+	CreateGroup(ctx context.Context, group *entity.Group) error
+	// GetGroup returns the group with its members
+	GetGroup(ctx context.Context, name string) (*entity.Group, error)
+	// ListGroups returns groups owned by the user or having the user as a member
+	ListGroups(ctx context.Context, login string) ([]*entity.Group, error)
+	DeleteGroup(ctx context.Context, name string) error
+	AddMember(ctx context.Context, name, login string) error
+	RemoveMember(ctx context.Context, name, login string) error
+	// GetUserGroups returns names of groups the user is a member of
+	GetUserGroups(ctx context.Context, login string) ([]string, error)
+	// GetGroupDocOwners returns owners of documents shared with the group
+	GetGroupDocOwners(ctx context.Context, name string) ([]string, error)
+}
+
+func NewGroupStorage(pool postgres.DBPool) GroupStorage {
+	return &groups{
+		pool: pool,
+	}
+}
+
+func (g *groups) CreateGroup(ctx context.Context, group *entity.Group) error {
+	query := `insert into groups(name, owner_login)
+				values($1, $2)
+				returning created`
+
+	err := g.pool.QueryRow(ctx, query, group.Name, group.Owner).Scan(&group.Created)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
+			return appError.BadRequest("group already exists")
+		}
+		log.Println("[CreateGroup] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+func (g *groups) GetGroup(ctx context.Context, name string) (*entity.Group, error) {
+	query := `select name, owner_login, created,
+				coalesce((select array_agg(login order by login) from group_members m where m.group_name = groups.name), '{}')
+			from groups
+			where name = $1`
+
+	var group entity.Group
+	err := g.pool.QueryRow(ctx, query, name).Scan(&group.Name, &group.Owner, &group.Created, &group.Members)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, appError.NotFound()
+		}
+		log.Println("[GetGroup] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	return &group, nil
+}
+
+func (g *groups) ListGroups(ctx context.Context, login string) ([]*entity.Group, error) {
+	query := `select name, owner_login, created
+			from groups
+			where owner_login = $1 or name in (select group_name from group_members where login = $1)
+			order by name`
+
+	rows, err := g.pool.Query(ctx, query, login)
+	if err != nil {
+		log.Println("[ListGroups] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	list := []*entity.Group{}
+	for rows.Next() {
+		var group entity.Group
+		if err := rows.Scan(&group.Name, &group.Owner, &group.Created); err != nil {
+			log.Println("[ListGroups] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		list = append(list, &group)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return list, nil
+}
+
+// DeleteGroup deletes the group, its members and permissions given to it
+func (g *groups) DeleteGroup(ctx context.Context, name string) error {
+	tag, err := g.pool.Exec(ctx, `delete from groups where name = $1`, name)
+	if err != nil {
+		log.Println("[DeleteGroup] error: ", err.Error())
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
+	return nil
+}
+
+// AddMember adds the user to the group, adding a member twice is not an error
+func (g *groups) AddMember(ctx context.Context, name, login string) error {
+	query := `insert into group_members(group_name, login)
+				values($1, $2)
+				on conflict do nothing`
+
+	_, err := g.pool.Exec(ctx, query, name, login)
+	if err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23503" {
+			return appError.BadRequest("user doesn't exist")
+		}
+		log.Println("[AddMember] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+func (g *groups) RemoveMember(ctx context.Context, name, login string) error {
+	tag, err := g.pool.Exec(ctx, `delete from group_members where group_name = $1 and login = $2`, name, login)
+	if err != nil {
+		log.Println("[RemoveMember] error: ", err.Error())
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
+	return nil
+}
+
+func (g *groups) GetUserGroups(ctx context.Context, login string) ([]string, error) {
+	return g.queryNames(ctx, "GetUserGroups", `select group_name from group_members where login = $1`, login)
+}
+
+func (g *groups) GetGroupDocOwners(ctx context.Context, name string) ([]string, error) {
+	query := `select distinct d.owner_login
+				from doc_permissions p
+				join docs d on d.id = p.doc_id
+				where p.group_name = $1`
+	return g.queryNames(ctx, "GetGroupDocOwners", query, name)
+}
+
+func (g *groups) queryNames(ctx context.Context, caller, query string, args ...interface{}) ([]string, error) {
+	rows, err := g.pool.Query(ctx, query, args...)
+	if err != nil {
+		log.Println("["+caller+"] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, appError.Internal()
+		}
+		names = append(names, name)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return names, nil
+}
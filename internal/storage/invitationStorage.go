@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage/postgres"
+	"AstralTest/pkg/appError"
+	"context"
+	"errors"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type InvitationStorage interface {
+	// CreateInvitation stores the invitation with hash of its code, sets inv.Created
+	CreateInvitation(ctx context.Context, inv *entity.Invitation, codeHash string) error
+	// GetInvitation returns the invitation by hash of its code, used and expired ones too
+	GetInvitation(ctx context.Context, codeHash string) (*entity.Invitation, error)
+	// ListInvitations returns invitations created by the user, newest first
+	ListInvitations(ctx context.Context, createdBy string) ([]*entity.Invitation, error)
+	// DeleteInvitation deletes the invitation which is not used yet
+	DeleteInvitation(ctx context.Context, createdBy string, id uuid.UUID) error
+	// RedeemInvitation marks the invitation used and adds the user with
+	// user.PasswordHash and user.Role to groups of the invitation, all or nothing
+	RedeemInvitation(ctx context.Context, id uuid.UUID, user *entity.User) error
+}
+
+func NewInvitationStorage(pool postgres.DBPool) InvitationStorage {
+	return &auth{
+		pool: pool,
+	}
+}
+
+const invitationSelect = `select id, prefix, created_by, coalesce(login, ''), role, groups, expires_at, created, used_at, coalesce(used_by, '')
+				from invitations`
+
+func scanInvitation(row pgx.Row) (*entity.Invitation, error) {
+	var inv entity.Invitation
+	err := row.Scan(
+		&inv.ID,
+		&inv.Prefix,
+		&inv.CreatedBy,
+		&inv.Login,
+		&inv.Role,
+		&inv.Groups,
+		&inv.Expires,
+		&inv.Created,
+		&inv.Used,
+		&inv.UsedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (a *auth) CreateInvitation(ctx context.Context, inv *entity.Invitation, codeHash string) error {
+	query := `insert into invitations(id, code_hash, prefix, created_by, login, role, groups, expires_at)
+				values($1, $2, $3, $4, nullif($5, ''), $6, $7, $8)
+				returning created`
+
+	err := a.pool.QueryRow(ctx, query,
+		inv.ID,
+		codeHash,
+		inv.Prefix,
+		inv.CreatedBy,
+		inv.Login,
+		inv.Role,
+		inv.Groups,
+		inv.Expires,
+	).Scan(&inv.Created)
+	if err != nil {
+		log.Println("[CreateInvitation] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+func (a *auth) GetInvitation(ctx context.Context, codeHash string) (*entity.Invitation, error) {
+	inv, err := scanInvitation(a.pool.QueryRow(ctx, invitationSelect+` where code_hash = $1`, codeHash))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, appError.NotFound()
+		}
+		log.Println("[GetInvitation] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	return inv, nil
+}
+
+func (a *auth) ListInvitations(ctx context.Context, createdBy string) ([]*entity.Invitation, error) {
+	rows, err := a.pool.Query(ctx, invitationSelect+` where created_by = $1 order by created desc`, createdBy)
+	if err != nil {
+		log.Println("[ListInvitations] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	invitations := []*entity.Invitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			log.Println("[ListInvitations] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		invitations = append(invitations, inv)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return invitations, nil
+}
+
+func (a *auth) DeleteInvitation(ctx context.Context, createdBy string, id uuid.UUID) error {
+	query := `delete from invitations
+				where id = $1 and created_by = $2 and used_at is null`
+	tag, err := a.pool.Exec(ctx, query, id, createdBy)
+	if err != nil {
+		log.Println("[DeleteInvitation] error: ", err.Error())
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
+	return nil
+}
+
+// RedeemInvitation consumes the invitation in the same transaction as the user is
+// created, so a code registers one user and a failed registration keeps the code
+func (a *auth) RedeemInvitation(ctx context.Context, id uuid.UUID, user *entity.User) error {
+	tx, err := a.pool.Begin(ctx)
+	if err != nil {
+		return appError.Internal()
+	}
+	defer tx.Rollback(ctx)
+
+	// the row lock makes concurrent registrations by one code wait, the loser sees used_at
+	query := `update invitations
+				set used_at = NOW(), used_by = $2
+				where id = $1 and used_at is null and expires_at > NOW()
+				returning groups`
+	var groups []string
+	if err := tx.QueryRow(ctx, query, id, user.Login).Scan(&groups); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return appError.BadRequest("invitation code is already used or expired")
+		}
+		log.Println("[RedeemInvitation] error: ", err.Error())
+		return appError.Internal()
+	}
+
+	query = `insert into users(login, password, role)
+				values($1, $2, $3)
+				returning created`
+	if err := tx.QueryRow(ctx, query, user.Login, user.PasswordHash, user.Role).Scan(&user.Created); err != nil {
+		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
+			return appError.BadRequest("unique login violation")
+		}
+		log.Println("[RedeemInvitation] error: ", err.Error())
+		return appError.Internal()
+	}
+
+	query = `insert into group_members(group_name, login)
+				select name, $2 from groups where name = ANY($1)
+				on conflict do nothing`
+	if _, err := tx.Exec(ctx, query, groups, user.Login); err != nil {
+		log.Println("[RedeemInvitation] error: ", err.Error())
+		return appError.Internal()
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		log.Println("[RedeemInvitation] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
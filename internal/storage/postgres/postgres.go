@@ -14,6 +14,7 @@ type DBPool interface {
 	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
 	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
 	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Begin(ctx context.Context) (pgx.Tx, error)
 }
 
 type PgxDBPool struct {
@@ -32,6 +33,10 @@ func (p *PgxDBPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.C
 	return p.pool.Exec(ctx, sql, args...)
 }
 
+func (p *PgxDBPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	return p.pool.Begin(ctx)
+}
+
 func (p *PgxDBPool) Close() {
 	p.pool.Close()
 }
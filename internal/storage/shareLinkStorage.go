@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/storage/postgres"
+	"AstralTest/pkg/appError"
+	"context"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type ShareLinkStorage interface {
+	// CreateShareLink stores the link, empty passwordHash means no password.
+	// Sets link.Created
+	CreateShareLink(ctx context.Context, link *entity.ShareLink, passwordHash string) error
+	// GetShareLink returns the link and its password hash, revoked and expired links too
+	GetShareLink(ctx context.Context, id uuid.UUID) (*entity.ShareLink, string, error)
+	ListShareLinks(ctx context.Context, docId uuid.UUID) ([]*entity.ShareLink, error)
+	RevokeShareLink(ctx context.Context, docId, id uuid.UUID) error
+	// CountDownload counts a download by the link,
+	// false if the link is revoked, expired or used up
+	CountDownload(ctx context.Context, id uuid.UUID) (bool, error)
+	LogShareLinkUse(ctx context.Context, id uuid.UUID, use entity.ShareLinkUse) error
+	// GetShareLinkUses returns the usage log of the link, newest first
+	GetShareLinkUses(ctx context.Context, id uuid.UUID, limit int) ([]entity.ShareLinkUse, error)
+}
+
+func NewShareLinkStorage(pool postgres.DBPool) ShareLinkStorage {
+	return &wcs{
+		pool: pool,
+	}
+}
+
+const shareLinkSelect = `select id, doc_id, created_by, expires_at, max_downloads, downloads,
+				password_hash is not null, revoked_at, created, coalesce(password_hash, '')
+			from share_links`
+
+func scanShareLink(row pgx.Row) (*entity.ShareLink, string, error) {
+	var link entity.ShareLink
+	var passwordHash string
+	err := row.Scan(
+		&link.ID,
+		&link.DocID,
+		&link.CreatedBy,
+		&link.Expires,
+		&link.MaxDownloads,
+		&link.Downloads,
+		&link.HasPassword,
+		&link.Revoked,
+		&link.Created,
+		&passwordHash,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	return &link, passwordHash, nil
+}
+
+func (wc *wcs) CreateShareLink(ctx context.Context, link *entity.ShareLink, passwordHash string) error {
+	query := `insert into share_links(id, doc_id, created_by, expires_at, max_downloads, password_hash)
+				values($1, $2, $3, $4, $5, nullif($6, ''))
+				returning created`
+
+	err := wc.pool.QueryRow(ctx, query,
+		link.ID,
+		link.DocID,
+		link.CreatedBy,
+		link.Expires,
+		link.MaxDownloads,
+		passwordHash,
+	).Scan(&link.Created)
+	if err != nil {
+		log.Println("[CreateShareLink] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+func (wc *wcs) GetShareLink(ctx context.Context, id uuid.UUID) (*entity.ShareLink, string, error) {
+	link, passwordHash, err := scanShareLink(wc.pool.QueryRow(ctx, shareLinkSelect+` where id = $1`, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, "", appError.NotFound()
+		}
+		log.Println("[GetShareLink] error: ", err.Error())
+		return nil, "", appError.Internal()
+	}
+	return link, passwordHash, nil
+}
+
+func (wc *wcs) ListShareLinks(ctx context.Context, docId uuid.UUID) ([]*entity.ShareLink, error) {
+	rows, err := wc.pool.Query(ctx, shareLinkSelect+` where doc_id = $1 order by created desc`, docId)
+	if err != nil {
+		log.Println("[ListShareLinks] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	links := []*entity.ShareLink{}
+	for rows.Next() {
+		link, _, err := scanShareLink(rows)
+		if err != nil {
+			log.Println("[ListShareLinks] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		links = append(links, link)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return links, nil
+}
+
+func (wc *wcs) RevokeShareLink(ctx context.Context, docId, id uuid.UUID) error {
+	query := `update share_links
+				set revoked_at = coalesce(revoked_at, NOW())
+				where id = $1 and doc_id = $2`
+
+	tag, err := wc.pool.Exec(ctx, query, id, docId)
+	if err != nil {
+		log.Println("[RevokeShareLink] error: ", err.Error())
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
+	return nil
+}
+
+// CountDownload checks the limits and counts in one statement,
+// so concurrent downloads can't exceed max_downloads
+func (wc *wcs) CountDownload(ctx context.Context, id uuid.UUID) (bool, error) {
+	query := `update share_links
+				set downloads = downloads + 1
+				where id = $1 and revoked_at is null and expires_at > NOW()
+					and (max_downloads is null or downloads < max_downloads)`
+
+	tag, err := wc.pool.Exec(ctx, query, id)
+	if err != nil {
+		log.Println("[CountDownload] error: ", err.Error())
+		return false, appError.Internal()
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func (wc *wcs) LogShareLinkUse(ctx context.Context, id uuid.UUID, use entity.ShareLinkUse) error {
+	query := `insert into share_link_uses(link_id, ip, user_agent, result)
+				values($1, $2, $3, $4)`
+
+	_, err := wc.pool.Exec(ctx, query, id, use.IP, use.UserAgent, use.Result)
+	if err != nil {
+		log.Println("[LogShareLinkUse] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
+}
+
+func (wc *wcs) GetShareLinkUses(ctx context.Context, id uuid.UUID, limit int) ([]entity.ShareLinkUse, error) {
+	query := `select used_at, coalesce(ip, ''), coalesce(user_agent, ''), result
+				from share_link_uses
+				where link_id = $1
+				order by used_at desc
+				limit $2`
+
+	rows, err := wc.pool.Query(ctx, query, id, limit)
+	if err != nil {
+		log.Println("[GetShareLinkUses] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	uses := []entity.ShareLinkUse{}
+	for rows.Next() {
+		var use entity.ShareLinkUse
+		if err := rows.Scan(&use.Time, &use.IP, &use.UserAgent, &use.Result); err != nil {
+			log.Println("[GetShareLinkUses] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		uses = append(uses, use)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return uses, nil
+}
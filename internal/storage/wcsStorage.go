@@ -5,87 +5,194 @@ import (
 	"AstralTest/internal/storage/postgres"
 	"AstralTest/pkg/appError"
 	"context"
-	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 )
 
 type wcs struct {
-	pool                postgres.DBPool
-	fileSavingDirectory string
+	pool postgres.DBPool
 }
 
+// FileStorage keeps documents metadata, file contents live in blob.BlobStore
 type FileStorage interface {
-	SaveFile(fileUUID uuid.UUID, fileData *[]byte) error
-	GetFilePath(fileUUID uuid.UUID) string
-	RmFile(fileUUID uuid.UUID) error
-
 	SaveDoc(ctx context.Context, doc *entity.Document) error
+	// UpdateDoc writes the document as a new version if doc.Version is still the current one
+	UpdateDoc(ctx context.Context, doc *entity.Document, author string) error
 	DeleteDoc(ctx context.Context, id uuid.UUID) error
 	GetDoc(ctx context.Context, id uuid.UUID) (*entity.Document, error)
-	GetDocsList(ctx context.Context, ownerLogin, login, key, value string, limit int) ([]*entity.Document, error)
+	GetVersions(ctx context.Context, id uuid.UUID) ([]*entity.Document, error)
+	GetVersion(ctx context.Context, id uuid.UUID, version int) (*entity.Document, error)
+	GetBlobKeys(ctx context.Context, id uuid.UUID) ([]string, error)
+
+	// TrashDoc moves the document to the trash, DeleteDoc removes it for good
+	TrashDoc(ctx context.Context, id uuid.UUID) error
+	RestoreDoc(ctx context.Context, id uuid.UUID) error
+	GetTrashedDoc(ctx context.Context, id uuid.UUID) (*entity.Document, error)
+	GetTrash(ctx context.Context, ownerLogin string) ([]*entity.Document, error)
+	// GetExpiredTrash returns documents moved to the trash before the given time,
+	// oldest first, which come after the given one (zero value for the first batch)
+	GetExpiredTrash(ctx context.Context, before time.Time, after TrashedDoc, limit int) ([]TrashedDoc, error)
+	// SetPermissions replaces roles of other users on the document
+	SetPermissions(ctx context.Context, id uuid.UUID, permissions []entity.Permission) error
+	// GetDocsList returns a page of documents of the owner visible to the caller
+	GetDocsList(ctx context.Context, q DocsListQuery) (*entity.DocsPage, error)
+	// SearchDocs returns documents visible to login matching the full-text query
+	SearchDocs(ctx context.Context, login string, owners []string, query string, limit int) ([]*entity.SearchHit, error)
+
+	// GetOwnerDocIds, GetOwnerGrantees and TransferDocs handle documents of a deleted user
+	GetOwnerDocIds(ctx context.Context, ownerLogin string) ([]uuid.UUID, error)
+	GetOwnerGrantees(ctx context.Context, ownerLogin string) ([]string, error)
+	TransferDocs(ctx context.Context, fromLogin, toLogin string) error
 }
 
-func NewFileStorage(pool postgres.DBPool, dir string) (FileStorage, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, err
-	}
+// TrashedDoc is the position of a document in the trash, the key of batches
+type TrashedDoc struct {
+	ID        uuid.UUID
+	DeletedAt time.Time
+}
+
+func NewFileStorage(pool postgres.DBPool) FileStorage {
 	return &wcs{
-		fileSavingDirectory: dir,
-		pool:                pool,
-	}, nil
+		pool: pool,
+	}
 }
 
-func (wc *wcs) SaveFile(fileUUID uuid.UUID, fileData *[]byte) error {
-	fileUUIDStr := fileUUID.String()
+// SaveDoc creates the document with its first version
+func (wc *wcs) SaveDoc(ctx context.Context, doc *entity.Document) error {
+	tx, err := wc.pool.Begin(ctx)
+	if err != nil {
+		return appError.Internal()
+	}
+	defer tx.Rollback(ctx)
+
+	query := `insert into docs(id, name, mime, file, public, owner_login, json_data, content_hash, blob_key, size, content_text)
+				values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+				returning created, current_version, updated`
+
+	err = tx.QueryRow(ctx, query,
+		doc.ID,
+		doc.Name,
+		doc.Mime,
+		doc.File,
+		doc.Public,
+		doc.Owner,
+		doc.JsonData,
+		doc.Hash,
+		doc.BlobKey,
+		doc.Size,
+		doc.ContentText,
+	).Scan(&doc.Created, &doc.Version, &doc.Updated)
+	if err != nil {
+		log.Println("[SaveDoc] error: ", err.Error())
+		return appError.Internal()
+	}
+
+	if err := insertVersion(ctx, tx, doc, doc.Owner); err != nil {
+		return err
+	}
+	if err := insertPermissions(ctx, tx, doc.ID, doc.Permissions); err != nil {
+		return err
+	}
 
-	// create file path
-	filePath := filepath.Join(wc.fileSavingDirectory, fileUUIDStr)
-	if err := os.WriteFile(filePath, *fileData, 0644); err != nil {
+	if err := tx.Commit(ctx); err != nil {
 		return appError.Internal()
 	}
 	return nil
 }
 
-func (wc *wcs) GetFilePath(fileUUID uuid.UUID) string {
-	return filepath.Join(wc.fileSavingDirectory, fileUUID.String())
-}
+// UpdateDoc stores doc as a new version and makes it current.
+// doc.Version and doc.Updated are set to the values of the new version.
+// Permissions are not changed, see SetPermissions.
+func (wc *wcs) UpdateDoc(ctx context.Context, doc *entity.Document, author string) error {
+	tx, err := wc.pool.Begin(ctx)
+	if err != nil {
+		return appError.Internal()
+	}
+	defer tx.Rollback(ctx)
+
+	query := `update docs
+				set name = $2, mime = $3, public = $4, json_data = $5, content_hash = $6,
+					blob_key = $7, size = $8, content_text = coalesce($9, content_text),
+					current_version = current_version + 1, updated = NOW()
+				where id = $1 and deleted_at is null and current_version = $10
+				returning current_version, updated`
 
-func (wc *wcs) RmFile(fileUUID uuid.UUID) error {
-	filePath := filepath.Join(wc.fileSavingDirectory, fileUUID.String())
-	// TODO: handle more error
-	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
-		log.Printf("Failed to delete file %s: %v", filePath, err)
+	err = tx.QueryRow(ctx, query,
+		doc.ID,
+		doc.Name,
+		doc.Mime,
+		doc.Public,
+		doc.JsonData,
+		doc.Hash,
+		doc.BlobKey,
+		doc.Size,
+		doc.ContentText,
+		doc.Version,
+	).Scan(&doc.Version, &doc.Updated)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return wc.updateConflict(ctx, tx, doc.ID)
+		}
+		log.Println("[UpdateDoc] error: ", err.Error())
+		return appError.Internal()
+	}
+
+	if err := insertVersion(ctx, tx, doc, author); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return appError.Internal()
 	}
 	return nil
 }
 
-func (wc *wcs) SaveDoc(ctx context.Context, doc *entity.Document) error {
-	query := `insert into docs(id, name, mime, file, public, owner_login, grant_logins, json_data)
-				values($1, $2, $3, $4, $5, $6, $7, $8)`
+// updateConflict tells a document changed by a concurrent request from a missing one
+func (wc *wcs) updateConflict(ctx context.Context, tx pgx.Tx, id uuid.UUID) error {
+	var exists bool
+	err := tx.QueryRow(ctx, `select exists(select 1 from docs where id = $1 and deleted_at is null)`, id).Scan(&exists)
+	if err != nil {
+		log.Println("[UpdateDoc] error: ", err.Error())
+		return appError.Internal()
+	}
+	if !exists {
+		return appError.NotFound()
+	}
+	return appError.Conflict("document was changed by another request, read it again")
+}
+
+func insertVersion(ctx context.Context, tx pgx.Tx, doc *entity.Document, author string) error {
+	query := `insert into doc_versions(doc_id, version, name, mime, public, json_data, content_hash, blob_key, size, author_login, created)
+				values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
 
-	_, err := wc.pool.Exec(ctx, query,
+	_, err := tx.Exec(ctx, query,
 		doc.ID,
+		doc.Version,
 		doc.Name,
 		doc.Mime,
-		doc.File,
 		doc.Public,
-		doc.Owner,
-		doc.Grant,
 		doc.JsonData,
+		doc.Hash,
+		doc.BlobKey,
+		doc.Size,
+		author,
+		doc.Updated,
 	)
-
-	return err
+	if err != nil {
+		log.Println("[insertVersion] error: ", err.Error())
+		return appError.Internal()
+	}
+	return nil
 }
 
 func (wc *wcs) GetDoc(ctx context.Context, id uuid.UUID) (*entity.Document, error) {
-	query := `select id, name, mime, file, public, owner_login, grant_logins, json_data
+	query := `select id, name, mime, file, public, created, owner_login, ` + permissionsOf("docs") + `, json_data,
+				coalesce(content_hash, ''), coalesce(blob_key, id::text), size, current_version, updated
 			from docs
-			where id = $1`
+			where id = $1 and deleted_at is null`
 	var doc entity.Document
 	err := wc.pool.QueryRow(ctx, query, id).Scan(
 		&doc.ID,
@@ -93,9 +200,15 @@ func (wc *wcs) GetDoc(ctx context.Context, id uuid.UUID) (*entity.Document, erro
 		&doc.Mime,
 		&doc.File,
 		&doc.Public,
+		&doc.Created,
 		&doc.Owner,
-		&doc.Grant,
-		&doc.JsonData)
+		&doc.Permissions,
+		&doc.JsonData,
+		&doc.Hash,
+		&doc.BlobKey,
+		&doc.Size,
+		&doc.Version,
+		&doc.Updated)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, appError.BadRequest("file doesnt exist")
@@ -106,62 +219,103 @@ func (wc *wcs) GetDoc(ctx context.Context, id uuid.UUID) (*entity.Document, erro
 	return &doc, nil
 }
 
-func (wc *wcs) GetDocsList(ctx context.Context, ownerLogin, login, key, value string, limit int) ([]*entity.Document, error) {
-	var args []interface{}
+// GetVersions returns all versions of the document, newest first.
+// Document-wide fields (file, owner, created) are taken from the docs row.
+func (wc *wcs) GetVersions(ctx context.Context, id uuid.UUID) ([]*entity.Document, error) {
+	query := versionSelect + ` where v.doc_id = $1
+			order by v.version desc`
 
-	query := `select id, name, mime, file, public, created, owner_login, grant_logins, json_data 
-            	from docs 
-             	where `
+	rows, err := wc.pool.Query(ctx, query, id)
+	if err != nil {
+		log.Println("[GetVersions] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
 
-	// add login sorting
-	if ownerLogin == "" {
-		query += fmt.Sprintf(" owner_login = $%d", len(args)+1)
-		args = append(args, login)
-	} else {
-		query += fmt.Sprintf(" owner_login = $%d and (public = true or $%d = ANY(grant_logins))", len(args)+1, len(args)+2)
-		args = append(args, ownerLogin, login)
+	var versions []*entity.Document
+	for rows.Next() {
+		doc, err := scanVersion(rows)
+		if err != nil {
+			log.Println("[GetVersions] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		versions = append(versions, doc)
 	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return versions, nil
+}
 
-	// add requset sorting values
-	if key != "" && value != "" {
-		query += fmt.Sprintf(" AND %s = $%d", key, len(args)+1)
-		args = append(args, value)
+func (wc *wcs) GetVersion(ctx context.Context, id uuid.UUID, version int) (*entity.Document, error) {
+	query := versionSelect + ` where v.doc_id = $1 and v.version = $2`
+
+	doc, err := scanVersion(wc.pool.QueryRow(ctx, query, id, version))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, appError.NotFound()
+		}
+		log.Println("[GetVersion] error: ", err.Error())
+		return nil, appError.Internal()
 	}
-	// add sorting by name and creation time
-	query += " ORDER BY name, created"
+	return doc, nil
+}
 
-	// add limit
-	query += fmt.Sprintf(" LIMIT $%d", len(args)+1)
-	args = append(args, limit)
+// GetBlobKeys returns all blob keys used by versions of the document
+func (wc *wcs) GetBlobKeys(ctx context.Context, id uuid.UUID) ([]string, error) {
+	query := `select distinct coalesce(v.blob_key, d.id::text)
+				from doc_versions v
+				join docs d on d.id = v.doc_id
+				where v.doc_id = $1 and d.file`
 
-	rows, err := wc.pool.Query(ctx, query, args...)
+	rows, err := wc.pool.Query(ctx, query, id)
 	if err != nil {
 		return nil, appError.Internal()
 	}
 	defer rows.Close()
 
-	var docs []*entity.Document
+	var keys []string
 	for rows.Next() {
-		var doc entity.Document
-		err := rows.Scan(
-			&doc.ID,
-			&doc.Name,
-			&doc.Mime,
-			&doc.File,
-			&doc.Public,
-			&doc.Created,
-			&doc.Owner,
-			&doc.Grant,
-			&doc.JsonData,
-		)
-		if err != nil {
+		var key string
+		if err := rows.Scan(&key); err != nil {
 			return nil, appError.Internal()
 		}
-		docs = append(docs, &doc)
+		keys = append(keys, key)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
 	}
+	return keys, nil
+}
 
-	return docs, nil
+// versions have no permissions, they are not versioned
+const versionSelect = `select d.id, v.name, v.mime, d.file, v.public, d.created, d.owner_login, v.json_data,
+				coalesce(v.content_hash, ''), coalesce(v.blob_key, d.id::text), v.size, v.version, v.created, v.author_login
+			from doc_versions v
+			join docs d on d.id = v.doc_id`
 
+func scanVersion(row pgx.Row) (*entity.Document, error) {
+	var doc entity.Document
+	err := row.Scan(
+		&doc.ID,
+		&doc.Name,
+		&doc.Mime,
+		&doc.File,
+		&doc.Public,
+		&doc.Created,
+		&doc.Owner,
+		&doc.JsonData,
+		&doc.Hash,
+		&doc.BlobKey,
+		&doc.Size,
+		&doc.Version,
+		&doc.Updated,
+		&doc.Author,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
 }
 
 func (wc *wcs) DeleteDoc(ctx context.Context, id uuid.UUID) error {
@@ -174,3 +328,129 @@ func (wc *wcs) DeleteDoc(ctx context.Context, id uuid.UUID) error {
 	}
 	return nil
 }
+
+func (wc *wcs) TrashDoc(ctx context.Context, id uuid.UUID) error {
+	query := `update docs
+				set deleted_at = NOW()
+				where id = $1 and deleted_at is null`
+
+	tag, err := wc.pool.Exec(ctx, query, id)
+	if err != nil {
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.BadRequest("file doesnt exist")
+	}
+	return nil
+}
+
+func (wc *wcs) RestoreDoc(ctx context.Context, id uuid.UUID) error {
+	query := `update docs
+				set deleted_at = null
+				where id = $1 and deleted_at is not null`
+
+	tag, err := wc.pool.Exec(ctx, query, id)
+	if err != nil {
+		return appError.Internal()
+	}
+	if tag.RowsAffected() == 0 {
+		return appError.NotFound()
+	}
+	return nil
+}
+
+func (wc *wcs) GetTrashedDoc(ctx context.Context, id uuid.UUID) (*entity.Document, error) {
+	query := trashSelect + ` where id = $1 and deleted_at is not null`
+
+	doc, err := scanTrashed(wc.pool.QueryRow(ctx, query, id))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, appError.NotFound()
+		}
+		log.Println("[GetTrashedDoc] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	return doc, nil
+}
+
+func (wc *wcs) GetTrash(ctx context.Context, ownerLogin string) ([]*entity.Document, error) {
+	query := trashSelect + ` where owner_login = $1 and deleted_at is not null
+			order by deleted_at desc`
+
+	rows, err := wc.pool.Query(ctx, query, ownerLogin)
+	if err != nil {
+		log.Println("[GetTrash] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	var docs []*entity.Document
+	for rows.Next() {
+		doc, err := scanTrashed(rows)
+		if err != nil {
+			log.Println("[GetTrash] error: ", err.Error())
+			return nil, appError.Internal()
+		}
+		docs = append(docs, doc)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return docs, nil
+}
+
+func (wc *wcs) GetExpiredTrash(ctx context.Context, before time.Time, after TrashedDoc, limit int) ([]TrashedDoc, error) {
+	query := `select id, deleted_at
+				from docs
+				where deleted_at < $1 and (deleted_at, id) > ($2, $3)
+				order by deleted_at, id
+				limit $4`
+
+	rows, err := wc.pool.Query(ctx, query, before, after.DeletedAt, after.ID, limit)
+	if err != nil {
+		log.Println("[GetExpiredTrash] error: ", err.Error())
+		return nil, appError.Internal()
+	}
+	defer rows.Close()
+
+	var docs []TrashedDoc
+	for rows.Next() {
+		var doc TrashedDoc
+		if err := rows.Scan(&doc.ID, &doc.DeletedAt); err != nil {
+			return nil, appError.Internal()
+		}
+		docs = append(docs, doc)
+	}
+	if rows.Err() != nil {
+		return nil, appError.Internal()
+	}
+	return docs, nil
+}
+
+var trashSelect = `select id, name, mime, file, public, created, owner_login, ` + permissionsOf("docs") + `, json_data,
+				coalesce(content_hash, ''), size, current_version, updated, deleted_at
+			from docs`
+
+func scanTrashed(row pgx.Row) (*entity.Document, error) {
+	var doc entity.Document
+	err := row.Scan(
+		&doc.ID,
+		&doc.Name,
+		&doc.Mime,
+		&doc.File,
+		&doc.Public,
+		&doc.Created,
+		&doc.Owner,
+		&doc.Permissions,
+		&doc.JsonData,
+		&doc.Hash,
+		&doc.Size,
+		&doc.Version,
+		&doc.Updated,
+		&doc.Deleted,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/models/response"
+	"AstralTest/internal/service"
+	"AstralTest/pkg/appError"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const adminUsersPath = "/api/admin/users/"
+
+type AdminHandler struct {
+	service service.AdminService
+}
+
+func NewAdminHandler(service service.AdminService) *AdminHandler {
+	return &AdminHandler{
+		service: service,
+	}
+}
+
+// UpdateUserRequest changes only the given fields
+type UpdateUserRequest struct {
+	Role      entity.UserRole `json:"role"`
+	CanInvite *bool           `json:"can_invite"`
+}
+
+type ResetPasswordRequest struct {
+	Password string `json:"pswd"`
+}
+
+// UsersHandler handles GET /api/admin/users - all users
+func (a *AdminHandler) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+	users, err := a.service.ListUsers(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"users": users,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// CacheStatsHandler handles GET /api/admin/cache - counters of the response cache
+// and of storage reads shared by concurrent cache misses
+func (a *AdminHandler) CacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+	stats, err := a.service.CacheStats(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"cache": stats,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// UserHandler handles /api/admin/users/{login}:
+//
+//	PATCH  /api/admin/users/{login}          - set role and invite permission,
+//	                                           {"role": "readonly", "can_invite": true}
+//	DELETE /api/admin/users/{login}          - delete user, ?transfer_to=<login> gives
+//	                                           documents and groups to another user,
+//	                                           without it the documents are purged
+//	POST   /api/admin/users/{login}/disable  - block the user and end its sessions
+//	POST   /api/admin/users/{login}/enable   - unblock the user
+//	POST   /api/admin/users/{login}/password - reset password, {"pswd": "..."}
+func (a *AdminHandler) UserHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminUsersPath), "/")
+	login := parts[0]
+	if login == "" || len(parts) > 2 {
+		writeError(w, appError.NotFound())
+		return
+	}
+
+	ctx := r.Context()
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodPatch:
+			var req UpdateUserRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, appError.BadRequest("invalid json"))
+				return
+			}
+			data := response.DataPayload{
+				"login": login,
+			}
+			if req.Role != "" {
+				if err := a.service.SetRole(ctx, login, req.Role); err != nil {
+					writeError(w, err)
+					return
+				}
+				data["role"] = req.Role
+			}
+			if req.CanInvite != nil {
+				if err := a.service.SetCanInvite(ctx, login, *req.CanInvite); err != nil {
+					writeError(w, err)
+					return
+				}
+				data["can_invite"] = *req.CanInvite
+			}
+			writeJSON(w, http.StatusOK, response.Standard{Data: &data})
+
+		case http.MethodDelete:
+			purged, err := a.service.DeleteUser(ctx, login, r.URL.Query().Get("transfer_to"))
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, response.Standard{
+				Data: &response.DataPayload{
+					"login":  login,
+					"purged": purged,
+				},
+			})
+
+		default:
+			writeError(w, appError.MethodNotAllowed())
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+	var err error
+	switch parts[1] {
+	case "disable":
+		err = a.service.DisableUser(ctx, login)
+	case "enable":
+		err = a.service.EnableUser(ctx, login)
+	case "password":
+		var req ResetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, appError.BadRequest("invalid json"))
+			return
+		}
+		err = a.service.ResetPassword(ctx, login, req.Password)
+	default:
+		err = appError.NotFound()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := response.Standard{
+		Response: &response.ResponsePayload{
+			login: true,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/models/response"
+	"AstralTest/pkg/appError"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CreateApiKeyRequest struct {
+	Name    string     `json:"name"`
+	Scopes  []string   `json:"scopes"`
+	Owners  []string   `json:"owners"`
+	Expires *time.Time `json:"expires"`
+}
+
+// ApiKeysHandler handles /api/keys:
+//
+//	GET  /api/keys - api keys of the user
+//	POST /api/keys - create api key, the secret is in the response only
+func (a *AuthHandler) ApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := a.service.ListApiKeys(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"keys": keys,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodPost:
+		var req CreateApiKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, appError.BadRequest("invalid json"))
+			return
+		}
+
+		key := &entity.ApiKey{
+			Name:    req.Name,
+			Scopes:  req.Scopes,
+			Owners:  req.Owners,
+			Expires: req.Expires,
+		}
+		token, err := a.service.CreateApiKey(r.Context(), key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"key":   key,
+				"token": token,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	default:
+		writeError(w, appError.MethodNotAllowed())
+	}
+}
+
+// RevokeApiKey handles DELETE /api/keys/{id}
+func (a *AuthHandler) RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] == "" {
+		writeError(w, appError.BadRequest("bad request"))
+		return
+	}
+	keyId, err := uuid.Parse(parts[3])
+	if err != nil {
+		writeError(w, appError.BadRequest("bad key id"))
+		return
+	}
+
+	if err := a.service.RevokeApiKey(r.Context(), keyId); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Response: &response.ResponsePayload{
+			keyId.String(): true,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
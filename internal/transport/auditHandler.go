@@ -0,0 +1,132 @@
+package transport
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/models/response"
+	"AstralTest/internal/service"
+	"AstralTest/internal/storage"
+	"AstralTest/pkg/appError"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type AuditHandler struct {
+	service service.AuditService
+}
+
+func NewAuditHandler(service service.AuditService) *AuditHandler {
+	return &AuditHandler{
+		service: service,
+	}
+}
+
+// AuditHandler handles /api/audit, admins see all records, others
+// records of their documents. Filters: ?actor=&action=&doc=&from=&to=
+// (RFC 3339 times), pages: ?limit=&before=<id of the last record>
+//
+//	GET /api/audit - page of records, newest first
+func (a *AuditHandler) AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+	query, err := auditQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	entries, err := a.service.QueryAudit(r.Context(), query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	data := response.DataPayload{
+		"entries": entries,
+	}
+	if len(entries) > 0 && len(entries) == query.Limit {
+		data["before"] = entries[len(entries)-1].ID
+	}
+	writeJSON(w, http.StatusOK, response.Standard{Data: &data})
+}
+
+// ExportHandler handles GET /api/audit/export with the same filters,
+// all records go as NDJSON, one record a line
+func (a *AuditHandler) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+	query, err := auditQuery(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// status is sent with the first record, so early errors are still json errors
+	started := false
+	encoder := json.NewEncoder(w)
+	err = a.service.ExportAudit(r.Context(), query, func(entry *entity.AuditEntry) error {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", "attachment; filename=audit.ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		return encoder.Encode(entry)
+	})
+	if err != nil {
+		if !started {
+			writeError(w, err)
+		}
+		return
+	}
+	if !started {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func auditQuery(r *http.Request) (storage.AuditQuery, error) {
+	params := r.URL.Query()
+	query := storage.AuditQuery{
+		Actor:  params.Get("actor"),
+		Action: params.Get("action"),
+	}
+	if doc := params.Get("doc"); doc != "" {
+		docId, err := uuid.Parse(doc)
+		if err != nil {
+			return query, appError.BadRequest("bad doc id")
+		}
+		query.DocID = &docId
+	}
+	for name, field := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return query, appError.BadRequest(name + " should be an RFC 3339 time")
+			}
+			*field = t
+		}
+	}
+	if before := params.Get("before"); before != "" {
+		id, err := strconv.ParseInt(before, 10, 64)
+		if err != nil || id < 1 {
+			return query, appError.BadRequest("bad before value")
+		}
+		query.Before = id
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return query, appError.BadRequest("limit value shuld be more than 0")
+		}
+		query.Limit = n
+	}
+	return query, nil
+}
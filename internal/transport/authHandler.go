@@ -1,32 +1,46 @@
 package transport
 
 import (
+	"AstralTest/internal/authctx"
 	"AstralTest/internal/models/entity"
 	"AstralTest/internal/models/response"
 	"AstralTest/internal/service"
 	"AstralTest/pkg/appError"
 	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type AuthHandler struct {
 	service service.AuthService
+	cookie  SessionCookie
 }
 
-func NewAuthHandler(service service.AuthService) *AuthHandler {
+// SessionCookie configures the cookie with session token set on login
+type SessionCookie struct {
+	// Secure cookie is sent only over https
+	Secure bool
+	MaxAge time.Duration
+}
+
+func NewAuthHandler(service service.AuthService, cookie SessionCookie) *AuthHandler {
 	return &AuthHandler{
 		service: service,
+		cookie:  cookie,
 	}
 }
 
 type RegisterRequest struct {
-	Token    uuid.UUID `json:"token"`
-	Login    string    `json:"login"`
-	Password string    `json:"pswd"`
+	Login    string          `json:"login"`
+	Password string          `json:"pswd"`
+	Role     entity.UserRole `json:"role"`
+	// Invite is the invitation code, with it anyone registers
+	Invite string `json:"invite"`
 }
 
 func writeJSON(w http.ResponseWriter, statusCode int, data interface{}) {
@@ -65,6 +79,8 @@ func writeError(w http.ResponseWriter, err error) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// Register handles POST /api/register, admins register users,
+// others register themselves with an invitation code
 func (a *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeError(w, appError.MethodNotAllowed())
@@ -80,16 +96,23 @@ func (a *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	reqUser := &entity.User{
 		Login:    req.Login,
 		Password: req.Password,
+		Role:     req.Role,
 	}
 
-	if err := a.service.Register(r.Context(), reqUser, req.Token); err != nil {
+	var err error
+	if req.Invite != "" {
+		err = a.service.RegisterInvited(r.Context(), req.Invite, reqUser)
+	} else {
+		err = a.service.Register(r.Context(), reqUser)
+	}
+	if err != nil {
 		writeError(w, err)
 		return
 	}
 
 	resp := response.Standard{
 		Response: &response.ResponsePayload{
-			"login": req.Login,
+			"login": reqUser.Login,
 		},
 	}
 	writeJSON(w, http.StatusOK, resp)
@@ -107,11 +130,12 @@ func (a *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userToken, err := a.service.Login(r.Context(), &loginRequest)
+	userToken, err := a.service.Login(r.Context(), &loginRequest, clientInfo(r))
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	a.setSessionCookie(w, userToken.String(), int(a.cookie.MaxAge.Seconds()))
 
 	resp := response.Standard{
 		Response: &response.ResponsePayload{
@@ -121,6 +145,49 @@ func (a *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, resp)
 }
 
+// CurrentSessionHandler handles /api/auth:
+//
+//	POST   /api/auth - login
+//	DELETE /api/auth - logout from the current session
+//
+// Login isn't behind the auth middleware, so a stale cookie doesn't block it
+func (a *AuthHandler) CurrentSessionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		a.Login(w, r)
+	case http.MethodDelete:
+		authMiddleware(a.service, a.logoutCurrent).ServeHTTP(w, r)
+	default:
+		writeError(w, appError.MethodNotAllowed())
+	}
+}
+
+func (a *AuthHandler) logoutCurrent(w http.ResponseWriter, r *http.Request) {
+	principal := authctx.Principal(r.Context())
+	if principal == nil {
+		writeError(w, appError.Unauthorized())
+		return
+	}
+	if principal.ApiKey != nil {
+		writeError(w, appError.BadRequest("api key can't be logged out, revoke it instead"))
+		return
+	}
+
+	if _, err := a.service.Logout(r.Context(), principal.SessionID); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.setSessionCookie(w, "", -1)
+
+	resp := response.Standard{
+		Response: &response.ResponsePayload{
+			principal.SessionID.String(): true,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Logout handles DELETE /api/auth/{token}
 func (a *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
 		writeError(w, appError.MethodNotAllowed())
@@ -139,11 +206,14 @@ func (a *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = a.service.Logout(r.Context(), token)
+	_, err = a.service.Logout(r.Context(), token)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value == token.String() {
+		a.setSessionCookie(w, "", -1)
+	}
 
 	resp := response.Standard{
 		Response: &response.ResponsePayload{
@@ -152,3 +222,98 @@ func (a *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
+
+// setSessionCookie sets the session cookie, negative maxAge deletes it.
+// HttpOnly keeps the token from scripts, SameSite=Lax from cross-site POSTs
+func (a *AuthHandler) setSessionCookie(w http.ResponseWriter, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/api",
+		MaxAge:   maxAge,
+		Secure:   a.cookie.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clientInfo takes user agent and ip of the request,
+// X-Forwarded-For is not trusted, it's set by the client
+func clientInfo(r *http.Request) entity.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return entity.ClientInfo{
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}
+}
+
+// SessionsHandler handles /api/sessions:
+//
+//	GET    /api/sessions - active sessions of the user
+//	DELETE /api/sessions - revoke all sessions of the user
+func (a *AuthHandler) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := a.service.ListSessions(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"sessions": sessions,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodDelete:
+		revoked, err := a.service.RevokeAllSessions(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Response: &response.ResponsePayload{
+				"revoked": revoked,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	default:
+		writeError(w, appError.MethodNotAllowed())
+	}
+}
+
+// RevokeSession handles DELETE /api/sessions/{id}, id is the public session id
+func (a *AuthHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] == "" {
+		writeError(w, appError.BadRequest("bad request"))
+		return
+	}
+	sessionId, err := uuid.Parse(parts[3])
+	if err != nil {
+		writeError(w, appError.BadRequest("bad session id"))
+		return
+	}
+
+	if err := a.service.RevokeSession(r.Context(), sessionId); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Response: &response.ResponsePayload{
+			sessionId.String(): true,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
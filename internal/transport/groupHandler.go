@@ -0,0 +1,137 @@
+package transport
+
+import (
+	"AstralTest/internal/models/response"
+	"AstralTest/internal/service"
+	"AstralTest/pkg/appError"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type GroupHandler struct {
+	service service.GroupService
+}
+
+func NewGroupHandler(service service.GroupService) *GroupHandler {
+	return &GroupHandler{
+		service: service,
+	}
+}
+
+type CreateGroupRequest struct {
+	Name string `json:"name"`
+}
+
+// GroupsHandler handles /api/groups:
+//
+//	GET  /api/groups - groups of the user
+//	POST /api/groups - create group
+func (g *GroupHandler) GroupsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		groups, err := g.service.ListGroups(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"groups": groups,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodPost:
+		var req CreateGroupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, appError.BadRequest("invalid json"))
+			return
+		}
+		group, err := g.service.CreateGroup(r.Context(), req.Name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"group": group,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	default:
+		writeError(w, appError.MethodNotAllowed())
+	}
+}
+
+// GroupHandler handles /api/groups/{name}:
+//
+//	GET    /api/groups/{name}                 - group with members
+//	DELETE /api/groups/{name}                 - delete group
+//	PUT    /api/groups/{name}/members/{login} - add member
+//	DELETE /api/groups/{name}/members/{login} - remove member
+func (g *GroupHandler) GroupHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/groups/"), "/")
+	name := parts[0]
+	if name == "" {
+		writeError(w, appError.BadRequest("bad request"))
+		return
+	}
+
+	ctx := r.Context()
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		group, err := g.service.GetGroup(ctx, name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"group": group,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if err := g.service.DeleteGroup(ctx, name); err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Response: &response.ResponsePayload{
+				name: true,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case len(parts) == 3 && parts[1] == "members" && parts[2] != "":
+		login := parts[2]
+		var err error
+		switch r.Method {
+		case http.MethodPut:
+			err = g.service.AddMember(ctx, name, login)
+		case http.MethodDelete:
+			err = g.service.RemoveMember(ctx, name, login)
+		default:
+			err = appError.MethodNotAllowed()
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Response: &response.ResponsePayload{
+				login: r.Method == http.MethodPut,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case len(parts) == 1 || (len(parts) == 3 && parts[1] == "members"):
+		writeError(w, appError.MethodNotAllowed())
+
+	default:
+		writeError(w, appError.NotFound())
+	}
+}
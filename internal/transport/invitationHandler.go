@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/models/response"
+	"AstralTest/pkg/appError"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CreateInvitationRequest struct {
+	Login  string          `json:"login"`
+	Role   entity.UserRole `json:"role"`
+	Groups []string        `json:"groups"`
+	// Expires is 7 days from now if empty
+	Expires *time.Time `json:"expires"`
+}
+
+// InvitationsHandler handles /api/invitations:
+//
+//	GET  /api/invitations - invitations created by the user
+//	POST /api/invitations - create invitation, the code is in the response only
+func (a *AuthHandler) InvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		invitations, err := a.service.ListInvitations(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"invitations": invitations,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodPost:
+		var req CreateInvitationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, appError.BadRequest("invalid json"))
+			return
+		}
+
+		inv := &entity.Invitation{
+			Login:  req.Login,
+			Role:   req.Role,
+			Groups: req.Groups,
+		}
+		if req.Expires != nil {
+			inv.Expires = *req.Expires
+		}
+		code, err := a.service.CreateInvitation(r.Context(), inv)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"invitation": inv,
+				"code":       code,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	default:
+		writeError(w, appError.MethodNotAllowed())
+	}
+}
+
+// RevokeInvitation handles DELETE /api/invitations/{id}, used invitations stay
+func (a *AuthHandler) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 4 || parts[3] == "" {
+		writeError(w, appError.BadRequest("bad request"))
+		return
+	}
+	id, err := uuid.Parse(parts[3])
+	if err != nil {
+		writeError(w, appError.BadRequest("bad invitation id"))
+		return
+	}
+
+	if err := a.service.RevokeInvitation(r.Context(), id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Response: &response.ResponsePayload{
+			id.String(): true,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"AstralTest/internal/authctx"
+	"AstralTest/internal/service"
+	"net/http"
+	"strings"
+)
+
+const sessionCookieName = "session"
+
+// authMiddleware resolves the caller of the request and puts it into the context.
+// Token is a session token or an api key, it is taken from (first found wins):
+//
+//  1. Authorization: Bearer <token>
+//  2. session cookie, set by /api/auth
+//  3. ?token= query parameter, legacy
+//
+// Requests without credentials go further as anonymous,
+// services decide if they need the caller. Bad credentials are rejected here.
+func authMiddleware(authService service.AuthService, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := authService.Authenticate(r.Context(), token)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(authctx.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, found := strings.Cut(header, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return r.URL.Query().Get("token")
+}
+
+// withClient puts the client of every request into the context, for the audit log
+func withClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(authctx.WithClient(r.Context(), clientInfo(r))))
+	})
+}
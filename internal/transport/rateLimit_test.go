@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(2)
+	limiter.now = func() time.Time { return now }
+
+	ok, _ := limiter.allow("10.0.0.1")
+	assert.True(t, ok)
+	ok, _ = limiter.allow("10.0.0.1")
+	assert.True(t, ok)
+	ok, wait := limiter.allow("10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	// other clients have their own buckets
+	ok, _ = limiter.allow("10.0.0.2")
+	assert.True(t, ok)
+
+	now = now.Add(30 * time.Second)
+	ok, _ = limiter.allow("10.0.0.1")
+	assert.True(t, ok)
+
+	// full buckets are dropped
+	now = now.Add(2 * time.Minute)
+	limiter.allow("10.0.0.3")
+	assert.NotContains(t, limiter.buckets, "10.0.0.1")
+	assert.NotContains(t, limiter.buckets, "10.0.0.2")
+}
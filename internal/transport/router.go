@@ -4,52 +4,113 @@ import (
 	"AstralTest/internal/service"
 	"AstralTest/pkg/appError"
 	"net/http"
+	"strings"
 )
 
 type Handler struct {
-	authService service.AuthService
-	wcsService  service.WcsService
+	authService   service.AuthService
+	wcsService    service.WcsService
+	groupService  service.GroupService
+	auditService  service.AuditService
+	adminService  service.AdminService
+	sessionCookie SessionCookie
+	// anonymous requests a minute from one IP
+	anonymousRateLimit int
 }
 
-func NewHandler(authService service.AuthService, wcsService service.WcsService) *Handler {
+func NewHandler(authService service.AuthService, wcsService service.WcsService, groupService service.GroupService, auditService service.AuditService, adminService service.AdminService, sessionCookie SessionCookie, anonymousRateLimit int) *Handler {
 	return &Handler{
-		authService: authService,
-		wcsService:  wcsService,
+		authService:        authService,
+		wcsService:         wcsService,
+		groupService:       groupService,
+		auditService:       auditService,
+		adminService:       adminService,
+		sessionCookie:      sessionCookie,
+		anonymousRateLimit: anonymousRateLimit,
 	}
 }
 
 // TODO: better use different router
-func (h *Handler) InitRouter() *http.ServeMux {
+func (h *Handler) InitRouter() http.Handler {
 	mux := http.NewServeMux()
 
-	authHandler := NewAuthHandler(h.authService)
+	// authenticated routes get the caller in the request context
+	authenticated := func(next http.HandlerFunc) http.Handler {
+		return authMiddleware(h.authService, next)
+	}
+	// routes open to anonymous clients are rate limited for them
+	limiter := newRateLimiter(h.anonymousRateLimit)
+	public := func(next http.HandlerFunc) http.Handler {
+		return authMiddleware(h.authService, limitAnonymous(limiter, next))
+	}
+
+	authHandler := NewAuthHandler(h.authService, h.sessionCookie)
 
-	mux.HandleFunc("/api/register", authHandler.Register)
-	mux.HandleFunc("/api/auth", authHandler.Login)
+	// invited users register without credentials
+	mux.Handle("/api/register", public(authHandler.Register))
+	mux.HandleFunc("/api/auth", authHandler.CurrentSessionHandler)
 	mux.HandleFunc("/api/auth/", authHandler.Logout)
+	mux.Handle("/api/sessions", authenticated(authHandler.SessionsHandler))
+	mux.Handle("/api/sessions/", authenticated(authHandler.RevokeSession))
+	mux.Handle("/api/keys", authenticated(authHandler.ApiKeysHandler))
+	mux.Handle("/api/keys/", authenticated(authHandler.RevokeApiKey))
+	mux.Handle("/api/invitations", authenticated(authHandler.InvitationsHandler))
+	mux.Handle("/api/invitations/", authenticated(authHandler.RevokeInvitation))
 
-	wcsHandler := NewWcsHandler(h.wcsService)
+	groupHandler := NewGroupHandler(h.groupService)
+	mux.Handle("/api/groups", authenticated(groupHandler.GroupsHandler))
+	mux.Handle("/api/groups/", authenticated(groupHandler.GroupHandler))
 
+	wcsHandler := NewWcsHandler(h.wcsService, h.authService)
+
+	// uploads may authenticate with the legacy meta.token, which is read
+	// from the body, so they are not limited as anonymous ones.
+	// Anonymous uploads are refused once meta is read
+	upload := authenticated(wcsHandler.UploadFileHandler)
+	docsList := public(wcsHandler.GetFilesList)
 	mux.HandleFunc("/api/docs", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
-			wcsHandler.UploadFileHandler(w, r)
+			upload.ServeHTTP(w, r)
 		} else if r.Method == http.MethodGet || r.Method == http.MethodHead {
-			wcsHandler.GetFilesList(w, r)
+			docsList.ServeHTTP(w, r)
 		} else {
 			writeError(w, appError.MethodNotAllowed())
 		}
 	})
-	mux.HandleFunc("/api/docs/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
+	mux.Handle("/api/docs/", public(func(w http.ResponseWriter, r *http.Request) {
+		// /api/docs/{id}/...
+		if strings.Count(r.URL.Path, "/") > 3 {
+			wcsHandler.DocSubresourceHandler(w, r)
+			return
 		}
-		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
 			wcsHandler.GetFileHandler(w, r)
-		} else if r.Method == http.MethodDelete {
+		case http.MethodPatch:
+			wcsHandler.UpdateDocHandler(w, r)
+		case http.MethodPut:
+			wcsHandler.ReplaceDocHandler(w, r)
+		case http.MethodDelete:
 			wcsHandler.DeleteDoc(w, r)
-		} else {
+		default:
 			writeError(w, appError.MethodNotAllowed())
 		}
-	})
+	}))
+	mux.Handle("/api/search", authenticated(wcsHandler.SearchHandler))
+	mux.Handle("/api/trash", authenticated(wcsHandler.TrashHandler))
+	mux.Handle("/api/trash/", authenticated(wcsHandler.TrashDocHandler))
+
+	// share link holders are anonymous
+	mux.HandleFunc(shareLinkPath, limitAnonymous(limiter, wcsHandler.SharedFileHandler))
+
+	auditHandler := NewAuditHandler(h.auditService)
+	mux.Handle("/api/audit", authenticated(auditHandler.AuditHandler))
+	mux.Handle("/api/audit/export", authenticated(auditHandler.ExportHandler))
+
+	adminHandler := NewAdminHandler(h.adminService)
+	mux.Handle("/api/admin/users", authenticated(adminHandler.UsersHandler))
+	mux.Handle(adminUsersPath, authenticated(adminHandler.UserHandler))
+	mux.Handle("/api/admin/cache", authenticated(adminHandler.CacheStatsHandler))
 
-	return mux
+	return withClient(mux)
 }
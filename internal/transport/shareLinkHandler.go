@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/internal/models/response"
+	"AstralTest/pkg/appError"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// shareLinkPath is the public route of share links, not authenticated
+const shareLinkPath = "/s/"
+
+func (wc *WcsHandler) getShareLinks(w http.ResponseWriter, r *http.Request, fileId uuid.UUID) {
+	links, err := wc.service.ListShareLinks(r.Context(), fileId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"links": links,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (wc *WcsHandler) createShareLink(w http.ResponseWriter, r *http.Request, fileId uuid.UUID) {
+	var options entity.ShareLinkOptions
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxFormFieldSize))
+	decoder.DisallowUnknownFields()
+	// empty body is a link with default limits
+	if err := decoder.Decode(&options); err != nil && err != io.EOF {
+		writeError(w, appError.BadRequest("invalid json: "+err.Error()))
+		return
+	}
+
+	link, token, err := wc.service.CreateShareLink(r.Context(), fileId, options)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"link":  link,
+			"token": token,
+			"url":   shareLinkPath + token,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (wc *WcsHandler) revokeShareLink(w http.ResponseWriter, r *http.Request, fileId uuid.UUID, linkIdStr string) {
+	linkId, err := uuid.Parse(linkIdStr)
+	if err != nil {
+		writeError(w, appError.BadRequest("bad link id"))
+		return
+	}
+
+	if err := wc.service.RevokeShareLink(r.Context(), fileId, linkId); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			linkId.String(): true,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (wc *WcsHandler) getShareLinkUses(w http.ResponseWriter, r *http.Request, fileId uuid.UUID, linkIdStr string) {
+	linkId, err := uuid.Parse(linkIdStr)
+	if err != nil {
+		writeError(w, appError.BadRequest("bad link id"))
+		return
+	}
+
+	uses, err := wc.service.GetShareLinkUses(r.Context(), fileId, linkId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"uses": uses,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// SharedFileHandler serves GET, HEAD /s/{token} without authentication.
+// Password of the link goes in X-Share-Password header, never in the url.
+// Only responses with content count as downloads, see countingWriter
+func (wc *WcsHandler) SharedFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, shareLinkPath)
+	if token == "" || strings.Contains(token, "/") {
+		writeError(w, appError.NotFound())
+		return
+	}
+	password := r.Header.Get("X-Share-Password")
+
+	file, err := wc.service.OpenSharedFile(r.Context(), token, password, clientInfo(r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer file.Close()
+
+	// the token is in the url, it should not leak or stay in caches
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if r.Method == http.MethodHead {
+		serveDocument(w, r, file.Doc, file.Content)
+		return
+	}
+	serveDocument(&countingWriter{ResponseWriter: w, r: r, file: file}, r, file.Doc, file.Content)
+}
+
+// downloadCounter is service.SharedFile
+type downloadCounter interface {
+	CountDownload(resumed bool) error
+}
+
+// countingWriter counts the download when the status is written, before the content.
+// 200 and ranges from the first byte are downloads, not modified answers
+// and other ranges are not. A link used up meanwhile gets an error instead
+type countingWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	file        downloadCounter
+	wroteHeader bool
+	refused     bool
+}
+
+func (cw *countingWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	if status == http.StatusOK || status == http.StatusPartialContent {
+		resumed := status == http.StatusPartialContent && !strings.HasPrefix(cw.r.Header.Get("Range"), "bytes=0-")
+		if err := cw.file.CountDownload(resumed); err != nil {
+			cw.refused = true
+			// headers of the content don't describe the error
+			for _, header := range []string{"Content-Length", "Content-Range", "Content-Disposition", "Content-Encoding", "ETag", "Last-Modified", "Accept-Ranges"} {
+				cw.Header().Del(header)
+			}
+			writeError(cw.ResponseWriter, err)
+			return
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.refused {
+		return 0, errDownloadRefused
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+var errDownloadRefused = errors.New("download refused")
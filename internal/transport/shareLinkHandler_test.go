@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"AstralTest/internal/models/entity"
+	"AstralTest/pkg/appError"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCounter struct {
+	calls   []bool
+	refused bool
+}
+
+func (c *fakeCounter) CountDownload(resumed bool) error {
+	c.calls = append(c.calls, resumed)
+	if c.refused {
+		return appError.NotFound()
+	}
+	return nil
+}
+
+func TestCountingWriter(t *testing.T) {
+	doc := &entity.Document{
+		Name:    "a.txt",
+		File:    true,
+		Mime:    "text/plain",
+		Hash:    "abc",
+		Created: time.Now().Add(-time.Hour),
+	}
+	serve := func(counter *fakeCounter, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, shareLinkPath+"token", nil)
+		r.Header = header
+		w := httptest.NewRecorder()
+		serveDocument(&countingWriter{ResponseWriter: w, r: r, file: counter}, r, doc, strings.NewReader("0123456789"))
+		return w
+	}
+
+	t.Run("full download", func(t *testing.T) {
+		counter := &fakeCounter{}
+		w := serve(counter, http.Header{})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, []bool{false}, counter.calls)
+	})
+
+	t.Run("not modified is not a download", func(t *testing.T) {
+		counter := &fakeCounter{}
+		w := serve(counter, http.Header{"If-None-Match": {strconv.Quote(doc.Hash)}})
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Empty(t, counter.calls)
+	})
+
+	t.Run("ranges", func(t *testing.T) {
+		counter := &fakeCounter{}
+		w := serve(counter, http.Header{"Range": {"bytes=0-4"}})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		w = serve(counter, http.Header{"Range": {"bytes=5-"}})
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		assert.Equal(t, "56789", w.Body.String())
+		// the service decides if a resumed range counts
+		assert.Equal(t, []bool{false, true}, counter.calls)
+	})
+
+	t.Run("used up meanwhile", func(t *testing.T) {
+		counter := &fakeCounter{refused: true}
+		w := serve(counter, http.Header{})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.NotContains(t, w.Body.String(), "0123456789")
+		assert.Empty(t, w.Header().Get("Content-Disposition"))
+	})
+}
@@ -1,14 +1,18 @@
 package transport
 
 import (
+	"AstralTest/internal/authctx"
 	"AstralTest/internal/models/entity"
 	"AstralTest/internal/models/response"
 	"AstralTest/internal/service"
+	"AstralTest/internal/storage"
+	"AstralTest/internal/storage/filter"
 	"AstralTest/pkg/appError"
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -19,22 +23,28 @@ import (
 
 // TODO: О названии wcs - web cache storage. Плохая фантазия, нужно придумать получше.
 type WcsHandler struct {
-	service service.WcsService
+	service     service.WcsService
+	authService service.AuthService
 }
 
-func NewWcsHandler(service service.WcsService) *WcsHandler {
+func NewWcsHandler(service service.WcsService, authService service.AuthService) *WcsHandler {
 	return &WcsHandler{
-		service: service,
+		service:     service,
+		authService: authService,
 	}
 }
 
 type FileMetaData struct {
-	Name   string   `json:"name"`
-	File   bool     `json:"file"`
-	Public bool     `json:"public"`
-	Token  string   `json:"token"`
-	Mime   string   `json:"mime"`
-	Grant  []string `json:"grant"`
+	Name   string `json:"name"`
+	File   bool   `json:"file"`
+	Public bool   `json:"public"`
+	// Token is the legacy way to authenticate upload,
+	// it's used only if the request has no other credentials
+	Token string `json:"token"`
+	Mime  string `json:"mime"`
+	// Grant is the legacy form of Permissions, all logins become viewers
+	Grant       []string            `json:"grant"`
+	Permissions []entity.Permission `json:"permissions"`
 }
 
 func (wc *WcsHandler) UploadFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -49,72 +59,128 @@ func (wc *WcsHandler) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// max form size is 10mb
-	const maxFormSize = 10 << 20
-	if err := r.ParseMultipartForm(maxFormSize); err != nil {
+	// parts are read one by one, so the file is never fully loaded in memory.
+	// meta (and json, if any) must be sent before the file part,
+	// the file part must be the last one
+	reader, err := r.MultipartReader()
+	if err != nil {
 		writeError(w, appError.BadRequest("failed to parse form"))
 		return
 	}
 
-	// read and validate meta
-	var metaData FileMetaData
-	metaDataString := r.FormValue("meta")
-	if metaDataString == "" {
-		writeError(w, appError.BadRequest("meta field is required"))
-		return
-	}
-	if err := json.Unmarshal([]byte(metaDataString), &metaData); err != nil {
-		writeError(w, appError.BadRequest("invalid meta JSON: "+err.Error()))
-		return
+	ctx := r.Context()
+	var (
+		metaData   FileMetaData
+		doc        entity.Document
+		metaRead   bool
+		fileId     *uuid.UUID
+		fileLoaded bool
+	)
+	for !fileLoaded {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, appError.BadRequest("failed to parse form"))
+			return
+		}
+
+		switch part.FormName() {
+		case "meta":
+			metaDataBytes, err := readFormField(part)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if err := json.Unmarshal(metaDataBytes, &metaData); err != nil {
+				writeError(w, appError.BadRequest("invalid meta JSON: "+err.Error()))
+				return
+			}
+			if metaData.Name == "" {
+				writeError(w, appError.BadRequest("meta.name is required"))
+				return
+			}
+			if metaData.Token != "" && authctx.Principal(ctx) == nil {
+				principal, err := wc.authService.Authenticate(ctx, metaData.Token)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				ctx = authctx.WithPrincipal(ctx, principal)
+			}
+			// the rest of the body isn't read for anonymous clients
+			if authctx.Principal(ctx) == nil {
+				writeError(w, appError.Unauthorized())
+				return
+			}
+			metaRead = true
+
+			doc.Name = metaData.Name
+			doc.File = metaData.File
+			doc.Public = metaData.Public
+			doc.Mime = metaData.Mime
+			doc.Permissions = append(metaData.Permissions, entity.ViewerPermissions(metaData.Grant)...)
+
+		case "json":
+			// read json data if exists
+			jsonData, err := readFormField(part)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if len(jsonData) != 0 {
+				var temp interface{}
+				if err := json.Unmarshal(jsonData, &temp); err != nil {
+					writeError(w, appError.BadRequest("invalid json field"))
+					return
+				}
+				doc.JsonData = json.RawMessage(jsonData)
+			}
+
+		case "file":
+			if !metaRead {
+				writeError(w, appError.BadRequest("meta field must be sent before file"))
+				return
+			}
+			if !metaData.File {
+				// file isn't expected, skip it
+				break
+			}
+			// TODO: maybe check safety of filename?
+			// fileName := sanitizeFileName(part.FileName())
+			if part.FileName() == "" {
+				writeError(w, appError.BadRequest("invalid file name"))
+				return
+			}
+
+			fileId, err = wc.service.HandleUploadingFile(ctx, doc, &lastPartReader{
+				r:      newLimitedFileReader(part, maxFileSize),
+				reader: reader,
+			})
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			fileLoaded = true
+		}
+		part.Close()
 	}
-	if metaData.Name == "" {
-		writeError(w, appError.BadRequest("meta.name is required"))
+
+	if !metaRead {
+		writeError(w, appError.BadRequest("meta field is required"))
 		return
 	}
-	if metaData.Token == "" {
-		writeError(w, appError.BadRequest("meta.token is required"))
+	if metaData.File && !fileLoaded {
+		writeError(w, appError.BadRequest("file field is required when meta.file is true"))
 		return
 	}
-
-	// TODO: converte token to uuid in entity.Document
-	doc := entity.Document{
-		Name:   metaData.Name,
-		File:   metaData.File,
-		Public: metaData.Public,
-		Token:  metaData.Token,
-		Mime:   metaData.Mime,
-		Grant:  metaData.Grant,
-	}
-
-	// read file data
-	var fileData []byte
-	if metaData.File {
-		temp, err := readFormFile(r)
+	if !metaData.File {
+		fileId, err = wc.service.HandleUploadingFile(ctx, doc, nil)
 		if err != nil {
 			writeError(w, err)
 			return
 		}
-		if len(temp) == 0 {
-			writeError(w, appError.BadRequest("file is required (meta.file = true)"))
-		}
-		fileData = temp
-	}
-
-	// read json data if exists
-	jsonDataString := r.FormValue("json")
-	if jsonDataString != "" {
-		var temp interface{}
-		if err := json.Unmarshal([]byte(jsonDataString), &temp); err != nil {
-			writeError(w, appError.BadRequest("invalid json field"))
-			return
-		}
-		doc.JsonData = json.RawMessage(jsonDataString)
-	}
-
-	fileId, err := wc.service.HandleUploadingFile(r.Context(), doc, &fileData)
-	if err != nil {
-		writeError(w, err)
-		return
 	}
 
 	// response to request
@@ -131,75 +197,126 @@ func (wc *WcsHandler) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 	writeJSON(w, http.StatusOK, resp)
 }
 
-func readFormFile(r *http.Request) ([]byte, error) {
-	file, header, err := r.FormFile("file")
+const (
+	// max size of a single form field (meta, json)
+	maxFormFieldSize = 10 << 20 // 10 MB
+	// max file size
+	maxFileSize = 50 << 20 // 50 MB
+)
+
+func readFormField(part *multipart.Part) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
 	if err != nil {
-		return nil, appError.BadRequest("file field is required when meta.file is true: " + err.Error())
+		return nil, appError.BadRequest("failed to parse form")
+	}
+	if len(data) > maxFormFieldSize {
+		return nil, appError.BadRequest(fmt.Sprintf("field %s is too large (max 10 MB)", part.FormName()))
+	}
+	return data, nil
+}
+
+// limitedFileReader works like io.LimitReader, but returns an error
+// instead of silently cutting the file
+type limitedFileReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+func newLimitedFileReader(r io.Reader, max int64) *limitedFileReader {
+	return &limitedFileReader{
+		r:   io.LimitReader(r, max+1),
+		max: max,
 	}
-	defer file.Close()
+}
 
-	// TODO: maybe check safety of filename?
-	// fileName := sanitizeFileName(header.Filename)
-	if header.Filename == "" {
-		return nil, appError.BadRequest("invalid file name")
+func (l *limitedFileReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return n, appError.BadRequest("file is too large (max 50 MB)")
 	}
+	return n, err
+}
 
-	// max file size
-	const maxFileSize = 50 << 20 // 50 MB
-	fileBytes, err := io.ReadAll(io.LimitReader(file, maxFileSize))
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			return nil, appError.BadRequest("file is too large (max 50 MB)")
-		} else {
-			return nil, appError.Internal()
+// lastPartReader fails the upload if more parts follow the file,
+// they would be lost after the document is saved
+type lastPartReader struct {
+	r      io.Reader
+	reader *multipart.Reader
+}
+
+func (l *lastPartReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if err == io.EOF {
+		switch _, next := l.reader.NextPart(); {
+		case next == nil:
+			return n, appError.BadRequest("file must be the last field")
+		case next != io.EOF:
+			return n, appError.BadRequest("failed to parse form")
 		}
 	}
-
-	return fileBytes, nil
+	return n, err
 }
 
 func (wc *WcsHandler) GetFileHandler(w http.ResponseWriter, r *http.Request) {
-	var headOnly bool
-	switch r.Method {
-	case http.MethodGet:
-		headOnly = false
-	case http.MethodHead:
-		headOnly = true
-	default:
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		writeError(w, appError.MethodNotAllowed())
 		return
 	}
 
-	userToken, fileId, err := getFileFileOperationsData(r)
+	fileId, err := getFileFileOperationsData(r)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
-	fileData, filePath, err := wc.service.GetFile(r.Context(), *userToken, *fileId, headOnly)
+	fileData, content, err := wc.service.GetFile(r.Context(), *fileId)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	if fileData.File {
-		w.Header().Set("Content-type", fileData.Mime)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s", url.PathEscape(fileData.Name)))
+	if content != nil {
+		defer content.Close()
+	}
 
-		if r.Method == http.MethodHead {
-			return
+	serveDocument(w, r, fileData, content)
+}
+
+// serveDocument sends file content or json of the document.
+// http.ServeContent handles HEAD, Range/If-Range and conditional
+// requests (If-None-Match, If-Modified-Since) using ETag and Last-Modified.
+func serveDocument(w http.ResponseWriter, r *http.Request, doc *entity.Document, content io.ReadSeeker) {
+	if doc.Hash != "" {
+		w.Header().Set("ETag", strconv.Quote(doc.Hash))
+	}
+	modTime := doc.Updated
+	if modTime.IsZero() {
+		modTime = doc.Created
+	}
+
+	if doc.File {
+		if doc.Mime != "" {
+			w.Header().Set("Content-Type", doc.Mime)
 		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s", url.PathEscape(doc.Name)))
 
 		// send file to user
-		http.ServeFile(w, r, filePath)
-	} else {
-		resp := response.Standard{
-			Data: &response.DataPayload{
-				"json": fileData.JsonData,
-			},
-		}
-		writeJSON(w, http.StatusOK, resp)
+		http.ServeContent(w, r, doc.Name, modTime, content)
+		return
 	}
 
+	body, err := json.Marshal(response.Standard{
+		Data: &response.DataPayload{
+			"json": doc.JsonData,
+		},
+	})
+	if err != nil {
+		writeError(w, appError.Internal())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
 }
 
 func (wc *WcsHandler) GetFilesList(w http.ResponseWriter, r *http.Request) {
@@ -215,17 +332,14 @@ func (wc *WcsHandler) GetFilesList(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// take all parametrs
-	tokenStr := r.URL.Query().Get("token")
-	token, err := uuid.Parse(tokenStr)
+	params := r.URL.Query()
+	where, err := listFilter(r)
 	if err != nil {
-		writeError(w, appError.BadRequest("bad user token"))
+		writeError(w, err)
 		return
 	}
-	ownerLogin := r.URL.Query().Get("login")
-	key := r.URL.Query().Get("key")
-	value := r.URL.Query().Get("value")
 	var limit int
-	limitStr := r.URL.Query().Get("limit")
+	limitStr := params.Get("limit")
 	if limitStr == "" {
 		limit = 100
 	} else {
@@ -241,7 +355,28 @@ func (wc *WcsHandler) GetFilesList(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	out, err := wc.service.GetFilesList(r.Context(), headOnly, token, ownerLogin, key, value, limit)
+	// sorting: ?sort=name|created|size|mime&order=asc|desc
+	var desc bool
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		writeError(w, appError.BadRequest("order value should be asc or desc"))
+		return
+	}
+
+	query := storage.DocsListQuery{
+		OwnerLogin: params.Get("login"),
+		Where:      where,
+		Sort:       params.Get("sort"),
+		Desc:       desc,
+		Cursor:     params.Get("cursor"),
+		Limit:      limit,
+		WithTotal:  params.Get("total") == "true",
+	}
+
+	page, err := wc.service.GetFilesList(r.Context(), headOnly, query)
 	if err != nil {
 		writeError(w, err)
 		return
@@ -251,23 +386,95 @@ func (wc *WcsHandler) GetFilesList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	data := response.DataPayload{
+		"docs": page.Docs,
+	}
+	// cursors of the neighbour pages, pass them as ?cursor= with the same sort
+	if page.Next != "" {
+		data["next"] = page.Next
+	}
+	if page.Prev != "" {
+		data["prev"] = page.Prev
+	}
+	if page.Total != nil {
+		data["total"] = *page.Total
+	}
+	resp := response.Standard{
+		Data: &data,
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// listFilter parses ?filter= (see package filter),
+// legacy ?key=&value= is the same as "key eq 'value'"
+func listFilter(r *http.Request) (filter.Expr, error) {
+	query := r.URL.Query()
+	filterStr := query.Get("filter")
+	key := query.Get("key")
+	value := query.Get("value")
+
+	switch {
+	case filterStr != "" && key != "":
+		return nil, appError.BadRequest("use either filter or key and value")
+	case filterStr != "":
+		return filter.Parse(filterStr)
+	case key != "" && value != "":
+		return filter.Equal(key, value)
+	}
+	return nil, nil
+}
+
+func (wc *WcsHandler) UpdateDocHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+
+	fileId, err := getFileFileOperationsData(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var patch entity.DocumentPatch
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxFormFieldSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		writeError(w, appError.BadRequest("invalid json: "+err.Error()))
+		return
+	}
+
+	doc, err := wc.service.UpdateFileMeta(r.Context(), *fileId, patch)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
 	resp := response.Standard{
 		Data: &response.DataPayload{
-			"docs": out,
+			"doc": doc,
 		},
 	}
-
 	writeJSON(w, http.StatusOK, resp)
 }
 
-func (wc *WcsHandler) DeleteDoc(w http.ResponseWriter, r *http.Request) {
-	userToken, fileId, err := getFileFileOperationsData(r)
+// ReplaceDocHandler replaces file content with the request body,
+// Content-Type of the request becomes the new mime of the file
+func (wc *WcsHandler) ReplaceDocHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+
+	fileId, err := getFileFileOperationsData(r)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
-	err = wc.service.DeleteFile(r.Context(), *userToken, *fileId)
+	doc, err := wc.service.ReplaceFileContent(r.Context(), *fileId,
+		r.Header.Get("Content-Type"), newLimitedFileReader(r.Body, maxFileSize))
 	if err != nil {
 		writeError(w, err)
 		return
@@ -275,29 +482,45 @@ func (wc *WcsHandler) DeleteDoc(w http.ResponseWriter, r *http.Request) {
 
 	resp := response.Standard{
 		Data: &response.DataPayload{
-			fileId.String(): true,
+			"doc": doc,
 		},
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
-func getFileFileOperationsData(r *http.Request) (*uuid.UUID, *uuid.UUID, error) {
-	// get user token
-	tokenStr := r.URL.Query().Get("token")
-	token, err := uuid.Parse(tokenStr)
+func (wc *WcsHandler) DeleteDoc(w http.ResponseWriter, r *http.Request) {
+	fileId, err := getFileFileOperationsData(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = wc.service.DeleteFile(r.Context(), *fileId)
 	if err != nil {
-		return nil, nil, appError.BadRequest("bad user token")
+		writeError(w, err)
+		return
 	}
 
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			fileId.String(): true,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getFileFileOperationsData returns file id from /api/docs/{id},
+// the caller is resolved by the auth middleware
+func getFileFileOperationsData(r *http.Request) (*uuid.UUID, error) {
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) != 4 || parts[3] == "" {
-		return nil, nil, appError.BadRequest("bad request")
+		return nil, appError.BadRequest("bad request")
 	}
 	fileId, err := uuid.Parse(parts[3])
 	if err != nil {
-		return nil, nil, appError.BadRequest("bad file id")
+		return nil, appError.BadRequest("bad file id")
 	}
-	return &token, &fileId, nil
+	return &fileId, nil
 }
 
 // func sanitizeFileName(name string) string {
@@ -0,0 +1,42 @@
+package transport
+
+import (
+	"AstralTest/internal/models/response"
+	"AstralTest/pkg/appError"
+	"net/http"
+	"strconv"
+)
+
+// SearchHandler handles GET /api/search?q=...&limit=...
+//
+// q is a websearch query: words, "quoted phrases", or, -excluded.
+// Headlines and snippets are html with matches in <b></b>.
+func (wc *WcsHandler) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, appError.MethodNotAllowed())
+		return
+	}
+
+	params := r.URL.Query()
+	var limit int
+	if limitStr := params.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			writeError(w, appError.BadRequest("limit value should be a positive number"))
+			return
+		}
+	}
+
+	hits, err := wc.service.SearchFiles(r.Context(), params.Get("q"), limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"docs": hits,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"AstralTest/internal/models/response"
+	"AstralTest/pkg/appError"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// TrashHandler handles /api/trash:
+//
+//	GET    /api/trash - documents in the trash
+//	DELETE /api/trash - empty the trash
+func (wc *WcsHandler) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		docs, err := wc.service.GetTrash(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"docs": docs,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case http.MethodDelete:
+		purged, err := wc.service.EmptyTrash(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp := response.Standard{
+			Data: &response.DataPayload{
+				"purged": purged,
+			},
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	default:
+		writeError(w, appError.MethodNotAllowed())
+	}
+}
+
+// TrashDocHandler handles /api/trash/{id}:
+//
+//	POST   /api/trash/{id}/restore - move document back from the trash
+//	DELETE /api/trash/{id}         - delete document for good
+func (wc *WcsHandler) TrashDocHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/trash/"), "/")
+	fileId, err := uuid.Parse(parts[0])
+	if err != nil {
+		writeError(w, appError.BadRequest("bad file id"))
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "restore":
+		if r.Method != http.MethodPost {
+			writeError(w, appError.MethodNotAllowed())
+			return
+		}
+		err = wc.service.RestoreFile(r.Context(), fileId)
+	case len(parts) == 1:
+		if r.Method != http.MethodDelete {
+			writeError(w, appError.MethodNotAllowed())
+			return
+		}
+		err = wc.service.PurgeFile(r.Context(), fileId)
+	default:
+		writeError(w, appError.NotFound())
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			fileId.String(): true,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
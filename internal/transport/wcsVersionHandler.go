@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"AstralTest/internal/models/response"
+	"AstralTest/pkg/appError"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// DocSubresourceHandler routes /api/docs/{id}/... requests:
+//
+//	GET       /api/docs/{id}/versions                  - versions list
+//	GET, HEAD /api/docs/{id}/versions/{version}        - download version
+//	POST      /api/docs/{id}/versions/{version}/restore - restore version
+//	GET       /api/docs/{id}/diff?from=1&to=2          - diff of json data
+//	GET       /api/docs/{id}/links                     - share links list
+//	POST      /api/docs/{id}/links                     - create share link
+//	DELETE    /api/docs/{id}/links/{linkId}            - revoke share link
+//	GET       /api/docs/{id}/links/{linkId}/uses       - share link usage log
+func (wc *WcsHandler) DocSubresourceHandler(w http.ResponseWriter, r *http.Request) {
+	fileId, rest, err := getDocSubresourceData(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch {
+	case len(rest) == 1 && rest[0] == "versions":
+		if r.Method != http.MethodGet {
+			writeError(w, appError.MethodNotAllowed())
+			return
+		}
+		wc.getVersions(w, r, *fileId)
+	case len(rest) == 2 && rest[0] == "versions":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, appError.MethodNotAllowed())
+			return
+		}
+		wc.getVersion(w, r, *fileId, rest[1])
+	case len(rest) == 3 && rest[0] == "versions" && rest[2] == "restore":
+		if r.Method != http.MethodPost {
+			writeError(w, appError.MethodNotAllowed())
+			return
+		}
+		wc.restoreVersion(w, r, *fileId, rest[1])
+	case len(rest) == 1 && rest[0] == "diff":
+		if r.Method != http.MethodGet {
+			writeError(w, appError.MethodNotAllowed())
+			return
+		}
+		wc.diffVersions(w, r, *fileId)
+	case len(rest) == 1 && rest[0] == "links":
+		switch r.Method {
+		case http.MethodGet:
+			wc.getShareLinks(w, r, *fileId)
+		case http.MethodPost:
+			wc.createShareLink(w, r, *fileId)
+		default:
+			writeError(w, appError.MethodNotAllowed())
+		}
+	case len(rest) == 2 && rest[0] == "links":
+		if r.Method != http.MethodDelete {
+			writeError(w, appError.MethodNotAllowed())
+			return
+		}
+		wc.revokeShareLink(w, r, *fileId, rest[1])
+	case len(rest) == 3 && rest[0] == "links" && rest[2] == "uses":
+		if r.Method != http.MethodGet {
+			writeError(w, appError.MethodNotAllowed())
+			return
+		}
+		wc.getShareLinkUses(w, r, *fileId, rest[1])
+	default:
+		writeError(w, appError.NotFound())
+	}
+}
+
+func (wc *WcsHandler) getVersions(w http.ResponseWriter, r *http.Request, fileId uuid.UUID) {
+	versions, err := wc.service.GetVersions(r.Context(), fileId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"versions": versions,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (wc *WcsHandler) getVersion(w http.ResponseWriter, r *http.Request, fileId uuid.UUID, versionStr string) {
+	version, err := parseVersion(versionStr)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	doc, content, err := wc.service.GetFileVersion(r.Context(), fileId, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if content != nil {
+		defer content.Close()
+	}
+
+	serveDocument(w, r, doc, content)
+}
+
+func (wc *WcsHandler) restoreVersion(w http.ResponseWriter, r *http.Request, fileId uuid.UUID, versionStr string) {
+	version, err := parseVersion(versionStr)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	doc, err := wc.service.RestoreVersion(r.Context(), fileId, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"doc": doc,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (wc *WcsHandler) diffVersions(w http.ResponseWriter, r *http.Request, fileId uuid.UUID) {
+	from, err := parseVersion(r.URL.Query().Get("from"))
+	if err != nil {
+		writeError(w, appError.BadRequest("bad from version"))
+		return
+	}
+	to, err := parseVersion(r.URL.Query().Get("to"))
+	if err != nil {
+		writeError(w, appError.BadRequest("bad to version"))
+		return
+	}
+
+	changes, err := wc.service.DiffVersions(r.Context(), fileId, from, to)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := response.Standard{
+		Data: &response.DataPayload{
+			"from":    from,
+			"to":      to,
+			"changes": changes,
+		},
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func parseVersion(versionStr string) (int, error) {
+	version, err := strconv.Atoi(versionStr)
+	if err != nil || version < 1 {
+		return 0, appError.BadRequest("bad version")
+	}
+	return version, nil
+}
+
+// getDocSubresourceData parses /api/docs/{id}/... path,
+// returns file id and the rest of the path
+func getDocSubresourceData(r *http.Request) (*uuid.UUID, []string, error) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 {
+		return nil, nil, appError.BadRequest("bad request")
+	}
+	fileId, err := uuid.Parse(parts[3])
+	if err != nil {
+		return nil, nil, appError.BadRequest("bad file id")
+	}
+	return &fileId, parts[4:], nil
+}
@@ -76,3 +76,19 @@ func Forbidden() AppError {
 		code:       403,
 	}
 }
+
+func Conflict(text string) AppError {
+	return appErr{
+		message:    text,
+		httpStatus: http.StatusConflict,
+		code:       409,
+	}
+}
+
+func TooManyRequests() AppError {
+	return appErr{
+		message:    "too many requests",
+		httpStatus: http.StatusTooManyRequests,
+		code:       429,
+	}
+}